@@ -7,13 +7,21 @@ import (
 
 	"lamdis/internal/adminapi"
 	"lamdis/pkg/config"
+	"lamdis/pkg/connectors"
+	"lamdis/pkg/connectors/rail"
 	pdb "lamdis/pkg/db"
 	"lamdis/pkg/logger"
+	"lamdis/pkg/upstream"
 )
 
 func main() {
 	cfg := config.Load()
 	log := logger.New(cfg.Env)
+	upstream.Default.SetEgressBaseline(upstream.EgressPolicy{
+		RequireHTTPS: cfg.EgressRequireHTTPS,
+		AllowPrivate: cfg.EgressAllowPrivate,
+		PrivateCIDRs: cfg.EgressPrivateCIDRs,
+	})
 	defer log.Sync()
 
 	bind := os.Getenv("ADMIN_HTTP_ADDR")
@@ -21,9 +29,13 @@ func main() {
 		bind = ":8082"
 	}
 
+	pool := pdb.MustConnect(cfg, log)
+	reg := connectors.NewRegistry(pool)
+	rail.Register(reg)
+
 	app := adminapi.New(
 		log,
-		pdb.MustConnect(cfg, log),
+		pool,
 		adminapi.Config{
 			HTTPAddr:      bind,
 			OIDCIssuer:    os.Getenv("ADMIN_OIDC_ISSUER"),
@@ -31,6 +43,7 @@ func main() {
 			JWKSURL:       os.Getenv("ADMIN_JWKS_URL"),
 			RegistryDir:   os.Getenv("REGISTRY_DIR"),
 			EncryptionKey: os.Getenv("ENCRYPTION_KEY"),
+			Registry:      reg,
 		},
 	)
 
@@ -14,19 +14,29 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"lamdis/internal/connector"
+	"lamdis/pkg/changes"
 	"lamdis/pkg/config"
 	"lamdis/pkg/connectors"
+	"lamdis/pkg/connectors/rail"
 	"lamdis/pkg/db"
 	"lamdis/pkg/logger"
 	"lamdis/pkg/middleware"
+	"lamdis/pkg/ratelimit"
 	"lamdis/pkg/tenants"
+	"lamdis/pkg/upstream"
 )
 
 func main() {
 	cfg := config.Load()
 	log := logger.New(cfg.Env)
+	upstream.Default.SetEgressBaseline(upstream.EgressPolicy{
+		RequireHTTPS: cfg.EgressRequireHTTPS,
+		AllowPrivate: cfg.EgressAllowPrivate,
+		PrivateCIDRs: cfg.EgressPrivateCIDRs,
+	})
 
 	var pool = db.MustConnect(cfg, log)
+	ratelimit.Default.UseRedis(db.MustRedis(cfg, log))
 
 	var prov tenants.Provider
 	if pool != nil {
@@ -42,6 +52,22 @@ func main() {
 	}
 
 	reg := connectors.NewRegistry(pool)
+	rail.Register(reg)
+
+	// Admin changes drop cached operations and limits as they happen.
+	followCtx, stopFollowing := context.WithCancel(context.Background())
+	defer stopFollowing()
+	if pool != nil {
+		reg.SetTTL(cfg.RegistryCacheTTL)
+		go changes.Follow(followCtx, pool, log, func(ev changes.Event) {
+			if ev.Affects(changes.Connectors) {
+				reg.Invalidate(ev.TenantID)
+			}
+			if ev.Affects(changes.RateLimits) {
+				ratelimit.Default.Invalidate(ev.TenantID)
+			}
+		})
+	}
 
 	r := chi.NewRouter()
 	r.Use(middleware.RequestID())
@@ -14,6 +14,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"lamdis/internal/manifest"
+	"lamdis/pkg/changes"
 	"lamdis/pkg/config"
 	"lamdis/pkg/connectors"
 	"lamdis/pkg/db"
@@ -42,6 +43,17 @@ func main() {
 
 	// Always create registry (dbPool may be nil -> dev fallback operations)
 	reg := connectors.NewRegistry(dbPool)
+	// Admin changes drop cached operations as they happen; the TTL is a safety net.
+	followCtx, stopFollowing := context.WithCancel(context.Background())
+	defer stopFollowing()
+	if dbPool != nil {
+		reg.SetTTL(cfg.RegistryCacheTTL)
+		go changes.Follow(followCtx, dbPool, appLog, func(ev changes.Event) {
+			if ev.Affects(changes.Connectors) {
+				reg.Invalidate(ev.TenantID)
+			}
+		})
+	}
 
 	// 4. Build HTTP router and register middlewares.
 	router := chi.NewRouter()
@@ -12,19 +12,29 @@ import (
 	"github.com/go-chi/chi/v5"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"lamdis/internal/orchestrator"
 	"lamdis/internal/policy"
+	"lamdis/pkg/changes"
 	"lamdis/pkg/config"
 	"lamdis/pkg/db"
 	"lamdis/pkg/logger"
 	"lamdis/pkg/middleware"
+	"lamdis/pkg/ratelimit"
 	"lamdis/pkg/tenants"
+	"lamdis/pkg/upstream"
 )
 
 func main() {
 	cfg := config.Load()
 	log := logger.New(cfg.Env)
+	upstream.Default.SetEgressBaseline(upstream.EgressPolicy{
+		RequireHTTPS: cfg.EgressRequireHTTPS,
+		AllowPrivate: cfg.EgressAllowPrivate,
+		PrivateCIDRs: cfg.EgressPrivateCIDRs,
+	})
 
 	pool := db.MustConnect(cfg, log)
+	ratelimit.Default.UseRedis(db.MustRedis(cfg, log))
 
 	var prov tenants.Provider
 	if pool != nil {
@@ -47,6 +57,33 @@ func main() {
 	policy.RegisterHTTP(r, pool)
 	r.Get("/metrics", promhttp.Handler().ServeHTTP)
 
+	// Admin changes to rate limits apply as they happen.
+	followCtx, stopFollowing := context.WithCancel(context.Background())
+	defer stopFollowing()
+	go changes.Follow(followCtx, pool, log, func(ev changes.Event) {
+		if ev.Affects(changes.RateLimits) {
+			ratelimit.Default.Invalidate(ev.TenantID)
+		}
+	})
+
+	// Async execution workers drain the execution_jobs queue.
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	workersDone := make(chan struct{})
+	if pool != nil {
+		worker := orchestrator.NewWorker(pool, log, orchestrator.WorkerOptions{
+			Concurrency:       cfg.ExecWorkers,
+			VisibilityTimeout: cfg.ExecVisibilityTimeout,
+			DrainTimeout:      cfg.ExecDrainTimeout,
+			Revalidate:        policy.RevalidateScheduled(pool),
+		})
+		go func() {
+			worker.Run(workerCtx)
+			close(workersDone)
+		}()
+	} else {
+		close(workersDone)
+	}
+
 	addr := cfg.ManifestAddr // reuse manifest addr or introduce POLICY_ADDR via env in future
 	srv := &http.Server{Addr: addr, Handler: r}
 	go func() {
@@ -62,5 +99,9 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	_ = srv.Shutdown(ctx)
+	// Jobs in flight are finished (within the drain timeout, plus any
+	// compensations) before exit; idle workers stop claiming at once.
+	stopWorkers()
+	<-workersDone
 	fmt.Println("policy-service stopped")
 }
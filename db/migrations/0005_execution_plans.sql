@@ -0,0 +1,5 @@
+-- 0005_execution_plans.sql
+-- Multi-step execution plans stored per action.
+-- actions.flow holds { "steps": [ { name, action, when, request_tmpl } ] }.
+
+ALTER TABLE actions ADD COLUMN IF NOT EXISTS flow jsonb NOT NULL DEFAULT '{}'::jsonb;
@@ -0,0 +1,8 @@
+-- 0006_execution_compensation.sql
+-- Saga compensation outcomes for multi-step executions.
+-- ROLLED_BACK: a step failed and all compensations succeeded.
+-- COMPENSATION_FAILED: a step failed and at least one compensation failed.
+
+ALTER TABLE executions DROP CONSTRAINT IF EXISTS executions_status_check;
+ALTER TABLE executions ADD CONSTRAINT executions_status_check
+  CHECK (status IN ('SUCCEEDED','FAILED','PARTIAL','ROLLED_BACK','COMPENSATION_FAILED'));
@@ -0,0 +1,5 @@
+-- 0007_execution_failures.sql
+-- Failure classification for executions: client_error | upstream_error | timeout | policy.
+
+ALTER TABLE executions ADD COLUMN IF NOT EXISTS failure text;
+CREATE INDEX IF NOT EXISTS idx_executions_tenant_failure ON executions(tenant_id, failure) WHERE failure IS NOT NULL;
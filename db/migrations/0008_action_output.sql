@@ -0,0 +1,9 @@
+-- 0008_action_output.sql
+-- Stable action results: output schema + JMESPath mappings from the upstream response.
+-- output_mappings: [ { "path": "response.order.id", "key": "order_id", "transform": "", "required": true } ]
+
+ALTER TABLE actions ADD COLUMN IF NOT EXISTS output_schema jsonb NOT NULL DEFAULT '{}'::jsonb;
+ALTER TABLE actions ADD COLUMN IF NOT EXISTS output_mappings jsonb NOT NULL DEFAULT '[]'::jsonb;
+
+-- Raw upstream response retained for audit; agents receive the shaped result.
+ALTER TABLE executions ADD COLUMN IF NOT EXISTS raw_response jsonb;
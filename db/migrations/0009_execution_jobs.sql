@@ -0,0 +1,34 @@
+-- 0009_execution_jobs.sql
+-- Asynchronous executions: executions are created QUEUED and performed by workers
+-- claiming rows from execution_jobs with FOR UPDATE SKIP LOCKED.
+-- A claimed job holds a lease (locked_until); jobs whose lease expires are
+-- reclaimed by another worker, and jobs exceeding max_attempts are dead-lettered.
+
+ALTER TABLE executions DROP CONSTRAINT IF EXISTS executions_status_check;
+ALTER TABLE executions ADD CONSTRAINT executions_status_check
+  CHECK (status IN ('QUEUED','RUNNING','SUCCEEDED','FAILED','PARTIAL','ROLLED_BACK','COMPENSATION_FAILED'));
+ALTER TABLE executions ADD COLUMN IF NOT EXISTS problems jsonb NOT NULL DEFAULT '[]'::jsonb;
+ALTER TABLE executions ADD COLUMN IF NOT EXISTS updated_at timestamptz NOT NULL DEFAULT now();
+
+-- Queue rows are claimed across tenants by workers, so the table is not under RLS;
+-- tenant_id is carried so workers can scope their execution updates.
+CREATE TABLE IF NOT EXISTS execution_jobs (
+  id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+  execution_id uuid NOT NULL REFERENCES executions(id) ON DELETE CASCADE,
+  tenant_id uuid NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+  action_key text NOT NULL,
+  decision_id uuid,
+  inputs jsonb NOT NULL DEFAULT '{}'::jsonb,
+  status text NOT NULL DEFAULT 'queued' CHECK (status IN ('queued','running','done','dead')),
+  attempts int NOT NULL DEFAULT 0,
+  max_attempts int NOT NULL DEFAULT 3,
+  run_at timestamptz NOT NULL DEFAULT now(),
+  locked_until timestamptz,
+  locked_by text,
+  last_error text,
+  created_at timestamptz NOT NULL DEFAULT now(),
+  updated_at timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS idx_execution_jobs_ready ON execution_jobs(run_at) WHERE status = 'queued';
+CREATE INDEX IF NOT EXISTS idx_execution_jobs_lease ON execution_jobs(locked_until) WHERE status = 'running';
+CREATE UNIQUE INDEX IF NOT EXISTS idx_execution_jobs_execution ON execution_jobs(execution_id);
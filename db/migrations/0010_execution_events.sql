@@ -0,0 +1,20 @@
+-- 0010_execution_events.sql
+-- Per-execution progress events for the SSE stream (/v1/executions/{id}/events).
+-- seq orders events within an execution and doubles as the SSE event id.
+
+CREATE TABLE IF NOT EXISTS execution_events (
+  id bigserial PRIMARY KEY,
+  tenant_id uuid NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+  execution_id uuid NOT NULL REFERENCES executions(id) ON DELETE CASCADE,
+  seq bigint NOT NULL,
+  type text NOT NULL,
+  data jsonb NOT NULL DEFAULT '{}'::jsonb,
+  created_at timestamptz NOT NULL DEFAULT now(),
+  UNIQUE (execution_id, seq)
+);
+
+ALTER TABLE execution_events ENABLE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS tenant_isolation_execution_events ON execution_events;
+CREATE POLICY tenant_isolation_execution_events ON execution_events
+  USING (tenant_id = current_setting('app.tenant_id')::uuid)
+  WITH CHECK (tenant_id = current_setting('app.tenant_id')::uuid);
@@ -0,0 +1,22 @@
+-- 0011_scheduled_executions.sql
+-- Scheduled executions: execute with run_at persists a SCHEDULED execution whose
+-- job becomes claimable at run_at. When it fires the decision is re-validated,
+-- facts re-resolved and policy re-checked.
+--
+-- Decisions carry two scheduling TTLs separate from the short execute TTL:
+--   schedule_until        latest run_at the decision may be scheduled for (policy controlled)
+--   scheduled_expires_at  set when scheduled: run_at plus a grace period for queue lag
+
+ALTER TABLE decisions ADD COLUMN IF NOT EXISTS schedule_until timestamptz;
+ALTER TABLE decisions ADD COLUMN IF NOT EXISTS scheduled_expires_at timestamptz;
+
+ALTER TABLE executions ADD COLUMN IF NOT EXISTS run_at timestamptz;
+ALTER TABLE executions DROP CONSTRAINT IF EXISTS executions_status_check;
+ALTER TABLE executions ADD CONSTRAINT executions_status_check
+  CHECK (status IN ('SCHEDULED','QUEUED','RUNNING','SUCCEEDED','FAILED','PARTIAL','ROLLED_BACK','COMPENSATION_FAILED','CANCELLED'));
+CREATE INDEX IF NOT EXISTS idx_executions_tenant_scheduled ON executions(tenant_id, run_at) WHERE status = 'SCHEDULED';
+
+ALTER TABLE execution_jobs ADD COLUMN IF NOT EXISTS scheduled boolean NOT NULL DEFAULT false;
+ALTER TABLE execution_jobs DROP CONSTRAINT IF EXISTS execution_jobs_status_check;
+ALTER TABLE execution_jobs ADD CONSTRAINT execution_jobs_status_check
+  CHECK (status IN ('queued','running','done','dead','cancelled'));
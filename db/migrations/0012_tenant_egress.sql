@@ -0,0 +1,8 @@
+-- 0012_tenant_egress.sql
+-- Per-tenant egress policy for connector upstream calls:
+--   { "allow_hosts": ["api.example.com","*.example.org"], "allow_cidrs": ["203.0.113.0/24"], "require_https": true }
+-- Empty allowlists permit any public destination. Private, loopback and link-local
+-- destinations are blocked unless the operator permits them (EGRESS_ALLOW_PRIVATE,
+-- EGRESS_PRIVATE_CIDRS); tenants cannot opt in.
+
+ALTER TABLE tenants ADD COLUMN IF NOT EXISTS egress_policy jsonb NOT NULL DEFAULT '{}'::jsonb;
@@ -0,0 +1,39 @@
+-- 0013_user_connections.sql
+-- Per-end-user OAuth2 connections. An oauth2_user auth config (tenant_auth_configs)
+-- holds the tenant's OAuth2 client; each end user links their own upstream account
+-- through the authorize/callback flow and their tokens are stored here, encrypted,
+-- keyed by the actor's subject. Executions record the actor so queued and scheduled
+-- runs act with the token of the user who requested them.
+
+CREATE TABLE IF NOT EXISTS user_connections (
+  id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+  tenant_id uuid NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+  auth_id uuid NOT NULL,
+  actor_sub text NOT NULL,
+  tokens_encrypted bytea NOT NULL,
+  scopes text NOT NULL DEFAULT '',
+  expires_at timestamptz,
+  created_at timestamptz NOT NULL DEFAULT now(),
+  updated_at timestamptz NOT NULL DEFAULT now(),
+  UNIQUE (tenant_id, auth_id, actor_sub)
+);
+ALTER TABLE user_connections ENABLE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS tenants_rls_user_connections ON user_connections;
+CREATE POLICY tenants_rls_user_connections ON user_connections USING (tenant_id = current_setting('app.tenant_id')::uuid);
+
+-- Pending authorize requests. The callback arrives from the user's browser without
+-- the tenant's bearer token; the single-use state row is what authenticates it.
+CREATE TABLE IF NOT EXISTS oauth_link_states (
+  state text PRIMARY KEY,
+  tenant_id uuid NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+  auth_id uuid NOT NULL,
+  actor_sub text NOT NULL,
+  code_verifier text NOT NULL DEFAULT '',
+  return_to text NOT NULL DEFAULT '',
+  expires_at timestamptz NOT NULL,
+  created_at timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS idx_oauth_link_states_expiry ON oauth_link_states(expires_at);
+
+ALTER TABLE executions ADD COLUMN IF NOT EXISTS actor_sub text;
+ALTER TABLE execution_jobs ADD COLUMN IF NOT EXISTS actor_sub text NOT NULL DEFAULT '';
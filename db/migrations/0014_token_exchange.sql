@@ -0,0 +1,8 @@
+-- 0014_token_exchange.sql
+-- token_exchange auth configs trade the caller's access token for an upstream
+-- token (RFC 8693). Queued executions keep the caller's token, sealed like other
+-- secrets, until the job finishes, and only for tenants that configure a
+-- token_exchange. Scheduled executions never store it: by the time they fire
+-- the token has expired, so their token_exchange steps fail.
+
+ALTER TABLE execution_jobs ADD COLUMN IF NOT EXISTS subject_token_encrypted bytea;
@@ -0,0 +1,5 @@
+-- 0015_tenant_connector_config.sql
+-- Builtin connectors (registry connectors implemented in code, e.g. kind "rail")
+-- are instantiated per tenant from non-secret config and the sealed secrets.
+
+ALTER TABLE tenant_connectors ADD COLUMN IF NOT EXISTS config JSONB NOT NULL DEFAULT '{}'::jsonb;
@@ -0,0 +1,24 @@
+-- 0016_rate_limits.sql
+-- Plans carry a monthly quota (NULL = unlimited) and default rate limits;
+-- tenants pick a plan and may override its limits (see pkg/ratelimit).
+-- Tenants without a plan are not limited.
+
+CREATE TABLE IF NOT EXISTS plans (
+  name TEXT PRIMARY KEY,
+  monthly_quota BIGINT,
+  rate_limits JSONB NOT NULL DEFAULT '{}'::jsonb,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+INSERT INTO plans(name, monthly_quota, rate_limits) VALUES
+  ('free', 10000, '{"tenant":{"requests":60,"period_seconds":60},"actor":{"requests":20,"period_seconds":60}}'),
+  ('pro', 1000000, '{"tenant":{"requests":1200,"period_seconds":60},"actor":{"requests":120,"period_seconds":60}}'),
+  ('enterprise', NULL, '{"tenant":{"requests":6000,"period_seconds":60}}')
+ON CONFLICT (name) DO NOTHING;
+
+ALTER TABLE tenants ADD COLUMN IF NOT EXISTS plan TEXT;
+ALTER TABLE tenants ADD COLUMN IF NOT EXISTS rate_limits JSONB NOT NULL DEFAULT '{}'::jsonb;
+
+-- Monthly quota counts
+CREATE INDEX IF NOT EXISTS usage_events_tenant_started_idx ON usage_events(tenant_id, started_at);
@@ -0,0 +1,6 @@
+-- 0017_operation_passthrough.sql
+-- Passthrough operations relay the caller's concrete path, query string and
+-- selected headers. passthrough holds the per-operation header allow/deny
+-- rules and whether bodies are streamed (see upstream.Passthrough).
+
+ALTER TABLE connector_operations ADD COLUMN IF NOT EXISTS passthrough JSONB;
@@ -7,6 +7,8 @@ import (
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/lestrrat-go/jwx/v2/jwk"
 	"go.uber.org/zap"
+
+	"lamdis/pkg/connectors"
 )
 
 // Config holds admin-api specific configuration.
@@ -17,6 +19,9 @@ type Config struct {
 	JWKSURL       string
 	RegistryDir   string
 	EncryptionKey string
+	// Registry holds the builtin connector factories that tenant configs are
+	// checked against on save; nil skips the check.
+	Registry *connectors.Registry
 }
 
 // App is the admin-api application container.
@@ -37,6 +42,7 @@ type App struct {
 	adminIssuer  string
 	adminAud     string
 	encrypterKey []byte
+	registry     *connectors.Registry
 }
 
 // New constructs App and performs one-time startup tasks (schema, seeds, registry import).
@@ -46,6 +52,7 @@ func New(log *zap.SugaredLogger, db *pgxpool.Pool, cfg Config) *App {
 		db:          db,
 		adminIssuer: cfg.OIDCIssuer,
 		adminAud:    cfg.OIDCAudience,
+		registry:    cfg.Registry,
 	}
 	if k := cfg.EncryptionKey; k != "" {
 		app.encrypterKey = []byte(k)
@@ -0,0 +1,40 @@
+package adminapi
+
+import (
+	"net/http"
+
+	chimw "github.com/go-chi/chi/v5/middleware"
+
+	"lamdis/pkg/changes"
+)
+
+// publishes announces a change of topic for the tenant after each successful
+// write through the wrapped routes, so services drop what they cached.
+func (a *App) publishes(topic changes.Topic) func(http.Handler) http.Handler {
+	return a.announce(topic, false)
+}
+
+// publishesAll is publishes for writes to data every tenant shares, such as
+// the connector registry: the change is announced for all tenants.
+func (a *App) publishesAll(topic changes.Topic) func(http.Handler) http.Handler {
+	return a.announce(topic, true)
+}
+
+func (a *App) announce(topic changes.Topic, allTenants bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ww := chimw.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r)
+			if r.Method == http.MethodGet || ww.Status() >= 400 {
+				return
+			}
+			tid := ""
+			if !allTenants {
+				tid, _ = r.Context().Value("tid").(string)
+			}
+			if err := changes.Publish(r.Context(), a.db, changes.Event{Topic: topic, TenantID: tid}); err != nil {
+				a.log.Warnw("publish change", "topic", topic, "tenant", tid, "err", err)
+			}
+		})
+	}
+}
@@ -5,17 +5,25 @@ import (
 	"net/http"
 	"time"
 
+	"lamdis/internal/orchestrator"
+
 	"github.com/go-chi/chi/v5"
 )
 
 type UpsertActionBody struct {
 	DisplayName  *string        `json:"display_name"`
 	InputsSchema map[string]any `json:"inputs_schema"`
+	// Flow is the execution plan: { "steps": [ { name, action, when, request_tmpl } ] }
+	Flow map[string]any `json:"flow"`
+	// OutputSchema is the stable result shape published in the manifest.
+	OutputSchema map[string]any `json:"output_schema"`
+	// OutputMappings map the upstream response into the result: [ { path, key, transform, required } ]
+	OutputMappings []map[string]any `json:"output_mappings"`
 }
 
 func (a *App) listActions(w http.ResponseWriter, r *http.Request) {
 	tid := r.Context().Value("tid").(string)
-	rows, err := a.db.Query(r.Context(), `WITH s AS (SELECT set_config('app.tenant_id', $1, true)) SELECT key, display_name, inputs_schema, updated_at FROM actions ORDER BY key`, tid)
+	rows, err := a.db.Query(r.Context(), `WITH s AS (SELECT set_config('app.tenant_id', $1, true)) SELECT key, display_name, inputs_schema, COALESCE(flow,'{}'::jsonb), COALESCE(output_schema,'{}'::jsonb), COALESCE(output_mappings,'[]'::jsonb), updated_at FROM actions ORDER BY key`, tid)
 	if err != nil {
 		http.Error(w, "db error", 500)
 		return
@@ -24,20 +32,27 @@ func (a *App) listActions(w http.ResponseWriter, r *http.Request) {
 	type Row struct {
 		Key, DisplayName string
 		InputsSchema     map[string]any
+		Flow             map[string]any
+		OutputSchema     map[string]any
+		OutputMappings   []map[string]any
 		UpdatedAt        time.Time
 	}
 	out := []Row{}
 	for rows.Next() {
 		var rkey, disp string
-		var js []byte
+		var js, fl, osb, omb []byte
 		var upd time.Time
-		if err := rows.Scan(&rkey, &disp, &js, &upd); err != nil {
+		if err := rows.Scan(&rkey, &disp, &js, &fl, &osb, &omb, &upd); err != nil {
 			http.Error(w, "db error", 500)
 			return
 		}
-		var schema map[string]any
+		var schema, flow, outSchema map[string]any
+		var outMappings []map[string]any
 		_ = json.Unmarshal(js, &schema)
-		out = append(out, Row{Key: rkey, DisplayName: disp, InputsSchema: schema, UpdatedAt: upd})
+		_ = json.Unmarshal(fl, &flow)
+		_ = json.Unmarshal(osb, &outSchema)
+		_ = json.Unmarshal(omb, &outMappings)
+		out = append(out, Row{Key: rkey, DisplayName: disp, InputsSchema: schema, Flow: flow, OutputSchema: outSchema, OutputMappings: outMappings, UpdatedAt: upd})
 	}
 	writeJSON(w, map[string]any{"items": out}, 200)
 }
@@ -50,9 +65,17 @@ func (a *App) upsertAction(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "bad json", 400)
 		return
 	}
+	if err := validateOutputContract(b); err != nil {
+		http.Error(w, "invalid output contract: "+err.Error(), 400)
+		return
+	}
+	if err := validateFlow(b); err != nil {
+		http.Error(w, "invalid flow: "+err.Error(), 400)
+		return
+	}
 	_, err := a.db.Exec(r.Context(), `WITH s AS (SELECT set_config('app.tenant_id', $1, true))
-		INSERT INTO actions(tenant_id, key, display_name, inputs_schema) VALUES ($1::uuid,$2,COALESCE($3,''),COALESCE($4,'{}'::jsonb))
-		ON CONFLICT (tenant_id, key) DO UPDATE SET display_name=COALESCE($3,actions.display_name), inputs_schema=COALESCE($4,actions.inputs_schema), updated_at=NOW()`, tid, key, b.DisplayName, b.InputsSchema)
+		INSERT INTO actions(tenant_id, key, display_name, inputs_schema, flow, output_schema, output_mappings) VALUES ($1::uuid,$2,COALESCE($3,''),COALESCE($4,'{}'::jsonb),COALESCE($5,'{}'::jsonb),COALESCE($6,'{}'::jsonb),COALESCE($7,'[]'::jsonb))
+		ON CONFLICT (tenant_id, key) DO UPDATE SET display_name=COALESCE($3,actions.display_name), inputs_schema=COALESCE($4,actions.inputs_schema), flow=COALESCE($5,actions.flow), output_schema=COALESCE($6,actions.output_schema), output_mappings=COALESCE($7,actions.output_mappings), updated_at=NOW()`, tid, key, b.DisplayName, b.InputsSchema, b.Flow, b.OutputSchema, b.OutputMappings)
 	if err != nil {
 		http.Error(w, "db error", 500)
 		return
@@ -60,6 +83,33 @@ func (a *App) upsertAction(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, map[string]any{"ok": true}, 200)
 }
 
+// validateOutputContract checks the output schema and mappings in b, when set,
+// the way executions apply them.
+func validateOutputContract(b UpsertActionBody) error {
+	c := orchestrator.OutputContract{Schema: b.OutputSchema}
+	if b.OutputMappings != nil {
+		raw, _ := json.Marshal(b.OutputMappings)
+		if err := json.Unmarshal(raw, &c.Mappings); err != nil {
+			return err
+		}
+	}
+	return c.Validate()
+}
+
+// validateFlow checks the plan in b, when set: step conditions must compile
+// and templates must parse.
+func validateFlow(b UpsertActionBody) error {
+	if b.Flow == nil {
+		return nil
+	}
+	var plan orchestrator.Plan
+	raw, _ := json.Marshal(b.Flow)
+	if err := json.Unmarshal(raw, &plan); err != nil {
+		return err
+	}
+	return plan.Validate()
+}
+
 type UpsertResolverBody struct {
 	ConnectorKey   *string          `json:"connector_key"`
 	RequestTmpl    map[string]any   `json:"request_template"`
@@ -1,17 +1,31 @@
 package adminapi
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"regexp"
 	"strings"
 
 	"github.com/go-chi/chi/v5"
+
+	"lamdis/internal/connector"
+	"lamdis/internal/orchestrator"
+	"lamdis/pkg/connectors"
+	"lamdis/pkg/graphql"
+	"lamdis/pkg/grpcconn"
+	"lamdis/pkg/template"
+	"lamdis/pkg/upstream"
+	"lamdis/pkg/upstreamauth"
 )
 
 type ConnectorBody struct {
 	Enabled bool              `json:"enabled"`
 	Secrets map[string]string `json:"secrets"`
+	// Config is the non-secret config builtin connectors are created from
+	// (e.g. a rail's base_url); omitted keeps the stored config.
+	Config map[string]any `json:"config"`
 }
 
 func (a *App) putTenantConnector(w http.ResponseWriter, r *http.Request) {
@@ -27,6 +41,21 @@ func (a *App) putTenantConnector(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "bad json", 400)
 		return
 	}
+	// The config the connector will run with: the body's, or the stored one
+	// when omitted. Disabling skips the check so broken connectors can be
+	// switched off.
+	if b.Enabled || b.Config != nil {
+		cfg := b.Config
+		if cfg == nil {
+			var raw []byte
+			_ = a.db.QueryRow(r.Context(), `SELECT config FROM tenant_connectors WHERE tenant_id=$1 AND connector_id=$2`, tid, cid).Scan(&raw)
+			_ = json.Unmarshal(raw, &cfg)
+		}
+		if err := a.checkBuiltinConfig(r.Context(), tid, cid, cfg); err != nil {
+			http.Error(w, "invalid config: "+err.Error(), 400)
+			return
+		}
+	}
 
 	var enc []byte
 	var err error
@@ -50,22 +79,24 @@ func (a *App) putTenantConnector(w http.ResponseWriter, r *http.Request) {
 			_ = a.db.QueryRow(r.Context(), `SELECT kind FROM connectors WHERE id=$1`, cid).Scan(&kind)
 		}
 		_, err = a.db.Exec(r.Context(), `
-			INSERT INTO tenant_connectors (tenant_id, connector_id, kind, enabled, secrets_encrypted)
-			VALUES ($1,$2,$3,$4,$5)
+			INSERT INTO tenant_connectors (tenant_id, connector_id, kind, enabled, secrets_encrypted, config)
+			VALUES ($1,$2,$3,$4,$5,COALESCE($6::jsonb,'{}'::jsonb))
 			ON CONFLICT (tenant_id, connector_id) DO UPDATE SET
 			  enabled=EXCLUDED.enabled,
 			  secrets_encrypted=COALESCE(EXCLUDED.secrets_encrypted, tenant_connectors.secrets_encrypted),
+			  config=COALESCE($6::jsonb, tenant_connectors.config),
 			  updated_at=NOW()
-		`, tid, cid, kind, b.Enabled, enc)
+		`, tid, cid, kind, b.Enabled, enc, b.Config)
 	} else {
 		_, err = a.db.Exec(r.Context(), `
-			INSERT INTO tenant_connectors (tenant_id, connector_id, enabled, secrets_encrypted)
-			VALUES ($1,$2,$3,$4)
+			INSERT INTO tenant_connectors (tenant_id, connector_id, enabled, secrets_encrypted, config)
+			VALUES ($1,$2,$3,$4,COALESCE($5::jsonb,'{}'::jsonb))
 			ON CONFLICT (tenant_id, connector_id) DO UPDATE SET
 			  enabled=EXCLUDED.enabled,
 			  secrets_encrypted=COALESCE(EXCLUDED.secrets_encrypted, tenant_connectors.secrets_encrypted),
+			  config=COALESCE($5::jsonb, tenant_connectors.config),
 			  updated_at=NOW()
-		`, tid, cid, b.Enabled, enc)
+		`, tid, cid, b.Enabled, enc, b.Config)
 	}
 	if err != nil {
 		http.Error(w, "db error", 500)
@@ -94,6 +125,29 @@ func (a *App) putTenantConnector(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, map[string]any{"ok": true}, 200)
 }
 
+// checkBuiltinConfig validates a registry connector's config: its base_url
+// must pass the tenant's egress policy and the factory registered for its
+// kind must accept it, so configs are rejected when saved rather than when
+// the connector is first called.
+func (a *App) checkBuiltinConfig(ctx context.Context, tid, cid string, cfg map[string]any) error {
+	if base, ok := cfg["base_url"].(string); ok {
+		if err := a.checkEgress(ctx, tid, base); err != nil {
+			return fmt.Errorf("base_url: %w", err)
+		}
+	}
+	if a.registry == nil {
+		return nil
+	}
+	var kind string
+	_ = a.db.QueryRow(ctx, `SELECT kind FROM connectors WHERE id=$1`, cid).Scan(&kind)
+	if f, ok := a.registry.Factory(kind); ok {
+		if _, err := f(cfg, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // ===== Marketplace: Custom connectors =====
 
 type CustomConnectorBody struct {
@@ -104,29 +158,141 @@ type CustomConnectorBody struct {
 	BaseURL string  `json:"base_url"`
 	AuthRef *string `json:"auth_ref"`
 	Enabled *bool   `json:"enabled"`
+	// Protocol is "graphql" for GraphQL connectors, whose base_url is the
+	// endpoint and whose operations carry request_tmpl.graphql, or "grpc" for
+	// gRPC connectors (request_tmpl.grpc, descriptors from the gRPC import);
+	// empty means HTTP.
+	Protocol string `json:"protocol"`
 	// Accept legacy "operations" and new "actions" keys with identical shapes
 	Operations []struct {
-		Title       string           `json:"title"`
-		Method      string           `json:"method"`
-		Path        string           `json:"path"`
-		Summary     string           `json:"summary"`
-		Scopes      []string         `json:"scopes"`
-		Params      []map[string]any `json:"params"`
-		RequestTmpl map[string]any   `json:"request_tmpl"`
-		Enabled     *bool            `json:"enabled"`
+		Title       string                `json:"title"`
+		Method      string                `json:"method"`
+		Path        string                `json:"path"`
+		Summary     string                `json:"summary"`
+		Scopes      []string              `json:"scopes"`
+		Params      []map[string]any      `json:"params"`
+		RequestTmpl map[string]any        `json:"request_tmpl"`
+		CallOptions map[string]any        `json:"call_options"`
+		Passthrough *upstream.Passthrough `json:"passthrough"`
+		Success     map[string]any        `json:"success_criteria"`
+		Enabled     *bool                 `json:"enabled"`
 	} `json:"operations"`
 	Actions []struct {
-		Title       string           `json:"title"`
-		Method      string           `json:"method"`
-		Path        string           `json:"path"`
-		Summary     string           `json:"summary"`
-		Scopes      []string         `json:"scopes"`
-		Params      []map[string]any `json:"params"`
-		RequestTmpl map[string]any   `json:"request_tmpl"`
-		Enabled     *bool            `json:"enabled"`
+		Title       string                `json:"title"`
+		Method      string                `json:"method"`
+		Path        string                `json:"path"`
+		Summary     string                `json:"summary"`
+		Scopes      []string              `json:"scopes"`
+		Params      []map[string]any      `json:"params"`
+		RequestTmpl map[string]any        `json:"request_tmpl"`
+		CallOptions map[string]any        `json:"call_options"`
+		Passthrough *upstream.Passthrough `json:"passthrough"`
+		Success     map[string]any        `json:"success_criteria"`
+		Enabled     *bool                 `json:"enabled"`
 	} `json:"actions"`
 }
 
+// validateTemplates checks every operation's request_tmpl so broken placeholders
+// are rejected on save rather than at execution time.
+func (b CustomConnectorBody) validateTemplates() error {
+	switch b.Protocol {
+	case "", graphql.Protocol, grpcconn.Protocol:
+	default:
+		return fmt.Errorf("unknown protocol %q", b.Protocol)
+	}
+	check := func(method, path string, tmpl map[string]any) error {
+		switch b.Protocol {
+		case graphql.Protocol:
+			if _, ok := graphql.SpecFrom(tmpl); !ok {
+				return fmt.Errorf("%s %s: graphql.query is required", strings.ToUpper(method), path)
+			}
+		case grpcconn.Protocol:
+			if _, ok := grpcconn.SpecFrom(tmpl); !ok {
+				return fmt.Errorf("%s %s: grpc.method is required (/package.Service/Method)", strings.ToUpper(method), path)
+			}
+		}
+		if err := template.Validate(graphql.Templated(tmpl)); err != nil {
+			return fmt.Errorf("%s %s: %w", strings.ToUpper(method), path, err)
+		}
+		return nil
+	}
+	checkPassthrough := func(method, path string, p *upstream.Passthrough) error {
+		if p == nil {
+			return nil
+		}
+		if err := p.Validate(); err != nil {
+			return fmt.Errorf("%s %s: passthrough: %w", strings.ToUpper(method), path, err)
+		}
+		return nil
+	}
+	for _, op := range b.Actions {
+		if err := check(op.Method, op.Path, op.RequestTmpl); err != nil {
+			return err
+		}
+		if err := checkPassthrough(op.Method, op.Path, op.Passthrough); err != nil {
+			return err
+		}
+	}
+	for _, op := range b.Operations {
+		if err := check(op.Method, op.Path, op.RequestTmpl); err != nil {
+			return err
+		}
+		if err := checkPassthrough(op.Method, op.Path, op.Passthrough); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateOperations checks every operation's call_options against the ranges
+// the upstream client accepts, and its success_criteria the way executions
+// apply them.
+func (b CustomConnectorBody) validateOperations() error {
+	check := func(method, path string, opts, success map[string]any) error {
+		if opts != nil {
+			var co upstream.CallOptions
+			raw, _ := json.Marshal(opts)
+			if err := json.Unmarshal(raw, &co); err != nil {
+				return fmt.Errorf("%s %s: call_options: %w", strings.ToUpper(method), path, err)
+			}
+			if err := co.Validate(); err != nil {
+				return fmt.Errorf("%s %s: call_options: %w", strings.ToUpper(method), path, err)
+			}
+		}
+		if success != nil {
+			var sc orchestrator.SuccessCriteria
+			raw, _ := json.Marshal(success)
+			if err := json.Unmarshal(raw, &sc); err != nil {
+				return fmt.Errorf("%s %s: success_criteria: %w", strings.ToUpper(method), path, err)
+			}
+			if err := sc.Validate(); err != nil {
+				return fmt.Errorf("%s %s: success_criteria: %w", strings.ToUpper(method), path, err)
+			}
+		}
+		return nil
+	}
+	for _, op := range b.Actions {
+		if err := check(op.Method, op.Path, op.CallOptions, op.Success); err != nil {
+			return err
+		}
+	}
+	for _, op := range b.Operations {
+		if err := check(op.Method, op.Path, op.CallOptions, op.Success); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// config is the connector_definitions.config written for the body.
+func (b CustomConnectorBody) config() map[string]any {
+	cfg := map[string]any{}
+	if b.Protocol != "" {
+		cfg["protocol"] = b.Protocol
+	}
+	return cfg
+}
+
 func (a *App) listTenantConnectors(w http.ResponseWriter, r *http.Request) {
 	tid := r.Context().Value("tid").(string)
 	rows, err := a.db.Query(r.Context(), `
@@ -172,6 +338,13 @@ func (a *App) listTenantConnectors(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, map[string]any{"items": out}, 200)
 }
 
+// checkEgress rejects base URLs the tenant's egress policy (merged with the
+// operator baseline) would block, including hosts resolving to internal addresses.
+func (a *App) checkEgress(ctx context.Context, tid, baseURL string) error {
+	pol := upstream.Default.EgressPolicy(connectors.LoadEgressPolicy(ctx, a.db, tid))
+	return pol.CheckResolved(ctx, baseURL)
+}
+
 func (a *App) createCustomConnector(w http.ResponseWriter, r *http.Request) {
 	tid := r.Context().Value("tid").(string)
 	var b CustomConnectorBody
@@ -179,12 +352,24 @@ func (a *App) createCustomConnector(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "bad json", 400)
 		return
 	}
+	if err := b.validateTemplates(); err != nil {
+		http.Error(w, "invalid request_tmpl: "+err.Error(), 400)
+		return
+	}
+	if err := b.validateOperations(); err != nil {
+		http.Error(w, "invalid operation: "+err.Error(), 400)
+		return
+	}
 	if b.Display == "" || b.BaseURL == "" {
 		http.Error(w, "missing fields", 400)
 		return
 	}
+	if err := a.checkEgress(r.Context(), tid, b.BaseURL); err != nil {
+		http.Error(w, "invalid base_url: "+err.Error(), 400)
+		return
+	}
 	defID := uuidNew()
-	if _, err := a.db.Exec(r.Context(), `INSERT INTO connector_definitions(id,tenant_id,kind,builtin_kind,auth,config,secret,base_url,auth_ref,title,summary) VALUES ($1,$2,$3,'', '{}'::jsonb, '{}'::jsonb, '{}'::jsonb, $4, $5, $6, $7)`, defID, tid, b.Display, b.BaseURL, b.AuthRef, nullIfEmpty(b.Title), nullIfEmpty(b.Summary)); err != nil {
+	if _, err := a.db.Exec(r.Context(), `INSERT INTO connector_definitions(id,tenant_id,kind,builtin_kind,auth,config,secret,base_url,auth_ref,title,summary) VALUES ($1,$2,$3,'', '{}'::jsonb, $8, '{}'::jsonb, $4, $5, $6, $7)`, defID, tid, b.Display, b.BaseURL, b.AuthRef, nullIfEmpty(b.Title), nullIfEmpty(b.Summary), b.config()); err != nil {
 		http.Error(w, "db error", 500)
 		return
 	}
@@ -198,7 +383,7 @@ func (a *App) createCustomConnector(w http.ResponseWriter, r *http.Request) {
 		if op.Enabled != nil {
 			enabled = *op.Enabled
 		}
-		_, _ = a.db.Exec(r.Context(), `INSERT INTO connector_operations(id,connector_id,method,path,summary,scopes,request_tmpl,params,enabled) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9)`, uuidNew(), defID, strings.ToUpper(op.Method), op.Path, op.Summary, op.Scopes, op.RequestTmpl, op.Params, enabled)
+		_, _ = a.db.Exec(r.Context(), `INSERT INTO connector_operations(id,connector_id,method,path,summary,scopes,request_tmpl,params,enabled,call_options,success_criteria,passthrough) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12)`, uuidNew(), defID, strings.ToUpper(op.Method), op.Path, op.Summary, op.Scopes, op.RequestTmpl, op.Params, enabled, op.CallOptions, op.Success, op.Passthrough)
 	}
 	if b.Enabled != nil && *b.Enabled {
 		// Legacy compatibility: populate 'kind' if the column exists to satisfy NOT NULL/PK variants
@@ -231,13 +416,45 @@ func (a *App) updateCustomConnector(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "bad json", 400)
 		return
 	}
-	var builtin string
-	_ = a.db.QueryRow(r.Context(), `SELECT COALESCE(builtin_kind,'') FROM connector_definitions WHERE id=$1 AND tenant_id=$2`, id, tid).Scan(&builtin)
+	var builtin, protocol string
+	_ = a.db.QueryRow(r.Context(), `SELECT COALESCE(builtin_kind,''), COALESCE(config->>'protocol','') FROM connector_definitions WHERE id=$1 AND tenant_id=$2`, id, tid).Scan(&builtin, &protocol)
 	if strings.TrimSpace(builtin) != "" {
 		http.Error(w, "builtin_connectors_are_readonly", http.StatusForbidden)
 		return
 	}
-	_, err := a.db.Exec(r.Context(), `UPDATE connector_definitions SET kind=COALESCE($1,kind), base_url=COALESCE($2,base_url), auth_ref=COALESCE($3,auth_ref), title=COALESCE($4,title), summary=COALESCE($5,summary) WHERE id=$6 AND tenant_id=$7`, nullIfEmpty(b.Display), nullIfEmpty(b.BaseURL), b.AuthRef, nullIfEmpty(b.Title), nullIfEmpty(b.Summary), id, tid)
+	// The protocol decides how the stored operations are called, so it is
+	// fixed at creation; operations are validated against the stored one.
+	if b.Protocol != "" && b.Protocol != protocol {
+		http.Error(w, fmt.Sprintf("invalid protocol: cannot change %q to %q", protocol, b.Protocol), 400)
+		return
+	}
+	b.Protocol = protocol
+	if err := b.validateTemplates(); err != nil {
+		http.Error(w, "invalid request_tmpl: "+err.Error(), 400)
+		return
+	}
+	if err := b.validateOperations(); err != nil {
+		http.Error(w, "invalid operation: "+err.Error(), 400)
+		return
+	}
+	if protocol == grpcconn.Protocol && b.AuthRef != nil && *b.AuthRef != "" {
+		auth, err := upstreamauth.Load(r.Context(), a.db, tid, *b.AuthRef)
+		if err != nil {
+			http.Error(w, "auth_ref could not be loaded: "+err.Error(), 400)
+			return
+		}
+		if err := grpcconn.CheckAuth(auth); err != nil {
+			http.Error(w, "invalid auth_ref: "+err.Error(), 400)
+			return
+		}
+	}
+	if b.BaseURL != "" {
+		if err := a.checkEgress(r.Context(), tid, b.BaseURL); err != nil {
+			http.Error(w, "invalid base_url: "+err.Error(), 400)
+			return
+		}
+	}
+	_, err := a.db.Exec(r.Context(), `UPDATE connector_definitions SET kind=COALESCE($1,kind), base_url=COALESCE($2,base_url), auth_ref=COALESCE($3,auth_ref), title=COALESCE($4,title), summary=COALESCE($5,summary), config=COALESCE(config,'{}'::jsonb) || $8::jsonb WHERE id=$6 AND tenant_id=$7`, nullIfEmpty(b.Display), nullIfEmpty(b.BaseURL), b.AuthRef, nullIfEmpty(b.Title), nullIfEmpty(b.Summary), id, tid, b.config())
 	if err != nil {
 		http.Error(w, "db error", 500)
 		return
@@ -279,7 +496,7 @@ func (a *App) updateCustomConnector(w http.ResponseWriter, r *http.Request) {
 			if op.Enabled != nil {
 				enabled = *op.Enabled
 			}
-			_, _ = a.db.Exec(r.Context(), `INSERT INTO connector_operations(id,connector_id,method,path,summary,scopes,request_tmpl,params,enabled) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9)`, uuidNew(), id, strings.ToUpper(op.Method), op.Path, op.Summary, op.Scopes, op.RequestTmpl, op.Params, enabled)
+			_, _ = a.db.Exec(r.Context(), `INSERT INTO connector_operations(id,connector_id,method,path,summary,scopes,request_tmpl,params,enabled,call_options,success_criteria,passthrough) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12)`, uuidNew(), id, strings.ToUpper(op.Method), op.Path, op.Summary, op.Scopes, op.RequestTmpl, op.Params, enabled, op.CallOptions, op.Success, op.Passthrough)
 		}
 	}
 	writeJSON(w, map[string]any{"ok": true}, 200)
@@ -355,7 +572,7 @@ func (a *App) getCustomConnector(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	opr, err := a.db.Query(r.Context(), `
-		SELECT id::text, method, path, summary, COALESCE(scopes, ARRAY[]::text[]), COALESCE(params,'[]'::jsonb), COALESCE(request_tmpl,'{}'::jsonb), COALESCE(enabled,true)
+		SELECT id::text, method, path, summary, COALESCE(scopes, ARRAY[]::text[]), COALESCE(params,'[]'::jsonb), COALESCE(request_tmpl,'{}'::jsonb), COALESCE(call_options,'{}'::jsonb), COALESCE(success_criteria,'{}'::jsonb), COALESCE(enabled,true), COALESCE(passthrough,'{}'::jsonb)
 		FROM connector_operations WHERE connector_id::text=$1 ORDER BY id
 	`, id)
 	if err != nil {
@@ -370,25 +587,33 @@ func (a *App) getCustomConnector(w http.ResponseWriter, r *http.Request) {
 			method, path, summary string
 			scopes                []string
 			paramsRaw, tmplRaw    []byte
+			callRaw, successRaw   []byte
+			passRaw               []byte
 			opEnabled             bool
 		)
-		if err := opr.Scan(&opID, &method, &path, &summary, &scopes, &paramsRaw, &tmplRaw, &opEnabled); err != nil {
+		if err := opr.Scan(&opID, &method, &path, &summary, &scopes, &paramsRaw, &tmplRaw, &callRaw, &successRaw, &opEnabled, &passRaw); err != nil {
 			http.Error(w, "db error", 500)
 			return
 		}
 		var params []map[string]any
-		var tmpl map[string]any
+		var tmpl, callOpts, success, passthrough map[string]any
 		_ = json.Unmarshal(paramsRaw, &params)
 		_ = json.Unmarshal(tmplRaw, &tmpl)
+		_ = json.Unmarshal(callRaw, &callOpts)
+		_ = json.Unmarshal(successRaw, &success)
+		_ = json.Unmarshal(passRaw, &passthrough)
 		ops = append(ops, map[string]any{
-			"id":           opID,
-			"method":       method,
-			"path":         path,
-			"summary":      summary,
-			"scopes":       scopes,
-			"params":       params,
-			"request_tmpl": tmpl,
-			"enabled":      opEnabled,
+			"id":               opID,
+			"method":           method,
+			"path":             path,
+			"summary":          summary,
+			"scopes":           scopes,
+			"params":           params,
+			"request_tmpl":     tmpl,
+			"call_options":     callOpts,
+			"passthrough":      passthrough,
+			"success_criteria": success,
+			"enabled":          opEnabled,
 		})
 	}
 	writeJSON(w, map[string]any{
@@ -498,6 +723,23 @@ func (a *App) listConnectorActions(w http.ResponseWriter, r *http.Request) {
 	}, 200)
 }
 
+// listOperationConflicts reports enabled operations the connector service does
+// not route because a canonical operation or another connector's operation
+// (same method and path) takes precedence, or because their path is invalid.
+func (a *App) listOperationConflicts(w http.ResponseWriter, r *http.Request) {
+	tid := r.Context().Value("tid").(string)
+	set, err := connectors.NewRegistry(a.db).LoadOperationSet(r.Context(), tid)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	conflicts := connector.OperationConflicts(set)
+	if conflicts == nil {
+		conflicts = []connectors.Conflict{}
+	}
+	writeJSON(w, map[string]any{"conflicts": conflicts}, 200)
+}
+
 // Helpers to avoid importing database/sql here
 type sqlNullString struct {
 	Valid  bool
@@ -0,0 +1,44 @@
+package adminapi
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+
+	"lamdis/internal/orchestrator"
+)
+
+// listScheduledExecutions returns executions waiting for their run_at, soonest first.
+func (a *App) listScheduledExecutions(w http.ResponseWriter, r *http.Request) {
+	tid := r.Context().Value("tid").(string)
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 && n <= 500 {
+			limit = n
+		}
+	}
+	items, err := orchestrator.ListScheduled(r.Context(), a.db, tid, limit)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	writeJSON(w, map[string]any{"items": items}, 200)
+}
+
+// cancelScheduledExecution cancels a scheduled execution before it fires.
+// Executions already picked up by a worker can no longer be cancelled.
+func (a *App) cancelScheduledExecution(w http.ResponseWriter, r *http.Request) {
+	tid := r.Context().Value("tid").(string)
+	id := chi.URLParam(r, "id")
+	ok, err := orchestrator.CancelScheduled(r.Context(), a.db, tid, id)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if !ok {
+		http.Error(w, "not a pending scheduled execution", http.StatusConflict)
+		return
+	}
+	writeJSON(w, map[string]any{"id": id, "status": orchestrator.StatusCancelled}, 200)
+}
@@ -0,0 +1,146 @@
+package adminapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"lamdis/pkg/connectors"
+	"lamdis/pkg/graphql"
+	"lamdis/pkg/upstream"
+	"lamdis/pkg/upstreamauth"
+)
+
+// GraphQLImportBody is the request of the GraphQL connector import endpoint.
+type GraphQLImportBody struct {
+	Display  string   `json:"display_name"`
+	Title    string   `json:"title"`
+	Summary  string   `json:"summary"`
+	Endpoint string   `json:"endpoint"` // stored as the connector's base_url
+	AuthRef  *string  `json:"auth_ref"`
+	Enabled  *bool    `json:"enabled"`
+	Scopes   []string `json:"scopes"` // applied to every imported operation
+	// Introspect queries the endpoint's schema to generate operations and type
+	// document variables. Default true.
+	Introspect *bool `json:"introspect"`
+	// Fields selects root fields to generate operations for ("user" or
+	// "Mutation.createUser"). Without fields or documents every root field is generated.
+	Fields []string `json:"fields"`
+	Depth  int      `json:"depth"` // nesting of generated selection sets, default 2
+	// Documents are hand-written named queries or mutations imported as they are.
+	Documents []struct {
+		Query   string `json:"query"`
+		Summary string `json:"summary"`
+	} `json:"documents"`
+	DryRun bool `json:"dry_run"`
+}
+
+// importGraphQLConnector creates a GraphQL custom connector. Operations are
+// generated from the introspected schema and/or taken from supplied documents;
+// with dry_run they are returned without being stored.
+func (a *App) importGraphQLConnector(w http.ResponseWriter, r *http.Request) {
+	tid := r.Context().Value("tid").(string)
+	var b GraphQLImportBody
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&b); err != nil {
+		http.Error(w, "bad json", 400)
+		return
+	}
+	display := strings.TrimSpace(b.Display)
+	if display == "" {
+		http.Error(w, "missing display_name", 400)
+		return
+	}
+	if u, err := url.Parse(b.Endpoint); err != nil || !u.IsAbs() {
+		http.Error(w, "endpoint must be an absolute url", 400)
+		return
+	}
+	if err := a.checkEgress(r.Context(), tid, b.Endpoint); err != nil {
+		http.Error(w, "invalid endpoint: "+err.Error(), 400)
+		return
+	}
+
+	var schema *graphql.Schema
+	warning := ""
+	if b.Introspect == nil || *b.Introspect {
+		auth := upstreamauth.None
+		if b.AuthRef != nil && *b.AuthRef != "" {
+			var err error
+			if auth, err = upstreamauth.Load(r.Context(), a.db, tid, *b.AuthRef); err != nil {
+				http.Error(w, "auth_ref could not be loaded: "+err.Error(), 400)
+				return
+			}
+		}
+		ctx := upstream.WithTenant(upstream.WithEgress(r.Context(), connectors.LoadEgressPolicy(r.Context(), a.db, tid)), tid)
+		s, err := graphql.Introspect(ctx, upstream.Default, auth, b.Endpoint)
+		if err != nil && len(b.Documents) == 0 {
+			http.Error(w, "introspection failed: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		if err != nil {
+			warning = "introspection failed, document variables are untyped: " + err.Error()
+		}
+		schema = s
+	}
+
+	var ops []graphql.Operation
+	for i, d := range b.Documents {
+		op, err := schema.FromDocument(d.Query, d.Summary)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("documents[%d]: %v", i, err), 400)
+			return
+		}
+		ops = append(ops, op)
+	}
+	if schema != nil && (len(b.Fields) > 0 || len(b.Documents) == 0) {
+		ops = append(ops, schema.Generate(graphql.GenerateOptions{Fields: b.Fields, Depth: b.Depth})...)
+	}
+	if len(ops) == 0 {
+		http.Error(w, "no operations selected", 400)
+		return
+	}
+	seen := map[string]bool{}
+	for _, op := range ops {
+		if seen[op.Name] {
+			http.Error(w, "duplicate operation name "+op.Name, 400)
+			return
+		}
+		seen[op.Name] = true
+	}
+	if b.DryRun {
+		writeJSON(w, map[string]any{"dry_run": true, "introspected": schema != nil, "warning": nullIfEmpty(warning), "operations": ops}, 200)
+		return
+	}
+
+	cfg := map[string]any{"protocol": graphql.Protocol, "graphql": map[string]any{"introspected": schema != nil}}
+	tx, err := a.db.Begin(r.Context())
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	defer tx.Rollback(r.Context())
+	defID := uuidNew()
+	if _, err := tx.Exec(r.Context(), `INSERT INTO connector_definitions(id,tenant_id,kind,builtin_kind,auth,config,secret,base_url,auth_ref,title,summary) VALUES ($1,$2,$3,'', '{}'::jsonb, $4, '{}'::jsonb, $5, $6, $7, $8)`,
+		defID, tid, display, cfg, b.Endpoint, b.AuthRef, nullIfEmpty(b.Title), nullIfEmpty(b.Summary)); err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	names := make([]string, 0, len(ops))
+	for _, op := range ops {
+		if _, err := tx.Exec(r.Context(), `INSERT INTO connector_operations(id,connector_id,method,path,summary,scopes,request_tmpl,params,enabled) VALUES ($1,$2,'POST',$3,$4,$5,$6,$7,true)`,
+			uuidNew(), defID, op.Path(), op.Summary, b.Scopes, op.RequestTmpl(), op.Params); err != nil {
+			http.Error(w, "db error", 500)
+			return
+		}
+		names = append(names, op.Name)
+	}
+	if err := tx.Commit(r.Context()); err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if b.Enabled != nil && *b.Enabled {
+		a.enableCustomConnector(r.Context(), tid, defID, display)
+	}
+	writeJSON(w, map[string]any{"ok": true, "id": defID, "operations": names, "introspected": schema != nil, "warning": nullIfEmpty(warning)}, 201)
+}
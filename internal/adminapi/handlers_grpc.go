@@ -0,0 +1,135 @@
+package adminapi
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"lamdis/pkg/connectors"
+	"lamdis/pkg/grpcconn"
+	"lamdis/pkg/upstream"
+	"lamdis/pkg/upstreamauth"
+)
+
+// GRPCImportBody is the request of the gRPC connector import endpoint.
+type GRPCImportBody struct {
+	Display string   `json:"display_name"`
+	Title   string   `json:"title"`
+	Summary string   `json:"summary"`
+	Target  string   `json:"target"` // grpcs://host:port or grpc://host:port, stored as base_url
+	AuthRef *string  `json:"auth_ref"`
+	Enabled *bool    `json:"enabled"`
+	Scopes  []string `json:"scopes"` // applied to every imported operation
+	// DescriptorSet is a base64 binary FileDescriptorSet built with
+	// protoc --include_imports. Without it the target's server reflection is used.
+	DescriptorSet string `json:"descriptor_set"`
+	// Services ("orders.v1.Orders") and Methods ("GetOrder" or
+	// "orders.v1.Orders/GetOrder") select what is imported; empty means all
+	// unary methods.
+	Services []string `json:"services"`
+	Methods  []string `json:"methods"`
+	DryRun   bool     `json:"dry_run"`
+}
+
+// importGRPCConnector creates a gRPC custom connector with one operation per
+// unary method. The descriptors are stored on the connector so requests can be
+// encoded without reaching the server's reflection service at execution time.
+func (a *App) importGRPCConnector(w http.ResponseWriter, r *http.Request) {
+	tid := r.Context().Value("tid").(string)
+	var b GRPCImportBody
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 8<<20)).Decode(&b); err != nil {
+		http.Error(w, "bad json", 400)
+		return
+	}
+	display := strings.TrimSpace(b.Display)
+	if display == "" {
+		http.Error(w, "missing display_name", 400)
+		return
+	}
+	if u, err := url.Parse(b.Target); err != nil || (u.Scheme != "grpc" && u.Scheme != "grpcs") || u.Host == "" {
+		http.Error(w, "target must be grpcs://host:port or grpc://host:port", 400)
+		return
+	}
+	if err := a.checkEgress(r.Context(), tid, b.Target); err != nil {
+		http.Error(w, "invalid target: "+err.Error(), 400)
+		return
+	}
+
+	auth := upstreamauth.None
+	if b.AuthRef != nil && *b.AuthRef != "" {
+		var err error
+		if auth, err = upstreamauth.Load(r.Context(), a.db, tid, *b.AuthRef); err != nil {
+			http.Error(w, "auth_ref could not be loaded: "+err.Error(), 400)
+			return
+		}
+	}
+	if err := grpcconn.CheckAuth(auth); err != nil {
+		http.Error(w, "invalid auth_ref: "+err.Error(), 400)
+		return
+	}
+
+	var raw []byte
+	source := "upload"
+	if strings.TrimSpace(b.DescriptorSet) != "" {
+		var err error
+		if raw, err = base64.StdEncoding.DecodeString(strings.TrimSpace(b.DescriptorSet)); err != nil {
+			http.Error(w, "descriptor_set must be base64", 400)
+			return
+		}
+	} else {
+		source = "reflection"
+		ctx := upstream.WithTenant(upstream.WithEgress(r.Context(), connectors.LoadEgressPolicy(r.Context(), a.db, tid)), tid)
+		var err error
+		if raw, err = grpcconn.Reflect(ctx, upstream.Default, auth, b.Target); err != nil {
+			http.Error(w, "reflection failed: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+	desc, err := grpcconn.ParseDescriptors(raw)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	ops := desc.Operations(b.Services, b.Methods)
+	if len(ops) == 0 {
+		http.Error(w, "no unary methods selected", 400)
+		return
+	}
+	if b.DryRun {
+		writeJSON(w, map[string]any{"dry_run": true, "source": source, "operations": ops}, 200)
+		return
+	}
+
+	cfg := map[string]any{"protocol": grpcconn.Protocol, "grpc": map[string]any{"descriptor_set": grpcconn.Encode(raw), "source": source}}
+	tx, err := a.db.Begin(r.Context())
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	defer tx.Rollback(r.Context())
+	defID := uuidNew()
+	if _, err := tx.Exec(r.Context(), `INSERT INTO connector_definitions(id,tenant_id,kind,builtin_kind,auth,config,secret,base_url,auth_ref,title,summary) VALUES ($1,$2,$3,'', '{}'::jsonb, $4, '{}'::jsonb, $5, $6, $7, $8)`,
+		defID, tid, display, cfg, b.Target, b.AuthRef, nullIfEmpty(b.Title), nullIfEmpty(b.Summary)); err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	methods := make([]string, 0, len(ops))
+	for _, op := range ops {
+		if _, err := tx.Exec(r.Context(), `INSERT INTO connector_operations(id,connector_id,method,path,summary,scopes,request_tmpl,params,enabled) VALUES ($1,$2,'POST',$3,$4,$5,$6,$7,true)`,
+			uuidNew(), defID, op.Path(), op.Summary, b.Scopes, op.RequestTmpl(), op.Params); err != nil {
+			http.Error(w, "db error", 500)
+			return
+		}
+		methods = append(methods, op.Method)
+	}
+	if err := tx.Commit(r.Context()); err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if b.Enabled != nil && *b.Enabled {
+		a.enableCustomConnector(r.Context(), tid, defID, display)
+	}
+	writeJSON(w, map[string]any{"ok": true, "id": defID, "source": source, "operations": methods}, 201)
+}
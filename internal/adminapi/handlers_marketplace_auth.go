@@ -6,6 +6,8 @@ import (
 	"time"
 
 	"github.com/go-chi/chi/v5"
+
+	"lamdis/pkg/upstreamauth"
 )
 
 type AuthBody struct {
@@ -15,6 +17,14 @@ type AuthBody struct {
 	Secrets map[string]string `json:"secrets"`
 }
 
+func (b AuthBody) secretMap() map[string]any {
+	m := make(map[string]any, len(b.Secrets))
+	for k, v := range b.Secrets {
+		m[k] = v
+	}
+	return m
+}
+
 func (a *App) listAuth(w http.ResponseWriter, r *http.Request) {
 	tid := r.Context().Value("tid").(string)
 	rows, err := a.db.Query(r.Context(), `SELECT id, name, type, config, updated_at FROM tenant_auth_configs WHERE tenant_id=$1 ORDER BY name`, tid)
@@ -55,6 +65,14 @@ func (a *App) createAuth(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "missing fields", 400)
 		return
 	}
+	if !upstreamauth.Supported(b.Type) {
+		http.Error(w, "unsupported auth type", 400)
+		return
+	}
+	if err := upstreamauth.Validate(b.Type, b.Config, b.secretMap()); err != nil {
+		http.Error(w, "invalid auth config: "+err.Error(), 400)
+		return
+	}
 	enc, err := a.encryptJSON(b.Secrets)
 	if err != nil {
 		http.Error(w, "encrypt", 500)
@@ -76,6 +94,17 @@ func (a *App) updateAuth(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "bad json", 400)
 		return
 	}
+	if b.Type != "" && !upstreamauth.Supported(b.Type) {
+		http.Error(w, "unsupported auth type", 400)
+		return
+	}
+	// Full validation needs type, config and secrets together; partial updates skip it.
+	if b.Type != "" && b.Config != nil && b.Secrets != nil {
+		if err := upstreamauth.Validate(b.Type, b.Config, b.secretMap()); err != nil {
+			http.Error(w, "invalid auth config: "+err.Error(), 400)
+			return
+		}
+	}
 	var enc []byte
 	var err error
 	if b.Secrets != nil {
@@ -101,5 +130,54 @@ func (a *App) deleteAuth(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "db error", 500)
 		return
 	}
+	// End-user tokens issued under the config go with it.
+	_, _ = a.db.Exec(r.Context(), `WITH s AS (SELECT set_config('app.tenant_id', $1, true))
+		DELETE FROM user_connections WHERE tenant_id=$1 AND auth_id=$2`, tid, id)
+	writeJSON(w, map[string]any{"ok": true}, 200)
+}
+
+// listAuthConnections lists the end users who linked an account under an
+// oauth2_user config. Tokens are never returned.
+func (a *App) listAuthConnections(w http.ResponseWriter, r *http.Request) {
+	tid := r.Context().Value("tid").(string)
+	rows, err := a.db.Query(r.Context(), `WITH s AS (SELECT set_config('app.tenant_id', $1, true))
+		SELECT actor_sub, scopes, expires_at, created_at, updated_at FROM user_connections
+		WHERE tenant_id=$1 AND auth_id=$2 ORDER BY updated_at DESC LIMIT 500`, tid, chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	defer rows.Close()
+	type Row struct {
+		ActorSub  string     `json:"actor_sub"`
+		Scopes    string     `json:"scopes"`
+		ExpiresAt *time.Time `json:"expires_at,omitempty"`
+		CreatedAt time.Time  `json:"created_at"`
+		UpdatedAt time.Time  `json:"updated_at"`
+	}
+	out := []Row{}
+	for rows.Next() {
+		var row Row
+		if err := rows.Scan(&row.ActorSub, &row.Scopes, &row.ExpiresAt, &row.CreatedAt, &row.UpdatedAt); err != nil {
+			http.Error(w, "db error", 500)
+			return
+		}
+		out = append(out, row)
+	}
+	writeJSON(w, map[string]any{"items": out}, 200)
+}
+
+// revokeAuthConnection removes one end user's link; they must authorize again.
+func (a *App) revokeAuthConnection(w http.ResponseWriter, r *http.Request) {
+	tid := r.Context().Value("tid").(string)
+	found, err := upstreamauth.Unlink(r.Context(), a.db, tid, chi.URLParam(r, "id"), chi.URLParam(r, "sub"))
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if !found {
+		http.Error(w, "not found", 404)
+		return
+	}
 	writeJSON(w, map[string]any{"ok": true}, 200)
 }
@@ -0,0 +1,329 @@
+package adminapi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+
+	"lamdis/pkg/openapi"
+)
+
+// maxOpenAPIDocument bounds uploaded OpenAPI documents.
+const maxOpenAPIDocument = 8 << 20
+
+// OpenAPIImportBody is the request of the OpenAPI import endpoints.
+type OpenAPIImportBody struct {
+	// Document is the OpenAPI 3.0/3.1 document as a JSON object, or its JSON or YAML text as a string.
+	Document    json.RawMessage `json:"document"`
+	Display     string          `json:"display_name"`
+	BaseURL     string          `json:"base_url"` // overrides the document's first server
+	AuthRef     *string         `json:"auth_ref"`
+	Enabled     *bool           `json:"enabled"`
+	Operations  []string        `json:"operations"` // operationIds or "METHOD /path"
+	Tags        []string        `json:"tags"`
+	DryRun      bool            `json:"dry_run"`
+	KeepRemoved bool            `json:"keep_removed"` // re-import: keep operations no longer in the document
+	// ReplaceTemplates regenerates request_tmpl of changed operations on re-import;
+	// by default templates edited since the last import are kept.
+	ReplaceTemplates bool `json:"replace_templates"`
+}
+
+// openAPISource is kept in connector_definitions.config.openapi so a re-import
+// without an explicit selection reuses the previous one.
+type openAPISource struct {
+	Title      string   `json:"title"`
+	Version    string   `json:"version,omitempty"`
+	Operations []string `json:"operations,omitempty"`
+	Tags       []string `json:"tags,omitempty"`
+}
+
+func (b OpenAPIImportBody) document() []byte {
+	var s string
+	if err := json.Unmarshal(b.Document, &s); err == nil {
+		return []byte(s)
+	}
+	return b.Document
+}
+
+func decodeOpenAPIBody(w http.ResponseWriter, r *http.Request) (OpenAPIImportBody, bool) {
+	var b OpenAPIImportBody
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxOpenAPIDocument)).Decode(&b); err != nil {
+		http.Error(w, "bad json", 400)
+		return b, false
+	}
+	if len(b.Document) == 0 {
+		http.Error(w, "missing document", 400)
+		return b, false
+	}
+	return b, true
+}
+
+// importOpenAPIConnector creates a custom connector from an OpenAPI document.
+// With dry_run the derived connector is returned without being stored.
+func (a *App) importOpenAPIConnector(w http.ResponseWriter, r *http.Request) {
+	tid := r.Context().Value("tid").(string)
+	b, ok := decodeOpenAPIBody(w, r)
+	if !ok {
+		return
+	}
+	imp, err := openapi.Import(b.document(), openapi.ImportOptions{Operations: b.Operations, Tags: b.Tags})
+	if err != nil {
+		http.Error(w, "invalid openapi document: "+err.Error(), 400)
+		return
+	}
+	if len(imp.Operations) == 0 {
+		http.Error(w, "no operations selected", 400)
+		return
+	}
+	if b.BaseURL != "" {
+		imp.BaseURL = strings.TrimRight(b.BaseURL, "/")
+	}
+	if u, err := url.Parse(imp.BaseURL); err != nil || !u.IsAbs() {
+		http.Error(w, "base_url required: the document has no absolute server url", 400)
+		return
+	}
+	if err := a.checkEgress(r.Context(), tid, imp.BaseURL); err != nil {
+		http.Error(w, "invalid base_url: "+err.Error(), 400)
+		return
+	}
+	display := strings.TrimSpace(b.Display)
+	if display == "" {
+		display = imp.Title
+	}
+	if display == "" {
+		http.Error(w, "missing display_name", 400)
+		return
+	}
+	if b.DryRun {
+		writeJSON(w, map[string]any{"dry_run": true, "display_name": display, "connector": imp}, 200)
+		return
+	}
+	src := openAPISource{Title: imp.Title, Version: imp.Version, Operations: b.Operations, Tags: b.Tags}
+	tx, err := a.db.Begin(r.Context())
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	defer tx.Rollback(r.Context())
+	defID := uuidNew()
+	if _, err := tx.Exec(r.Context(), `INSERT INTO connector_definitions(id,tenant_id,kind,builtin_kind,auth,config,secret,base_url,auth_ref,title,summary) VALUES ($1,$2,$3,'', '{}'::jsonb, $4, '{}'::jsonb, $5, $6, $7, $8)`,
+		defID, tid, display, map[string]any{"openapi": src}, imp.BaseURL, b.AuthRef, nullIfEmpty(imp.Title), nullIfEmpty(imp.Summary)); err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	for _, op := range imp.Operations {
+		if _, err := tx.Exec(r.Context(), `INSERT INTO connector_operations(id,connector_id,method,path,summary,scopes,request_tmpl,params,enabled) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,true)`,
+			uuidNew(), defID, op.Method, op.Path, op.Summary, op.Scopes, op.RequestTmpl, op.Params); err != nil {
+			http.Error(w, "db error", 500)
+			return
+		}
+	}
+	if err := tx.Commit(r.Context()); err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if b.Enabled != nil && *b.Enabled {
+		a.enableCustomConnector(r.Context(), tid, defID, display)
+	}
+	keys := make([]string, 0, len(imp.Operations))
+	for _, op := range imp.Operations {
+		keys = append(keys, op.Key())
+	}
+	writeJSON(w, map[string]any{"ok": true, "id": defID, "operations": keys}, 201)
+}
+
+// existingOperation is a stored operation compared against a re-import.
+type existingOperation struct {
+	ID      string
+	Summary string
+	Scopes  []string
+	Params  []map[string]any
+}
+
+// reimportOpenAPIConnector refreshes a custom connector's operations from a
+// new revision of its OpenAPI document and reports what was added, changed and
+// removed. Operations are matched by method and path. Changed operations get
+// the new summary, scopes and params; their request_tmpl, call options,
+// success criteria and enabled flag are kept unless replace_templates is set.
+func (a *App) reimportOpenAPIConnector(w http.ResponseWriter, r *http.Request) {
+	tid := r.Context().Value("tid").(string)
+	id := chi.URLParam(r, "id")
+	b, ok := decodeOpenAPIBody(w, r)
+	if !ok {
+		return
+	}
+	var builtin string
+	var cfgRaw []byte
+	if err := a.db.QueryRow(r.Context(), `SELECT COALESCE(builtin_kind,''), COALESCE(config,'{}'::jsonb) FROM connector_definitions WHERE id::text=$1 AND tenant_id=$2`, id, tid).Scan(&builtin, &cfgRaw); err != nil {
+		http.Error(w, "custom connector not found for tenant", 404)
+		return
+	}
+	if strings.TrimSpace(builtin) != "" {
+		http.Error(w, "builtin_connectors_are_readonly", http.StatusForbidden)
+		return
+	}
+	var cfg struct {
+		OpenAPI openAPISource `json:"openapi"`
+	}
+	_ = json.Unmarshal(cfgRaw, &cfg)
+	opts := openapi.ImportOptions{Operations: b.Operations, Tags: b.Tags}
+	if len(opts.Operations) == 0 && len(opts.Tags) == 0 {
+		opts.Operations, opts.Tags = cfg.OpenAPI.Operations, cfg.OpenAPI.Tags
+	}
+	imp, err := openapi.Import(b.document(), opts)
+	if err != nil {
+		http.Error(w, "invalid openapi document: "+err.Error(), 400)
+		return
+	}
+	if b.BaseURL != "" {
+		if err := a.checkEgress(r.Context(), tid, b.BaseURL); err != nil {
+			http.Error(w, "invalid base_url: "+err.Error(), 400)
+			return
+		}
+	}
+
+	rows, err := a.db.Query(r.Context(), `SELECT id::text, method, path, COALESCE(summary,''), COALESCE(scopes, ARRAY[]::text[]), COALESCE(params,'[]'::jsonb)
+		FROM connector_operations WHERE connector_id::text=$1`, id)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	existing := map[string]existingOperation{}
+	for rows.Next() {
+		var eo existingOperation
+		var method, path string
+		var paramsRaw []byte
+		if err := rows.Scan(&eo.ID, &method, &path, &eo.Summary, &eo.Scopes, &paramsRaw); err != nil {
+			rows.Close()
+			http.Error(w, "db error", 500)
+			return
+		}
+		_ = json.Unmarshal(paramsRaw, &eo.Params)
+		existing[openapi.OperationKey(method, path)] = eo
+	}
+	rows.Close()
+
+	type change struct {
+		Key    string   `json:"key"`
+		Fields []string `json:"fields"`
+	}
+	added, removed := []string{}, []string{}
+	changed := []change{}
+	unchanged := 0
+	seen := map[string]bool{}
+	var toAdd, toUpdate []openapi.ImportedOperation
+	for _, op := range imp.Operations {
+		key := op.Key()
+		seen[key] = true
+		eo, ok := existing[key]
+		if !ok {
+			added = append(added, key)
+			toAdd = append(toAdd, op)
+			continue
+		}
+		if fields := operationDiff(eo, op); len(fields) > 0 {
+			changed = append(changed, change{Key: key, Fields: fields})
+			toUpdate = append(toUpdate, op)
+		} else {
+			unchanged++
+		}
+	}
+	for key := range existing {
+		if !seen[key] {
+			removed = append(removed, key)
+		}
+	}
+	sort.Strings(removed)
+	result := map[string]any{"added": added, "changed": changed, "removed": removed, "unchanged": unchanged, "dry_run": b.DryRun, "kept_removed": b.KeepRemoved}
+	if b.DryRun {
+		writeJSON(w, result, 200)
+		return
+	}
+
+	tx, err := a.db.Begin(r.Context())
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	defer tx.Rollback(r.Context())
+	for _, op := range toAdd {
+		if _, err := tx.Exec(r.Context(), `INSERT INTO connector_operations(id,connector_id,method,path,summary,scopes,request_tmpl,params,enabled) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,true)`,
+			uuidNew(), id, op.Method, op.Path, op.Summary, op.Scopes, op.RequestTmpl, op.Params); err != nil {
+			http.Error(w, "db error", 500)
+			return
+		}
+	}
+	for _, op := range toUpdate {
+		var tmpl any
+		if b.ReplaceTemplates {
+			tmpl = op.RequestTmpl
+		}
+		if _, err := tx.Exec(r.Context(), `UPDATE connector_operations SET summary=$2, scopes=$3, params=$4, request_tmpl=COALESCE($5,request_tmpl) WHERE id::text=$1`,
+			existing[op.Key()].ID, op.Summary, op.Scopes, op.Params, tmpl); err != nil {
+			http.Error(w, "db error", 500)
+			return
+		}
+	}
+	if !b.KeepRemoved {
+		for _, key := range removed {
+			if _, err := tx.Exec(r.Context(), `DELETE FROM connector_operations WHERE id::text=$1`, existing[key].ID); err != nil {
+				http.Error(w, "db error", 500)
+				return
+			}
+		}
+	}
+	src := openAPISource{Title: imp.Title, Version: imp.Version, Operations: opts.Operations, Tags: opts.Tags}
+	if _, err := tx.Exec(r.Context(), `UPDATE connector_definitions SET config=COALESCE(config,'{}'::jsonb) || $3::jsonb, base_url=COALESCE($4,base_url), auth_ref=COALESCE($5,auth_ref) WHERE id::text=$1 AND tenant_id=$2`,
+		id, tid, map[string]any{"openapi": src}, nullIfEmpty(strings.TrimRight(b.BaseURL, "/")), b.AuthRef); err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if err := tx.Commit(r.Context()); err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	writeJSON(w, result, 200)
+}
+
+// operationDiff names the imported fields that differ from the stored operation.
+func operationDiff(eo existingOperation, op openapi.ImportedOperation) []string {
+	var fields []string
+	if eo.Summary != op.Summary {
+		fields = append(fields, "summary")
+	}
+	a, b := append([]string{}, eo.Scopes...), append([]string{}, op.Scopes...)
+	sort.Strings(a)
+	sort.Strings(b)
+	if !reflect.DeepEqual(a, b) && (len(a) > 0 || len(b) > 0) {
+		fields = append(fields, "scopes")
+	}
+	// Compare params through JSON so stored and freshly derived values share types.
+	var want []map[string]any
+	raw, _ := json.Marshal(op.Params)
+	_ = json.Unmarshal(raw, &want)
+	if !reflect.DeepEqual(eo.Params, want) && (len(eo.Params) > 0 || len(want) > 0) {
+		fields = append(fields, "params")
+	}
+	return fields
+}
+
+// enableCustomConnector enables a custom connector for the tenant and seeds an
+// action keyed from its display name, as createCustomConnector does.
+func (a *App) enableCustomConnector(ctx context.Context, tid, defID, display string) {
+	var hasKind bool
+	_ = a.db.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name='tenant_connectors' AND column_name='kind')`).Scan(&hasKind)
+	if hasKind {
+		_, _ = a.db.Exec(ctx, `INSERT INTO tenant_connectors(tenant_id,connector_id,kind,enabled) VALUES ($1::uuid,$2,$3,true) ON CONFLICT (tenant_id,connector_id) DO UPDATE SET enabled=true, updated_at=NOW()`, tid, defID, display)
+	} else {
+		_, _ = a.db.Exec(ctx, `INSERT INTO tenant_connectors(tenant_id,connector_id,enabled) VALUES ($1::uuid,$2,true) ON CONFLICT (tenant_id,connector_id) DO UPDATE SET enabled=true, updated_at=NOW()`, tid, defID)
+	}
+	if disp := strings.TrimSpace(display); disp != "" {
+		_, _ = a.db.Exec(ctx, `INSERT INTO actions(tenant_id, key, display_name) VALUES ($1::uuid,$2,$3) ON CONFLICT (tenant_id, key) DO NOTHING`, tid, slugify(disp), disp)
+	}
+}
@@ -4,8 +4,13 @@ import (
 	"database/sql"
 	"encoding/json"
 	"net/http"
+	"time"
 
 	"github.com/jackc/pgx/v5"
+
+	"lamdis/pkg/connectors"
+	"lamdis/pkg/ratelimit"
+	"lamdis/pkg/upstream"
 )
 
 type OIDCBody struct {
@@ -76,3 +81,133 @@ func (a *App) putTenantOIDC(w http.ResponseWriter, r *http.Request) {
 	}
 	writeJSON(w, map[string]any{"ok": true}, 200)
 }
+
+// getTenantEgress returns the tenant's egress policy for connector upstreams.
+func (a *App) getTenantEgress(w http.ResponseWriter, r *http.Request) {
+	tid := r.Context().Value("tid").(string)
+	writeJSON(w, connectors.LoadEgressPolicy(r.Context(), a.db, tid), 200)
+}
+
+// putTenantEgress replaces the tenant's egress policy. Existing connectors whose
+// base_url the new policy blocks are listed so they can be fixed; their calls
+// are refused from now on.
+func (a *App) putTenantEgress(w http.ResponseWriter, r *http.Request) {
+	tid := r.Context().Value("tid").(string)
+	var b upstream.EgressPolicy
+	if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+		http.Error(w, "bad json", 400)
+		return
+	}
+	if err := b.Validate(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if _, err := a.db.Exec(r.Context(), `UPDATE tenants SET egress_policy=$1 WHERE id=$2`, b, tid); err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	violations := []map[string]any{}
+	pol := upstream.Default.EgressPolicy(b)
+	rows, err := a.db.Query(r.Context(), `SELECT id::text, kind, base_url FROM connector_definitions WHERE tenant_id=$1 AND COALESCE(base_url,'')<>''`, tid)
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			var id, kind, baseURL string
+			if rows.Scan(&id, &kind, &baseURL) != nil {
+				continue
+			}
+			if err := pol.CheckURL(baseURL); err != nil {
+				violations = append(violations, map[string]any{"connector_id": id, "kind": kind, "base_url": baseURL, "error": err.Error()})
+			}
+		}
+	}
+	writeJSON(w, map[string]any{"ok": true, "violations": violations}, 200)
+}
+
+// RateLimitsBody sets the tenant's plan and its overrides of the plan's limits.
+// Plan is left unchanged when omitted and cleared when empty.
+type RateLimitsBody struct {
+	Plan       *string          `json:"plan"`
+	RateLimits ratelimit.Policy `json:"rate_limits"`
+}
+
+// getTenantRateLimits returns the tenant's plan, its own limits and the limits
+// in effect (the tenant's over the plan's).
+func (a *App) getTenantRateLimits(w http.ResponseWriter, r *http.Request) {
+	tid := r.Context().Value("tid").(string)
+	var plan string
+	var tenantRaw, planRaw []byte
+	err := a.db.QueryRow(r.Context(), `
+		SELECT COALESCE(t.plan,''), COALESCE(t.rate_limits,'{}'::jsonb), COALESCE(p.rate_limits,'{}'::jsonb)
+		FROM tenants t LEFT JOIN plans p ON p.name=t.plan
+		WHERE t.id=$1`, tid).Scan(&plan, &tenantRaw, &planRaw)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	var own, base ratelimit.Policy
+	_ = json.Unmarshal(tenantRaw, &own)
+	_ = json.Unmarshal(planRaw, &base)
+	writeJSON(w, map[string]any{"plan": plan, "rate_limits": own, "plan_rate_limits": base, "effective": own.Over(base)}, 200)
+}
+
+// putTenantRateLimits replaces the tenant's limits and optionally its plan.
+// Services pick the change up within half a minute.
+func (a *App) putTenantRateLimits(w http.ResponseWriter, r *http.Request) {
+	tid := r.Context().Value("tid").(string)
+	var b RateLimitsBody
+	if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+		http.Error(w, "bad json", 400)
+		return
+	}
+	if err := b.RateLimits.Validate(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	setPlan, plan := b.Plan != nil, ""
+	if setPlan {
+		plan = *b.Plan
+	}
+	if plan != "" {
+		var exists bool
+		if err := a.db.QueryRow(r.Context(), `SELECT EXISTS(SELECT 1 FROM plans WHERE name=$1)`, plan).Scan(&exists); err != nil {
+			http.Error(w, "db error", 500)
+			return
+		}
+		if !exists {
+			http.Error(w, "unknown plan", 400)
+			return
+		}
+	}
+	_, err := a.db.Exec(r.Context(), `
+		UPDATE tenants SET rate_limits=$1, plan=CASE WHEN $2 THEN NULLIF($3,'') ELSE plan END
+		WHERE id=$4`, b.RateLimits, setPlan, plan, tid)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	writeJSON(w, map[string]any{"ok": true}, 200)
+}
+
+// getTenantQuota returns the tenant's usage this month against its plan's
+// monthly quota; limit is null when the plan is unlimited or none is set.
+func (a *App) getTenantQuota(w http.ResponseWriter, r *http.Request) {
+	tid := r.Context().Value("tid").(string)
+	var plan string
+	var limit *int64
+	err := a.db.QueryRow(r.Context(), `
+		SELECT COALESCE(t.plan,''), p.monthly_quota
+		FROM tenants t LEFT JOIN plans p ON p.name=t.plan
+		WHERE t.id=$1`, tid).Scan(&plan, &limit)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	month := ratelimit.MonthStart(time.Now())
+	used, err := ratelimit.CountUsage(r.Context(), a.db, tid, month)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	writeJSON(w, map[string]any{"plan": plan, "limit": limit, "used": used, "period_start": month, "resets_at": month.AddDate(0, 1, 0)}, 200)
+}
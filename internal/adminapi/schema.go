@@ -16,7 +16,7 @@ CREATE TABLE IF NOT EXISTS tenant_auth_configs (
 	id UUID PRIMARY KEY,
 	tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
 	name TEXT NOT NULL,
-	type TEXT NOT NULL, -- api_key | bearer | oauth2_client
+	type TEXT NOT NULL, -- api_key | bearer | basic | oauth2_client | oauth2_user | token_exchange | hmac | aws_sigv4 | mtls
 	config JSONB NOT NULL DEFAULT '{}'::JSONB,
 	secrets_encrypted BYTEA,
 	updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
@@ -29,14 +29,34 @@ ALTER TABLE connector_definitions ADD COLUMN IF NOT EXISTS summary TEXT;
 ALTER TABLE connector_operations ADD COLUMN IF NOT EXISTS request_tmpl JSONB;
 ALTER TABLE connector_operations ADD COLUMN IF NOT EXISTS params JSONB;
 ALTER TABLE connector_operations ADD COLUMN IF NOT EXISTS enabled BOOLEAN NOT NULL DEFAULT true;
+-- Per-operation upstream call settings: timeout, retries/backoff, idempotency header, circuit breaker
+ALTER TABLE connector_operations ADD COLUMN IF NOT EXISTS call_options JSONB;
+-- Per-operation success criteria: accepted status ranges and optional JMESPath assertion
+ALTER TABLE connector_operations ADD COLUMN IF NOT EXISTS success_criteria JSONB;
+-- Per-operation passthrough settings: header rules and streaming (see db/migrations/0017_operation_passthrough.sql)
+ALTER TABLE connector_operations ADD COLUMN IF NOT EXISTS passthrough JSONB;
 -- Align tenant_connectors for marketplace usage
 ALTER TABLE tenant_connectors ADD COLUMN IF NOT EXISTS connector_id TEXT;
 ALTER TABLE tenant_connectors ADD COLUMN IF NOT EXISTS enabled BOOLEAN DEFAULT false;
 ALTER TABLE tenant_connectors ADD COLUMN IF NOT EXISTS secrets_encrypted BYTEA;
 ALTER TABLE tenant_connectors ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ DEFAULT NOW();
+-- Non-secret config of builtin connectors (see db/migrations/0015_tenant_connector_config.sql)
+ALTER TABLE tenant_connectors ADD COLUMN IF NOT EXISTS config JSONB NOT NULL DEFAULT '{}'::jsonb;
 -- Ensure tenants timestamp columns exist for triggers defined in base migrations
 ALTER TABLE tenants ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT NOW();
 ALTER TABLE tenants ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW();
+-- Per-tenant egress policy for connector upstreams (see db/migrations/0012_tenant_egress.sql)
+ALTER TABLE tenants ADD COLUMN IF NOT EXISTS egress_policy JSONB NOT NULL DEFAULT '{}'::jsonb;
+-- Plans, tenant plan and rate limit overrides (see db/migrations/0016_rate_limits.sql)
+CREATE TABLE IF NOT EXISTS plans (
+	name TEXT PRIMARY KEY,
+	monthly_quota BIGINT,
+	rate_limits JSONB NOT NULL DEFAULT '{}'::jsonb,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+ALTER TABLE tenants ADD COLUMN IF NOT EXISTS plan TEXT;
+ALTER TABLE tenants ADD COLUMN IF NOT EXISTS rate_limits JSONB NOT NULL DEFAULT '{}'::jsonb;
 -- Backfill connector_id from legacy 'kind' where needed
 DO $$
 DECLARE in_pk BOOLEAN;
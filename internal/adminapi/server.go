@@ -7,6 +7,8 @@ import (
 
 	"github.com/go-chi/chi/v5"
 	chimw "github.com/go-chi/chi/v5/middleware"
+
+	"lamdis/pkg/changes"
 )
 
 // Handler builds the HTTP handler with routes and middleware.
@@ -38,26 +40,45 @@ func (a *App) Handler() http.Handler {
 		ar.Use(a.adminAuth)
 		ar.Get("/tenant/self", a.getTenantSelf)
 		ar.Put("/tenant/oidc", a.putTenantOIDC)
+		ar.Get("/tenant/egress", a.getTenantEgress)
+		ar.Put("/tenant/egress", a.putTenantEgress)
+		ar.Get("/tenant/rate-limits", a.getTenantRateLimits)
+		ar.With(a.publishes(changes.RateLimits)).Put("/tenant/rate-limits", a.putTenantRateLimits)
+		ar.Get("/tenant/quota", a.getTenantQuota)
 		ar.Get("/registry/connectors", a.getRegistry)
-		ar.Put("/registry/connectors/{id}", a.upsertConnector)
-		ar.Put("/tenant/connectors/{connectorId}", a.putTenantConnector)
+		ar.With(a.publishesAll(changes.Connectors)).Put("/registry/connectors/{id}", a.upsertConnector)
+		ar.With(a.publishes(changes.Connectors)).Put("/tenant/connectors/{connectorId}", a.putTenantConnector)
 		ar.Put("/tenant/policies", a.putPolicies)
 		ar.Get("/audit", a.getAudit)
 		ar.Get("/decisions", a.listDecisions)
+		// Scheduled executions
+		ar.Get("/executions/scheduled", a.listScheduledExecutions)
+		ar.Delete("/executions/scheduled/{id}", a.cancelScheduledExecution)
 		// Marketplace endpoints
 		ar.Get("/auth", a.listAuth)
 		ar.Post("/auth", a.createAuth)
 		ar.Put("/auth/{id}", a.updateAuth)
 		ar.Delete("/auth/{id}", a.deleteAuth)
+		ar.Get("/auth/{id}/connections", a.listAuthConnections)
+		ar.Delete("/auth/{id}/connections/{sub}", a.revokeAuthConnection)
 		ar.Get("/tenant/connectors", a.listTenantConnectors)
 		ar.Get("/tenant/configured-connectors", a.listConfiguredConnectors)
-		ar.Post("/tenant/connectors", a.createCustomConnector)
+		// Connector writes invalidate cached operations in the services
+		cw := ar.With(a.publishes(changes.Connectors))
+		cw.Post("/tenant/connectors", a.createCustomConnector)
 		ar.Get("/tenant/custom-connectors/{id}", a.getCustomConnector)
-		ar.Put("/tenant/custom-connectors/{id}", a.updateCustomConnector)
+		cw.Put("/tenant/custom-connectors/{id}", a.updateCustomConnector)
+		// Create from an OpenAPI 3 document or GraphQL endpoint; refresh from OpenAPI
+		cw.Post("/tenant/connectors/openapi", a.importOpenAPIConnector)
+		cw.Post("/tenant/connectors/graphql", a.importGraphQLConnector)
+		cw.Post("/tenant/connectors/grpc", a.importGRPCConnector)
+		cw.Post("/tenant/custom-connectors/{id}/openapi", a.reimportOpenAPIConnector)
 		// Enable/disable a specific operation (action) on a custom connector
-		ar.Put("/tenant/custom-connectors/{id}/actions/{opId}", a.putConnectorAction)
+		cw.Put("/tenant/custom-connectors/{id}/actions/{opId}", a.putConnectorAction)
 		// List enabled actions for a connector (optimized UI)
 		ar.Get("/tenant/custom-connectors/{id}/actions", a.listConnectorActions)
+		// Operations shadowed by an earlier route with the same method and path
+		ar.Get("/tenant/operations/conflicts", a.listOperationConflicts)
 		ar.Get("/usage/summary", a.getUsageSummary)
 		// Policies admin
 		ar.Get("/policies/versions", a.listPolicyVersions)
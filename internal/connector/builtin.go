@@ -0,0 +1,81 @@
+package connector
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"lamdis/pkg/connectors"
+	"lamdis/pkg/upstream"
+)
+
+// canonicalInputs merges the inputs of a canonical call: query parameters,
+// then the JSON body's fields, then the {rail} and {id} path params.
+func canonicalInputs(r *http.Request, body any) map[string]any {
+	in := map[string]any{}
+	for k, vs := range r.URL.Query() {
+		if len(vs) > 0 {
+			in[k] = vs[0]
+		}
+	}
+	if m, ok := body.(map[string]any); ok {
+		for k, v := range m {
+			in[k] = v
+		}
+	}
+	for _, k := range []string{"rail", "id"} {
+		if v := chi.URLParam(r, k); v != "" {
+			in[k] = v
+		}
+	}
+	return in
+}
+
+// resolveRail instantiates the tenant's builtin connector for rail. On failure
+// it returns the status code and error document to answer with.
+func resolveRail(ctx context.Context, reg *connectors.Registry, tenantID, rail string) (connectors.Builtin, connectors.ConnectorRecord, int, map[string]any) {
+	b, rec, err := reg.TenantBuiltin(ctx, tenantID, rail)
+	if errors.Is(err, connectors.ErrRailNotEnabled) {
+		return nil, rec, http.StatusNotFound, map[string]any{"error": "rail_not_enabled", "rail": rail}
+	}
+	if err != nil {
+		return nil, rec, http.StatusBadGateway, map[string]any{"error": "rail_unavailable", "rail": rail, "detail": err.Error()}
+	}
+	return b, rec, http.StatusOK, nil
+}
+
+// executeRail runs a canonical operation on a rail's builtin connector. It
+// returns the status code and either the result or an error document.
+func executeRail(ctx context.Context, b connectors.Builtin, pool *pgxpool.Pool, tenantID, rail, op string, inputs map[string]any) (int, map[string]any, map[string]any) {
+	ctx = upstream.WithTenant(upstream.WithEgress(ctx, connectors.LoadEgressPolicy(ctx, pool, tenantID)), tenantID)
+	res, err := b.Execute(ctx, op, inputs)
+	if err != nil {
+		status, code := railError(err)
+		doc := map[string]any{"error": code, "rail": rail}
+		if status == http.StatusBadRequest || status == http.StatusForbidden || status == http.StatusBadGateway {
+			doc["detail"] = err.Error()
+		}
+		return status, nil, doc
+	}
+	return http.StatusOK, res, nil
+}
+
+// railError maps an Execute error onto a response status and error code.
+func railError(err error) (int, string) {
+	switch {
+	case errors.Is(err, connectors.ErrUnsupported):
+		return http.StatusNotImplemented, "operation_not_supported"
+	case errors.Is(err, connectors.ErrNotFound):
+		return http.StatusNotFound, "order_not_found"
+	case errors.Is(err, connectors.ErrInvalidInput):
+		return http.StatusBadRequest, "invalid_input"
+	case errors.Is(err, upstream.ErrEgressDenied):
+		return http.StatusForbidden, "egress_denied"
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, "rail_timeout"
+	}
+	return http.StatusBadGateway, "rail_error"
+}
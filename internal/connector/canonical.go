@@ -0,0 +1,102 @@
+package connector
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"lamdis/internal/facts"
+	"lamdis/internal/policy"
+	"lamdis/pkg/connectors"
+)
+
+// canonicalOutcome is the result of a canonical call, before it is written.
+type canonicalOutcome struct {
+	status    int
+	mode      string
+	result    map[string]any
+	failure   map[string]any // error document; result is unused when set
+	decision  policy.Decision
+	usageRail string
+}
+
+// runCanonical evaluates the tenant policy for the canonical id, selects the
+// mode and, unless the call is referred, executes it on the named rail (or
+// fans orders.locate out when no rail is named).
+func runCanonical(ctx context.Context, co CanonicalOperation, reg *connectors.Registry, pool *pgxpool.Pool, tenantID string, inputs map[string]any) canonicalOutcome {
+	rail, _ := inputs["rail"].(string)
+	out := canonicalOutcome{status: http.StatusOK, mode: co.Mode, usageRail: rail}
+	if rail == "" && co.ID != connectors.OpOrdersLocate {
+		out.status, out.failure = http.StatusBadRequest, map[string]any{"error": "rail_required"}
+		return out
+	}
+	var b connectors.Builtin
+	var rec connectors.ConnectorRecord
+	if rail != "" {
+		if b, rec, out.status, out.failure = resolveRail(ctx, reg, tenantID, rail); out.failure != nil {
+			return out
+		}
+	}
+
+	fa, _ := facts.ResolveFacts(ctx, pool, tenantID, co.ID, inputs)
+	dec, _ := policy.Evaluate(ctx, pool, tenantID, co.ID, inputs, fa)
+	if dec.Status == policy.NeedsInput {
+		needs, _ := facts.ResolverNeeds(ctx, pool, tenantID, co.ID)
+		out.status, out.failure = http.StatusUnprocessableEntity, map[string]any{"error": "needs_input", "status": string(dec.Status), "needs": needs}
+		return out
+	}
+	dec.ID, _ = policy.PersistDecision(ctx, pool, tenantID, dec)
+	out.decision = dec
+	out.mode = selectMode(co, rail, rec, dec.Status)
+
+	params := make(map[string]any, len(inputs)+1)
+	for k, v := range inputs {
+		params[k] = v
+	}
+	params["mode"] = out.mode
+	switch {
+	case out.mode == connectors.ModeRefer:
+		out.result = map[string]any{"reasons": dec.Reasons, "alternatives": dec.Alternatives}
+	case rail != "":
+		out.status, out.result, out.failure = executeRail(ctx, b, pool, tenantID, rail, co.ID, params)
+		if out.failure == nil && co.ID == connectors.OpOrdersLocate {
+			matches := normalizeMatches(rail, out.result)
+			if matches == nil {
+				matches = []connectors.Order{}
+			}
+			out.result = map[string]any{"matches": matches, "rails": []string{rail}, "failed_rails": []railFailure{}}
+		}
+	default:
+		// Fan out to every rail declaring the capability; usage records the rails that matched.
+		var matched []string
+		out.status, out.result, out.failure, matched = locateOrders(ctx, reg, pool, tenantID, params)
+		out.usageRail = strings.Join(matched, ",")
+	}
+	return out
+}
+
+// selectMode starts from the operation's default mode and weakens it by the
+// rail's declared capability (undeclared capabilities are referred) and the
+// decision: blocked calls are referred, conditional ones only requested.
+func selectMode(co CanonicalOperation, rail string, rec connectors.ConnectorRecord, status policy.DecisionStatus) string {
+	mode := co.Mode
+	if rail != "" {
+		declared := false
+		for _, c := range rec.Capabilities {
+			declared = declared || c == co.ID
+		}
+		if !declared {
+			return connectors.ModeRefer
+		}
+		mode = connectors.WeakerMode(mode, rec.Modes[co.ID])
+	}
+	switch status {
+	case policy.Allow:
+		return mode
+	case policy.AllowWithConditions:
+		return connectors.WeakerMode(mode, connectors.ModeRequest)
+	}
+	return connectors.ModeRefer
+}
@@ -0,0 +1,65 @@
+package connector
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"lamdis/pkg/connectors"
+	"lamdis/pkg/grpcconn"
+	"lamdis/pkg/upstream"
+	"lamdis/pkg/upstreamauth"
+)
+
+// serveGRPC performs the unary call of a gRPC operation with the request body
+// as its message and writes the passthrough response. It returns the status
+// code recorded for usage.
+func serveGRPC(ctx context.Context, w http.ResponseWriter, rpc *connectors.GRPCOperation, target string, auth upstreamauth.Config, body []byte, idemKey string, callOpts upstream.CallOptions, method, opPath string, start time.Time) int {
+	writeErr := func(status int, v map[string]any) int {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(v)
+		return status
+	}
+	if rpc.Descriptors == nil {
+		return writeErr(http.StatusBadGateway, map[string]any{"error": "grpc_descriptors_unavailable"})
+	}
+	var msg map[string]any
+	if len(body) > 0 && json.Unmarshal(body, &msg) != nil {
+		return writeErr(http.StatusBadRequest, map[string]any{"error": "grpc_message_must_be_a_json_object"})
+	}
+	res, attempts, err := grpcconn.Invoke(ctx, upstream.Default, auth, rpc.Descriptors, grpcconn.Call{
+		Target: target, Method: rpc.Spec.Method, Message: msg, IdempotencyKey: idemKey,
+	}, callOpts)
+	switch {
+	case errors.Is(err, grpcconn.ErrInvalidMessage):
+		return writeErr(http.StatusBadRequest, map[string]any{"error": "invalid_grpc_message", "detail": err.Error()})
+	case errors.Is(err, upstream.ErrEgressDenied):
+		return writeErr(http.StatusForbidden, map[string]any{"error": "egress_denied", "detail": err.Error()})
+	case res == nil:
+		return writeErr(http.StatusBadGateway, map[string]any{"error": "upstream_unreachable", "attempts": attempts})
+	}
+	status := upstream.HTTPStatusFromCode(res.Code)
+	out := map[string]any{
+		"passthrough":     true,
+		"upstream_status": status,
+		"grpc_code":       res.Code.String(),
+		"operation":       map[string]any{"method": method, "path": opPath, "grpc_method": rpc.Spec.Method},
+		"upstream":        res.Body,
+		"attempts":        attempts,
+		"duration_ms":     time.Since(start).Milliseconds(),
+	}
+	if res.Detail != "" {
+		out["detail"] = res.Detail
+	}
+	if err != nil {
+		out["error"], out["detail"] = "invalid_grpc_response", err.Error()
+		return writeErr(http.StatusBadGateway, out)
+	}
+	w.Header().Set("X-Connector-Upstream", target+rpc.Spec.Method)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+	return status
+}
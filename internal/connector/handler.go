@@ -2,16 +2,10 @@
 package connector
 
 import (
-	"bytes"
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/sha256"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"io"
 	"net/http"
-	"net/url"
-	"os"
 	"strings"
 	"time"
 
@@ -21,9 +15,13 @@ import (
 	"lamdis/internal/policy"
 	"lamdis/pkg/config"
 	"lamdis/pkg/connectors"
+	"lamdis/pkg/graphql"
 	"lamdis/pkg/middleware"
 	"lamdis/pkg/openapi"
+	"lamdis/pkg/ratelimit"
 	"lamdis/pkg/tenants"
+	"lamdis/pkg/upstream"
+	"lamdis/pkg/upstreamauth"
 )
 
 // CanonicalOperation describes a first-class platform action.
@@ -71,10 +69,10 @@ func DynamicRouter(r chi.Router, cfg config.Config, tenantProv tenants.Provider,
 		// Mount canonical first
 		for _, co := range canonicalOps {
 			co := co
-			pr.Method(co.Method, co.Path, canonicalHandler(co, pool))
+			pr.Method(co.Method, co.Path, canonicalHandler(co, reg, pool))
 		}
 		// Dynamic connector-provided operations under /v1 (already include /v1 in path definitions)
-		pr.Mount("/", dynamicOperationsRouter(reg, pool))
+		pr.Mount("/", newTenantRouters(reg, pool))
 	})
 }
 
@@ -95,38 +93,11 @@ func serveOpenAPI(w http.ResponseWriter, req *http.Request, reg *connectors.Regi
 	_ = json.NewEncoder(w).Encode(regDoc.Build("connector-service", "v1"))
 }
 
-// dynamicOperationsRouter builds a sub-router with concrete operation endpoints at request time (lazy building each call if uncached).
-func dynamicOperationsRouter(reg *connectors.Registry, pool *pgxpool.Pool) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		ctx := req.Context()
-		tenant := middleware.TenantFrom(ctx)
-		ops, err := reg.LoadOperations(ctx, tenant.ID)
-		if err != nil {
-			http.Error(w, err.Error(), 500)
-			return
-		}
-		router := chi.NewRouter()
-		for _, o := range ops {
-			method := strings.ToUpper(o.Method)
-			p := o.Path
-			if strings.HasPrefix(p, "/v1/") { // keep as-is
-			}
-			required := o.Scopes
-			handler := makeDynamicOperationHandler(method, p, o.BaseURL, o.AuthRef, pool)
-			router.Method(method, p, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				if !middleware.HasAnyScope(r.Context(), required) {
-					http.Error(w, "insufficient_scope", http.StatusForbidden)
-					return
-				}
-				handler.ServeHTTP(w, r)
-			}))
-		}
-		router.ServeHTTP(w, req)
-	})
-}
-
-// canonicalHandler implements mode selection + basic policy enforcement.
-func canonicalHandler(co CanonicalOperation, pool *pgxpool.Pool) http.HandlerFunc {
+// canonicalHandler implements mode selection + policy enforcement. Calls are
+// evaluated against the tenant policy with the canonical id as action key;
+// operations naming a rail ({rail} path param, or "rail" in the query or body)
+// are executed by the tenant's builtin connector for that rail.
+func canonicalHandler(co CanonicalOperation, reg *connectors.Registry, pool *pgxpool.Pool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 		if !middleware.HasAnyScope(ctx, co.Scopes) {
@@ -148,22 +119,6 @@ func canonicalHandler(co CanonicalOperation, pool *pgxpool.Pool) http.HandlerFun
 				_ = json.Unmarshal(b, &body)
 			}
 		}
-		// Placeholder business logic; choose mode from canonical default (later influenced by connector capability & policy)
-		mode := co.Mode
-		result := map[string]any{}
-		// Very minimal sample responses
-		switch co.ID {
-		case "orders.locate":
-			result["matches"] = []map[string]any{}
-		case "orders.status":
-			result["status"] = "UNKNOWN"
-		case "orders.cancel":
-			result["accepted"] = true
-		case "refunds.request":
-			result["case_id"] = "CASE-PLACEHOLDER"
-		case "reorder.link":
-			result["link"] = "https://example.com/reorder/demo"
-		}
 		actorSub := middleware.ActorSub(ctx)
 		tenant := middleware.TenantFrom(ctx)
 		reqID := ""
@@ -172,33 +127,61 @@ func canonicalHandler(co CanonicalOperation, pool *pgxpool.Pool) http.HandlerFun
 				reqID = s
 			}
 		}
-		resp := map[string]any{
-			"mode":   mode,
-			"result": result,
-			"audit": map[string]any{
-				"action":    co.ID,
-				"actor_sub": actorSub,
-				"timestamp": time.Now().UTC().Format(time.RFC3339),
-			},
-			"duration_ms": time.Since(start).Milliseconds(),
+		inputs := canonicalInputs(r, body)
+		rail, _ := inputs["rail"].(string)
+		if !ratelimit.Default.Enforce(w, r, pool, ratelimit.Scope{Connector: rail, Operation: co.ID}) {
+			return
 		}
+		out := runCanonical(ctx, co, reg, pool, tenant.ID, inputs)
 		w.Header().Set("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(resp)
+		if out.failure != nil {
+			w.WriteHeader(out.status)
+			_ = json.NewEncoder(w).Encode(out.failure)
+		} else {
+			audit := map[string]any{
+				"action":      co.ID,
+				"actor_sub":   actorSub,
+				"decision_id": out.decision.ID,
+				"timestamp":   time.Now().UTC().Format(time.RFC3339),
+			}
+			if rail != "" {
+				audit["rail"] = rail
+			}
+			decision := map[string]any{"status": out.decision.Status}
+			if out.decision.Reasons != nil {
+				decision["reasons"] = out.decision.Reasons
+			}
+			if out.decision.Status == policy.AllowWithConditions && out.decision.Needs != nil {
+				decision["conditions"] = out.decision.Needs
+			}
+			resp := map[string]any{
+				"mode":        out.mode,
+				"result":      out.result,
+				"decision":    decision,
+				"audit":       audit,
+				"duration_ms": time.Since(start).Milliseconds(),
+			}
+			_ = json.NewEncoder(w).Encode(resp)
+		}
 		// log usage after response write
 		if pool != nil && tenant.ID != "" {
 			dur := time.Since(start)
 			_, _ = pool.Exec(ctx, `
 				INSERT INTO usage_events(tenant_id, action_id, method, path, mode, rail, actor_sub, request_id, status_code, duration_ms, started_at, finished_at)
 				VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12)
-			`, tenant.ID, co.ID, co.Method, co.Path, mode, "", actorSub, reqID, http.StatusOK, int(dur.Milliseconds()), start.UTC(), time.Now().UTC())
+			`, tenant.ID, co.ID, co.Method, co.Path, out.mode, out.usageRail, actorSub, reqID, out.status, int(dur.Milliseconds()), start.UTC(), time.Now().UTC())
 		}
 	}
 }
 
-// makeOperationHandler returns a placeholder execution handler for a dynamic operation with logging.
 // makeDynamicOperationHandler executes dynamic operations. If baseURL is provided, it proxies to that upstream (passthrough); otherwise returns a simple echo payload.
-func makeDynamicOperationHandler(method, opPath string, baseURL *string, authRef *string, pool *pgxpool.Pool) http.HandlerFunc {
-	client := &http.Client{Timeout: 15 * time.Second}
+// Upstream calls go through the shared upstream client so per-operation timeouts, retries and breakers apply.
+// GraphQL operations (gql set) take the request body as the operation's variables and POST the stored
+// document to the connector endpoint; a populated errors array is answered with 502.
+// gRPC operations (rpc set) take the request body as the method's request message.
+// HTTP operations forward the concrete path, the query string and the headers pass selects;
+// in stream mode the upstream response is relayed as is.
+func makeDynamicOperationHandler(method, opPath string, baseURL *string, authRef *string, callOpts upstream.CallOptions, pass upstream.Passthrough, gql *graphql.Spec, rpc *connectors.GRPCOperation, pool *pgxpool.Pool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 		ctx := r.Context()
@@ -211,90 +194,76 @@ func makeDynamicOperationHandler(method, opPath string, baseURL *string, authRef
 			}
 		}
 		statusCode := http.StatusOK
-		var resultBody any
+		var relayErr error
 		// Passthrough when baseURL present
 		if baseURL != nil && *baseURL != "" {
 			upBase := strings.TrimRight(*baseURL, "/")
-			// Use the request's path (already concrete with params) but keep only the operation suffix (assumes opPath starts with /)
-			reqPath := opPath
-			// Build full URL
-			full := upBase + reqPath
-			if _, err := url.Parse(full); err != nil {
-				http.Error(w, "invalid_upstream_url", http.StatusBadGateway)
+			// The concrete request path (route params substituted) and query string
+			full, err := upstreamURL(upBase, opPath, r)
+			if errors.Is(err, errPathParam) {
+				http.Error(w, "invalid_path_param", http.StatusBadRequest)
 				return
 			}
-			var bodyBytes []byte
-			if r.Body != nil && (method == http.MethodPost || method == http.MethodPut || method == http.MethodPatch) {
-				bodyBytes, _ = io.ReadAll(http.MaxBytesReader(w, r.Body, 2<<20))
-			}
-			upReq, err := http.NewRequestWithContext(ctx, method, full, bytes.NewReader(bodyBytes))
 			if err != nil {
-				http.Error(w, "upstream_request_build_failed", http.StatusBadGateway)
+				http.Error(w, "invalid_upstream_url", http.StatusBadGateway)
 				return
 			}
-			// Inject auth if configured via authRef (supports simple api_key)
-			if authRef != nil && *authRef != "" && pool != nil {
-				var typ string
-				var cfgRaw, secEnc []byte
-				if err := pool.QueryRow(ctx, `SELECT type, config, secrets_encrypted FROM tenant_auth_configs WHERE id=$1`, *authRef).Scan(&typ, &cfgRaw, &secEnc); err == nil {
-					var cfg map[string]any
-					_ = json.Unmarshal(cfgRaw, &cfg)
-					if strings.EqualFold(typ, "api_key") {
-						apiKey := ""
-						if v, ok := cfg["api_key"].(string); ok && v != "" { // plain config override
-							apiKey = v
-						}
-						if apiKey == "" && len(secEnc) > 0 { // decrypt blob
-							if k := os.Getenv("ENCRYPTION_KEY"); k != "" {
-								if secrets, err := decryptSecrets(secEnc, []byte(k)); err == nil {
-									if v, ok := secrets["api_key"].(string); ok && v != "" {
-										apiKey = v
-									}
-								}
-							}
-						}
-						if apiKey != "" {
-							upReq.Header.Set("x-api-key", apiKey)
-						}
-					}
+			// Credentials from authRef are applied by the shared upstream auth module
+			auth := upstreamauth.None
+			if authRef != nil && *authRef != "" {
+				auth, err = upstreamauth.Load(upstreamauth.WithActor(ctx, actorSub), pool, tenant.ID, *authRef)
+				if errors.Is(err, upstreamauth.ErrNotLinked) {
+					w.Header().Set("Content-Type", "application/json")
+					w.WriteHeader(http.StatusForbidden)
+					_ = json.NewEncoder(w).Encode(map[string]any{"error": "account_not_linked", "authorize": "/v1/connections/" + *authRef + "/authorize"})
+					return
+				}
+				if err != nil {
+					http.Error(w, "upstream_auth_unavailable", http.StatusBadGateway)
+					return
 				}
 			}
-			// Minimal header passthrough
-			if ct := r.Header.Get("Content-Type"); ct != "" {
-				upReq.Header.Set("Content-Type", ct)
+			// Plain HTTP operations in stream mode relay bodies unbuffered; signed bodies are still buffered.
+			stream := pass.Stream && gql == nil && rpc == nil
+			var bodyBytes []byte
+			var bodyStream io.Reader
+			if r.Body != nil && (method == http.MethodPost || method == http.MethodPut || method == http.MethodPatch) {
+				if stream && !auth.SignsBody() {
+					bodyStream = r.Body
+				} else if bodyBytes, err = io.ReadAll(http.MaxBytesReader(w, r.Body, pass.BufferLimit())); err != nil {
+					w.Header().Set("Content-Type", "application/json")
+					w.WriteHeader(http.StatusRequestEntityTooLarge)
+					_ = json.NewEncoder(w).Encode(map[string]any{"error": "request_body_too_large", "limit": pass.BufferLimit()})
+					return
+				}
 			}
-			if accept := r.Header.Get("Accept"); accept != "" {
-				upReq.Header.Set("Accept", accept)
+			upMethod := method
+			if gql != nil {
+				var vars map[string]any
+				if len(bodyBytes) > 0 && json.Unmarshal(bodyBytes, &vars) != nil {
+					http.Error(w, "graphql_variables_must_be_a_json_object", http.StatusBadRequest)
+					return
+				}
+				full, upMethod = upBase, http.MethodPost
+				bodyBytes, _ = json.Marshal(graphql.Body(gql.Query, gql.OperationName, vars))
 			}
-			resp, err := client.Do(upReq)
-			if err != nil {
-				http.Error(w, "upstream_unreachable", http.StatusBadGateway)
-				return
+			header := pass.Forward(r.Header)
+			if gql != nil {
+				header.Set("Content-Type", "application/json")
 			}
-			defer resp.Body.Close()
-			statusCode = resp.StatusCode
-			respBytes, _ := io.ReadAll(http.MaxBytesReader(w, resp.Body, 4<<20))
-			ct := resp.Header.Get("Content-Type")
-			if strings.Contains(ct, "application/json") {
-				var jb any
-				if err := json.Unmarshal(respBytes, &jb); err == nil {
-					resultBody = jb
-				} else {
-					resultBody = string(respBytes)
-				}
+			// Callers may pass their own Idempotency-Key; otherwise the request id keys retries.
+			idemKey := r.Header.Get("Idempotency-Key")
+			if idemKey == "" {
+				idemKey = reqID
+			}
+			egressCtx := upstream.WithTenant(upstream.WithEgress(ctx, connectors.LoadEgressPolicy(ctx, pool, tenant.ID)), tenant.ID)
+			egressCtx = upstreamauth.WithSubjectToken(upstreamauth.WithActor(egressCtx, actorSub), middleware.RawToken(ctx))
+			if rpc != nil {
+				statusCode = serveGRPC(egressCtx, w, rpc, upBase, auth, bodyBytes, idemKey, callOpts, method, opPath, start)
 			} else {
-				// Return raw as string (could be HTML/text); callers can inspect
-				resultBody = string(respBytes)
+				req := upstream.Request{Method: upMethod, URL: full, Header: header, Body: bodyBytes, BodyStream: bodyStream, IdempotencyKey: idemKey}
+				statusCode, relayErr = serveHTTP(egressCtx, w, req, auth, callOpts, pass, gql, method, opPath, start)
 			}
-			w.Header().Set("X-Connector-Upstream", full)
-			w.Header().Set("Content-Type", "application/json")
-			_ = json.NewEncoder(w).Encode(map[string]any{
-				"passthrough":     true,
-				"upstream_status": statusCode,
-				"operation":       map[string]any{"method": method, "path": opPath},
-				"upstream":        resultBody,
-				"duration_ms":     time.Since(start).Milliseconds(),
-			})
 		} else {
 			// Fallback echo (no upstream)
 			var body any
@@ -320,38 +289,10 @@ func makeDynamicOperationHandler(method, opPath string, baseURL *string, authRef
 				VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12)
 			`, tenant.ID, "", method, opPath, "", "", actorSub, reqID, statusCode, int(dur.Milliseconds()), start.UTC(), time.Now().UTC())
 		}
+		if relayErr != nil {
+			// The streamed body was cut short after the headers went out; abort
+			// the response so the caller does not take it for complete.
+			panic(http.ErrAbortHandler)
+		}
 	}
 }
-
-// decryptSecrets reverses the admin-api encryptJSON format (versioned: 0x01 | nonce | ciphertext[GCM]).
-func decryptSecrets(blob []byte, key []byte) (map[string]any, error) {
-	if len(blob) < 2 { // version + minimal nonce
-		return nil, fmt.Errorf("invalid blob")
-	}
-	if blob[0] != 0x01 { // only support version 1
-		return nil, fmt.Errorf("unsupported version")
-	}
-	h := sha256.Sum256(key)
-	block, err := aes.NewCipher(h[:])
-	if err != nil {
-		return nil, err
-	}
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, err
-	}
-	if len(blob) < 1+gcm.NonceSize() {
-		return nil, fmt.Errorf("short nonce")
-	}
-	nonce := blob[1 : 1+gcm.NonceSize()]
-	ct := blob[1+gcm.NonceSize():]
-	plain, err := gcm.Open(nil, nonce, ct, nil)
-	if err != nil {
-		return nil, err
-	}
-	var m map[string]any
-	if err := json.Unmarshal(plain, &m); err != nil {
-		return nil, err
-	}
-	return m, nil
-}
@@ -0,0 +1,155 @@
+package connector
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"lamdis/pkg/connectors"
+	"lamdis/pkg/upstream"
+)
+
+// defaultLocateTimeout bounds each rail's part of an orders.locate fan-out.
+// Tenants override it per connector with config locate_timeout_ms.
+const defaultLocateTimeout = 5 * time.Second
+
+// railFailure reports a rail that could not answer a fan-out.
+type railFailure struct {
+	Rail   string `json:"rail"`
+	Error  string `json:"error"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// locateOrders fans orders.locate out concurrently to every enabled connector
+// declaring the capability and merges their normalized, deduplicated matches.
+// Failed rails are reported without failing the call unless every rail failed.
+// It returns the status code, the result or an error document, and the rails
+// that returned matches.
+func locateOrders(ctx context.Context, reg *connectors.Registry, pool *pgxpool.Pool, tenantID string, inputs map[string]any) (int, map[string]any, map[string]any, []string) {
+	if !hasAnyInput(inputs, "email", "order_number", "phone") {
+		return http.StatusBadRequest, nil, map[string]any{"error": "invalid_input", "detail": "one of email, order_number or phone is required"}, nil
+	}
+	rails, err := reg.TenantBuiltins(ctx, tenantID, connectors.OpOrdersLocate)
+	if err != nil {
+		return http.StatusInternalServerError, nil, map[string]any{"error": "registry_unavailable"}, nil
+	}
+	ctx = upstream.WithTenant(upstream.WithEgress(ctx, connectors.LoadEgressPolicy(ctx, pool, tenantID)), tenantID)
+	type answer struct {
+		matches []connectors.Order
+		failure *railFailure
+	}
+	answers := make([]answer, len(rails))
+	var wg sync.WaitGroup
+	for i, tr := range rails {
+		rail := tr.Record.ID
+		if tr.Err != nil {
+			answers[i].failure = &railFailure{Rail: rail, Error: "rail_unavailable", Detail: tr.Err.Error()}
+			continue
+		}
+		wg.Add(1)
+		go func(i int, tr connectors.TenantRail) {
+			defer wg.Done()
+			rctx, cancel := context.WithTimeout(ctx, locateTimeout(tr.Record))
+			defer cancel()
+			res, err := tr.Builtin.Execute(rctx, connectors.OpOrdersLocate, inputs)
+			if err == nil && rctx.Err() != nil {
+				err = rctx.Err()
+			}
+			if err != nil {
+				_, code := railError(err)
+				answers[i].failure = &railFailure{Rail: rail, Error: code, Detail: err.Error()}
+				return
+			}
+			answers[i].matches = normalizeMatches(rail, res)
+		}(i, tr)
+	}
+	wg.Wait()
+
+	failed := []railFailure{}
+	queried := make([]string, 0, len(rails))
+	var matched []string
+	lists := make([][]connectors.Order, 0, len(answers))
+	for i, a := range answers {
+		queried = append(queried, rails[i].Record.ID)
+		if a.failure != nil {
+			failed = append(failed, *a.failure)
+			continue
+		}
+		if len(a.matches) > 0 {
+			matched = append(matched, rails[i].Record.ID)
+		}
+		lists = append(lists, a.matches)
+	}
+	matches := mergeMatches(lists)
+	if len(rails) > 0 && len(failed) == len(rails) {
+		return http.StatusBadGateway, nil, map[string]any{"error": "all_rails_failed", "failed_rails": failed}, nil
+	}
+	return http.StatusOK, map[string]any{"matches": matches, "rails": queried, "failed_rails": failed}, nil, matched
+}
+
+// mergeMatches deduplicates the rails' matches by order identity, keeping the
+// first rail's copy of each order and recording every rail that returned it.
+func mergeMatches(lists [][]connectors.Order) []connectors.Order {
+	out := []connectors.Order{}
+	index := map[string]int{}
+	for _, list := range lists {
+		for _, o := range list {
+			i, ok := index[o.Key()]
+			if !ok {
+				o.Rails = []string{o.Rail}
+				index[o.Key()] = len(out)
+				out = append(out, o)
+				continue
+			}
+			if !slices.Contains(out[i].Rails, o.Rail) {
+				out[i].Rails = append(out[i].Rails, o.Rail)
+			}
+		}
+	}
+	return out
+}
+
+// normalizeMatches converts a rail's orders.locate result to canonical orders.
+func normalizeMatches(rail string, res map[string]any) []connectors.Order {
+	var out []connectors.Order
+	list, _ := res["matches"].([]any)
+	if list == nil {
+		if ms, ok := res["matches"].([]map[string]any); ok {
+			for _, m := range ms {
+				list = append(list, m)
+			}
+		}
+	}
+	for _, v := range list {
+		if m, ok := v.(map[string]any); ok {
+			if o := connectors.NormalizeOrder(rail, m); o.ID != "" || o.Number != "" {
+				out = append(out, o)
+			}
+		}
+	}
+	return out
+}
+
+func locateTimeout(rec connectors.ConnectorRecord) time.Duration {
+	if ms, ok := rec.ConfigJSON["locate_timeout_ms"].(float64); ok && ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return defaultLocateTimeout
+}
+
+func hasAnyInput(inputs map[string]any, keys ...string) bool {
+	for _, k := range keys {
+		if s, ok := inputs[k].(string); ok && strings.TrimSpace(s) != "" {
+			return true
+		}
+		if _, ok := inputs[k].(float64); ok {
+			return true
+		}
+	}
+	return false
+}
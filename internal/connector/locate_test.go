@@ -0,0 +1,56 @@
+package connector
+
+import (
+	"reflect"
+	"testing"
+
+	"lamdis/pkg/connectors"
+)
+
+func TestMergeMatches(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		lists [][]connectors.Order
+		want  []connectors.Order
+	}{
+		{
+			name: "none",
+			want: []connectors.Order{},
+		},
+		{
+			name: "same id from two rails",
+			lists: [][]connectors.Order{
+				{{Rail: "shop", ID: "o-1", Status: "paid"}, {Rail: "shop", ID: "o-2"}},
+				{{Rail: "erp", ID: "o-1", Status: "shipped"}},
+			},
+			want: []connectors.Order{
+				{Rail: "shop", Rails: []string{"shop", "erp"}, ID: "o-1", Status: "paid"},
+				{Rail: "shop", Rails: []string{"shop"}, ID: "o-2"},
+			},
+		},
+		{
+			name: "number when there is no id",
+			lists: [][]connectors.Order{
+				{{Rail: "shop", Number: "#1001"}},
+				{{Rail: "erp", Number: "#1001"}, {Rail: "erp", ID: "#1001"}},
+			},
+			want: []connectors.Order{
+				{Rail: "shop", Rails: []string{"shop", "erp"}, Number: "#1001"},
+				{Rail: "erp", Rails: []string{"erp"}, ID: "#1001"},
+			},
+		},
+		{
+			name: "duplicate within one rail",
+			lists: [][]connectors.Order{
+				{{Rail: "shop", ID: "o-1"}, {Rail: "shop", ID: "o-1"}},
+			},
+			want: []connectors.Order{{Rail: "shop", Rails: []string{"shop"}, ID: "o-1"}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := mergeMatches(tc.lists); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("matches %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
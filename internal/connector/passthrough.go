@@ -0,0 +1,153 @@
+package connector
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"lamdis/pkg/graphql"
+	"lamdis/pkg/upstream"
+	"lamdis/pkg/upstreamauth"
+)
+
+// routeParam matches a chi route parameter, optionally with a pattern ({id}, {id:[0-9]+}).
+var routeParam = regexp.MustCompile(`\{([^{}:]+)(?::[^{}]*)?\}`)
+
+// errPathParam reports a route parameter value that would change the upstream
+// path beyond its own segment.
+var errPathParam = errors.New("path parameter must not be a dot segment or contain a slash")
+
+// upstreamURL joins the connector base URL with the concrete request path,
+// which is the operation path with the route parameters chi matched
+// substituted, and appends the caller's query string. Parameter values are
+// escaped segment by segment; "." and ".." segments, and slashes outside the
+// wildcard, are rejected with errPathParam so callers cannot reach upstream
+// paths beyond the operation's.
+func upstreamURL(base, opPath string, r *http.Request) (string, error) {
+	escaped := r.URL.RawPath != "" // chi then matched, and captured, escaped values
+	var perr error
+	param := func(name string) string {
+		segs := []string{chi.URLParam(r, name)}
+		if name == "*" {
+			segs = strings.Split(segs[0], "/")
+		}
+		for i, s := range segs {
+			if escaped {
+				d, err := url.PathUnescape(s)
+				if err != nil {
+					perr = err
+					return ""
+				}
+				s = d
+			}
+			if s == "." || s == ".." || strings.Contains(s, "/") {
+				perr = errPathParam
+				return ""
+			}
+			segs[i] = url.PathEscape(s)
+		}
+		return strings.Join(segs, "/")
+	}
+	p := routeParam.ReplaceAllStringFunc(opPath, func(m string) string {
+		return param(routeParam.FindStringSubmatch(m)[1])
+	})
+	if strings.HasSuffix(p, "*") {
+		p = strings.TrimSuffix(p, "*") + param("*")
+	}
+	if perr != nil {
+		return "", errPathParam
+	}
+	u, err := url.Parse(base + p)
+	if err != nil {
+		return "", err
+	}
+	if q := r.URL.RawQuery; q != "" {
+		if u.RawQuery != "" {
+			u.RawQuery += "&" + q
+		} else {
+			u.RawQuery = q
+		}
+	}
+	return u.String(), nil
+}
+
+// serveHTTP performs an HTTP passthrough call and writes the response: the
+// upstream status, selected headers and body as is in stream mode, the JSON
+// envelope otherwise. It returns the status code recorded for usage and, in
+// stream mode, the error that cut the relayed body short, after which the
+// response must be aborted rather than ended normally.
+func serveHTTP(ctx context.Context, w http.ResponseWriter, req upstream.Request, auth upstreamauth.Config, callOpts upstream.CallOptions, pass upstream.Passthrough, gql *graphql.Spec, method, opPath string, start time.Time) (int, error) {
+	writeErr := func(status int, v map[string]any) (int, error) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(v)
+		return status, nil
+	}
+	resp, attempts, err := upstreamauth.Open(ctx, upstream.Default, auth, req, callOpts)
+	if resp != nil {
+		defer resp.Stream.Close()
+	}
+	if errors.Is(err, upstream.ErrEgressDenied) {
+		return writeErr(http.StatusForbidden, map[string]any{"error": "egress_denied", "detail": err.Error()})
+	}
+	if err != nil || resp == nil {
+		return writeErr(http.StatusBadGateway, map[string]any{"error": "upstream_unreachable", "attempts": attempts})
+	}
+	w.Header().Set("X-Connector-Upstream", upstream.RedactURL(req.URL))
+	if pass.Stream && gql == nil {
+		for k, vs := range pass.Relay(resp.Header) {
+			w.Header()[k] = vs
+		}
+		w.WriteHeader(resp.Status)
+		_, err := io.Copy(w, resp.Stream)
+		return resp.Status, err
+	}
+
+	limit := pass.BufferLimit()
+	respBytes, err := io.ReadAll(io.LimitReader(resp.Stream, limit+1))
+	if err != nil {
+		return writeErr(http.StatusBadGateway, map[string]any{"error": "upstream_unreachable", "detail": err.Error(), "attempts": attempts})
+	}
+	if int64(len(respBytes)) > limit {
+		return writeErr(http.StatusBadGateway, map[string]any{"error": "upstream_response_too_large", "limit": limit, "upstream_status": resp.Status})
+	}
+	statusCode := resp.Status
+	var resultBody any
+	if strings.Contains(resp.Header.Get("Content-Type"), "application/json") {
+		var jb any
+		if err := json.Unmarshal(respBytes, &jb); err == nil {
+			resultBody = jb
+		} else {
+			resultBody = string(respBytes)
+		}
+	} else {
+		// Return raw as string (could be HTML/text); callers can inspect
+		resultBody = string(respBytes)
+	}
+	out := map[string]any{
+		"passthrough":     true,
+		"upstream_status": statusCode,
+		"operation":       map[string]any{"method": method, "path": opPath},
+		"upstream":        resultBody,
+		"attempts":        attempts,
+		"duration_ms":     time.Since(start).Milliseconds(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if rb, ok := resultBody.(map[string]any); ok && gql != nil {
+		if msg, failed := graphql.Errors(rb); failed {
+			out["error"], out["detail"] = "graphql_errors", msg
+			statusCode = http.StatusBadGateway
+			w.WriteHeader(statusCode)
+		}
+	}
+	_ = json.NewEncoder(w).Encode(out)
+	return statusCode, nil
+}
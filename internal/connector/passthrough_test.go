@@ -0,0 +1,57 @@
+package connector
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// routedURL routes target through opPath and returns upstreamURL's result.
+func routedURL(t *testing.T, opPath, target string) (string, error) {
+	t.Helper()
+	var got string
+	var err error
+	routed := false
+	r := chi.NewRouter()
+	r.Get(opPath, func(_ http.ResponseWriter, req *http.Request) {
+		routed = true
+		got, err = upstreamURL("https://api.example.com/base", opPath, req)
+	})
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil))
+	if !routed {
+		t.Fatalf("%s not routed by %s", target, opPath)
+	}
+	return got, err
+}
+
+func TestUpstreamURL(t *testing.T) {
+	for _, tc := range []struct{ opPath, target, want string }{
+		{"/v1/orders/{id}", "/v1/orders/o-1?expand=items", "https://api.example.com/base/v1/orders/o-1?expand=items"},
+		{"/v1/orders/{id}", "/v1/orders/a%20b", "https://api.example.com/base/v1/orders/a%20b"},
+		{"/v1/orders/{id}", "/v1/orders/.hidden", "https://api.example.com/base/v1/orders/.hidden"},
+		{"/v1/files/*", "/v1/files/a/b%3Fc.txt", "https://api.example.com/base/v1/files/a/b%3Fc.txt"},
+	} {
+		got, err := routedURL(t, tc.opPath, tc.target)
+		if err != nil || got != tc.want {
+			t.Errorf("%s: got %q, %v; want %q", tc.target, got, err, tc.want)
+		}
+	}
+}
+
+func TestUpstreamURLRejectsPathTraversal(t *testing.T) {
+	for _, tc := range []struct{ opPath, target string }{
+		{"/v1/orders/{id}/status", "/v1/orders/%2E%2E/status"},
+		{"/v1/orders/{id}/status", "/v1/orders/%2e/status"},
+		{"/v1/orders/{id}/status", "/v1/orders/..%2Fadmin/status"},
+		{"/v1/orders/{id}", "/v1/orders/a%2Fb"},
+		{"/v1/files/*", "/v1/files/a/%2E%2E/%2E%2E/admin"},
+		{"/v1/files/*", "/v1/files/a%2F..%2Fb"},
+	} {
+		if got, err := routedURL(t, tc.opPath, tc.target); !errors.Is(err, errPathParam) {
+			t.Errorf("%s: got %q, %v; want errPathParam", tc.target, got, err)
+		}
+	}
+}
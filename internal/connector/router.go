@@ -0,0 +1,186 @@
+package connector
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"lamdis/pkg/connectors"
+	"lamdis/pkg/middleware"
+	"lamdis/pkg/ratelimit"
+)
+
+var (
+	routerBuilds = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "lamdis_dynamic_router_builds_total",
+		Help: "Tenant routers compiled for dynamic connector operations.",
+	})
+	routeConflicts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "lamdis_dynamic_route_conflicts_total",
+		Help: "Dynamic operations left unrouted at router compilation because an earlier route matches the same requests or the router rejects their path.",
+	})
+)
+
+// maxTenantRouters bounds the compiled routers kept; the least recently used
+// tenant's router is dropped to make room for another tenant's.
+const maxTenantRouters = 1000
+
+// tenantRouters serves dynamic connector operations through a router compiled
+// per tenant, rebuilt only when the tenant's operation set changes.
+type tenantRouters struct {
+	reg  *connectors.Registry
+	pool *pgxpool.Pool
+
+	mu       sync.RWMutex
+	byTenant map[string]*compiledRouter
+	limit    int
+}
+
+type compiledRouter struct {
+	fingerprint string
+	handler     http.Handler
+	used        atomic.Int64 // unix nanoseconds of the last request
+}
+
+func newTenantRouters(reg *connectors.Registry, pool *pgxpool.Pool) *tenantRouters {
+	return &tenantRouters{reg: reg, pool: pool, byTenant: map[string]*compiledRouter{}, limit: maxTenantRouters}
+}
+
+func (t *tenantRouters) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	tenant := middleware.TenantFrom(ctx)
+	set, err := t.reg.LoadOperationSet(ctx, tenant.ID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	t.router(tenant.ID, set).ServeHTTP(w, req)
+}
+
+// router returns the tenant's compiled router for set, compiling it when the
+// cached one was built for a different fingerprint.
+func (t *tenantRouters) router(tenantID string, set connectors.OperationSet) http.Handler {
+	t.mu.RLock()
+	c, ok := t.byTenant[tenantID]
+	t.mu.RUnlock()
+	if !ok || c.fingerprint != set.Fingerprint {
+		c = &compiledRouter{fingerprint: set.Fingerprint, handler: t.compile(set)}
+		c.used.Store(time.Now().UnixNano())
+		t.mu.Lock()
+		if _, cached := t.byTenant[tenantID]; !cached && len(t.byTenant) >= t.limit {
+			t.evictLeastRecentlyUsed()
+		}
+		t.byTenant[tenantID] = c
+		t.mu.Unlock()
+	}
+	c.used.Store(time.Now().UnixNano())
+	return c.handler
+}
+
+// evictLeastRecentlyUsed drops the router of the tenant served longest ago.
+// The caller holds t.mu.
+func (t *tenantRouters) evictLeastRecentlyUsed() {
+	oldest, at := "", int64(math.MaxInt64)
+	for id, c := range t.byTenant {
+		if u := c.used.Load(); u < at {
+			oldest, at = id, u
+		}
+	}
+	delete(t.byTenant, oldest)
+}
+
+// compile builds the router for an operation set. Operations conflicting with
+// a canonical operation or an earlier operation, and operations whose path chi
+// rejects, are left out (see OperationConflicts).
+func (t *tenantRouters) compile(set connectors.OperationSet) http.Handler {
+	routerBuilds.Inc()
+	ops := set.Operations
+	serve, conflicts := planOperations(set)
+	for _, c := range conflicts {
+		routeConflicts.Add(float64(max(1, len(c.Shadowed))))
+	}
+	router := chi.NewRouter()
+	for _, i := range serve {
+		if i < len(canonicalOps) {
+			continue // served by the parent router
+		}
+		o := ops[i-len(canonicalOps)]
+		method := strings.ToUpper(o.Method)
+		p := o.Path
+		required := o.Scopes
+		limits := ratelimit.Scope{Operation: ratelimit.OperationKey(method, p)}
+		if o.Kind != nil {
+			limits.Connector = *o.Kind
+		}
+		handler := makeDynamicOperationHandler(method, p, o.BaseURL, o.AuthRef, o.CallOptions, o.Passthrough, o.GraphQL, o.GRPC, t.pool)
+		// planOperations left out the patterns chi rejects.
+		router.Method(method, p, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !middleware.HasAnyScope(r.Context(), required) {
+				http.Error(w, "insufficient_scope", http.StatusForbidden)
+				return
+			}
+			if !ratelimit.Default.Enforce(w, r, t.pool, limits) {
+				return
+			}
+			handler.ServeHTTP(w, r)
+		}))
+	}
+	return router
+}
+
+func mount(router chi.Router, method, pattern string, h http.Handler) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("%v", v)
+		}
+	}()
+	router.Method(method, pattern, h)
+	return nil
+}
+
+// OperationConflicts reports the tenant operations that are not routed because
+// a canonical operation or an earlier operation matches the same requests, or
+// because chi rejects their path.
+func OperationConflicts(set connectors.OperationSet) []connectors.Conflict {
+	_, conflicts := planOperations(set)
+	return conflicts
+}
+
+// planOperations returns the indexes in operationRoutes(set) of the routes to
+// serve and the conflicts leaving the others unrouted. Paths chi rejects are
+// reported as conflicts with an Error rather than failing the whole router.
+func planOperations(set connectors.OperationSet) ([]int, []connectors.Conflict) {
+	routes := operationRoutes(set)
+	planned, conflicts := connectors.PlanRoutes(routes)
+	var serve []int
+	for _, i := range planned {
+		if i >= len(canonicalOps) {
+			rt := routes[i]
+			if err := mount(chi.NewRouter(), rt.Method, rt.Path, http.NotFoundHandler()); err != nil {
+				conflicts = append(conflicts, connectors.Conflict{Served: rt, Error: err.Error()})
+				continue
+			}
+		}
+		serve = append(serve, i)
+	}
+	return serve, conflicts
+}
+
+// operationRoutes lists the canonical routes followed by the set's, in order
+// of precedence.
+func operationRoutes(set connectors.OperationSet) []connectors.Route {
+	routes := make([]connectors.Route, 0, len(canonicalOps)+len(set.Operations))
+	for _, co := range canonicalOps {
+		routes = append(routes, connectors.Route{Method: co.Method, Path: co.Path, Kind: "canonical"})
+	}
+	return append(routes, set.Routes()...)
+}
@@ -0,0 +1,124 @@
+package connector
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"lamdis/pkg/connectors"
+	"lamdis/pkg/middleware"
+)
+
+// sampleSet returns the sample operations the registry serves without a database.
+func sampleSet(tb testing.TB) (*connectors.Registry, connectors.OperationSet) {
+	tb.Helper()
+	reg := connectors.NewRegistry(nil)
+	set, err := reg.LoadOperationSet(context.Background(), "t-1")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return reg, set
+}
+
+func TestOperationConflictsReportsRejectedPaths(t *testing.T) {
+	_, set := sampleSet(t)
+	bad := set.Operations[0]
+	bad.Path = "/v1/dev/files/*/raw" // chi only allows a wildcard at the end
+	set.Operations = append(set.Operations, bad)
+	set.Fingerprint = "with-bad"
+
+	conflicts := OperationConflicts(set)
+	if len(conflicts) != 1 || conflicts[0].Served.Path != bad.Path || conflicts[0].Error == "" {
+		t.Fatalf("conflicts %+v", conflicts)
+	}
+	// The other operations are still routed.
+	rec := httptest.NewRecorder()
+	(&tenantRouters{}).compile(set).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/dev/orders/o-1", nil))
+	if rec.Code == http.StatusNotFound || rec.Code == http.StatusMethodNotAllowed {
+		t.Fatalf("sample operation not routed: %d", rec.Code)
+	}
+}
+
+func TestTenantRoutersCache(t *testing.T) {
+	reg, set := sampleSet(t)
+	changed := set
+	changed.Fingerprint = "changed"
+	for _, tc := range []struct {
+		name   string
+		limit  int
+		serve  []string // tenant ids, served in order with set
+		then   func(rs *tenantRouters)
+		cached []string
+	}{
+		{
+			name:   "one router per tenant",
+			limit:  3,
+			serve:  []string{"t-1", "t-2", "t-1"},
+			cached: []string{"t-1", "t-2"},
+		},
+		{
+			name:   "least recently used is evicted",
+			limit:  2,
+			serve:  []string{"t-1", "t-2", "t-1", "t-3"},
+			cached: []string{"t-1", "t-3"},
+		},
+		{
+			name:  "new fingerprint replaces the tenant's router",
+			limit: 2,
+			serve: []string{"t-1", "t-2"},
+			then: func(rs *tenantRouters) {
+				rs.router("t-1", changed)
+				if fp := rs.byTenant["t-1"].fingerprint; fp != "changed" {
+					t.Fatalf("fingerprint %q", fp)
+				}
+			},
+			cached: []string{"t-1", "t-2"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rs := newTenantRouters(reg, nil)
+			rs.limit = tc.limit
+			for _, id := range tc.serve {
+				rs.router(id, set)
+				time.Sleep(time.Millisecond) // distinct last-use times
+			}
+			if tc.then != nil {
+				tc.then(rs)
+			}
+			var got []string
+			for id := range rs.byTenant {
+				got = append(got, id)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tc.cached) {
+				t.Fatalf("cached tenants %v, want %v", got, tc.cached)
+			}
+		})
+	}
+}
+
+// BenchmarkDynamicRouter compares serving through the cached tenant router
+// with compiling a router for every request.
+func BenchmarkDynamicRouter(b *testing.B) {
+	reg, set := sampleSet(b)
+	routers := newTenantRouters(reg, nil)
+	ctx := middleware.WithScopes(context.Background(), []string{"order:read"})
+	req := httptest.NewRequest(http.MethodGet, "/v1/dev/orders/o-1", nil).WithContext(ctx)
+
+	b.Run("cached", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			routers.ServeHTTP(httptest.NewRecorder(), req)
+		}
+	})
+	b.Run("per-request", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			routers.compile(set).ServeHTTP(httptest.NewRecorder(), req)
+		}
+	})
+}
@@ -12,6 +12,8 @@ import (
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	jmes "github.com/jmespath/go-jmespath"
+
+	"lamdis/pkg/template"
 )
 
 // Resolver represents a configured fact resolver row
@@ -25,16 +27,18 @@ type Resolver struct {
 	Needs          []map[string]any
 }
 
-// Mapping represents a configured mapping row
+// Mapping represents a configured mapping row. The JSON form
+// ({ "path", "key", "transform", "transform_args", "required" }) is also used
+// by action output mappings, which shape upstream responses into results.
 type Mapping struct {
-	ID            string
-	ActionKey     string
-	Name          string
-	Path          string
-	FactKey       string
-	Transform     string
-	TransformArgs []any
-	Required      bool
+	ID            string `json:"id,omitempty"`
+	ActionKey     string `json:"action_key,omitempty"`
+	Name          string `json:"name,omitempty"`
+	Path          string `json:"path"`
+	FactKey       string `json:"key"`
+	Transform     string `json:"transform,omitempty"`
+	TransformArgs []any  `json:"transform_args,omitempty"`
+	Required      bool   `json:"required,omitempty"`
 }
 
 // ResolveFacts resolves facts for an action using response_sample as stubbed data.
@@ -48,39 +52,86 @@ func ResolveFacts(ctx context.Context, pool *pgxpool.Pool, tenantID, actionKey s
 		}
 		return out, nil
 	}
-	tx, err := pool.Begin(ctx)
+	cfg, err := LoadConfig(ctx, pool, tenantID, actionKey)
 	if err != nil {
 		return nil, err
 	}
-	defer tx.Rollback(ctx)
-	if _, err := tx.Exec(ctx, "SELECT set_config('app.tenant_id', $1, true)", tenantID); err != nil {
-		return nil, err
+	responses := map[string]any{}
+	for _, r := range cfg.Resolvers {
+		responses[r.Name] = r.Fetch(ctx, r.Inputs(inputs))
 	}
+	return cfg.Facts(inputs, responses)
+}
+
+// Config is an action's fact configuration: the resolvers whose responses
+// feed the facts document and the mappings that read facts from it.
+type Config struct {
+	Resolvers []Resolver
+	Mappings  []Mapping
+}
 
-	// Load resolvers
-	resolvers, err := loadResolvers(ctx, tx, actionKey)
+// LoadConfig reads the action's enabled resolvers and its mappings.
+func LoadConfig(ctx context.Context, pool *pgxpool.Pool, tenantID, actionKey string) (Config, error) {
+	var cfg Config
+	tx, err := pool.Begin(ctx)
 	if err != nil {
-		return nil, err
+		return cfg, err
 	}
-	// Load mappings
-	mappings, err := loadMappings(ctx, tx, actionKey)
-	if err != nil {
-		return nil, err
+	defer tx.Rollback(ctx)
+	if _, err := tx.Exec(ctx, "SELECT set_config('app.tenant_id', $1, true)", tenantID); err != nil {
+		return cfg, err
+	}
+	if cfg.Resolvers, err = loadResolvers(ctx, tx, actionKey); err != nil {
+		return cfg, err
 	}
+	if cfg.Mappings, err = loadMappings(ctx, tx, actionKey); err != nil {
+		return cfg, err
+	}
+	return cfg, tx.Commit(ctx)
+}
+
+// Facts applies the mappings to { inputs, resolvers: {name: response} }.
+func (c Config) Facts(inputs map[string]any, responses map[string]any) (map[string]any, error) {
+	return ApplyMappings(c.Mappings, map[string]any{"inputs": inputs, "resolvers": responses})
+}
 
-	// Compose a shared document for JMESPath: { inputs, resolvers: {name: response_sample} }
-	doc := map[string]any{"inputs": inputs, "resolvers": map[string]any{}}
-	resMap := doc["resolvers"].(map[string]any)
-	for _, r := range resolvers {
-		resMap[r.Name] = r.ResponseSample
+// Inputs returns the subset of inputs the resolver's request template refers
+// to; its response depends on nothing else, so callers may share it between
+// evaluations with equal subsets.
+func (r Resolver) Inputs(inputs map[string]any) map[string]any {
+	out := map[string]any{}
+	for _, ref := range template.References(r.RequestTmpl) {
+		root, rest, _ := strings.Cut(ref, ".")
+		if root != "inputs" {
+			continue
+		}
+		if rest == "" {
+			return inputs
+		}
+		name, _, _ := strings.Cut(rest, ".")
+		if v, ok := inputs[name]; ok {
+			out[name] = v
+		}
 	}
-	facts := map[string]any{}
-	// Apply mappings
+	return out
+}
+
+// Fetch returns the resolver's response for its inputs: the configured
+// response_sample, until resolvers call their connectors.
+func (r Resolver) Fetch(ctx context.Context, inputs map[string]any) map[string]any {
+	return r.ResponseSample
+}
+
+// ApplyMappings evaluates each mapping's JMESPath against doc, applies its
+// transform and stores the value under its key. Errors on optional mappings
+// skip the key; errors on required mappings abort.
+func ApplyMappings(mappings []Mapping, doc map[string]any) (map[string]any, error) {
+	out := map[string]any{}
 	for _, m := range mappings {
 		val, err := jmes.Search(m.Path, doc)
 		if err != nil {
 			if m.Required {
-				return nil, err
+				return nil, fmt.Errorf("%s: %w", m.FactKey, err)
 			}
 			continue
 		}
@@ -89,16 +140,15 @@ func ResolveFacts(ctx context.Context, pool *pgxpool.Pool, tenantID, actionKey s
 			tv, terr := applyTransform(m.Transform, val, m.TransformArgs...)
 			if terr != nil {
 				if m.Required {
-					return nil, terr
+					return nil, fmt.Errorf("%s: %w", m.FactKey, terr)
 				}
 				continue
 			}
 			val = tv
 		}
-		facts[m.FactKey] = val
+		out[m.FactKey] = val
 	}
-
-	return facts, tx.Commit(ctx)
+	return out, nil
 }
 
 func loadResolvers(ctx context.Context, tx pgx.Tx, actionKey string) ([]Resolver, error) {
@@ -33,6 +33,7 @@ type Action struct {
 	ExecuteEndpoint           string            `json:"execute_endpoint,omitempty"`
 	ExecutionRequiresDecision bool              `json:"execution_requires_decision,omitempty"`
 	InputsSchema              map[string]any    `json:"inputs_schema,omitempty"`
+	OutputSchema              map[string]any    `json:"output_schema,omitempty"`
 	NeedsContract             bool              `json:"needs_contract,omitempty"`
 	AlternativesSupported     []string          `json:"alternatives_supported,omitempty"`
 	ProblemTypes              map[string]string `json:"problem_types,omitempty"`
@@ -84,6 +85,8 @@ func BuildManifest(ctx context.Context, cfg config.Config, t tenants.Tenant, reg
 	}
 	var actions []Action
 	if reg != nil {
+		// output schemas are best-effort; actions without one return raw upstream JSON
+		outputSchemas, _ := reg.LoadOutputSchemas(ctx, t.ID)
 		if ops, err := reg.LoadOperations(ctx, t.ID); err == nil {
 			for _, o := range ops {
 				scope := ""
@@ -126,6 +129,7 @@ func BuildManifest(ctx context.Context, cfg config.Config, t tenants.Tenant, reg
 					ExecuteEndpoint:           "/v1/actions/{key}/execute",
 					ExecutionRequiresDecision: true,
 					InputsSchema:              map[string]any{},
+					OutputSchema:              outputSchemas[key],
 					NeedsContract:             true,
 					AlternativesSupported:     []string{"create_checkout_link", "open_support_case"},
 					ProblemTypes: map[string]string{
@@ -0,0 +1,97 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Progress event types streamed on /v1/executions/{id}/events. Step and
+// compensation events carry the same records that end up in executions.steps.
+const (
+	EventStepStarted   = "step-started"
+	EventStepCompleted = "step-completed"
+	EventRetry         = "retry"
+	EventCompensation  = "compensation"
+	EventStatus        = "status" // execution status change; terminal statuses end the stream
+)
+
+// Event is one progress event; Seq orders events within an execution and is
+// used as the SSE event id for Last-Event-ID resume.
+type Event struct {
+	Seq  int64          `json:"seq"`
+	Type string         `json:"type"`
+	Data map[string]any `json:"data"`
+}
+
+// emitter receives progress events as the orchestrator produces them.
+type emitter func(typ string, data map[string]any)
+
+func (e emitter) send(typ string, data map[string]any) {
+	if e != nil {
+		e(typ, data)
+	}
+}
+
+// Terminal reports whether an execution status is final.
+func Terminal(status string) bool {
+	return status != StatusScheduled && status != StatusQueued && status != StatusRunning
+}
+
+// eventWriter returns an emitter that persists each event immediately,
+// continuing the sequence of events already stored for the execution
+// (a retried job appends to the events of earlier attempts).
+func eventWriter(ctx context.Context, pool *pgxpool.Pool, tenantID, executionID string) emitter {
+	var mu sync.Mutex
+	var seq int64
+	_ = pool.QueryRow(ctx, `WITH s AS (
+		SELECT set_config('app.tenant_id', $1, true)
+	) SELECT COALESCE(MAX(seq),0) FROM execution_events WHERE tenant_id=$1 AND execution_id=$2`, tenantID, executionID).Scan(&seq)
+	return func(typ string, data map[string]any) {
+		mu.Lock()
+		seq++
+		ev := Event{Seq: seq, Type: typ, Data: data}
+		mu.Unlock()
+		appendEvents(ctx, pool, tenantID, executionID, []Event{ev})
+	}
+}
+
+// appendEvents stores events for an execution; no-op without a database.
+func appendEvents(ctx context.Context, pool *pgxpool.Pool, tenantID, executionID string, events []Event) {
+	if pool == nil {
+		return
+	}
+	for _, ev := range events {
+		_, _ = pool.Exec(ctx, `WITH s AS (
+			SELECT set_config('app.tenant_id', $1, true)
+		) INSERT INTO execution_events(tenant_id, execution_id, seq, type, data)
+		  VALUES ($1,$2,$3,$4,$5) ON CONFLICT (execution_id, seq) DO NOTHING`, tenantID, executionID, ev.Seq, ev.Type, toJSON(ev.Data))
+	}
+}
+
+// ListEvents returns the execution's events after the given sequence number.
+func ListEvents(ctx context.Context, pool *pgxpool.Pool, tenantID, executionID string, after int64) ([]Event, error) {
+	if pool == nil {
+		return nil, nil
+	}
+	rows, err := pool.Query(ctx, `WITH s AS (
+		SELECT set_config('app.tenant_id', $1, true)
+	) SELECT seq, type, data FROM execution_events WHERE tenant_id=$1 AND execution_id=$2 AND seq>$3 ORDER BY seq`, tenantID, executionID, after)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Event
+	for rows.Next() {
+		var ev Event
+		var raw []byte
+		if err := rows.Scan(&ev.Seq, &ev.Type, &raw); err != nil {
+			return nil, err
+		}
+		_ = json.Unmarshal(raw, &ev.Data)
+		out = append(out, ev)
+	}
+	return out, rows.Err()
+}
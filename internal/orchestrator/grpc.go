@@ -0,0 +1,56 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+
+	"lamdis/pkg/grpcconn"
+	"lamdis/pkg/upstream"
+	"lamdis/pkg/upstreamauth"
+)
+
+// do performs a rendered request over the operation's protocol and returns
+// one step record per attempt plus the decoded response of the last one.
+func (op operation) do(ctx context.Context, rr renderedRequest, auth upstreamauth.Config, idemKey string, onRetry func(map[string]any)) ([]map[string]any, map[string]any) {
+	if op.Protocol == grpcconn.Protocol {
+		return doGRPC(ctx, op, rr, auth, idemKey, onRetry)
+	}
+	return doRequest(ctx, rr, auth, op.CallOptions, idemKey, onRetry)
+}
+
+// doGRPC performs a unary gRPC call. Attempt records carry the gRPC code as
+// grpc_code and its HTTP equivalent as status, so success criteria and the
+// failure classes apply as for HTTP: INVALID_ARGUMENT, NOT_FOUND and other
+// caller errors are client errors, DEADLINE_EXCEEDED a timeout, and
+// UNAVAILABLE, INTERNAL and the rest upstream errors.
+func doGRPC(ctx context.Context, op operation, rr renderedRequest, auth upstreamauth.Config, idemKey string, onRetry func(map[string]any)) ([]map[string]any, map[string]any) {
+	if op.Descriptors == nil {
+		return []map[string]any{{"op": "request", "method": rr.Method, "url": rr.LogURL, "error": "grpc descriptors are missing or invalid; re-import the connector", "error_kind": errKindInvalidRequest}}, nil
+	}
+	call := grpcconn.Call{Target: op.BaseURL, Method: rr.Method, Header: rr.Headers, Message: rr.Body, IdempotencyKey: idemKey}
+	if onRetry != nil {
+		call.OnRetry = func(at upstream.Attempt) { onRetry(attemptRecord(rr, at)) }
+	}
+	res, attempts, err := grpcconn.Invoke(ctx, upstream.Default, auth, op.Descriptors, call, op.CallOptions)
+	if errors.Is(err, grpcconn.ErrInvalidMessage) {
+		return []map[string]any{{"op": "request", "method": rr.Method, "url": rr.LogURL, "error": err.Error(), "error_kind": errKindInvalidRequest}}, nil
+	}
+	recs := make([]map[string]any, 0, len(attempts))
+	for _, at := range attempts {
+		recs = append(recs, attemptRecord(rr, at))
+	}
+	if len(recs) == 0 {
+		recs = append(recs, map[string]any{"op": "request", "method": rr.Method, "url": rr.LogURL, "error": "no_attempt"})
+		if err != nil {
+			recs[0]["error"] = err.Error()
+		}
+	}
+	if res == nil {
+		return recs, nil
+	}
+	last := recs[len(recs)-1]
+	if res.Detail != "" {
+		last["grpc_message"] = res.Detail
+	}
+	return recs, res.Body
+}
@@ -0,0 +1,395 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"lamdis/pkg/logger"
+	"lamdis/pkg/problems"
+	"lamdis/pkg/secrets"
+	"lamdis/pkg/upstreamauth"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Enqueue creates a QUEUED execution and its job row in one transaction and
+// returns the execution id. Workers pick the job up and perform the plan.
+func Enqueue(ctx context.Context, pool *pgxpool.Pool, tenantID, actionKey, decisionID string, input map[string]any) (string, error) {
+	return enqueue(ctx, pool, tenantID, actionKey, decisionID, input, nil)
+}
+
+// enqueue inserts the execution and job rows. With runAt set the execution is
+// SCHEDULED and the job only becomes claimable at runAt.
+func enqueue(ctx context.Context, pool *pgxpool.Pool, tenantID, actionKey, decisionID string, input map[string]any, runAt *time.Time) (string, error) {
+	status := StatusQueued
+	if runAt != nil {
+		status = StatusScheduled
+	}
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+	if _, err := tx.Exec(ctx, "SELECT set_config('app.tenant_id', $1, true)", tenantID); err != nil {
+		return "", err
+	}
+	var id string
+	// The requesting end user travels with the job so per-user credentials apply when it runs.
+	actor := upstreamauth.ActorFrom(ctx)
+	var subject []byte
+	if runAt == nil {
+		if subject, err = sealSubjectToken(ctx, tx, tenantID); err != nil {
+			return "", err
+		}
+	}
+	if err := tx.QueryRow(ctx, `INSERT INTO executions(tenant_id, action_key, decision_id, idempotency_key, status, run_at, actor_sub)
+		VALUES ($1,$2,$3,$4,$5,$6,$7) RETURNING id::text`, tenantID, actionKey, decisionID, idempotencyKeyFor(input, decisionID), status, runAt, nullIfEmpty(actor)).Scan(&id); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(ctx, `INSERT INTO execution_jobs(execution_id, tenant_id, action_key, decision_id, inputs, run_at, scheduled, actor_sub, subject_token_encrypted)
+		VALUES ($1,$2,$3,$4,$5,COALESCE($6,now()),$7,$8,$9)`, id, tenantID, actionKey, decisionID, toJSON(input), runAt, runAt != nil, actor, subject); err != nil {
+		return "", err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return "", err
+	}
+	data := map[string]any{"status": status}
+	if runAt != nil {
+		data["run_at"] = runAt
+	}
+	appendEvents(ctx, pool, tenantID, id, []Event{{Seq: 1, Type: EventStatus, Data: data}})
+	return id, nil
+}
+
+// sealSubjectToken returns the caller's token encrypted for the job row, or nil
+// when there is none or the tenant has no token_exchange config to use it.
+func sealSubjectToken(ctx context.Context, tx pgx.Tx, tenantID string) ([]byte, error) {
+	tok := upstreamauth.SubjectTokenFrom(ctx)
+	if tok == "" {
+		return nil, nil
+	}
+	var used bool
+	if err := tx.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM tenant_auth_configs WHERE tenant_id=$1 AND type=$2)`,
+		tenantID, upstreamauth.TypeTokenExchange).Scan(&used); err != nil || !used {
+		return nil, err
+	}
+	return secrets.Seal(map[string]any{"token": tok})
+}
+
+// GetExecution loads an execution by id for status polling.
+func GetExecution(ctx context.Context, pool *pgxpool.Pool, tenantID, id string) (ExecuteResult, bool) {
+	var res ExecuteResult
+	if pool == nil {
+		return res, false
+	}
+	var stepsRaw, resultRaw, probRaw []byte
+	var failure *string
+	row := pool.QueryRow(ctx, `WITH s AS (
+		SELECT set_config('app.tenant_id', $1, true)
+	) SELECT id::text, status, COALESCE(steps,'[]'::jsonb), COALESCE(result,'null'::jsonb), failure, COALESCE(problems,'[]'::jsonb)
+	  FROM executions WHERE tenant_id=$1 AND id=$2`, tenantID, id)
+	if err := row.Scan(&res.ID, &res.Status, &stepsRaw, &resultRaw, &failure, &probRaw); err != nil {
+		return res, false
+	}
+	_ = json.Unmarshal(stepsRaw, &res.Steps)
+	_ = json.Unmarshal(resultRaw, &res.Result)
+	_ = json.Unmarshal(probRaw, &res.Problems)
+	if failure != nil {
+		res.Failure = *failure
+	}
+	if res.Steps == nil {
+		res.Steps = []map[string]any{}
+	}
+	return res, true
+}
+
+// WorkerOptions configures the async execution worker pool.
+type WorkerOptions struct {
+	Concurrency  int           // parallel jobs per process; default 4
+	PollInterval time.Duration // idle wait between claims; default 1s
+	// VisibilityTimeout is the lease a worker holds on a claimed job. It is renewed
+	// while the job runs; if the worker dies the job becomes claimable again once
+	// the lease expires. Default 5m.
+	VisibilityTimeout time.Duration
+	// DrainTimeout is how long a run in flight at shutdown may keep going
+	// before its upstream calls are cancelled. Runs are finished rather than
+	// handed back, because a rerun would repeat completed steps whose upstreams
+	// do not deduplicate. Default 1m.
+	DrainTimeout time.Duration
+	// Revalidate re-checks a scheduled execution's decision when its job fires.
+	// A false result fails the execution with the returned problem instead of
+	// running the plan; otherwise the run uses the facts it returns. Nil skips
+	// the check.
+	Revalidate RevalidateFunc
+}
+
+// RevalidateFunc re-validates the decision bound to a scheduled execution and
+// returns the facts it was checked against, which the run then uses in place
+// of the facts stored on the decision (nil keeps those). It is supplied by the
+// policy layer, which the orchestrator cannot import.
+type RevalidateFunc func(ctx context.Context, tenantID, actionKey, decisionID string, inputs map[string]any) (facts map[string]any, ok bool, problem map[string]any)
+
+func (o WorkerOptions) withDefaults() WorkerOptions {
+	if o.Concurrency <= 0 {
+		o.Concurrency = 4
+	}
+	if o.PollInterval <= 0 {
+		o.PollInterval = time.Second
+	}
+	if o.VisibilityTimeout <= 0 {
+		o.VisibilityTimeout = 5 * time.Minute
+	}
+	if o.DrainTimeout <= 0 {
+		o.DrainTimeout = time.Minute
+	}
+	return o
+}
+
+// Worker claims execution jobs with FOR UPDATE SKIP LOCKED and performs them.
+type Worker struct {
+	pool *pgxpool.Pool
+	log  logger.Sugared
+	opts WorkerOptions
+	id   string
+}
+
+// NewWorker builds a worker pool; call Run to start it.
+func NewWorker(pool *pgxpool.Pool, log logger.Sugared, opts WorkerOptions) *Worker {
+	host, _ := os.Hostname()
+	return &Worker{pool: pool, log: log, opts: opts.withDefaults(), id: fmt.Sprintf("%s-%d", host, os.Getpid())}
+}
+
+// Run processes jobs until ctx is cancelled.
+func (w *Worker) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < w.opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.loop(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+type job struct {
+	ID, ExecutionID, TenantID, ActionKey, DecisionID string
+	ActorSub                                         string
+	SubjectToken                                     string
+	Inputs                                           map[string]any
+	Attempts, MaxAttempts                            int
+	Scheduled                                        bool
+}
+
+func (w *Worker) loop(ctx context.Context) {
+	for ctx.Err() == nil {
+		j, ok, err := w.claim(ctx)
+		if err != nil && ctx.Err() == nil {
+			w.log.Warnw("execution job claim failed", "err", err)
+		}
+		if !ok {
+			_ = sleepCtx(ctx, w.opts.PollInterval)
+			continue
+		}
+		w.process(ctx, j)
+	}
+}
+
+// claim leases the next ready job: queued and due, or running with an expired lease.
+func (w *Worker) claim(ctx context.Context) (job, bool, error) {
+	var j job
+	var inRaw, subject []byte
+	err := w.pool.QueryRow(ctx, `UPDATE execution_jobs SET status='running', attempts=attempts+1,
+		locked_until=now()+make_interval(secs => $1), locked_by=$2, updated_at=now()
+	WHERE id = (
+		SELECT id FROM execution_jobs
+		WHERE (status='queued' AND run_at<=now()) OR (status='running' AND locked_until<now())
+		ORDER BY run_at
+		FOR UPDATE SKIP LOCKED
+		LIMIT 1
+	) RETURNING id::text, execution_id::text, tenant_id::text, action_key, COALESCE(decision_id::text,''), inputs, attempts, max_attempts, scheduled, actor_sub, subject_token_encrypted`,
+		w.opts.VisibilityTimeout.Seconds(), w.id).Scan(&j.ID, &j.ExecutionID, &j.TenantID, &j.ActionKey, &j.DecisionID, &inRaw, &j.Attempts, &j.MaxAttempts, &j.Scheduled, &j.ActorSub, &subject)
+	if err == pgx.ErrNoRows {
+		return j, false, nil
+	}
+	if err != nil {
+		return j, false, err
+	}
+	_ = json.Unmarshal(inRaw, &j.Inputs)
+	if len(subject) > 0 {
+		if m, err := secrets.Open(subject); err == nil {
+			j.SubjectToken, _ = m["token"].(string)
+		}
+	}
+	return j, true, nil
+}
+
+func (w *Worker) process(ctx context.Context, j job) {
+	// A job claimed more often than allowed keeps killing its workers (or its
+	// leases keep expiring); park it instead of retrying forever.
+	if j.Attempts > j.MaxAttempts {
+		w.deadLetter(ctx, j, "exceeded max attempts")
+		return
+	}
+	// A scheduled execution was authorised when it was scheduled; policy, facts
+	// or the decision itself may have changed since, so check again before running.
+	var facts map[string]any
+	if j.Scheduled && w.opts.Revalidate != nil {
+		fa, ok, prob := w.opts.Revalidate(ctx, j.TenantID, j.ActionKey, j.DecisionID, j.Inputs)
+		if !ok {
+			w.reject(ctx, j, prob)
+			return
+		}
+		facts = fa
+	}
+	// From here the job is finished even if the worker is asked to stop: the
+	// run only loses its context DrainTimeout after shutdown starts, while the
+	// lease renewal and the bookkeeping writes outlive both.
+	stopping := ctx.Done()
+	ctx = context.WithoutCancel(ctx)
+	jobCtx, cancelJob := context.WithCancel(ctx)
+	defer cancelJob()
+	go func() {
+		select {
+		case <-jobCtx.Done():
+		case <-stopping:
+			select {
+			case <-jobCtx.Done():
+			case <-time.After(w.opts.DrainTimeout):
+				w.log.Warnw("execution job cancelled after drain timeout", "job", j.ID, "execution", j.ExecutionID)
+				cancelJob()
+			}
+		}
+	}()
+	hbCtx, stopHeartbeat := context.WithCancel(ctx)
+	defer stopHeartbeat()
+	go w.heartbeat(hbCtx, j)
+
+	w.setStatus(ctx, j, StatusRunning)
+	var (
+		res  ExecuteResult
+		idem string
+		raw  map[string]any
+		perr any
+	)
+	func() {
+		defer func() { perr = recover() }()
+		runCtx := upstreamauth.WithSubjectToken(upstreamauth.WithActor(jobCtx, j.ActorSub), j.SubjectToken)
+		res, idem, raw = run(runCtx, w.pool, j.TenantID, j.ActionKey, j.DecisionID, j.Inputs, facts, eventWriter(ctx, w.pool, j.TenantID, j.ExecutionID))
+	}()
+	if perr != nil {
+		w.log.Errorw("execution job panicked", "job", j.ID, "execution", j.ExecutionID, "panic", perr)
+		w.retry(ctx, j, fmt.Sprint(perr))
+		return
+	}
+	w.complete(ctx, j, res, idem, raw)
+}
+
+func (w *Worker) heartbeat(ctx context.Context, j job) {
+	t := time.NewTicker(w.opts.VisibilityTimeout / 3)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			_, _ = w.pool.Exec(ctx, `UPDATE execution_jobs SET locked_until=now()+make_interval(secs => $1), updated_at=now()
+				WHERE id=$2 AND locked_by=$3 AND status='running'`, w.opts.VisibilityTimeout.Seconds(), j.ID, w.id)
+		}
+	}
+}
+
+// setStatus records a non-terminal status change on the execution and its event stream.
+func (w *Worker) setStatus(ctx context.Context, j job, status string) {
+	_, _ = w.pool.Exec(ctx, `WITH s AS (
+		SELECT set_config('app.tenant_id', $1, true)
+	) UPDATE executions SET status=$2, updated_at=now() WHERE tenant_id=$1 AND id=$3`, j.TenantID, status, j.ExecutionID)
+	eventWriter(ctx, w.pool, j.TenantID, j.ExecutionID).send(EventStatus, map[string]any{"status": status, "attempt": j.Attempts})
+}
+
+func (w *Worker) complete(ctx context.Context, j job, res ExecuteResult, idem string, raw map[string]any) {
+	tx, err := w.pool.Begin(ctx)
+	if err != nil {
+		w.log.Errorw("execution job completion failed", "job", j.ID, "err", err)
+		return
+	}
+	defer tx.Rollback(ctx)
+	if _, err := tx.Exec(ctx, "SELECT set_config('app.tenant_id', $1, true)", j.TenantID); err != nil {
+		return
+	}
+	// A worker whose lease lapsed (and whose job another worker claimed) must
+	// not overwrite that worker's result.
+	tag, err := tx.Exec(ctx, `UPDATE execution_jobs SET status='done', locked_until=NULL, subject_token_encrypted=NULL, updated_at=now()
+		WHERE id=$1 AND locked_by=$2 AND status='running'`, j.ID, w.id)
+	if err != nil {
+		w.log.Errorw("execution job completion failed", "job", j.ID, "err", err)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		w.log.Warnw("execution job lease lost before completion", "job", j.ID, "execution", j.ExecutionID)
+		return
+	}
+	if _, err := tx.Exec(ctx, `UPDATE executions SET steps=$2, result=$3, status=$4, failure=$5, raw_response=$6, problems=$7, idempotency_key=$8, updated_at=now()
+		WHERE id=$1`, j.ExecutionID, toJSON(res.Steps), toJSON(res.Result), res.Status, nullIfEmpty(res.Failure), toJSON(raw), toJSON(res.Problems), idem); err != nil {
+		w.log.Errorw("execution job completion failed", "job", j.ID, "err", err)
+		return
+	}
+	_ = tx.Commit(ctx)
+}
+
+// retry schedules the job again with exponential backoff, or dead-letters it
+// once its attempts are spent.
+func (w *Worker) retry(ctx context.Context, j job, reason string) {
+	if j.Attempts >= j.MaxAttempts {
+		w.deadLetter(ctx, j, reason)
+		return
+	}
+	delay := time.Duration(1<<uint(j.Attempts)) * time.Second
+	_, _ = w.pool.Exec(ctx, `UPDATE execution_jobs SET status='queued', locked_until=NULL, locked_by=NULL, last_error=$2,
+		run_at=now()+make_interval(secs => $3), updated_at=now() WHERE id=$1`, j.ID, reason, delay.Seconds())
+	w.setStatus(ctx, j, StatusQueued)
+}
+
+func (w *Worker) deadLetter(ctx context.Context, j job, reason string) {
+	w.log.Warnw("execution job dead-lettered", "job", j.ID, "execution", j.ExecutionID, "reason", reason)
+	_, _ = w.pool.Exec(ctx, `UPDATE execution_jobs SET status='dead', locked_until=NULL, last_error=$2, subject_token_encrypted=NULL, updated_at=now() WHERE id=$1`, j.ID, reason)
+	probs := []Problem{{
+		Type:   problems.Type("execution-dead-lettered"),
+		Title:  "Execution abandoned after repeated failures",
+		Detail: reason,
+	}}
+	_, _ = w.pool.Exec(ctx, `WITH s AS (
+		SELECT set_config('app.tenant_id', $1, true)
+	) UPDATE executions SET status=$2, failure=$3, problems=$4, result=$5, updated_at=now() WHERE tenant_id=$1 AND id=$6`,
+		j.TenantID, StatusFailed, FailureUpstreamError, toJSON(probs), toJSON(map[string]any{"ok": false}), j.ExecutionID)
+	eventWriter(ctx, w.pool, j.TenantID, j.ExecutionID).send(EventStatus, map[string]any{"status": StatusFailed, "failure": FailureUpstreamError, "reason": reason})
+}
+
+// reject fails a scheduled execution whose decision no longer holds.
+func (w *Worker) reject(ctx context.Context, j job, prob map[string]any) {
+	str := func(k string) string { s, _ := prob[k].(string); return s }
+	p := Problem{Type: str("type"), Title: str("title"), Detail: str("detail")}
+	w.log.Infow("scheduled execution rejected", "job", j.ID, "execution", j.ExecutionID, "problem", p.Type)
+	_, _ = w.pool.Exec(ctx, `UPDATE execution_jobs SET status='done', locked_until=NULL, last_error=$2, subject_token_encrypted=NULL, updated_at=now() WHERE id=$1`, j.ID, p.Title)
+	_, _ = w.pool.Exec(ctx, `WITH s AS (
+		SELECT set_config('app.tenant_id', $1, true)
+	) UPDATE executions SET status=$2, failure=$3, problems=$4, result=$5, updated_at=now() WHERE tenant_id=$1 AND id=$6`,
+		j.TenantID, StatusFailed, FailurePolicy, toJSON([]Problem{p}), toJSON(map[string]any{"ok": false}), j.ExecutionID)
+	eventWriter(ctx, w.pool, j.TenantID, j.ExecutionID).send(EventStatus, map[string]any{"status": StatusFailed, "failure": FailurePolicy, "problem": p})
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -0,0 +1,523 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"lamdis/pkg/graphql"
+	"lamdis/pkg/grpcconn"
+	"lamdis/pkg/template"
+	"lamdis/pkg/upstream"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	jmes "github.com/jmespath/go-jmespath"
+)
+
+// Plan is the ordered list of steps an action performs when executed.
+// It is stored in actions.flow as { "steps": [...] }; actions without a plan
+// execute a single step bound to the operation matching the action key.
+type Plan struct {
+	Steps []PlanStep `json:"steps"`
+}
+
+// PlanStep binds one connector operation into a plan.
+//   - Action selects the operation using the same <namespace>.<short> key scheme
+//     as the manifest; empty means the executing action itself.
+//   - When is an optional JMESPath condition evaluated against
+//     { inputs, steps }; the step is skipped when it yields a falsy value.
+//   - RequestTmpl overrides the operation's request_tmpl for this step.
+//   - Compensate optionally undoes the step when a later step fails.
+//
+// Templates may reference earlier step outputs as {{steps.<name>.response.<path>}}
+// in addition to inputs, facts, decision and secrets (see pkg/template).
+type PlanStep struct {
+	Name        string         `json:"name"`
+	Action      string         `json:"action,omitempty"`
+	When        string         `json:"when,omitempty"`
+	RequestTmpl map[string]any `json:"request_tmpl,omitempty"`
+	Compensate  *Compensation  `json:"compensate,omitempty"`
+}
+
+// Compensation is the operation that reverses a completed step (saga rollback).
+// Its template is rendered with the forward step's output available as
+// {{response.<path>}} and {{status}}, in addition to inputs and earlier steps.
+type Compensation struct {
+	Action      string         `json:"action"`
+	RequestTmpl map[string]any `json:"request_tmpl,omitempty"`
+}
+
+// operation is a resolved connector operation ready to be rendered into a request.
+type operation struct {
+	BaseURL     string
+	Method      string
+	Path        string
+	Tmpl        map[string]any
+	CallOptions upstream.CallOptions
+	Success     SuccessCriteria
+	AuthRef     string // tenant_auth_configs.id applied to requests; templates may also reference its secrets
+	Protocol    string // connector_definitions.config.protocol: "graphql", "grpc" or empty for plain HTTP
+	// Descriptors of gRPC connectors; nil when the stored descriptor set is missing or invalid.
+	Descriptors *grpcconn.Descriptors
+}
+
+var (
+	capRe      = regexp.MustCompile(`([a-z0-9])([A-Z])`)
+	nonAlnumRe = regexp.MustCompile(`[^a-zA-Z0-9]+`)
+	dupDashRe  = regexp.MustCompile(`-+`)
+	pathVarRe  = regexp.MustCompile(`\{([a-zA-Z0-9_]+)\}`)
+)
+
+func slug(s string) string {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return s
+	}
+	s = capRe.ReplaceAllString(s, `$1-$2`)
+	s = nonAlnumRe.ReplaceAllString(s, "-")
+	s = strings.ToLower(strings.Trim(s, "-"))
+	return dupDashRe.ReplaceAllString(s, "-")
+}
+
+// deriveShort mirrors the manifest's action naming: last static path segment.
+func deriveShort(p string) string {
+	p = strings.Split(p, "?")[0]
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return "root"
+	}
+	segs := strings.Split(p, "/")
+	for i := len(segs) - 1; i >= 0; i-- {
+		s := segs[i]
+		if strings.Contains(s, "{") || strings.Contains(s, "}") || s == "v1" {
+			continue
+		}
+		s = slug(s)
+		if s != "" {
+			return s
+		}
+	}
+	return "action"
+}
+
+// Validate reports step conditions that are not valid JMESPath and request
+// templates with broken placeholders, so plans are checked when saved rather
+// than failing executions.
+func (p Plan) Validate() error {
+	for i, ps := range p.Steps {
+		if strings.TrimSpace(ps.When) != "" {
+			if _, err := jmes.Compile(ps.When); err != nil {
+				return fmt.Errorf("steps[%d].when: %v", i, err)
+			}
+		}
+		if err := template.Validate(ps.RequestTmpl); err != nil {
+			return fmt.Errorf("steps[%d].request_tmpl: %w", i, err)
+		}
+		if c := ps.Compensate; c != nil {
+			if strings.TrimSpace(c.Action) == "" {
+				return fmt.Errorf("steps[%d].compensate: missing action", i)
+			}
+			if err := template.Validate(c.RequestTmpl); err != nil {
+				return fmt.Errorf("steps[%d].compensate.request_tmpl: %w", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// loadPlan reads the execution plan for an action, falling back to a single step.
+func loadPlan(ctx context.Context, pool *pgxpool.Pool, tenantID, actionKey string) Plan {
+	var plan Plan
+	if pool != nil {
+		var raw []byte
+		row := pool.QueryRow(ctx, `WITH s AS (
+			SELECT set_config('app.tenant_id', $1, true)
+		) SELECT COALESCE(flow,'{}'::jsonb) FROM actions WHERE tenant_id=$1 AND key=$2`, tenantID, actionKey)
+		if err := row.Scan(&raw); err == nil {
+			_ = json.Unmarshal(raw, &plan)
+		}
+	}
+	if len(plan.Steps) == 0 {
+		return Plan{Steps: []PlanStep{{Name: "request", Action: actionKey}}}
+	}
+	for i := range plan.Steps {
+		if strings.TrimSpace(plan.Steps[i].Name) == "" {
+			plan.Steps[i].Name = fmt.Sprintf("step%d", i+1)
+		}
+		if strings.TrimSpace(plan.Steps[i].Action) == "" {
+			plan.Steps[i].Action = actionKey
+		}
+	}
+	return plan
+}
+
+// resolveOperation finds the enabled connector operation for an action key by
+// splitting it into <namespace>.<short>. The namespace comes from the slugified
+// connector kind or title; short is derived from the last static path segment.
+func resolveOperation(ctx context.Context, pool *pgxpool.Pool, tenantID, actionKey string) (operation, bool) {
+	var op operation
+	if pool == nil {
+		return op, false
+	}
+	ns := actionKey
+	short := ""
+	if i := strings.Index(actionKey, "."); i >= 0 {
+		ns = actionKey[:i]
+		if i+1 < len(actionKey) {
+			short = actionKey[i+1:]
+		}
+	}
+	rows, err := pool.Query(ctx, `WITH s AS (
+		SELECT set_config('app.tenant_id', $1, true)
+	) SELECT COALESCE(d.base_url,''), o.method, o.path, COALESCE(o.request_tmpl,'{}'::jsonb), COALESCE(o.call_options,'{}'::jsonb), COALESCE(o.success_criteria,'{}'::jsonb), d.kind, COALESCE(d.title,''), COALESCE(d.auth_ref::text,''), COALESCE(d.config->>'protocol',''), d.id::text
+	FROM connector_operations o
+	JOIN connector_definitions d ON o.connector_id=d.id
+	WHERE d.tenant_id=$1 AND COALESCE(o.enabled,true)=true`, tenantID)
+	if err != nil {
+		return op, false
+	}
+	defer rows.Close()
+	var tmplRaw, optsRaw, succRaw []byte
+	var connectorID string
+	var fallbackSet bool
+	for rows.Next() {
+		var (
+			b     string
+			m     string
+			p     string
+			tr    []byte
+			co    []byte
+			sc    []byte
+			kind  string
+			title string
+			auth  string
+			proto string
+			defID string
+		)
+		if scanErr := rows.Scan(&b, &m, &p, &tr, &co, &sc, &kind, &title, &auth, &proto, &defID); scanErr != nil {
+			continue
+		}
+		if slug(kind) != ns && slug(title) != ns {
+			continue
+		}
+		candShort := deriveShort(p)
+		if candShort == short || !fallbackSet {
+			op.BaseURL, op.Method, op.Path, op.AuthRef, op.Protocol, connectorID, tmplRaw, optsRaw, succRaw = b, m, p, auth, proto, defID, tr, co, sc
+			if candShort == short {
+				break
+			} // best match
+			fallbackSet = true
+		}
+	}
+	if op.Method == "" || op.Path == "" {
+		return op, false
+	}
+	_ = json.Unmarshal(tmplRaw, &op.Tmpl)
+	_ = json.Unmarshal(optsRaw, &op.CallOptions)
+	_ = json.Unmarshal(succRaw, &op.Success)
+	if op.Tmpl == nil {
+		op.Tmpl = map[string]any{}
+	}
+	if op.Protocol == grpcconn.Protocol {
+		rows.Close()
+		var set string
+		_ = pool.QueryRow(ctx, `WITH s AS (
+			SELECT set_config('app.tenant_id', $1, true)
+		) SELECT COALESCE(config->'grpc'->>'descriptor_set','') FROM connector_definitions WHERE tenant_id=$1 AND id::text=$2`, tenantID, connectorID).Scan(&set)
+		op.Descriptors, _ = grpcconn.DecodeDescriptors(set)
+	}
+	return op, true
+}
+
+// renderedRequest is an operation rendered against the execution scope.
+type renderedRequest struct {
+	Method string
+	URL    string
+	// LogURL is URL as kept in step records and progress events: the path
+	// template and the query parameter names only, since rendered values may
+	// carry secrets.
+	LogURL  string
+	Headers map[string]string
+	Body    any
+}
+
+// errUnresolvedPath reports path placeholders left unbound after rendering.
+var errUnresolvedPath = errors.New("unresolved path parameters")
+
+// render resolves the template against scope and builds the outgoing request.
+// The body is rendered as a JSON tree so nested objects, arrays and typed values
+// survive; headers, query and path params are rendered as strings.
+func render(op operation, tmpl map[string]any, scope map[string]any) (renderedRequest, error) {
+	switch op.Protocol {
+	case graphql.Protocol:
+		return renderGraphQL(op, tmpl, scope)
+	case grpcconn.Protocol:
+		return renderGRPC(op, tmpl, scope)
+	}
+	out := renderedRequest{Method: op.Method}
+	var err error
+	fullURL := strings.TrimRight(op.BaseURL, "/") + op.Path
+	if out.Headers, err = renderHeaders(tmpl, scope); err != nil {
+		return out, err
+	}
+	query := url.Values{}
+	if qv, ok := tmpl["query"].(map[string]any); ok {
+		// stable order for testing/logging
+		keys := make([]string, 0, len(qv))
+		for k := range qv {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			v, err := template.Render(qv[k], scope)
+			if err != nil {
+				return out, fmt.Errorf("query.%s: %w", k, err)
+			}
+			// Optional parameters bound to absent inputs are left out rather than sent empty.
+			if v == nil {
+				continue
+			}
+			if arr, ok := v.([]any); ok {
+				for _, it := range arr {
+					query.Add(k, template.Stringify(it))
+				}
+				continue
+			}
+			query.Set(k, template.Stringify(v))
+		}
+	}
+	if bv, ok := tmpl["body"]; ok && bv != nil {
+		b, err := template.Render(bv, scope)
+		if err != nil {
+			return out, fmt.Errorf("body: %w", err)
+		}
+		out.Body = b
+	}
+	out.LogURL = logURL(fullURL, query)
+	if pv, ok := tmpl["path_params"].(map[string]any); ok {
+		var perr error
+		fullURL = pathVarRe.ReplaceAllStringFunc(fullURL, func(m string) string {
+			name := strings.Trim(m, "{}")
+			if raw, ok := pv[name]; ok {
+				s, err := template.RenderString(template.Stringify(raw), scope)
+				if err != nil && perr == nil {
+					perr = fmt.Errorf("path_params.%s: %w", name, err)
+				}
+				if val := url.PathEscape(s); val != "" {
+					return val
+				}
+			}
+			// leave curly braces to surface error
+			return m
+		})
+		if perr != nil {
+			return out, perr
+		}
+	}
+	out.URL = fullURL
+	if strings.Contains(fullURL, "{") {
+		return out, errUnresolvedPath
+	}
+	if enc := query.Encode(); enc != "" {
+		if strings.Contains(out.URL, "?") {
+			out.URL += "&" + enc
+		} else {
+			out.URL += "?" + enc
+		}
+	}
+	return out, nil
+}
+
+// logURL is raw with query values dropped, followed by the names in query.
+func logURL(raw string, query url.Values) string {
+	base, q, _ := strings.Cut(raw, "?")
+	seen := map[string]bool{}
+	var names []string
+	add := func(name string) {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for _, kv := range strings.Split(q, "&") {
+		name, _, _ := strings.Cut(kv, "=")
+		add(name)
+	}
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		add(url.QueryEscape(k))
+	}
+	if len(names) == 0 {
+		return base
+	}
+	return base + "?" + strings.Join(names, "&")
+}
+
+// renderHeaders renders the template's headers section.
+func renderHeaders(tmpl map[string]any, scope map[string]any) (map[string]string, error) {
+	out := map[string]string{}
+	if hv, ok := tmpl["headers"].(map[string]any); ok {
+		for k, v := range hv {
+			s, err := template.RenderString(template.Stringify(v), scope)
+			if err != nil {
+				return out, fmt.Errorf("headers.%s: %w", k, err)
+			}
+			out[k] = s
+		}
+	}
+	return out, nil
+}
+
+// renderGraphQL builds the POST of a GraphQL operation to the connector's
+// endpoint. Variables keep their JSON types; optional variables bound to absent
+// inputs are left out so the server applies its defaults.
+func renderGraphQL(op operation, tmpl map[string]any, scope map[string]any) (renderedRequest, error) {
+	out := renderedRequest{Method: http.MethodPost, URL: op.BaseURL, LogURL: logURL(op.BaseURL, nil)}
+	var err error
+	if out.Headers, err = renderHeaders(tmpl, scope); err != nil {
+		return out, err
+	}
+	spec, ok := graphql.SpecFrom(tmpl)
+	if !ok {
+		return out, errors.New("graphql.query is missing")
+	}
+	vars := map[string]any{}
+	for k, v := range spec.Variables {
+		rv, err := template.Render(v, scope)
+		if err != nil {
+			return out, fmt.Errorf("graphql.variables.%s: %w", k, err)
+		}
+		if rv != nil {
+			vars[k] = rv
+		}
+	}
+	out.Body = graphql.Body(spec.Query, spec.OperationName, vars)
+	return out, nil
+}
+
+// renderGRPC builds a unary gRPC call: Method is the full method name, URL the
+// target and method for step records, Headers the metadata and Body the
+// message as JSON. Fields bound to absent inputs are left unset.
+func renderGRPC(op operation, tmpl map[string]any, scope map[string]any) (renderedRequest, error) {
+	out := renderedRequest{}
+	var err error
+	if out.Headers, err = renderHeaders(tmpl, scope); err != nil {
+		return out, err
+	}
+	spec, ok := grpcconn.SpecFrom(tmpl)
+	if !ok {
+		return out, errors.New("grpc.method is missing")
+	}
+	out.Method, out.URL = spec.Method, strings.TrimRight(op.BaseURL, "/")+spec.Method
+	out.LogURL = out.URL
+	msg := map[string]any{}
+	for k, v := range spec.Message {
+		rv, err := template.Render(v, scope)
+		if err != nil {
+			return out, fmt.Errorf("grpc.message.%s: %w", k, err)
+		}
+		if rv != nil {
+			msg[k] = rv
+		}
+	}
+	out.Body = msg
+	return out, nil
+}
+
+// execContext is the per-execution data templates may reference besides step outputs.
+type execContext struct {
+	inputs   map[string]any
+	facts    map[string]any
+	decision map[string]any
+}
+
+// loadDecision reads the bound decision so templates can use its facts and metadata.
+func loadDecision(ctx context.Context, pool *pgxpool.Pool, tenantID, decisionID string, input map[string]any) execContext {
+	ec := execContext{inputs: input, facts: map[string]any{}, decision: map[string]any{"id": decisionID}}
+	if pool == nil || decisionID == "" {
+		return ec
+	}
+	var status string
+	var ver int
+	var inRaw, factsRaw []byte
+	row := pool.QueryRow(ctx, `WITH s AS (
+		SELECT set_config('app.tenant_id', $1, true)
+	) SELECT status, policy_version, COALESCE(inputs,'{}'::jsonb), COALESCE(facts,'{}'::jsonb) FROM decisions WHERE tenant_id=$1 AND id=$2`, tenantID, decisionID)
+	if err := row.Scan(&status, &ver, &inRaw, &factsRaw); err != nil {
+		return ec
+	}
+	var decInputs map[string]any
+	_ = json.Unmarshal(inRaw, &decInputs)
+	_ = json.Unmarshal(factsRaw, &ec.facts)
+	ec.decision["status"] = status
+	ec.decision["policy_version"] = float64(ver)
+	ec.decision["inputs"] = decInputs
+	ec.decision["facts"] = ec.facts
+	return ec
+}
+
+// stepScope exposes inputs at the top level (legacy {{key}} placeholders) and
+// under "inputs", alongside facts, decision, the operation's secrets and completed
+// step outputs under "steps".
+func stepScope(ec execContext, outputs map[string]any, sec map[string]any) map[string]any {
+	scope := make(map[string]any, len(ec.inputs)+5)
+	for k, v := range ec.inputs {
+		scope[k] = v
+	}
+	scope["inputs"] = ec.inputs
+	scope["facts"] = ec.facts
+	scope["decision"] = ec.decision
+	scope["secrets"] = sec
+	scope["steps"] = outputs
+	return scope
+}
+
+// compensationScope extends the step scope with the forward step's own output.
+func compensationScope(ec execContext, outputs map[string]any, sec map[string]any, own map[string]any) map[string]any {
+	scope := stepScope(ec, outputs, sec)
+	for k, v := range own {
+		scope[k] = v
+	}
+	return scope
+}
+
+// shouldRun evaluates a step's When condition; empty conditions always run.
+func shouldRun(when string, input map[string]any, outputs map[string]any) (bool, error) {
+	if strings.TrimSpace(when) == "" {
+		return true, nil
+	}
+	v, err := jmes.Search(when, map[string]any{"inputs": input, "steps": outputs})
+	if err != nil {
+		return false, err
+	}
+	return truthy(v), nil
+}
+
+func truthy(v any) bool {
+	switch t := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return t
+	case string:
+		return t != ""
+	case float64:
+		return t != 0
+	case []any:
+		return len(t) > 0
+	case map[string]any:
+		return len(t) > 0
+	default:
+		return true
+	}
+}
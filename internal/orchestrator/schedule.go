@@ -0,0 +1,89 @@
+package orchestrator
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Schedule creates a SCHEDULED execution whose job fires at runAt. The caller
+// is responsible for validating the decision now; the worker re-validates it
+// through WorkerOptions.Revalidate when the job fires.
+func Schedule(ctx context.Context, pool *pgxpool.Pool, tenantID, actionKey, decisionID string, input map[string]any, runAt time.Time) (string, error) {
+	return enqueue(ctx, pool, tenantID, actionKey, decisionID, input, &runAt)
+}
+
+// ScheduledExecution is a pending scheduled execution as listed for admins.
+type ScheduledExecution struct {
+	ID         string    `json:"id"`
+	ActionKey  string    `json:"action_key"`
+	DecisionID string    `json:"decision_id"`
+	RunAt      time.Time `json:"run_at"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// ListScheduled returns the tenant's executions still waiting to fire, soonest first.
+func ListScheduled(ctx context.Context, pool *pgxpool.Pool, tenantID string, limit int) ([]ScheduledExecution, error) {
+	out := []ScheduledExecution{}
+	if pool == nil {
+		return out, nil
+	}
+	rows, err := pool.Query(ctx, `WITH s AS (
+		SELECT set_config('app.tenant_id', $1, true)
+	) SELECT id::text, action_key, COALESCE(decision_id::text,''), run_at, created_at
+	  FROM executions WHERE tenant_id=$1 AND status=$2 AND run_at IS NOT NULL
+	  ORDER BY run_at, id LIMIT $3`, tenantID, StatusScheduled, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var x ScheduledExecution
+		if err := rows.Scan(&x.ID, &x.ActionKey, &x.DecisionID, &x.RunAt, &x.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, x)
+	}
+	return out, rows.Err()
+}
+
+// CancelScheduled cancels a scheduled execution that has not fired yet. It
+// reports false when the execution is unknown or already picked up by a worker.
+func CancelScheduled(ctx context.Context, pool *pgxpool.Pool, tenantID, id string) (bool, error) {
+	if pool == nil {
+		return false, nil
+	}
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+	if _, err := tx.Exec(ctx, "SELECT set_config('app.tenant_id', $1, true)", tenantID); err != nil {
+		return false, err
+	}
+	// Lock the job first: a worker claiming it concurrently either wins (status is
+	// no longer queued) or waits for this transaction and skips the cancelled row.
+	var jobID string
+	err = tx.QueryRow(ctx, `UPDATE execution_jobs SET status='cancelled', locked_until=NULL, updated_at=now()
+		WHERE execution_id=$1 AND tenant_id=$2 AND scheduled AND status='queued' RETURNING id::text`, id, tenantID).Scan(&jobID)
+	if err == pgx.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	tag, err := tx.Exec(ctx, `UPDATE executions SET status=$2, updated_at=now() WHERE id=$1 AND status=$3 AND tenant_id=$4`, id, StatusCancelled, StatusScheduled, tenantID)
+	if err != nil {
+		return false, err
+	}
+	if tag.RowsAffected() == 0 {
+		return false, nil
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return false, err
+	}
+	eventWriter(ctx, pool, tenantID, id).send(EventStatus, map[string]any{"status": StatusCancelled})
+	return true, nil
+}
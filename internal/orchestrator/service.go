@@ -1,25 +1,26 @@
 package orchestrator
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"net/http"
-	"net/url"
-	"regexp"
-	"sort"
-	"strings"
+	"time"
 
+	"lamdis/pkg/connectors"
 	"lamdis/pkg/problems"
+	"lamdis/pkg/upstream"
+	"lamdis/pkg/upstreamauth"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 type ExecuteResult struct {
+	ID       string           `json:"execution_id,omitempty"`
 	Steps    []map[string]any `json:"steps"`
 	Result   map[string]any   `json:"result"`
 	Status   string           `json:"status"`
+	Failure  string           `json:"failure,omitempty"` // failure class when Status is not SUCCEEDED
 	Problems []Problem        `json:"problems,omitempty"`
 }
 
@@ -30,288 +31,407 @@ type Problem struct {
 	Step   string `json:"step,omitempty"`
 }
 
-// Execute binds to a prior decision id and performs side-effects via connector service (stubbed here).
+// Execution statuses persisted to executions.status.
+const (
+	StatusScheduled = "SCHEDULED" // execution deferred until its run_at
+	StatusQueued    = "QUEUED"    // async execution accepted, waiting for a worker
+	StatusRunning   = "RUNNING"   // async execution claimed by a worker
+	StatusSucceeded = "SUCCEEDED"
+	StatusFailed    = "FAILED"
+	// StatusPartial means upstream effects took place but the action did not
+	// complete: a later plan step failed, or the result broke the output contract.
+	StatusPartial = "PARTIAL"
+	// StatusRolledBack means a step failed and every completed step was
+	// compensated successfully, leaving upstream systems consistent.
+	StatusRolledBack = "ROLLED_BACK"
+	// StatusCompensationFailed means a step failed and at least one compensation
+	// also failed; upstream systems may be inconsistent and need manual repair.
+	StatusCompensationFailed = "COMPENSATION_FAILED"
+	StatusCancelled          = "CANCELLED" // scheduled execution cancelled before it fired
+)
+
+// Execute binds to a prior decision id and performs the action's plan against connector operations.
+// Each plan step renders its operation's request_tmpl against the inputs and earlier step outputs.
+// When the action declares an output contract the result is shaped and validated against it.
 func Execute(ctx context.Context, pool *pgxpool.Pool, tenantID, actionKey, decisionID string, input map[string]any) (ExecuteResult, error) {
-	// Idempotency key: allow clients to pass one; else derive weak key from decisionID
-	idempotencyKey := ""
-	if v, ok := input["idempotency_key"].(string); ok {
-		idempotencyKey = v
+	// Synchronous executions have no id until persisted; their progress events
+	// are buffered and written afterwards so the event stream can replay them.
+	var buffered []Event
+	emit := func(typ string, data map[string]any) {
+		buffered = append(buffered, Event{Seq: int64(len(buffered) + 1), Type: typ, Data: data})
 	}
-	if idempotencyKey == "" {
-		idempotencyKey = decisionID
+	res, idempotencyKey, raw := run(ctx, pool, tenantID, actionKey, decisionID, input, nil, emit)
+	res.ID = persistExecution(ctx, pool, tenantID, actionKey, decisionID, idempotencyKey, res, raw)
+	if res.ID != "" {
+		appendEvents(ctx, pool, tenantID, res.ID, buffered)
 	}
-	// Resolve connector operation by splitting actionKey: <namespace>.<short>
-	// namespace comes from slugified connector kind; short derived from last static segment of path.
-	var (
-		baseURL string
-		method  string
-		path    string
-		tmplRaw []byte
-	)
-	ns := actionKey
-	short := ""
-	if i := strings.Index(actionKey, "."); i >= 0 {
-		ns = actionKey[:i]
-		if i+1 < len(actionKey) {
-			short = actionKey[i+1:]
-		}
+	return res, nil
+}
+
+// run performs the plan and returns the result, the idempotency key used for
+// upstream calls and the raw last upstream response; it does not persist.
+// Non-nil facts replace the decision's stored facts (see RevalidateFunc).
+// Every step record is also emitted as a progress event as it is produced.
+func run(ctx context.Context, pool *pgxpool.Pool, tenantID, actionKey, decisionID string, input, facts map[string]any, emit emitter) (ExecuteResult, string, map[string]any) {
+	idempotencyKey := idempotencyKeyFor(input, decisionID)
+	// Every upstream call of this execution is held to the tenant's egress policy
+	// and counted against the tenant's own circuit breakers.
+	ctx = upstream.WithTenant(upstream.WithEgress(ctx, connectors.LoadEgressPolicy(ctx, pool, tenantID)), tenantID)
+	plan := loadPlan(ctx, pool, tenantID, actionKey)
+	ec := loadDecision(ctx, pool, tenantID, decisionID, input)
+	if facts != nil {
+		ec.facts = facts
+		ec.decision["facts"] = facts
 	}
-	slug := func(s string) string {
-		s = strings.TrimSpace(s)
-		if s == "" {
-			return s
-		}
-		capRe := regexp.MustCompile(`([a-z0-9])([A-Z])`)
-		s = capRe.ReplaceAllString(s, `$1-$2`)
-		non := regexp.MustCompile(`[^a-zA-Z0-9]+`)
-		s = non.ReplaceAllString(s, "-")
-		s = strings.ToLower(strings.Trim(s, "-"))
-		dh := regexp.MustCompile(`-+`)
-		s = dh.ReplaceAllString(s, "-")
-		return s
+	steps := []map[string]any{}
+	// record appends a finished step record and streams it.
+	record := func(rec map[string]any) {
+		steps = append(steps, rec)
+		emit.send(EventStepCompleted, rec)
 	}
-	deriveShort := func(p string) string {
-		p = strings.Split(p, "?")[0]
-		p = strings.Trim(p, "/")
-		if p == "" {
-			return "root"
-		}
-		segs := strings.Split(p, "/")
-		for i := len(segs) - 1; i >= 0; i-- {
-			s := segs[i]
-			if strings.Contains(s, "{") || strings.Contains(s, "}") || s == "v1" {
-				continue
-			}
-			s = slug(s)
-			if s != "" {
-				return s
-			}
+	problemList := []Problem{}
+	outputs := map[string]any{}
+	var result map[string]any
+	var done []PlanStep // completed forward steps, in order
+	failed := false
+	shapeFailed := false // steps succeeded but the result broke the output contract
+	failure := ""
+	for _, ps := range plan.Steps {
+		run, err := shouldRun(ps.When, input, outputs)
+		if err != nil {
+			record(map[string]any{"op": "request", "step": ps.Name, "error": "invalid_condition"})
+			problemList = append(problemList, Problem{
+				Type:   problems.Type("invalid-plan"),
+				Title:  "Invalid step condition",
+				Detail: err.Error(),
+				Step:   ps.Name,
+			})
+			failed, failure = true, FailureClientError
+			break
 		}
-		return "action"
-	}
-	if pool != nil {
-		rows, err := pool.Query(ctx, `WITH s AS (
-			SELECT set_config('app.tenant_id', $1, true)
-		) SELECT COALESCE(d.base_url,''), o.method, o.path, COALESCE(o.request_tmpl,'{}'::jsonb), d.kind, COALESCE(d.title,'')
-		FROM connector_operations o
-		JOIN connector_definitions d ON o.connector_id=d.id
-		WHERE d.tenant_id=$1 AND COALESCE(o.enabled,true)=true`, tenantID)
-		if err == nil {
-			defer rows.Close()
-			var fallbackSet bool
-			for rows.Next() {
-				var (
-					b     string
-					m     string
-					p     string
-					tr    []byte
-					kind  string
-					title string
-				)
-				if scanErr := rows.Scan(&b, &m, &p, &tr, &kind, &title); scanErr != nil {
-					continue
-				}
-				kSlug := slug(kind)
-				tSlug := slug(title)
-				if kSlug != ns && tSlug != ns {
-					continue
-				}
-				candShort := deriveShort(p)
-				if candShort == short || !fallbackSet {
-					baseURL, method, path, tmplRaw = b, m, p, tr
-					if candShort == short {
-						break
-					} // best match
-					fallbackSet = true
-				}
-			}
+		if !run {
+			record(map[string]any{"op": "request", "step": ps.Name, "skipped": true})
+			continue
 		}
-	}
-	// If we couldn't resolve any operation, return a problem
-	if method == "" || path == "" {
-		res := ExecuteResult{
-			Steps:  []map[string]any{{"op": "request", "error": "no_operation_mapping"}},
-			Result: map[string]any{"ok": false},
-			Status: "FAILED",
-			Problems: []Problem{{
+		op, ok := resolveOperation(ctx, pool, tenantID, ps.Action)
+		if !ok {
+			record(map[string]any{"op": "request", "step": ps.Name, "error": "no_operation_mapping"})
+			problemList = append(problemList, Problem{
 				Type:   problems.Type("no-operation"),
 				Title:  "No connector operation mapped to action",
 				Detail: "No enabled connector operation was found for this action key. Ensure your custom connector title or kind matches the action key, or add an explicit mapping.",
-			}},
+				Step:   ps.Name,
+			})
+			failed, failure = true, FailureClientError
+			break
 		}
-		if pool == nil {
-			return res, nil
+		tmpl := op.Tmpl
+		if ps.RequestTmpl != nil {
+			tmpl = ps.RequestTmpl
 		}
-		_, _ = pool.Exec(ctx, `WITH s AS (
-			SELECT set_config('app.tenant_id', $1, true)
-		) INSERT INTO executions(tenant_id, action_key, decision_id, idempotency_key, steps, result, status)
-		  VALUES ($1,$2,$3,$4,$5,$6,$7)
-		  ON CONFLICT DO NOTHING`, tenantID, actionKey, decisionID, idempotencyKey, toJSON(res.Steps), toJSON(res.Result), res.Status)
-		return res, nil
-	}
-	// Build outgoing request using request_tmpl and inputs
-	steps := []map[string]any{}
-	problemList := []Problem{}
-	// Prepare template
-	var tmpl map[string]any
-	_ = json.Unmarshal(tmplRaw, &tmpl)
-	if tmpl == nil {
-		tmpl = map[string]any{}
-	}
-	headers := map[string]string{}
-	query := url.Values{}
-	var body any
-	// Resolve placeholders of the form {{key}} from input
-	resolve := func(v any) string {
-		s := fmt.Sprintf("%v", v)
-		if !strings.Contains(s, "{{") {
-			return s
+		auth, err := upstreamauth.Load(ctx, pool, tenantID, op.AuthRef)
+		if errors.Is(err, upstreamauth.ErrNotLinked) {
+			record(map[string]any{"op": "request", "step": ps.Name, "error": "account_not_linked"})
+			problemList = append(problemList, Problem{
+				Type:   problems.Type("account-not-linked"),
+				Title:  "Upstream account not linked",
+				Detail: "This action acts as the end user. Link the account through /v1/connections/" + op.AuthRef + "/authorize and retry.",
+				Step:   ps.Name,
+			})
+			failed, failure = true, FailureClientError
+			break
 		}
-		re := regexp.MustCompile(`\{\{\s*([a-zA-Z0-9_\.]+)\s*\}\}`)
-		return re.ReplaceAllStringFunc(s, func(m string) string {
-			g := re.FindStringSubmatch(m)
-			if len(g) != 2 {
-				return ""
-			}
-			key := g[1]
-			// dot path support: a.b.c
-			cur := any(input)
-			for _, seg := range strings.Split(key, ".") {
-				if mm, ok := cur.(map[string]any); ok {
-					cur = mm[seg]
-				} else {
-					cur = nil
-					break
-				}
-			}
-			if cur == nil {
-				return ""
-			}
-			return fmt.Sprintf("%v", cur)
+		if err != nil {
+			record(map[string]any{"op": "request", "step": ps.Name, "error": "auth_config_error"})
+			problemList = append(problemList, Problem{
+				Type:   problems.Type("upstream-auth-unavailable"),
+				Title:  "Upstream credentials could not be loaded",
+				Detail: err.Error(),
+				Step:   ps.Name,
+			})
+			failed, failure = true, FailureClientError
+			break
+		}
+		rr, err := render(op, tmpl, stepScope(ec, outputs, auth.Secrets))
+		if errors.Is(err, errUnresolvedPath) {
+			record(map[string]any{"op": "request", "step": ps.Name, "url": rr.LogURL, "error": "unresolved_path_params"})
+			problemList = append(problemList, Problem{
+				Type:   problems.Type("unresolved-path-params"),
+				Title:  "Unresolved path parameters",
+				Detail: "One or more path placeholders were not bound. Ensure request_tmpl.path_params maps every {name} in the path and inputs provide values.",
+				Step:   ps.Name,
+			})
+			failed, failure = true, FailureClientError
+			break
+		}
+		if err != nil {
+			record(map[string]any{"op": "request", "step": ps.Name, "error": "template_error"})
+			problemList = append(problemList, Problem{
+				Type:   problems.Type("invalid-template"),
+				Title:  "Request template could not be rendered",
+				Detail: err.Error(),
+				Step:   ps.Name,
+			})
+			failed, failure = true, FailureClientError
+			break
+		}
+		emit.send(EventStepStarted, map[string]any{"op": "request", "step": ps.Name, "method": rr.Method, "url": rr.LogURL})
+		recs, resp := op.do(ctx, rr, auth, idempotencyKey+":"+ps.Name, func(rec map[string]any) {
+			rec["step"] = ps.Name
+			emit.send(EventRetry, rec)
 		})
-	}
-	// headers
-	if hv, ok := tmpl["headers"].(map[string]any); ok {
-		for k, v := range hv {
-			headers[k] = resolve(v)
+		for _, rec := range recs {
+			rec["step"] = ps.Name
 		}
-	}
-	// query
-	if qv, ok := tmpl["query"].(map[string]any); ok {
-		// stable order for testing/logging
-		keys := make([]string, 0, len(qv))
-		for k := range qv {
-			keys = append(keys, k)
+		steps = append(steps, recs...)
+		step := recs[len(recs)-1]
+		out := map[string]any{"response": resp}
+		if sc, ok := step["status"].(int); ok {
+			out["status"] = float64(sc) // JMESPath compares numbers as float64
 		}
-		sort.Strings(keys)
-		for _, k := range keys {
-			query.Set(k, resolve(qv[k]))
+		outputs[ps.Name] = out
+		class, detail := op.judge(step, resp)
+		if class != "" {
+			step["failure"] = class
 		}
-	}
-	// body
-	if bv, ok := tmpl["body"].(map[string]any); ok {
-		// deep resolve strings
-		rb := map[string]any{}
-		for k, v := range bv {
-			switch t := v.(type) {
-			case string:
-				rb[k] = resolve(t)
-			default:
-				rb[k] = t
-			}
+		emit.send(EventStepCompleted, step)
+		if class != "" {
+			problemList = append(problemList, failureProblem(class, detail, ps.Name))
+			failed, failure = true, class
+			break
 		}
-		body = rb
+		result = resp
+		done = append(done, ps)
 	}
-	// path params substitution
-	fullURL := strings.TrimRight(baseURL, "/") + path
-	if pv, ok := tmpl["path_params"].(map[string]any); ok {
-		re := regexp.MustCompile(`\{([a-zA-Z0-9_]+)\}`)
-		fullURL = re.ReplaceAllStringFunc(fullURL, func(m string) string {
-			name := strings.Trim(m, "{}")
-			if raw, ok := pv[name]; ok {
-				val := url.PathEscape(resolve(raw))
-				if val == "" {
-					// leave curly braces to surface error
-					return m
+	// raw is the last upstream response. Actions with an output contract return
+	// the shaped result; the raw response is kept in the audit record only.
+	raw := result
+	if !failed {
+		if contract := loadOutputContract(ctx, pool, tenantID, actionKey); contract.defined() {
+			doc := map[string]any{"inputs": input, "steps": outputs, "response": result}
+			if len(done) > 0 {
+				if last, ok := outputs[done[len(done)-1].Name].(map[string]any); ok {
+					doc["status"] = last["status"]
 				}
-				return val
 			}
-			// No mapping provided, keep placeholder
-			return m
-		})
-	}
-	// If unresolved placeholders remain, fail early with problem
-	if strings.Contains(fullURL, "{") {
-		steps = append(steps, map[string]any{"op": "request", "url": fullURL, "error": "unresolved_path_params"})
-		res := ExecuteResult{Steps: steps, Result: map[string]any{"ok": false}, Status: "FAILED", Problems: []Problem{{
-			Type:   problems.Type("unresolved-path-params"),
-			Title:  "Unresolved path parameters",
-			Detail: "One or more path placeholders were not bound. Ensure request_tmpl.path_params maps every {name} in the path and inputs provide values.",
-		}}}
-		if pool == nil {
-			return res, nil
+			shaped, err := contract.shape(doc)
+			if err != nil {
+				// Every step succeeded, so the upstream effects stand: the
+				// mapping problem is reported without compensating them.
+				problemList = append(problemList, Problem{
+					Type:   problems.Type("output-schema-violation"),
+					Title:  "Upstream response does not match the action output schema",
+					Detail: err.Error(),
+				})
+				shapeFailed, failure = true, FailureUpstreamError
+				shaped = map[string]any{"ok": false}
+			}
+			result = shaped
 		}
-		_, _ = pool.Exec(ctx, `WITH s AS (
-			SELECT set_config('app.tenant_id', $1, true)
-		) INSERT INTO executions(tenant_id, action_key, decision_id, idempotency_key, steps, result, status)
-		  VALUES ($1,$2,$3,$4,$5,$6,$7)
-		  ON CONFLICT DO NOTHING`, tenantID, actionKey, decisionID, idempotencyKey, toJSON(res.Steps), toJSON(res.Result), res.Status)
-		return res, nil
 	}
-	// attach query
-	if enc := query.Encode(); enc != "" {
-		if strings.Contains(fullURL, "?") {
-			fullURL += "&" + enc
-		} else {
-			fullURL += "?" + enc
-		}
+	compensations, compensated := 0, true
+	if failed && len(done) > 0 {
+		// Compensations undo upstream effects that already happened, so they
+		// run to completion even when the caller or the job is cancelled.
+		cctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), compensationTimeout)
+		compSteps, compProblems, ran, ok := compensate(cctx, pool, tenantID, idempotencyKey, ec, outputs, done, emit)
+		cancel()
+		steps = append(steps, compSteps...)
+		problemList = append(problemList, compProblems...)
+		compensations, compensated = ran, ok
+	}
+	status := finalStatus(failed, shapeFailed, len(done), compensations, compensated)
+	if failed && (result == nil || status == StatusRolledBack) {
+		result = map[string]any{"ok": false}
+	}
+	emit.send(EventStatus, map[string]any{"status": status, "failure": failure})
+	return ExecuteResult{Steps: steps, Result: result, Status: status, Failure: failure, Problems: problemList}, idempotencyKey, raw
+}
+
+// finalStatus is the status of an execution whose plan stopped at a failed
+// step (failed) after done steps completed, or whose steps all succeeded but
+// whose result broke the output contract (shapeFailed). compensations is how
+// many completed steps had a compensation run, and compensated whether all of
+// them succeeded.
+func finalStatus(failed, shapeFailed bool, done, compensations int, compensated bool) string {
+	switch {
+	case !failed && shapeFailed:
+		return StatusPartial
+	case !failed:
+		return StatusSucceeded
+	case done == 0:
+		return StatusFailed
+	case !compensated:
+		return StatusCompensationFailed
+	// Steps without a declared compensation keep their effects: the
+	// execution is only rolled back when every completed step was undone.
+	case compensations == done:
+		return StatusRolledBack
+	default:
+		return StatusPartial
 	}
-	// Make HTTP request if we have a method and url
-	step := map[string]any{"op": "request", "method": method, "url": fullURL}
-	var resp map[string]any
-	if method != "" && fullURL != "" {
-		var reqBody *bytes.Reader
-		if body != nil {
-			bb, _ := json.Marshal(body)
-			reqBody = bytes.NewReader(bb)
-		} else {
-			reqBody = bytes.NewReader(nil)
+}
+
+// idempotencyKeyFor lets clients pass an idempotency key; else a weak key is derived from the decision id.
+func idempotencyKeyFor(input map[string]any, decisionID string) string {
+	if v, ok := input["idempotency_key"].(string); ok && v != "" {
+		return v
+	}
+	return decisionID
+}
+
+// compensationTimeout bounds the compensations of one execution.
+const compensationTimeout = 2 * time.Minute
+
+// compensate runs the declared compensations of completed steps in reverse order.
+// It returns the compensation step records, problems, how many compensations ran,
+// and whether all of them succeeded. Every compensation is attempted even if an
+// earlier one fails so that as much state as possible is restored.
+func compensate(ctx context.Context, pool *pgxpool.Pool, tenantID, idempotencyKey string, ec execContext, outputs map[string]any, done []PlanStep, emit emitter) ([]map[string]any, []Problem, int, bool) {
+	var steps []map[string]any
+	var probs []Problem
+	ran := 0
+	allOK := true
+	for i := len(done) - 1; i >= 0; i-- {
+		ps := done[i]
+		if ps.Compensate == nil {
+			continue
 		}
-		req, err := http.NewRequestWithContext(ctx, method, fullURL, reqBody)
-		if err == nil {
-			for k, v := range headers {
-				req.Header.Set(k, v)
-			}
-			if body != nil && req.Header.Get("Content-Type") == "" {
-				req.Header.Set("Content-Type", "application/json")
-			}
-			// Best-effort execute; we do not propagate network errors as failures at this layer yet.
-			// In air-gapped or dev scenarios, this will be a no-op with empty response.
-			if resp2, err2 := http.DefaultClient.Do(req); err2 == nil {
-				defer resp2.Body.Close()
-				step["status"] = resp2.StatusCode
-				var out map[string]any
-				_ = json.NewDecoder(resp2.Body).Decode(&out)
-				resp = out
-			} else {
-				step["error"] = err2.Error()
-			}
-		} else {
-			step["error"] = err.Error()
+		ran++
+		own, _ := outputs[ps.Name].(map[string]any)
+		fail := func(step map[string]any, detail string) {
+			steps = append(steps, step)
+			emit.send(EventCompensation, step)
+			probs = append(probs, Problem{
+				Type:   problems.Type("compensation-failed"),
+				Title:  "Compensation failed",
+				Detail: detail,
+				Step:   ps.Name,
+			})
+			allOK = false
 		}
+		op, ok := resolveOperation(ctx, pool, tenantID, ps.Compensate.Action)
+		if !ok {
+			fail(map[string]any{"op": "compensate", "step": ps.Name, "error": "no_operation_mapping"}, "No enabled connector operation was found for the compensating action.")
+			continue
+		}
+		tmpl := op.Tmpl
+		if ps.Compensate.RequestTmpl != nil {
+			tmpl = ps.Compensate.RequestTmpl
+		}
+		auth, err := upstreamauth.Load(ctx, pool, tenantID, op.AuthRef)
+		if err != nil {
+			fail(map[string]any{"op": "compensate", "step": ps.Name, "error": "auth_config_error"}, "The compensating operation's credentials could not be loaded: "+err.Error())
+			continue
+		}
+		rr, err := render(op, tmpl, compensationScope(ec, outputs, auth.Secrets, own))
+		if errors.Is(err, errUnresolvedPath) {
+			fail(map[string]any{"op": "compensate", "step": ps.Name, "url": rr.LogURL, "error": "unresolved_path_params"}, "The compensating request has unbound path placeholders.")
+			continue
+		}
+		if err != nil {
+			fail(map[string]any{"op": "compensate", "step": ps.Name, "error": "template_error"}, "The compensating request template could not be rendered: "+err.Error())
+			continue
+		}
+		recs, resp := op.do(ctx, rr, auth, idempotencyKey+":"+ps.Name+":compensate", func(rec map[string]any) {
+			rec["op"] = "compensate"
+			rec["step"] = ps.Name
+			emit.send(EventRetry, rec)
+		})
+		for _, rec := range recs {
+			rec["op"] = "compensate"
+			rec["step"] = ps.Name
+		}
+		last := recs[len(recs)-1]
+		if class, detail := op.judge(last, resp); class != "" {
+			last["failure"] = class
+			steps = append(steps, recs[:len(recs)-1]...)
+			fail(last, "The compensating upstream call did not succeed; manual repair may be required. "+detail)
+			continue
+		}
+		steps = append(steps, recs...)
+		emit.send(EventCompensation, last)
+	}
+	return steps, probs, ran, allOK
+}
+
+// doRequest performs a rendered request through the shared upstream client with the
+// operation's credentials applied, and returns one step record per attempt plus the
+// decoded JSON response of the last one.
+// onRetry, when set, receives the record of each attempt that is about to be retried.
+func doRequest(ctx context.Context, rr renderedRequest, auth upstreamauth.Config, opts upstream.CallOptions, idemKey string, onRetry func(map[string]any)) ([]map[string]any, map[string]any) {
+	req := upstream.Request{Method: rr.Method, URL: rr.URL, Header: http.Header{}, IdempotencyKey: idemKey}
+	if rr.Body != nil {
+		req.Body, _ = json.Marshal(rr.Body)
+	}
+	for k, v := range rr.Headers {
+		req.Header.Set(k, v)
+	}
+	if rr.Body != nil && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if onRetry != nil {
+		req.OnRetry = func(at upstream.Attempt) { onRetry(attemptRecord(rr, at)) }
+	}
+	ctx, audit := upstreamauth.WithAudit(ctx)
+	resp, attempts, _ := upstreamauth.Do(ctx, upstream.Default, auth, req, opts)
+	recs := make([]map[string]any, 0, len(attempts))
+	for _, at := range attempts {
+		recs = append(recs, attemptRecord(rr, at))
+	}
+	if len(recs) == 0 {
+		recs = append(recs, map[string]any{"op": "request", "method": rr.Method, "url": rr.LogURL, "error": "no_attempt"})
+	}
+	// Token exchanges are audited with the step: who was acted for, by which mode and for which audience.
+	if ex := audit.Exchange(); ex != nil {
+		recs[len(recs)-1]["auth"] = map[string]any{"type": upstreamauth.TypeTokenExchange, "token_exchange": ex}
+	}
+	var out map[string]any
+	if resp != nil {
+		_ = json.Unmarshal(resp.Body, &out)
+	}
+	return recs, out
+}
+
+// attemptRecord is the executions.steps record for one upstream attempt.
+func attemptRecord(rr renderedRequest, at upstream.Attempt) map[string]any {
+	rec := map[string]any{"op": "request", "method": rr.Method, "url": rr.LogURL, "attempt": at.Number, "duration_ms": at.Duration.Milliseconds()}
+	if at.Status != 0 {
+		rec["status"] = at.Status
+	}
+	if at.Error != "" {
+		rec["error"] = at.Error
+		rec["error_kind"] = at.ErrKind
+	}
+	if at.Retrying {
+		rec["retrying"] = true
 	}
-	steps = append(steps, step)
-	res := ExecuteResult{Steps: steps, Result: resp, Status: "SUCCEEDED", Problems: problemList}
+	if at.GRPCCode != "" {
+		rec["grpc_code"] = at.GRPCCode
+	}
+	return rec
+}
+
+// persistExecution stores the execution row together with the raw upstream
+// response for audit and returns its id; no-op without a database.
+func persistExecution(ctx context.Context, pool *pgxpool.Pool, tenantID, actionKey, decisionID, idempotencyKey string, res ExecuteResult, raw map[string]any) string {
 	if pool == nil {
-		return res, nil
+		return ""
 	}
-	// Persist execution row
-	_, _ = pool.Exec(ctx, `WITH s AS (
-        SELECT set_config('app.tenant_id', $1, true)
-	) INSERT INTO executions(tenant_id, action_key, decision_id, idempotency_key, steps, result, status)
-	  VALUES ($1,$2,$3,$4,$5,$6,$7)
-	  ON CONFLICT DO NOTHING`, tenantID, actionKey, decisionID, idempotencyKey, toJSON(res.Steps), toJSON(res.Result), res.Status)
-	return res, nil
+	var id string
+	_ = pool.QueryRow(ctx, `WITH s AS (
+		SELECT set_config('app.tenant_id', $1, true)
+	) INSERT INTO executions(tenant_id, action_key, decision_id, idempotency_key, steps, result, status, failure, raw_response, problems, actor_sub)
+	  VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11)
+	  ON CONFLICT DO NOTHING RETURNING id::text`, tenantID, actionKey, decisionID, idempotencyKey, toJSON(res.Steps), toJSON(res.Result), res.Status, nullIfEmpty(res.Failure), toJSON(raw), toJSON(res.Problems), nullIfEmpty(upstreamauth.ActorFrom(ctx))).Scan(&id)
+	return id
 }
 
 func toJSON(v any) []byte { b, _ := json.Marshal(v); return b }
+
+func nullIfEmpty(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
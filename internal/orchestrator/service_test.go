@@ -0,0 +1,57 @@
+package orchestrator
+
+import (
+	"context"
+	"testing"
+)
+
+func TestFinalStatus(t *testing.T) {
+	for _, tc := range []struct {
+		name                string
+		failed, shapeFailed bool
+		done, compensations int
+		compensated         bool
+		want                string
+	}{
+		{"all steps succeeded", false, false, 2, 0, true, StatusSucceeded},
+		{"output contract broken", false, true, 2, 0, true, StatusPartial},
+		{"first step failed", true, false, 0, 0, true, StatusFailed},
+		{"every completed step compensated", true, false, 2, 2, true, StatusRolledBack},
+		{"a completed step without compensation", true, false, 2, 1, true, StatusPartial},
+		{"no compensation declared", true, false, 1, 0, true, StatusPartial},
+		{"a compensation failed", true, false, 2, 2, false, StatusCompensationFailed},
+		{"a compensation failed, another step without one", true, false, 3, 1, false, StatusCompensationFailed},
+	} {
+		if got := finalStatus(tc.failed, tc.shapeFailed, tc.done, tc.compensations, tc.compensated); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestCompensateRunsInReverseAndReportsFailures(t *testing.T) {
+	done := []PlanStep{
+		{Name: "reserve", Compensate: &Compensation{Action: "stock.release"}},
+		{Name: "notify"}, // nothing to undo
+		{Name: "charge", Compensate: &Compensation{Action: "payments.refund"}},
+	}
+	var events []map[string]any
+	emit := emitter(func(_ string, data map[string]any) { events = append(events, data) })
+
+	// Without a database no compensating operation resolves, so each declared
+	// compensation fails and is reported; undeclared ones are skipped.
+	steps, probs, ran, ok := compensate(context.Background(), nil, "t-1", "idem", execContext{}, map[string]any{}, done, emit)
+	if ran != 2 || ok {
+		t.Fatalf("ran %d, ok %v", ran, ok)
+	}
+	if len(steps) != 2 || steps[0]["step"] != "charge" || steps[1]["step"] != "reserve" {
+		t.Fatalf("steps %v", steps)
+	}
+	if len(probs) != 2 || probs[0].Step != "charge" || len(events) != 2 {
+		t.Fatalf("problems %+v, events %v", probs, events)
+	}
+
+	_, _, ran, ok = compensate(context.Background(), nil, "t-1", "idem", execContext{}, map[string]any{}, []PlanStep{{Name: "notify"}}, emit)
+	if ran != 0 || !ok {
+		t.Fatalf("without compensations: ran %d, ok %v", ran, ok)
+	}
+}
@@ -0,0 +1,269 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"lamdis/internal/facts"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	jmes "github.com/jmespath/go-jmespath"
+)
+
+// OutputContract is an action's stable result shape, stored on the action as
+// output_schema (a JSON Schema subset) and output_mappings (facts mappings).
+// Mappings are evaluated against { inputs, steps, response, status } where
+// response/status belong to the last completed step; the mapped object must
+// validate against the schema before it is returned to the agent.
+type OutputContract struct {
+	Schema   map[string]any  `json:"output_schema,omitempty"`
+	Mappings []facts.Mapping `json:"output_mappings,omitempty"`
+}
+
+// defined reports whether the action declares a result shape; actions without
+// one keep returning the raw upstream response.
+func (c OutputContract) defined() bool { return len(c.Mappings) > 0 || len(c.Schema) > 0 }
+
+// loadOutputContract reads the action's output schema and mappings.
+func loadOutputContract(ctx context.Context, pool *pgxpool.Pool, tenantID, actionKey string) OutputContract {
+	var c OutputContract
+	if pool == nil {
+		return c
+	}
+	var schemaRaw, mapRaw []byte
+	row := pool.QueryRow(ctx, `WITH s AS (
+		SELECT set_config('app.tenant_id', $1, true)
+	) SELECT COALESCE(output_schema,'{}'::jsonb), COALESCE(output_mappings,'[]'::jsonb) FROM actions WHERE tenant_id=$1 AND key=$2`, tenantID, actionKey)
+	if err := row.Scan(&schemaRaw, &mapRaw); err != nil {
+		return c
+	}
+	_ = json.Unmarshal(schemaRaw, &c.Schema)
+	_ = json.Unmarshal(mapRaw, &c.Mappings)
+	return c
+}
+
+// Validate reports mappings without a valid JMESPath or key and schemas
+// outside the supported subset, so contracts are checked when saved rather
+// than after an execution's upstream calls.
+func (c OutputContract) Validate() error {
+	keys := map[string]bool{}
+	for i, m := range c.Mappings {
+		if m.FactKey == "" {
+			return fmt.Errorf("output_mappings[%d]: missing key", i)
+		}
+		if keys[m.FactKey] {
+			return fmt.Errorf("output_mappings[%d]: duplicate key %q", i, m.FactKey)
+		}
+		keys[m.FactKey] = true
+		if _, err := jmes.Compile(m.Path); err != nil {
+			return fmt.Errorf("output_mappings[%d].path: %v", i, err)
+		}
+	}
+	if len(c.Schema) > 0 {
+		return checkSchema(c.Schema, "output_schema")
+	}
+	return nil
+}
+
+// checkSchema reports keywords of the supported subset with values of the wrong shape.
+func checkSchema(schema map[string]any, at string) error {
+	if t, ok := schema["type"]; ok {
+		names, _ := t.([]any)
+		if s, ok := t.(string); ok {
+			names = []any{s}
+		}
+		if len(names) == 0 {
+			return fmt.Errorf("%s.type: expected a type name or a list of them", at)
+		}
+		for _, n := range names {
+			switch n {
+			case "object", "array", "string", "number", "integer", "boolean", "null":
+			default:
+				return fmt.Errorf("%s.type: unknown type %v", at, n)
+			}
+		}
+	}
+	if e, ok := schema["enum"]; ok {
+		if _, ok := e.([]any); !ok {
+			return fmt.Errorf("%s.enum: expected an array", at)
+		}
+	}
+	if r, ok := schema["required"]; ok {
+		list, ok := r.([]any)
+		if !ok {
+			return fmt.Errorf("%s.required: expected an array of names", at)
+		}
+		for _, n := range list {
+			if _, ok := n.(string); !ok {
+				return fmt.Errorf("%s.required: expected an array of names", at)
+			}
+		}
+	}
+	if ap, ok := schema["additionalProperties"]; ok {
+		if _, ok := ap.(bool); !ok {
+			return fmt.Errorf("%s.additionalProperties: only true or false is supported", at)
+		}
+	}
+	if p, ok := schema["properties"]; ok {
+		props, ok := p.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s.properties: expected an object", at)
+		}
+		for k, v := range props {
+			ps, ok := v.(map[string]any)
+			if !ok {
+				return fmt.Errorf("%s.properties.%s: expected a schema object", at, k)
+			}
+			if err := checkSchema(ps, at+".properties."+k); err != nil {
+				return err
+			}
+		}
+	}
+	if it, ok := schema["items"]; ok {
+		items, ok := it.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s.items: expected a schema object", at)
+		}
+		if err := checkSchema(items, at+".items"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shape maps the execution document into the action result and validates it.
+func (c OutputContract) shape(doc map[string]any) (map[string]any, error) {
+	out := doc["response"]
+	if len(c.Mappings) > 0 {
+		m, err := facts.ApplyMappings(c.Mappings, doc)
+		if err != nil {
+			return nil, err
+		}
+		out = m
+	}
+	obj, _ := out.(map[string]any)
+	if obj == nil {
+		obj = map[string]any{}
+	}
+	if len(c.Schema) > 0 {
+		if err := validateSchema(c.Schema, obj, "result"); err != nil {
+			return nil, err
+		}
+	}
+	return obj, nil
+}
+
+// validateSchema checks v against a JSON Schema subset: type, enum, required,
+// properties, additionalProperties=false and items.
+func validateSchema(schema map[string]any, v any, at string) error {
+	if t, ok := schema["type"]; ok && !typeMatches(t, v) {
+		return fmt.Errorf("%s: expected %v, got %s", at, t, jsonType(v))
+	}
+	if enum, ok := schema["enum"].([]any); ok {
+		found := false
+		for _, e := range enum {
+			if fmt.Sprint(e) == fmt.Sprint(v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: value %v not in enum", at, v)
+		}
+	}
+	switch t := v.(type) {
+	case map[string]any:
+		if req, ok := schema["required"].([]any); ok {
+			for _, r := range req {
+				name := fmt.Sprint(r)
+				if val, ok := t[name]; !ok || val == nil {
+					return fmt.Errorf("%s.%s: required", at, name)
+				}
+			}
+		}
+		props, _ := schema["properties"].(map[string]any)
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			ps, ok := props[k].(map[string]any)
+			if !ok {
+				if ap, ok := schema["additionalProperties"].(bool); ok && !ap {
+					return fmt.Errorf("%s.%s: not allowed", at, k)
+				}
+				continue
+			}
+			if t[k] == nil {
+				continue // absent optional values are not type-checked
+			}
+			if err := validateSchema(ps, t[k], at+"."+k); err != nil {
+				return err
+			}
+		}
+	case []any:
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, it := range t {
+				if err := validateSchema(items, it, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func typeMatches(t any, v any) bool {
+	switch tt := t.(type) {
+	case string:
+		return typeIs(tt, v)
+	case []any:
+		for _, x := range tt {
+			if s, ok := x.(string); ok && typeIs(s, v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func typeIs(t string, v any) bool {
+	got := jsonType(v)
+	switch strings.ToLower(t) {
+	case "number":
+		return got == "number" || got == "integer"
+	case "integer":
+		return got == "integer"
+	default:
+		return got == strings.ToLower(t)
+	}
+}
+
+func jsonType(v any) string {
+	switch t := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if t == math.Trunc(t) {
+			return "integer"
+		}
+		return "number"
+	case int, int64:
+		return "integer"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
@@ -0,0 +1,193 @@
+package orchestrator
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"lamdis/pkg/graphql"
+	"lamdis/pkg/problems"
+	"lamdis/pkg/upstream"
+
+	jmes "github.com/jmespath/go-jmespath"
+)
+
+// Failure classes reported on ExecuteResult.Failure and executions.failure.
+const (
+	FailureClientError   = "client_error"   // request could not be built or upstream rejected it (4xx)
+	FailureUpstreamError = "upstream_error" // upstream failed, was unreachable or violated success criteria
+	FailureTimeout       = "timeout"        // upstream did not answer within the operation timeout
+	FailurePolicy        = "policy"         // execution refused by the decision/policy binding
+)
+
+// errKindInvalidRequest marks step records of requests refused before any
+// attempt because they cannot be built, e.g. a message that does not fit the
+// gRPC request type.
+const errKindInvalidRequest = "invalid_request"
+
+// SuccessCriteria decides whether an upstream response counts as success.
+// Stored per operation in connector_operations.success_criteria.
+//   - Status lists accepted codes or ranges: 201, "2xx", "200-299". Default "2xx".
+//   - Assert is an optional JMESPath expression over the JSON response body that
+//     must yield a truthy value, e.g. "status == 'accepted'".
+type SuccessCriteria struct {
+	Status []any  `json:"status,omitempty"`
+	Assert string `json:"assert,omitempty"`
+}
+
+// Validate reports status entries that are not a code, "Nxx" class or range,
+// and an assertion that is not valid JMESPath, so criteria are checked when
+// saved rather than surfacing as failures at execution time.
+func (c SuccessCriteria) Validate() error {
+	for _, s := range c.Status {
+		if !validStatusSpec(s) {
+			return fmt.Errorf("status: invalid entry %v (201, \"2xx\" or \"200-299\")", s)
+		}
+	}
+	if strings.TrimSpace(c.Assert) != "" {
+		if _, err := jmes.Compile(c.Assert); err != nil {
+			return fmt.Errorf("assert: %v", err)
+		}
+	}
+	return nil
+}
+
+// judge classifies a request step against the criteria. It returns an empty
+// class on success, else the failure class and a human-readable detail.
+func (c SuccessCriteria) judge(step map[string]any, body map[string]any) (string, string) {
+	if e, ok := step["error"]; ok {
+		switch k, _ := step["error_kind"].(string); k {
+		case upstream.ErrKindTimeout:
+			return FailureTimeout, "The upstream did not respond within the configured timeout."
+		case upstream.ErrKindEgress:
+			return FailurePolicy, "The upstream is blocked by the tenant egress policy: " + fmt.Sprint(e)
+		case errKindInvalidRequest:
+			return FailureClientError, fmt.Sprint(e)
+		}
+		return FailureUpstreamError, fmt.Sprint(e)
+	}
+	sc, _ := step["status"].(int)
+	if !c.statusOK(sc) {
+		if sc >= 400 && sc < 500 {
+			return FailureClientError, fmt.Sprintf("Upstream rejected the request with status %d.", sc)
+		}
+		return FailureUpstreamError, fmt.Sprintf("Upstream returned status %d, outside the accepted success statuses.", sc)
+	}
+	if strings.TrimSpace(c.Assert) != "" {
+		v, err := jmes.Search(c.Assert, body)
+		if err != nil {
+			return FailureUpstreamError, "Success assertion could not be evaluated: " + err.Error()
+		}
+		if !truthy(v) {
+			return FailureUpstreamError, "Upstream response did not satisfy the success assertion: " + c.Assert
+		}
+	}
+	return "", ""
+}
+
+// judge applies the operation's success criteria; GraphQL operations also fail
+// on a populated errors array, which servers return with status 200.
+func (op operation) judge(step map[string]any, body map[string]any) (string, string) {
+	if class, detail := op.Success.judge(step, body); class != "" {
+		return class, detail
+	}
+	if op.Protocol == graphql.Protocol {
+		if msg, ok := graphql.Errors(body); ok {
+			return FailureUpstreamError, "GraphQL errors: " + msg
+		}
+	}
+	return "", ""
+}
+
+func (c SuccessCriteria) statusOK(code int) bool {
+	if len(c.Status) == 0 {
+		return code >= 200 && code < 300
+	}
+	for _, s := range c.Status {
+		if statusMatches(s, code) {
+			return true
+		}
+	}
+	return false
+}
+
+// statusMatches accepts 201, "201", "2xx" or "200-299".
+func statusMatches(spec any, code int) bool {
+	switch t := spec.(type) {
+	case float64:
+		return int(t) == code
+	case int:
+		return t == code
+	case string:
+		s := strings.ToLower(strings.TrimSpace(t))
+		if len(s) == 3 && strings.HasSuffix(s, "xx") {
+			return strconv.Itoa(code)[:1] == s[:1]
+		}
+		if lo, hi, ok := strings.Cut(s, "-"); ok {
+			l, e1 := strconv.Atoi(strings.TrimSpace(lo))
+			h, e2 := strconv.Atoi(strings.TrimSpace(hi))
+			return e1 == nil && e2 == nil && code >= l && code <= h
+		}
+		n, err := strconv.Atoi(s)
+		return err == nil && n == code
+	}
+	return false
+}
+
+// validStatusSpec reports whether statusMatches understands spec.
+func validStatusSpec(spec any) bool {
+	code := func(s string) bool {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		return err == nil && n >= 100 && n <= 599
+	}
+	switch t := spec.(type) {
+	case float64:
+		return t == float64(int(t)) && t >= 100 && t <= 599
+	case int:
+		return t >= 100 && t <= 599
+	case string:
+		s := strings.ToLower(strings.TrimSpace(t))
+		if len(s) == 3 && strings.HasSuffix(s, "xx") {
+			return s[0] >= '1' && s[0] <= '5'
+		}
+		if lo, hi, ok := strings.Cut(s, "-"); ok {
+			return code(lo) && code(hi)
+		}
+		return code(s)
+	}
+	return false
+}
+
+// failureProblem maps a failure class onto a problem document entry.
+func failureProblem(class, detail, step string) Problem {
+	p := Problem{Detail: detail, Step: step}
+	switch class {
+	case FailureClientError:
+		p.Type, p.Title = problems.Type("upstream-client-error"), "Upstream rejected the request"
+	case FailureTimeout:
+		p.Type, p.Title = problems.Type("upstream-timeout"), "Upstream timed out"
+	case FailurePolicy:
+		p.Type, p.Title = problems.Type("policy-violation"), "Execution not permitted by policy"
+	default:
+		p.Type, p.Title = problems.Type("upstream-error"), "Upstream call failed"
+	}
+	return p
+}
+
+// HTTPStatus is the response code returned to the agent for this result.
+func (r ExecuteResult) HTTPStatus() int {
+	if r.Status == StatusSucceeded {
+		return http.StatusOK
+	}
+	switch r.Failure {
+	case FailureClientError:
+		return http.StatusUnprocessableEntity
+	case FailureTimeout:
+		return http.StatusGatewayTimeout
+	case FailurePolicy:
+		return http.StatusConflict
+	default:
+		return http.StatusBadGateway
+	}
+}
@@ -0,0 +1,63 @@
+package orchestrator
+
+import "testing"
+
+func TestSuccessCriteriaJudge(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		criteria SuccessCriteria
+		step     map[string]any
+		body     map[string]any
+		want     string
+	}{
+		{"2xx by default", SuccessCriteria{}, map[string]any{"status": 201}, nil, ""},
+		{"4xx is a client error", SuccessCriteria{}, map[string]any{"status": 404}, nil, FailureClientError},
+		{"5xx is an upstream error", SuccessCriteria{}, map[string]any{"status": 500}, nil, FailureUpstreamError},
+		{"accepted range", SuccessCriteria{Status: []any{"200-299", float64(409)}}, map[string]any{"status": 409}, nil, ""},
+		{"timeout", SuccessCriteria{}, map[string]any{"error": "deadline", "error_kind": "timeout"}, nil, FailureTimeout},
+		{"egress denied", SuccessCriteria{}, map[string]any{"error": "denied", "error_kind": "egress_denied"}, nil, FailurePolicy},
+		{"assertion holds", SuccessCriteria{Assert: "status == 'accepted'"}, map[string]any{"status": 200}, map[string]any{"status": "accepted"}, ""},
+		{"assertion fails", SuccessCriteria{Assert: "status == 'accepted'"}, map[string]any{"status": 200}, map[string]any{"status": "rejected"}, FailureUpstreamError},
+	} {
+		if got, _ := tc.criteria.judge(tc.step, tc.body); got != tc.want {
+			t.Errorf("%s: class %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSuccessCriteriaValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		criteria SuccessCriteria
+		ok       bool
+	}{
+		{"empty", SuccessCriteria{}, true},
+		{"codes, classes and ranges", SuccessCriteria{Status: []any{float64(201), "2xx", "200-299", "409"}, Assert: "ok"}, true},
+		{"unknown class", SuccessCriteria{Status: []any{"9xx"}}, false},
+		{"not a code", SuccessCriteria{Status: []any{"ok"}}, false},
+		{"fractional code", SuccessCriteria{Status: []any{200.5}}, false},
+		{"bad range", SuccessCriteria{Status: []any{"200-abc"}}, false},
+		{"assertion typo", SuccessCriteria{Assert: "status == 'accepted"}, false},
+	} {
+		if err := tc.criteria.Validate(); (err == nil) != tc.ok {
+			t.Errorf("%s: err %v", tc.name, err)
+		}
+	}
+}
+
+func TestPlanValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		plan Plan
+		ok   bool
+	}{
+		{"single step", Plan{Steps: []PlanStep{{Name: "a"}}}, true},
+		{"condition", Plan{Steps: []PlanStep{{Name: "a"}, {Name: "b", When: "steps.a.status == `200`"}}}, true},
+		{"condition typo", Plan{Steps: []PlanStep{{Name: "b", When: "steps.a.status =="}}}, false},
+		{"compensation without action", Plan{Steps: []PlanStep{{Name: "a", Compensate: &Compensation{}}}}, false},
+	} {
+		if err := tc.plan.Validate(); (err == nil) != tc.ok {
+			t.Errorf("%s: err %v", tc.name, err)
+		}
+	}
+}
@@ -0,0 +1,391 @@
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"lamdis/internal/facts"
+	"lamdis/internal/orchestrator"
+	"lamdis/pkg/middleware"
+	"lamdis/pkg/problems"
+	"lamdis/pkg/ratelimit"
+	"lamdis/pkg/upstreamauth"
+)
+
+const (
+	maxBatchItems      = 100
+	defaultBatchWorker = 8
+	maxBatchWorker     = 16
+)
+
+// factsResolver resolves facts for one action evaluation.
+type factsResolver func(ctx context.Context, key string, inputs map[string]any) map[string]any
+
+// resolveFacts returns a factsResolver resolving each evaluation on its own.
+func resolveFacts(pool *pgxpool.Pool, tenantID string) factsResolver {
+	return func(ctx context.Context, key string, inputs map[string]any) map[string]any {
+		fa, _ := facts.ResolveFacts(ctx, pool, tenantID, key, inputs)
+		return fa
+	}
+}
+
+// preflight evaluates an action and returns the preflight response body,
+// persisting the decision unless more input is needed.
+func preflight(ctx context.Context, pool *pgxpool.Pool, tenantID, key string, inputs map[string]any, resolve factsResolver) map[string]any {
+	fa := resolve(ctx, key, inputs)
+	dec, _ := Evaluate(ctx, pool, tenantID, key, inputs, fa)
+	// If required facts missing and policy needs inputs, surface needs
+	if dec.Status == NeedsInput {
+		needs, _ := facts.ResolverNeeds(ctx, pool, tenantID, key)
+		return map[string]any{
+			"status": "NEEDS_INPUT",
+			"needs":  needs,
+		}
+	}
+	// Persist decision for ALLOW or BLOCKED/conditions
+	id, _ := PersistDecision(ctx, pool, tenantID, dec)
+	dec.ID = id
+	resp := map[string]any{"status": string(dec.Status)}
+	if dec.Status == Allow || dec.Status == AllowWithConditions {
+		resp["decision_id"] = dec.ID
+		if dec.ExpiresAt != nil {
+			resp["expires_at"] = dec.ExpiresAt
+		}
+		if dec.ScheduleUntil != nil {
+			resp["schedule_until"] = dec.ScheduleUntil
+		}
+		if dec.Reasons != nil {
+			resp["reasons"] = dec.Reasons
+		}
+		if dec.Needs != nil {
+			resp["conditions"] = dec.Needs
+		}
+	} else if dec.Status == Blocked {
+		// Return structured reasons and alternatives
+		resp["reasons"] = dec.Reasons
+		resp["alternatives"] = dec.Alternatives
+	}
+	return resp
+}
+
+// executeOutcome is the HTTP response for one execute call.
+type executeOutcome struct {
+	status   int
+	body     any
+	problem  bool   // body is a problem document
+	location string // async status URL
+}
+
+// execute validates the decision binding and runs, queues or schedules the action.
+// A non-nil runAt schedules the execution; the decision is checked now and again
+// when it fires.
+func execute(ctx context.Context, pool *pgxpool.Pool, tenantID, key, decisionID string, inputs map[string]any, async bool, runAt *time.Time, resolve factsResolver) executeOutcome {
+	// Per-user upstream credentials are resolved for the caller, now or when the job runs.
+	ctx = upstreamauth.WithActor(ctx, middleware.ActorSub(ctx))
+	ctx = upstreamauth.WithSubjectToken(ctx, middleware.RawToken(ctx))
+	if strings.TrimSpace(decisionID) == "" {
+		return executeOutcome{status: http.StatusConflict, problem: true, body: map[string]any{
+			"type":   problems.Type("preflight-required"),
+			"title":  "Preflight required",
+			"detail": "Call eligibility first and pass decision_id to execute",
+		}}
+	}
+	// Validate decision binding against action and recomputed facts hash
+	if ok, prob := validateAndBind(ctx, pool, tenantID, decisionID, key, inputs, resolve); !ok {
+		prob["failure"] = orchestrator.FailurePolicy
+		return executeOutcome{status: http.StatusConflict, problem: true, body: prob}
+	}
+	if runAt != nil {
+		if pool == nil {
+			return executeOutcome{status: http.StatusNotImplemented, problem: true, body: problem(problems.Type("scheduling-unavailable"), "Scheduling unavailable", "Scheduled executions require a database")}
+		}
+		if ok, prob := bindSchedule(ctx, pool, tenantID, decisionID, *runAt); !ok {
+			prob["failure"] = orchestrator.FailurePolicy
+			return executeOutcome{status: http.StatusConflict, problem: true, body: prob}
+		}
+		id, err := orchestrator.Schedule(ctx, pool, tenantID, key, decisionID, inputs, *runAt)
+		if err != nil {
+			return executeOutcome{status: http.StatusInternalServerError, problem: true, body: map[string]any{
+				"type":  problems.Type("schedule-failed"),
+				"title": "Execution could not be scheduled",
+			}}
+		}
+		self := "/v1/executions/" + id
+		return executeOutcome{status: http.StatusAccepted, location: self, body: map[string]any{
+			"execution_id": id,
+			"status":       orchestrator.StatusScheduled,
+			"run_at":       runAt,
+			"links":        map[string]any{"self": self},
+		}}
+	}
+	if async && pool != nil {
+		id, err := orchestrator.Enqueue(ctx, pool, tenantID, key, decisionID, inputs)
+		if err != nil {
+			return executeOutcome{status: http.StatusInternalServerError, problem: true, body: map[string]any{
+				"type":  problems.Type("enqueue-failed"),
+				"title": "Execution could not be queued",
+			}}
+		}
+		self := "/v1/executions/" + id
+		return executeOutcome{status: http.StatusAccepted, location: self, body: map[string]any{
+			"execution_id": id,
+			"status":       orchestrator.StatusQueued,
+			"links":        map[string]any{"self": self},
+		}}
+	}
+	res, _ := orchestrator.Execute(ctx, pool, tenantID, key, decisionID, inputs)
+	// Status code reflects the outcome: 200 on success, else derived from the failure class.
+	return executeOutcome{status: res.HTTPStatus(), body: res}
+}
+
+type batchItem struct {
+	ID         string         `json:"id,omitempty"` // client correlation id, echoed back
+	Key        string         `json:"key"`
+	Inputs     map[string]any `json:"inputs"`
+	DecisionID string         `json:"decision_id,omitempty"`
+	Mode       string         `json:"mode,omitempty"`
+	RunAt      string         `json:"run_at,omitempty"` // RFC3339; schedules the item
+}
+
+type batchRequest struct {
+	// SharedInputs are merged under each item's inputs (item values win).
+	SharedInputs map[string]any `json:"shared_inputs"`
+	Items        []batchItem    `json:"items"`
+	MaxParallel  int            `json:"max_parallel"`
+}
+
+// decodeBatch parses and bounds a batch request, writing a problem on error.
+func decodeBatch(w http.ResponseWriter, req *http.Request) (batchRequest, bool) {
+	var b batchRequest
+	if err := json.NewDecoder(req.Body).Decode(&b); err != nil || len(b.Items) == 0 {
+		writeProblem(w, http.StatusBadRequest, problems.Type("invalid-batch"), "Invalid batch", "Body must be JSON with a non-empty items array")
+		return b, false
+	}
+	if len(b.Items) > maxBatchItems {
+		writeProblem(w, http.StatusRequestEntityTooLarge, problems.Type("batch-too-large"), "Batch too large", fmt.Sprintf("A batch may contain at most %d items", maxBatchItems))
+		return b, false
+	}
+	for i, it := range b.Items {
+		if strings.TrimSpace(it.Key) == "" {
+			writeProblem(w, http.StatusBadRequest, problems.Type("invalid-batch"), "Invalid batch", fmt.Sprintf("items[%d].key is required", i))
+			return b, false
+		}
+		if _, err := parseRunAt(it.RunAt); err != nil {
+			writeProblem(w, http.StatusBadRequest, problems.Type("invalid-batch"), "Invalid batch", fmt.Sprintf("items[%d].run_at must be an RFC3339 timestamp", i))
+			return b, false
+		}
+		merged := make(map[string]any, len(b.SharedInputs)+len(it.Inputs))
+		for k, v := range b.SharedInputs {
+			merged[k] = v
+		}
+		for k, v := range it.Inputs {
+			merged[k] = v
+		}
+		b.Items[i].Inputs = merged
+	}
+	if b.MaxParallel <= 0 {
+		b.MaxParallel = defaultBatchWorker
+	}
+	if b.MaxParallel > maxBatchWorker {
+		b.MaxParallel = maxBatchWorker
+	}
+	return b, true
+}
+
+// batchPreflight evaluates every item concurrently. Resolver responses are
+// shared across items whose inputs agree on what the resolver reads.
+func batchPreflight(w http.ResponseWriter, req *http.Request, pool *pgxpool.Pool) {
+	ctx := req.Context()
+	tenant := middleware.TenantFrom(ctx)
+	b, ok := decodeBatch(w, req)
+	if !ok {
+		return
+	}
+	cache := newFactsCache(pool, tenant.ID)
+	results := make([]map[string]any, len(b.Items))
+	forEachBounded(len(b.Items), b.MaxParallel, func(i int) {
+		it := b.Items[i]
+		out := map[string]any{"index": i, "key": it.Key}
+		if it.ID != "" {
+			out["id"] = it.ID
+		}
+		defer func() {
+			if p := recover(); p != nil {
+				out["ok"] = false
+				out["error"] = problem(problems.Type("internal-error"), "Item failed", fmt.Sprint(p))
+			}
+			results[i] = out
+		}()
+		if d := limitItem(ctx, pool, tenant.ID, it.Key); !d.Allowed {
+			out["ok"] = false
+			out["error"] = d.Problem()
+			return
+		}
+		start := time.Now()
+		dec := preflight(ctx, pool, tenant.ID, it.Key, it.Inputs, cache.resolve)
+		recordUsage(ctx, pool, tenant.ID, it.Key, usagePreflight, http.StatusOK, start)
+		st, _ := dec["status"].(string)
+		out["ok"] = st == string(Allow) || st == string(AllowWithConditions)
+		out["decision"] = dec
+	})
+	writeBatch(w, results)
+}
+
+// batchExecute runs every item concurrently; each item reports its own
+// HTTP-equivalent status so one failure does not fail the batch. Facts
+// re-checked against decisions share resolver responses like batchPreflight.
+func batchExecute(w http.ResponseWriter, req *http.Request, pool *pgxpool.Pool) {
+	ctx := req.Context()
+	tenant := middleware.TenantFrom(ctx)
+	b, ok := decodeBatch(w, req)
+	if !ok {
+		return
+	}
+	cache := newFactsCache(pool, tenant.ID)
+	results := make([]map[string]any, len(b.Items))
+	forEachBounded(len(b.Items), b.MaxParallel, func(i int) {
+		it := b.Items[i]
+		out := map[string]any{"index": i, "key": it.Key}
+		if it.ID != "" {
+			out["id"] = it.ID
+		}
+		defer func() {
+			if p := recover(); p != nil {
+				out["status"] = http.StatusInternalServerError
+				out["ok"] = false
+				out["error"] = problem(problems.Type("internal-error"), "Item failed", fmt.Sprint(p))
+			}
+			results[i] = out
+		}()
+		if d := limitItem(ctx, pool, tenant.ID, it.Key); !d.Allowed {
+			out["status"] = http.StatusTooManyRequests
+			out["ok"] = false
+			out["error"] = d.Problem()
+			return
+		}
+		start := time.Now()
+		runAt, _ := parseRunAt(it.RunAt) // validated by decodeBatch
+		o := execute(ctx, pool, tenant.ID, it.Key, it.DecisionID, it.Inputs, strings.EqualFold(it.Mode, "async"), runAt, cache.resolve)
+		recordUsage(ctx, pool, tenant.ID, it.Key, usageExecute, o.status, start)
+		out["status"] = o.status
+		out["ok"] = o.status < 300
+		if o.problem {
+			out["error"] = o.body
+		} else {
+			out["result"] = o.body
+		}
+	})
+	writeBatch(w, results)
+}
+
+// limitItem checks one batch item against the limits of its action, like the
+// single-action endpoints do.
+func limitItem(ctx context.Context, pool *pgxpool.Pool, tenantID, key string) ratelimit.Decision {
+	return ratelimit.Default.Check(ctx, pool, tenantID, middleware.ActorSub(ctx), ratelimit.Scope{Operation: key})
+}
+
+func writeBatch(w http.ResponseWriter, results []map[string]any) {
+	succeeded := 0
+	for _, r := range results {
+		if ok, _ := r["ok"].(bool); ok {
+			succeeded++
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"items": results,
+		"summary": map[string]any{
+			"total":     len(results),
+			"succeeded": succeeded,
+			"failed":    len(results) - succeeded,
+		},
+	})
+}
+
+// forEachBounded calls fn for 0..n-1 with at most limit calls in flight.
+func forEachBounded(n, limit int, fn func(i int)) {
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// factsCache shares fact resolution between the items of one batch: each
+// action's configuration is loaded once, and each resolver is fetched once per
+// distinct subset of inputs it reads (typically the batch's shared_inputs).
+// Mappings are applied per item. Concurrent callers wait for a single load.
+type factsCache struct {
+	pool     *pgxpool.Pool
+	tenantID string
+	mu       sync.Mutex
+	entries  map[string]*factsEntry
+}
+
+type factsEntry struct {
+	once sync.Once
+	val  any
+}
+
+func newFactsCache(pool *pgxpool.Pool, tenantID string) *factsCache {
+	return &factsCache{pool: pool, tenantID: tenantID, entries: map[string]*factsEntry{}}
+}
+
+// once returns the value fn produced for id, calling fn on first use only.
+func (c *factsCache) once(id string, fn func() any) any {
+	c.mu.Lock()
+	e, ok := c.entries[id]
+	if !ok {
+		e = &factsEntry{}
+		c.entries[id] = e
+	}
+	c.mu.Unlock()
+	e.once.Do(func() { e.val = fn() })
+	return e.val
+}
+
+func (c *factsCache) resolve(ctx context.Context, key string, inputs map[string]any) map[string]any {
+	if c.pool == nil {
+		return resolveFacts(nil, c.tenantID)(ctx, key, inputs)
+	}
+	cfg, ok := c.once("config|"+key, func() any {
+		cfg, err := facts.LoadConfig(ctx, c.pool, c.tenantID, key)
+		if err != nil {
+			return nil
+		}
+		return cfg
+	}).(facts.Config)
+	if !ok {
+		return nil
+	}
+	responses := map[string]any{}
+	for _, r := range cfg.Resolvers {
+		in := r.Inputs(inputs)
+		raw, _ := json.Marshal(in) // map keys are sorted, so equal subsets share an entry
+		responses[r.Name] = c.once("resolver|"+key+"|"+r.Name+"|"+string(raw), func() any {
+			return r.Fetch(ctx, in)
+		})
+	}
+	fa, _ := cfg.Facts(inputs, responses)
+	return fa
+}
+
+func writeProblem(w http.ResponseWriter, status int, typ, title, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(problem(typ, title, detail))
+}
@@ -0,0 +1,220 @@
+package policy
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"lamdis/pkg/connectors"
+	"lamdis/pkg/middleware"
+	"lamdis/pkg/problems"
+	"lamdis/pkg/upstream"
+	"lamdis/pkg/upstreamauth"
+)
+
+// linkStateTTL bounds how long a user may take to approve an authorize request.
+const linkStateTTL = 10 * time.Minute
+
+// ConnectionCallbackPath receives the upstream's authorization response. It is
+// the redirect_uri path of oauth2_user configs and is authenticated by state,
+// not by the tenant's bearer token.
+const ConnectionCallbackPath = "/v1/connections/callback"
+
+// registerConnections mounts the end-user account linking endpoints:
+// GET    /v1/connections                     oauth2_user configs and the caller's link status
+// POST   /v1/connections/{authId}/authorize  body: { return_to? } -> { authorize_url }
+// GET    /v1/connections/callback            upstream redirect target (code, state)
+// DELETE /v1/connections/{authId}            unlink the caller's account
+func registerConnections(r chi.Router, pool *pgxpool.Pool) {
+	r.Get("/v1/connections", func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		tenant := middleware.TenantFrom(ctx)
+		sub, ok := requireActor(w, req)
+		if !ok {
+			return
+		}
+		items := []map[string]any{}
+		if pool != nil {
+			rows, err := pool.Query(ctx, `WITH s AS (
+				SELECT set_config('app.tenant_id', $1, true)
+			) SELECT a.id::text, a.name, c.scopes, c.expires_at, c.updated_at
+			  FROM tenant_auth_configs a
+			  LEFT JOIN user_connections c ON c.tenant_id=a.tenant_id AND c.auth_id=a.id AND c.actor_sub=$2
+			  WHERE a.tenant_id=$1 AND a.type=$3 ORDER BY a.name`, tenant.ID, sub, upstreamauth.TypeOAuth2User)
+			if err != nil {
+				writeProblem(w, http.StatusInternalServerError, problems.Type("connections-unavailable"), "Connections unavailable", "")
+				return
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var id, name string
+				var scopes *string
+				var expires, linkedAt *time.Time
+				if err := rows.Scan(&id, &name, &scopes, &expires, &linkedAt); err != nil {
+					continue
+				}
+				item := map[string]any{"auth_id": id, "name": name, "linked": linkedAt != nil}
+				if linkedAt != nil {
+					item["scopes"] = scopes
+					item["expires_at"] = expires
+					item["updated_at"] = linkedAt
+				}
+				items = append(items, item)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"items": items})
+	})
+	r.Post("/v1/connections/{authId}/authorize", func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		tenant := middleware.TenantFrom(ctx)
+		sub, ok := requireActor(w, req)
+		if !ok {
+			return
+		}
+		if pool == nil {
+			writeProblem(w, http.StatusNotImplemented, problems.Type("connections-unavailable"), "Connections unavailable", "Account linking requires a database")
+			return
+		}
+		var body struct {
+			ReturnTo string `json:"return_to"`
+		}
+		_ = json.NewDecoder(req.Body).Decode(&body)
+		authID := chi.URLParam(req, "authId")
+		c, err := upstreamauth.LoadLinkable(ctx, pool, tenant.ID, authID)
+		if err != nil {
+			writeProblem(w, http.StatusNotFound, problems.Type("connection-not-found"), "Connection not found", "No oauth2_user auth config with this id")
+			return
+		}
+		if body.ReturnTo != "" && !c.ReturnAllowed(body.ReturnTo) {
+			writeProblem(w, http.StatusBadRequest, problems.Type("invalid-return-to"), "Invalid return_to", "return_to is not one of the auth config's return_urls")
+			return
+		}
+		state := upstreamauth.NewState()
+		verifier, challenge := upstreamauth.NewPKCE()
+		if !c.PKCE() {
+			verifier = ""
+		}
+		authURL, err := c.AuthorizeURL(state, challenge)
+		if err != nil {
+			writeProblem(w, http.StatusConflict, problems.Type("connection-misconfigured"), "Connection misconfigured", err.Error())
+			return
+		}
+		expires := time.Now().Add(linkStateTTL)
+		_, _ = pool.Exec(ctx, `DELETE FROM oauth_link_states WHERE expires_at < now()`)
+		if _, err := pool.Exec(ctx, `INSERT INTO oauth_link_states(state, tenant_id, auth_id, actor_sub, code_verifier, return_to, expires_at)
+			VALUES ($1,$2,$3,$4,$5,$6,$7)`, state, tenant.ID, authID, sub, verifier, body.ReturnTo, expires); err != nil {
+			writeProblem(w, http.StatusInternalServerError, problems.Type("connections-unavailable"), "Connections unavailable", "")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"authorize_url": authURL, "expires_at": expires})
+	})
+	r.Get(ConnectionCallbackPath, func(w http.ResponseWriter, req *http.Request) {
+		connectionCallback(w, req, pool)
+	})
+	r.Delete("/v1/connections/{authId}", func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		tenant := middleware.TenantFrom(ctx)
+		sub, ok := requireActor(w, req)
+		if !ok {
+			return
+		}
+		if pool == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		found, err := upstreamauth.Unlink(ctx, pool, tenant.ID, chi.URLParam(req, "authId"), sub)
+		if err != nil {
+			writeProblem(w, http.StatusInternalServerError, problems.Type("connections-unavailable"), "Connections unavailable", "")
+			return
+		}
+		if !found {
+			writeProblem(w, http.StatusNotFound, problems.Type("connection-not-found"), "Connection not found", "The account is not linked")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// connectionCallback completes a link: the single-use state identifies the
+// tenant, auth config and actor that started it, and the code is exchanged for
+// the actor's tokens. With a return_to the browser is redirected there with
+// connected=<authId> or error=<code>; otherwise a JSON result is written.
+func connectionCallback(w http.ResponseWriter, req *http.Request, pool *pgxpool.Pool) {
+	ctx := req.Context()
+	tenant := middleware.TenantFrom(ctx)
+	q := req.URL.Query()
+	if pool == nil {
+		writeProblem(w, http.StatusNotImplemented, problems.Type("connections-unavailable"), "Connections unavailable", "Account linking requires a database")
+		return
+	}
+	var authID, sub, verifier, returnTo string
+	err := pool.QueryRow(ctx, `DELETE FROM oauth_link_states WHERE state=$1 AND tenant_id=$2 AND expires_at > now()
+		RETURNING auth_id::text, actor_sub, code_verifier, return_to`, q.Get("state"), tenant.ID).Scan(&authID, &sub, &verifier, &returnTo)
+	if err == pgx.ErrNoRows || q.Get("state") == "" {
+		writeProblem(w, http.StatusBadRequest, problems.Type("invalid-link-state"), "Invalid or expired state", "Start the connection again from the authorize endpoint")
+		return
+	}
+	if err != nil {
+		writeProblem(w, http.StatusInternalServerError, problems.Type("connections-unavailable"), "Connections unavailable", "")
+		return
+	}
+	finish := func(status int, code, detail string) {
+		if returnTo != "" {
+			u, _ := url.Parse(returnTo)
+			rq := u.Query()
+			if code == "" {
+				rq.Set("connected", authID)
+			} else {
+				rq.Set("error", code)
+			}
+			u.RawQuery = rq.Encode()
+			http.Redirect(w, req, u.String(), http.StatusFound)
+			return
+		}
+		if code != "" {
+			writeProblem(w, status, problems.Type("link-failed"), "Account could not be linked", detail)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"ok": true, "auth_id": authID})
+	}
+	if e := q.Get("error"); e != "" {
+		finish(http.StatusBadRequest, e, q.Get("error_description"))
+		return
+	}
+	c, err := upstreamauth.LoadLinkable(ctx, pool, tenant.ID, authID)
+	if err != nil {
+		finish(http.StatusNotFound, "connection_not_found", err.Error())
+		return
+	}
+	// The token endpoint is an upstream like any other and is held to the tenant's egress policy.
+	ctx = upstream.WithTenant(upstream.WithEgress(ctx, connectors.LoadEgressPolicy(ctx, pool, tenant.ID)), tenant.ID)
+	if err := c.Link(ctx, pool, upstream.Default, tenant.ID, sub, q.Get("code"), verifier); err != nil {
+		status := http.StatusBadGateway
+		if errors.Is(err, upstream.ErrEgressDenied) {
+			status = http.StatusForbidden
+		}
+		finish(status, "token_exchange_failed", err.Error())
+		return
+	}
+	finish(http.StatusOK, "", "")
+}
+
+// requireActor returns the caller's subject; account links belong to an end
+// user, so anonymous callers are refused.
+func requireActor(w http.ResponseWriter, req *http.Request) (string, bool) {
+	sub := middleware.ActorSub(req.Context())
+	if sub == "" {
+		writeProblem(w, http.StatusUnauthorized, problems.Type("actor-required"), "End user required", "Account linking needs a user token with a sub claim")
+		return "", false
+	}
+	return sub, true
+}
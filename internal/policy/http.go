@@ -2,94 +2,180 @@ package policy
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 
-	"lamdis/internal/facts"
 	"lamdis/internal/orchestrator"
 	"lamdis/pkg/middleware"
 	"lamdis/pkg/problems"
+	"lamdis/pkg/ratelimit"
 )
 
 // RegisterHTTP mounts preflight and execute endpoints for actions.
 // POST /v1/actions/{key}/preflight  body: { inputs }
-// POST /v1/actions/{key}/execute    body: { decision_id, inputs? }
+// POST /v1/actions/{key}/execute    body: { decision_id, inputs?, mode?, run_at? }
+// POST /v1/actions:batchPreflight   body: { shared_inputs?, items: [ { key, inputs } ] }
+// POST /v1/actions:batchExecute     body: { shared_inputs?, items: [ { key, decision_id, inputs, mode?, run_at? } ] }
+// GET  /v1/executions/{id}          status polling for async executions
+// GET  /v1/executions/{id}/events   SSE progress stream (Last-Event-ID resume)
+// /v1/connections/...               end-user account linking (see registerConnections)
+//
+// Action calls are rate limited per tenant, actor and action key (see pkg/ratelimit)
+// and recorded in usage_events for the monthly quota; batch items count singly.
+//
+// Execute runs synchronously unless mode is "async" or the request carries
+// "Prefer: respond-async"; async executions are queued and answered with 202.
+// A future run_at (RFC3339) schedules the execution instead, also with 202; it
+// is re-validated against the decision and current policy when it fires.
 func RegisterHTTP(r chi.Router, pool *pgxpool.Pool) {
 	r.Post("/v1/actions/{key}/preflight", func(w http.ResponseWriter, req *http.Request) {
 		ctx := req.Context()
 		tenant := middleware.TenantFrom(ctx)
 		key := chi.URLParam(req, "key")
+		if !ratelimit.Default.Enforce(w, req, pool, ratelimit.Scope{Operation: key}) {
+			return
+		}
+		start := time.Now()
 		var body struct {
 			Inputs map[string]any `json:"inputs"`
 			Hints  map[string]any `json:"hints"`
 		}
 		_ = json.NewDecoder(req.Body).Decode(&body)
-		fa, _ := facts.ResolveFacts(ctx, pool, tenant.ID, key, body.Inputs)
-		dec, _ := Evaluate(ctx, pool, tenant.ID, key, body.Inputs, fa)
-		// If required facts missing and policy needs inputs, surface needs
-		if dec.Status == NeedsInput {
-			needs, _ := facts.ResolverNeeds(ctx, pool, tenant.ID, key)
-			w.Header().Set("Content-Type", "application/json")
-			_ = json.NewEncoder(w).Encode(map[string]any{
-				"status": "NEEDS_INPUT",
-				"needs":  needs,
-			})
-			return
-		}
-		// Persist decision for ALLOW or BLOCKED/conditions
-		id, _ := PersistDecision(ctx, pool, tenant.ID, dec)
-		dec.ID = id
-		resp := map[string]any{"status": string(dec.Status)}
-		if dec.Status == Allow || dec.Status == AllowWithConditions {
-			resp["decision_id"] = dec.ID
-			if dec.ExpiresAt != nil {
-				resp["expires_at"] = dec.ExpiresAt
-			}
-			if dec.Reasons != nil {
-				resp["reasons"] = dec.Reasons
-			}
-			if dec.Needs != nil {
-				resp["conditions"] = dec.Needs
-			}
-		} else if dec.Status == Blocked {
-			// Return structured reasons and alternatives
-			resp["reasons"] = dec.Reasons
-			resp["alternatives"] = dec.Alternatives
-		}
 		w.Header().Set("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(resp)
+		_ = json.NewEncoder(w).Encode(preflight(ctx, pool, tenant.ID, key, body.Inputs, resolveFacts(pool, tenant.ID)))
+		recordUsage(ctx, pool, tenant.ID, key, usagePreflight, http.StatusOK, start)
 	})
 	r.Post("/v1/actions/{key}/execute", func(w http.ResponseWriter, req *http.Request) {
 		ctx := req.Context()
 		tenant := middleware.TenantFrom(ctx)
 		key := chi.URLParam(req, "key")
+		if !ratelimit.Default.Enforce(w, req, pool, ratelimit.Scope{Operation: key}) {
+			return
+		}
+		start := time.Now()
 		var body struct {
 			DecisionID string         `json:"decision_id"`
 			Inputs     map[string]any `json:"inputs"`
+			Mode       string         `json:"mode"`
+			RunAt      string         `json:"run_at"`
 		}
 		_ = json.NewDecoder(req.Body).Decode(&body)
-		if strings.TrimSpace(body.DecisionID) == "" {
-			w.Header().Set("Content-Type", "application/problem+json")
-			w.WriteHeader(http.StatusConflict)
-			_ = json.NewEncoder(w).Encode(map[string]any{
-				"type":   problems.Type("preflight-required"),
-				"title":  "Preflight required",
-				"detail": "Call eligibility first and pass decision_id to execute",
-			})
+		runAt, err := parseRunAt(body.RunAt)
+		if err != nil {
+			writeProblem(w, http.StatusBadRequest, problems.Type("invalid-run-at"), "Invalid run_at", "run_at must be an RFC3339 timestamp")
 			return
 		}
-		// Validate decision binding against action and recomputed facts hash
-		if ok, prob := ValidateAndBindDecision(ctx, pool, tenant.ID, body.DecisionID, key, body.Inputs); !ok {
+		async := strings.EqualFold(body.Mode, "async") || strings.Contains(strings.ToLower(req.Header.Get("Prefer")), "respond-async")
+		out := execute(ctx, pool, tenant.ID, key, body.DecisionID, body.Inputs, async, runAt, resolveFacts(pool, tenant.ID))
+		if out.problem {
+			w.Header().Set("Content-Type", "application/problem+json")
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		if out.location != "" {
+			w.Header().Set("Location", out.location)
+		}
+		w.WriteHeader(out.status)
+		_ = json.NewEncoder(w).Encode(out.body)
+		recordUsage(ctx, pool, tenant.ID, key, usageExecute, out.status, start)
+	})
+	// Batch items are limited and metered one by one, as the single calls they stand for.
+	r.Post("/v1/actions:batchPreflight", func(w http.ResponseWriter, req *http.Request) {
+		batchPreflight(w, req, pool)
+	})
+	r.Post("/v1/actions:batchExecute", func(w http.ResponseWriter, req *http.Request) {
+		batchExecute(w, req, pool)
+	})
+	r.Get("/v1/executions/{id}", func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		tenant := middleware.TenantFrom(ctx)
+		res, ok := orchestrator.GetExecution(ctx, pool, tenant.ID, chi.URLParam(req, "id"))
+		if !ok {
 			w.Header().Set("Content-Type", "application/problem+json")
-			w.WriteHeader(http.StatusConflict)
-			_ = json.NewEncoder(w).Encode(prob)
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(map[string]any{
+				"type":   problems.Type("execution-not-found"),
+				"title":  "Execution not found",
+				"detail": "The execution id is unknown or not accessible",
+			})
 			return
 		}
-		res, _ := orchestrator.Execute(ctx, pool, tenant.ID, key, body.DecisionID, body.Inputs)
 		w.Header().Set("Content-Type", "application/json")
 		_ = json.NewEncoder(w).Encode(res)
 	})
+	r.Get("/v1/executions/{id}/events", func(w http.ResponseWriter, req *http.Request) {
+		streamExecutionEvents(w, req, pool)
+	})
+	registerConnections(r, pool)
+}
+
+// streamExecutionEvents serves an execution's progress as Server-Sent Events.
+// Events are polled from execution_events; the stream ends after a terminal
+// status event. Clients resume with Last-Event-ID (or ?last_event_id=).
+func streamExecutionEvents(w http.ResponseWriter, req *http.Request, pool *pgxpool.Pool) {
+	ctx := req.Context()
+	tenant := middleware.TenantFrom(ctx)
+	id := chi.URLParam(req, "id")
+	if _, ok := orchestrator.GetExecution(ctx, pool, tenant.ID, id); !ok {
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"type":   problems.Type("execution-not-found"),
+			"title":  "Execution not found",
+			"detail": "The execution id is unknown or not accessible",
+		})
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming_unsupported", http.StatusInternalServerError)
+		return
+	}
+	lastID := req.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = req.URL.Query().Get("last_event_id")
+	}
+	after, _ := strconv.ParseInt(strings.TrimSpace(lastID), 10, 64)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	poll := time.NewTicker(500 * time.Millisecond)
+	defer poll.Stop()
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		events, err := orchestrator.ListEvents(ctx, pool, tenant.ID, id, after)
+		if err != nil {
+			return
+		}
+		for _, ev := range events {
+			data, _ := json.Marshal(ev.Data)
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.Seq, ev.Type, data)
+			after = ev.Seq
+		}
+		if len(events) > 0 {
+			flusher.Flush()
+			last := events[len(events)-1]
+			if st, _ := last.Data["status"].(string); last.Type == orchestrator.EventStatus && orchestrator.Terminal(st) {
+				return
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-poll.C:
+		}
+	}
 }
@@ -0,0 +1,112 @@
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"lamdis/internal/facts"
+	"lamdis/internal/orchestrator"
+	"lamdis/pkg/problems"
+)
+
+const (
+	// defaultScheduleTTL is how far ahead a decision may be scheduled when the
+	// policy does not return schedule_ttl_seconds.
+	defaultScheduleTTL = 7 * 24 * time.Hour
+	// scheduledDecisionGrace keeps a scheduled decision valid for a while after
+	// run_at so queue lag or a retried job does not expire it.
+	scheduledDecisionGrace = 15 * time.Minute
+)
+
+// parseRunAt parses an RFC3339 run_at. Empty or non-future values return nil,
+// meaning the execution runs now.
+func parseRunAt(s string) (*time.Time, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return nil, err
+	}
+	if !t.After(time.Now()) {
+		return nil, nil
+	}
+	return &t, nil
+}
+
+// bindSchedule checks runAt against the decision's schedule window and extends
+// the decision's validity to cover the scheduled run.
+func bindSchedule(ctx context.Context, pool *pgxpool.Pool, tenantID, decisionID string, runAt time.Time) (bool, map[string]any) {
+	var until *time.Time
+	row := pool.QueryRow(ctx, `WITH s AS (
+		SELECT set_config('app.tenant_id', $1, true)
+	) SELECT schedule_until FROM decisions WHERE tenant_id=$1 AND id=$2`, tenantID, decisionID)
+	if err := row.Scan(&until); err != nil {
+		return false, problem(problems.Type("invalid-decision"), "Invalid decision id", "The provided decision_id is unknown or not accessible")
+	}
+	if until == nil || runAt.After(*until) {
+		detail := "The decision does not allow scheduling"
+		if until != nil {
+			detail = fmt.Sprintf("The decision may only be scheduled until %s", until.UTC().Format(time.RFC3339))
+		}
+		return false, problem(problems.Type("schedule-out-of-range"), "Schedule out of range", detail)
+	}
+	if _, err := pool.Exec(ctx, `WITH s AS (
+		SELECT set_config('app.tenant_id', $1, true)
+	) UPDATE decisions SET scheduled_expires_at=GREATEST(COALESCE(scheduled_expires_at,$3),$3) WHERE tenant_id=$1 AND id=$2`,
+		tenantID, decisionID, runAt.Add(scheduledDecisionGrace)); err != nil {
+		return false, problem(problems.Type("schedule-failed"), "Execution could not be scheduled", "")
+	}
+	return true, nil
+}
+
+// RevalidateScheduled returns the check run when a scheduled execution fires.
+// The decision must still exist and allow the action and its scheduled
+// validity must not have lapsed. Facts are re-resolved and the published
+// policy re-evaluated, so facts may legitimately differ from preflight time
+// but the action runs only if policy still allows it, and then with the
+// re-resolved facts.
+func RevalidateScheduled(pool *pgxpool.Pool) orchestrator.RevalidateFunc {
+	return func(ctx context.Context, tenantID, actionKey, decisionID string, inputs map[string]any) (map[string]any, bool, map[string]any) {
+		if pool == nil {
+			return nil, true, nil
+		}
+		var status, storedAction string
+		var storedInputs []byte
+		var scheduledExpiresAt *time.Time
+		row := pool.QueryRow(ctx, `WITH s AS (
+			SELECT set_config('app.tenant_id', $1, true)
+		) SELECT status, action_key, COALESCE(inputs,'null'::jsonb), scheduled_expires_at FROM decisions WHERE tenant_id=$1 AND id=$2`, tenantID, decisionID)
+		if err := row.Scan(&status, &storedAction, &storedInputs, &scheduledExpiresAt); err != nil {
+			return nil, false, problem(problems.Type("invalid-decision"), "Invalid decision id", "The scheduled execution's decision no longer exists")
+		}
+		if storedAction != actionKey {
+			return nil, false, problem(problems.Type("decision-mismatch"), "Decision mismatch", "The decision_id does not match this action")
+		}
+		if status != string(Allow) && status != string(AllowWithConditions) {
+			return nil, false, problem(problems.Type("decision-blocked"), "Decision is blocked", "The decision is not allowed for execution")
+		}
+		if scheduledExpiresAt == nil || scheduledExpiresAt.Before(time.Now()) {
+			return nil, false, problem(problems.Type("decision-expired"), "Decision expired", "The scheduled decision expired before the execution ran")
+		}
+		// Inputs stay bound to the decision; only facts are allowed to move.
+		var decided map[string]any
+		_ = json.Unmarshal(storedInputs, &decided)
+		if string(mustJSON(decided)) != string(mustJSON(inputs)) {
+			return nil, false, problem(problems.Type("decision-mismatch"), "Decision mismatch", "Inputs differ from the decision's inputs")
+		}
+		fa, _ := facts.ResolveFacts(ctx, pool, tenantID, actionKey, inputs)
+		dec, _ := Evaluate(ctx, pool, tenantID, actionKey, inputs, fa)
+		if dec.Status != Allow && dec.Status != AllowWithConditions {
+			p := problem(problems.Type("decision-revoked"), "Policy no longer allows this action", "Re-evaluation at run time returned "+string(dec.Status))
+			p["reasons"] = dec.Reasons
+			return nil, false, p
+		}
+		return fa, true, nil
+	}
+}
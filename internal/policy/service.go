@@ -8,8 +8,6 @@ import (
 	"fmt"
 	"time"
 
-	"lamdis/internal/facts"
-
 	"lamdis/pkg/problems"
 
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -36,6 +34,9 @@ type Decision struct {
 	Needs         any            `json:"needs,omitempty"`
 	Alternatives  any            `json:"alternatives,omitempty"`
 	ExpiresAt     *time.Time     `json:"expires_at,omitempty"`
+	// ScheduleUntil is the latest run_at this decision may be scheduled for.
+	// It is independent of ExpiresAt, which only bounds immediate execution.
+	ScheduleUntil *time.Time `json:"schedule_until,omitempty"`
 }
 
 // Evaluate loads the latest published policy for the tenant and evaluates it with inputs and facts.
@@ -53,7 +54,8 @@ func Evaluate(ctx context.Context, pool *pgxpool.Pool, tenantID, actionKey strin
 	if mod == "" {
 		// short TTL by default
 		t := time.Now().Add(15 * time.Minute)
-		return Decision{ActionKey: actionKey, Inputs: inputs, Facts: facts, PolicyVersion: ver, Status: Allow, ExpiresAt: &t}, nil
+		su := time.Now().Add(defaultScheduleTTL)
+		return Decision{ActionKey: actionKey, Inputs: inputs, Facts: facts, PolicyVersion: ver, Status: Allow, ExpiresAt: &t, ScheduleUntil: &su}, nil
 	}
 	// Evaluate rego entrypoint `data.policy.decide`
 	r := rego.New(
@@ -93,10 +95,20 @@ func Evaluate(ctx context.Context, pool *pgxpool.Pool, tenantID, actionKey strin
 			t := time.Now().Add(15 * time.Minute)
 			dec.ExpiresAt = &t
 		}
+		// schedule_ttl_seconds bounds how far ahead the decision may be scheduled
+		if ttl, ok := m["schedule_ttl_seconds"].(float64); ok && ttl > 0 {
+			t := time.Now().Add(time.Duration(ttl) * time.Second)
+			dec.ScheduleUntil = &t
+		} else {
+			t := time.Now().Add(defaultScheduleTTL)
+			dec.ScheduleUntil = &t
+		}
 	} else {
 		dec.Status = Allow
 		t := time.Now().Add(15 * time.Minute)
 		dec.ExpiresAt = &t
+		su := time.Now().Add(defaultScheduleTTL)
+		dec.ScheduleUntil = &su
 	}
 	return dec, nil
 }
@@ -111,8 +123,8 @@ func PersistDecision(ctx context.Context, pool *pgxpool.Pool, tenantID string, d
 	hash := hex.EncodeToString(h[:])
 	row := pool.QueryRow(ctx, `WITH s AS (
 		SELECT set_config('app.tenant_id', $1, true)
-	) INSERT INTO decisions(tenant_id, action_key, inputs, facts, policy_version, status, reasons, needs, alternatives, hash, expires_at)
-	  VALUES ($1::uuid,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11) RETURNING id`, tenantID, d.ActionKey, toJSON(d.Inputs), toJSON(d.Facts), d.PolicyVersion, string(d.Status), toJSON(d.Reasons), toJSON(d.Needs), toJSON(d.Alternatives), hash, d.ExpiresAt)
+	) INSERT INTO decisions(tenant_id, action_key, inputs, facts, policy_version, status, reasons, needs, alternatives, hash, expires_at, schedule_until)
+	  VALUES ($1::uuid,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12) RETURNING id`, tenantID, d.ActionKey, toJSON(d.Inputs), toJSON(d.Facts), d.PolicyVersion, string(d.Status), toJSON(d.Reasons), toJSON(d.Needs), toJSON(d.Alternatives), hash, d.ExpiresAt, d.ScheduleUntil)
 	var id string
 	if err := row.Scan(&id); err != nil {
 		return "", err
@@ -156,6 +168,11 @@ func problem(tp, title, detail string) map[string]any {
 // ValidateAndBindDecision ensures the decision is executable, matches action_key,
 // is not expired, and that the binding hash for inputs+facts+policy_version matches.
 func ValidateAndBindDecision(ctx context.Context, pool *pgxpool.Pool, tenantID, decisionID, actionKey string, inputs map[string]any) (bool, map[string]any) {
+	return validateAndBind(ctx, pool, tenantID, decisionID, actionKey, inputs, resolveFacts(pool, tenantID))
+}
+
+// validateAndBind is ValidateAndBindDecision with facts resolved by resolve.
+func validateAndBind(ctx context.Context, pool *pgxpool.Pool, tenantID, decisionID, actionKey string, inputs map[string]any, resolve factsResolver) (bool, map[string]any) {
 	if pool == nil {
 		return true, nil
 	}
@@ -178,7 +195,7 @@ func ValidateAndBindDecision(ctx context.Context, pool *pgxpool.Pool, tenantID,
 		return false, problem(problems.Type("decision-expired"), "Decision expired", "The decision has expired; call eligibility again")
 	}
 	// Recompute facts with provided inputs and compare hash
-	fa, _ := facts.ResolveFacts(ctx, pool, tenantID, actionKey, inputs)
+	fa := resolve(ctx, actionKey, inputs)
 	h := sha256.Sum256([]byte(fmt.Sprintf("%x|%x|%d", mustJSON(inputs), mustJSON(fa), ver)))
 	calc := hex.EncodeToString(h[:])
 	if storedHash != "" && storedHash != calc {
@@ -0,0 +1,30 @@
+package policy
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"lamdis/pkg/middleware"
+)
+
+// Usage modes of action calls in usage_events.
+const (
+	usagePreflight = "preflight"
+	usageExecute   = "execute"
+)
+
+// recordUsage writes the usage_events row for one admitted action call, which
+// the monthly quota is counted from. Batch items are recorded one by one,
+// under the path of the single-action endpoint they stand for.
+func recordUsage(ctx context.Context, pool *pgxpool.Pool, tenantID, key, mode string, status int, start time.Time) {
+	if pool == nil || tenantID == "" {
+		return
+	}
+	reqID, _ := ctx.Value(middleware.CtxKeyRequestID).(string)
+	_, _ = pool.Exec(ctx, `
+		INSERT INTO usage_events(tenant_id, action_id, method, path, mode, rail, actor_sub, request_id, status_code, duration_ms, started_at, finished_at)
+		VALUES ($1,$2,'POST',$3,$4,'',$5,$6,$7,$8,$9,$10)
+	`, tenantID, key, "/v1/actions/"+key+"/"+mode, mode, middleware.ActorSub(ctx), reqID, status, int(time.Since(start).Milliseconds()), start.UTC(), time.Now().UTC())
+}
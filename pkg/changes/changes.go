@@ -0,0 +1,110 @@
+// Package changes carries configuration change events from admin-api to the
+// services caching that configuration, over Postgres LISTEN/NOTIFY.
+//
+// Events name what changed and for which tenant; followers drop the matching
+// cache entries. Delivery is best effort: caches keep a TTL as a safety net,
+// and a follower that (re)connects treats everything as changed because
+// events sent while it was not listening are lost.
+package changes
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.uber.org/zap"
+)
+
+// Channel is the notification channel events are sent on.
+const Channel = "lamdis_changes"
+
+// Topic names a kind of configuration.
+type Topic string
+
+const (
+	// Connectors covers a tenant's connector definitions, their operations
+	// and which connectors the tenant has enabled.
+	Connectors Topic = "connectors"
+	// RateLimits covers tenant plans and rate limits.
+	RateLimits Topic = "rate_limits"
+)
+
+// Event reports a change. An empty TenantID means every tenant; an empty
+// Topic means every topic.
+type Event struct {
+	Topic    Topic  `json:"topic,omitempty"`
+	TenantID string `json:"tenant_id,omitempty"`
+}
+
+// Affects reports whether caches of topic t must be dropped for the event.
+func (e Event) Affects(t Topic) bool { return e.Topic == "" || e.Topic == t }
+
+// Publish sends the event to every follower. Without a database it is a no-op.
+func Publish(ctx context.Context, pool *pgxpool.Pool, ev Event) error {
+	if pool == nil {
+		return nil
+	}
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = pool.Exec(ctx, `SELECT pg_notify($1, $2)`, Channel, string(payload))
+	return err
+}
+
+// maxBackoff caps the wait between reconnect attempts.
+const maxBackoff = 30 * time.Second
+
+// Follow calls fn for every event until ctx is done, reconnecting with backoff
+// when the listening connection fails. fn is called with the empty Event
+// whenever listening (re)starts. Without a database Follow returns at once.
+func Follow(ctx context.Context, pool *pgxpool.Pool, log *zap.SugaredLogger, fn func(Event)) {
+	if pool == nil {
+		return
+	}
+	backoff := time.Second
+	for {
+		listening, err := listen(ctx, pool, fn)
+		if ctx.Err() != nil {
+			return
+		}
+		if listening {
+			backoff = time.Second
+		}
+		log.Warnw("change events", "err", err, "retry_in", backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxBackoff)
+	}
+}
+
+// listen holds a dedicated connection for LISTEN and reports whether it got
+// as far as listening before failing.
+func listen(ctx context.Context, pool *pgxpool.Pool, fn func(Event)) (bool, error) {
+	pc, err := pool.Acquire(ctx)
+	if err != nil {
+		return false, err
+	}
+	// The connection stays subscribed, so it is closed rather than returned to the pool.
+	conn := pc.Hijack()
+	defer conn.Close(context.Background())
+	if _, err := conn.Exec(ctx, "LISTEN "+Channel); err != nil {
+		return false, err
+	}
+	fn(Event{})
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return true, err
+		}
+		var ev Event
+		if json.Unmarshal([]byte(n.Payload), &ev) != nil {
+			continue
+		}
+		fn(ev)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/joho/godotenv"
@@ -28,23 +29,44 @@ type Config struct {
 	// Redis & Postgres
 	RedisURL    string
 	DatabaseURL string
+
+	// How long connector operations stay cached when services follow change
+	// events from admin-api; the TTL only matters if an event is lost.
+	RegistryCacheTTL time.Duration
+
+	// Async execution workers (policy-service)
+	ExecWorkers           int
+	ExecVisibilityTimeout time.Duration
+	ExecDrainTimeout      time.Duration // how long in-flight jobs may run on after shutdown starts
+
+	// Egress baseline for connector upstream calls (tenants may narrow it further)
+	EgressRequireHTTPS bool     // default true when LAMDIS_ENV=prod
+	EgressAllowPrivate bool     // permit private/loopback/link-local upstreams (local development)
+	EgressPrivateCIDRs []string // specific private ranges upstreams may use
 }
 
 func Load() Config {
 	_ = godotenv.Load()
 	cfg := Config{
-		Env:                  env("LAMDIS_ENV", "dev"),
-		HTTPAddr:             env("LAMDIS_HTTP_ADDR", ":8080"),
-		ManifestAddr:         env("LAMDIS_MANIFEST_ADDR", ":8081"),
-		DefaultBasePublicURL: env("BASE_PUBLIC_URL", "http://localhost:8080"),
-		Issuer:               env("OIDC_ISSUER", ""),
-		Audience:             env("OIDC_AUDIENCE", "lamdis-gateway"),
-		JWKSURL:              env("JWKS_URL", ""),
-		RequireDPoP:          envBool("REQUIRE_DPOP", false),
-		DPoPClockSkew:        envDur("DPOP_CLOCK_SKEW_SEC", 60) * time.Second,
-		RedisURL:             env("REDIS_URL", ""),
-		DatabaseURL:          env("DATABASE_URL", ""),
+		Env:                   env("LAMDIS_ENV", "dev"),
+		HTTPAddr:              env("LAMDIS_HTTP_ADDR", ":8080"),
+		ManifestAddr:          env("LAMDIS_MANIFEST_ADDR", ":8081"),
+		DefaultBasePublicURL:  env("BASE_PUBLIC_URL", "http://localhost:8080"),
+		Issuer:                env("OIDC_ISSUER", ""),
+		Audience:              env("OIDC_AUDIENCE", "lamdis-gateway"),
+		JWKSURL:               env("JWKS_URL", ""),
+		RequireDPoP:           envBool("REQUIRE_DPOP", false),
+		DPoPClockSkew:         envDur("DPOP_CLOCK_SKEW_SEC", 60) * time.Second,
+		RedisURL:              env("REDIS_URL", ""),
+		DatabaseURL:           env("DATABASE_URL", ""),
+		RegistryCacheTTL:      envDur("REGISTRY_CACHE_TTL_SEC", 30) * time.Second,
+		ExecWorkers:           envInt("EXEC_WORKERS", 4),
+		ExecVisibilityTimeout: envDur("EXEC_VISIBILITY_TIMEOUT_SEC", 300) * time.Second,
+		ExecDrainTimeout:      envDur("EXEC_DRAIN_TIMEOUT_SEC", 60) * time.Second,
 	}
+	cfg.EgressRequireHTTPS = envBool("EGRESS_REQUIRE_HTTPS", cfg.Env == "prod")
+	cfg.EgressAllowPrivate = envBool("EGRESS_ALLOW_PRIVATE", false)
+	cfg.EgressPrivateCIDRs = envList("EGRESS_PRIVATE_CIDRS")
 	if cfg.DatabaseURL == "" {
 		log.Println("[WARN] DATABASE_URL not set — using in-memory tenant provider for dev")
 	}
@@ -64,6 +86,14 @@ func envBool(k string, def bool) bool {
 	}
 	return def
 }
+func envInt(k string, def int) int {
+	if v := os.Getenv(k); v != "" {
+		if i, err := strconv.Atoi(v); err == nil {
+			return i
+		}
+	}
+	return def
+}
 func envDur(k string, def int) time.Duration {
 	if v := os.Getenv(k); v != "" {
 		i, _ := strconv.Atoi(v)
@@ -71,3 +101,12 @@ func envDur(k string, def int) time.Duration {
 	}
 	return time.Duration(def)
 }
+func envList(k string) []string {
+	var out []string
+	for _, v := range strings.Split(os.Getenv(k), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
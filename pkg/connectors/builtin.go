@@ -0,0 +1,104 @@
+package connectors
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Canonical operations builtin connectors execute. Inputs and results:
+//
+//	orders.locate    email, order_number, phone       -> {"matches": [order...]}
+//	orders.status    id                               -> {"status": "...", "order": {...}}
+//	orders.cancel    id, reason                       -> {"accepted": bool, "status": "..."}
+//	refunds.request  id, amount, currency, reason, items -> {"case_id": "...", "status": "..."}
+//	reorder.link     id                               -> {"link": "https://..."}
+//
+// Inputs also carry "mode", the mode the call was admitted in (ModeExecute or
+// ModeRequest); rails that distinguish them file the action for fulfilment in
+// request mode instead of performing it.
+const (
+	OpOrdersLocate   = "orders.locate"
+	OpOrdersStatus   = "orders.status"
+	OpOrdersCancel   = "orders.cancel"
+	OpRefundsRequest = "refunds.request"
+	OpReorderLink    = "reorder.link"
+)
+
+// Canonical modes, strongest first. Refer calls never reach the connector: the
+// caller is handed the decision's reasons and alternatives instead.
+const (
+	ModeExecute = "execute"
+	ModeRequest = "request"
+	ModeRefer   = "refer"
+)
+
+var modeRank = map[string]int{ModeRefer: 0, ModeRequest: 1, ModeExecute: 2}
+
+// WeakerMode returns the weaker of two modes; unknown modes are ignored.
+func WeakerMode(a, b string) string {
+	ra, okA := modeRank[a]
+	rb, okB := modeRank[b]
+	if !okA || (okB && rb < ra) {
+		return b
+	}
+	return a
+}
+
+var (
+	// ErrUnsupported is returned by Execute for operations the connector does not implement.
+	ErrUnsupported = errors.New("operation not supported by connector")
+	// ErrNotFound is returned by Execute when the referenced order does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrInvalidInput wraps input problems reported by Execute or the rail behind it.
+	ErrInvalidInput = errors.New("invalid input")
+	// ErrRailNotEnabled is returned by TenantBuiltin for rails the tenant has not enabled.
+	ErrRailNotEnabled = errors.New("rail not enabled")
+)
+
+// TenantBuiltin instantiates the enabled registry connector a tenant refers to
+// as rail, matched on connector id or kind.
+func (r *Registry) TenantBuiltin(ctx context.Context, tenantID, rail string) (Builtin, ConnectorRecord, error) {
+	recs, err := r.ListTenantConnectors(ctx, tenantID)
+	if err != nil {
+		return nil, ConnectorRecord{}, err
+	}
+	for _, rec := range recs {
+		if rec.ID == rail || rec.Kind == rail {
+			b, err := r.InstantiateBuiltin(rec)
+			if err != nil {
+				return nil, rec, fmt.Errorf("rail %s: %w", rail, err)
+			}
+			return b, rec, nil
+		}
+	}
+	return nil, ConnectorRecord{}, fmt.Errorf("%w: %s", ErrRailNotEnabled, rail)
+}
+
+// TenantRail is an enabled registry connector and its builtin, or the error
+// instantiating it.
+type TenantRail struct {
+	Record  ConnectorRecord
+	Builtin Builtin
+	Err     error
+}
+
+// TenantBuiltins instantiates the tenant's enabled registry connectors that
+// declare capability (a canonical operation) in the connectors registry.
+func (r *Registry) TenantBuiltins(ctx context.Context, tenantID, capability string) ([]TenantRail, error) {
+	recs, err := r.ListTenantConnectors(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	var out []TenantRail
+	for _, rec := range recs {
+		for _, c := range rec.Capabilities {
+			if c == capability {
+				b, err := r.InstantiateBuiltin(rec)
+				out = append(out, TenantRail{Record: rec, Builtin: b, Err: err})
+				break
+			}
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,26 @@
+package connectors
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"lamdis/pkg/upstream"
+)
+
+// LoadEgressPolicy returns the tenant's egress policy (tenants.egress_policy).
+// The zero policy is returned without a database or when none is configured;
+// the upstream client's baseline still applies to it.
+func LoadEgressPolicy(ctx context.Context, pool *pgxpool.Pool, tenantID string) upstream.EgressPolicy {
+	var p upstream.EgressPolicy
+	if pool == nil || tenantID == "" {
+		return p
+	}
+	var raw []byte
+	if err := pool.QueryRow(ctx, `SELECT COALESCE(egress_policy,'{}'::jsonb) FROM tenants WHERE id=$1`, tenantID).Scan(&raw); err != nil {
+		return p
+	}
+	_ = json.Unmarshal(raw, &p)
+	return p
+}
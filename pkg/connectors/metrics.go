@@ -0,0 +1,20 @@
+package connectors
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// registryCacheLookups counts LoadOperations cache lookups by result:
+	// "hit", "miss" (not cached) or "expired" (dropped by the TTL).
+	registryCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "lamdis_registry_cache_lookups_total",
+		Help: "Connector registry operation cache lookups by result.",
+	}, []string{"result"})
+	// registryCacheInvalidations counts cache invalidations by scope: "tenant" or "all".
+	registryCacheInvalidations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "lamdis_registry_cache_invalidations_total",
+		Help: "Connector registry operation cache invalidations by scope.",
+	}, []string{"scope"})
+)
@@ -0,0 +1,82 @@
+package connectors
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Order is the canonical order schema returned by orders.locate. Rail is the
+// connector id the order came from; it addresses the order's other canonical
+// operations (/v1/orders/{rail}/{id}/...). Rails lists every connector that
+// returned the order when several did, Rail first.
+type Order struct {
+	Rail      string   `json:"rail"`
+	Rails     []string `json:"rails,omitempty"`
+	ID        string   `json:"id"`
+	Number    string   `json:"number,omitempty"`
+	Status    string   `json:"status,omitempty"`
+	Email     string   `json:"email,omitempty"`
+	Total     *float64 `json:"total,omitempty"`
+	Currency  string   `json:"currency,omitempty"`
+	CreatedAt string   `json:"created_at,omitempty"`
+}
+
+// Key identifies an order for deduplication: its id, or its number when the
+// rail returned none. It ignores the rail, so an order several rails know is
+// one match.
+func (o Order) Key() string {
+	if o.ID != "" {
+		return "id\x00" + o.ID
+	}
+	return "number\x00" + o.Number
+}
+
+// NormalizeOrder maps a rail's order document onto the canonical schema,
+// accepting the field names common order systems use.
+func NormalizeOrder(rail string, m map[string]any) Order {
+	o := Order{
+		Rail:      rail,
+		ID:        firstString(m, "id", "order_id", "orderId"),
+		Number:    firstString(m, "number", "order_number", "orderNumber", "name"),
+		Status:    strings.ToLower(firstString(m, "status", "state", "fulfillment_status")),
+		Email:     firstString(m, "email", "customer_email", "customerEmail"),
+		Currency:  strings.ToUpper(firstString(m, "currency", "currency_code", "currencyCode")),
+		CreatedAt: firstString(m, "created_at", "createdAt", "placed_at", "date"),
+	}
+	for _, k := range []string{"total", "total_price", "totalPrice", "amount"} {
+		if f, ok := toFloat(m[k]); ok {
+			o.Total = &f
+			break
+		}
+	}
+	return o
+}
+
+func firstString(m map[string]any, keys ...string) string {
+	for _, k := range keys {
+		switch t := m[k].(type) {
+		case string:
+			if s := strings.TrimSpace(t); s != "" {
+				return s
+			}
+		case float64:
+			return strconv.FormatFloat(t, 'f', -1, 64)
+		case nil:
+		default:
+			return fmt.Sprint(t)
+		}
+	}
+	return ""
+}
+
+func toFloat(v any) (float64, bool) {
+	switch t := v.(type) {
+	case float64:
+		return t, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(t), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,117 @@
+package rail
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Fake is an in-memory rail implementing the contract, for tests and local
+// development: serve it with httptest.NewServer and point a tenant's rail
+// config at the server URL.
+type Fake struct {
+	mu      sync.Mutex
+	orders  map[string]map[string]any
+	refunds int
+	// APIKey, when set, is required as a bearer token.
+	APIKey string
+}
+
+// NewFake returns a fake rail holding the given orders, keyed by their "id".
+func NewFake(orders ...map[string]any) *Fake {
+	f := &Fake{orders: map[string]map[string]any{}}
+	for _, o := range orders {
+		if id, _ := o["id"].(string); id != "" {
+			f.orders[id] = o
+		}
+	}
+	return f
+}
+
+// Order returns a copy of a stored order.
+func (f *Fake) Order(id string) (map[string]any, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	o, ok := f.orders[id]
+	if !ok {
+		return nil, false
+	}
+	cp := make(map[string]any, len(o))
+	for k, v := range o {
+		cp[k] = v
+	}
+	return cp, true
+}
+
+func (f *Fake) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if f.APIKey != "" && r.Header.Get("Authorization") != "Bearer "+f.APIKey {
+		fakeJSON(w, http.StatusUnauthorized, map[string]any{"error": "unauthorized"})
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] != "orders" {
+		fakeJSON(w, http.StatusNotFound, map[string]any{"error": "not_found"})
+		return
+	}
+	if len(parts) == 1 && r.Method == http.MethodGet {
+		q := r.URL.Query()
+		matches := []map[string]any{}
+		for _, o := range f.orders {
+			if (q.Get("email") != "" && strings.EqualFold(fmt.Sprint(o["email"]), q.Get("email"))) ||
+				(q.Get("order_number") != "" && fmt.Sprint(o["number"]) == q.Get("order_number")) ||
+				(q.Get("phone") != "" && fmt.Sprint(o["phone"]) == q.Get("phone")) {
+				matches = append(matches, o)
+			}
+		}
+		sort.Slice(matches, func(i, j int) bool { return fmt.Sprint(matches[i]["id"]) < fmt.Sprint(matches[j]["id"]) })
+		fakeJSON(w, http.StatusOK, map[string]any{"orders": matches})
+		return
+	}
+	if len(parts) < 2 {
+		fakeJSON(w, http.StatusMethodNotAllowed, map[string]any{"error": "method_not_allowed"})
+		return
+	}
+	o, ok := f.orders[parts[1]]
+	if !ok {
+		fakeJSON(w, http.StatusNotFound, map[string]any{"error": "order_not_found"})
+		return
+	}
+	action := ""
+	if len(parts) == 3 {
+		action = parts[2]
+	}
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		fakeJSON(w, http.StatusOK, o)
+	case action == "cancel" && r.Method == http.MethodPost:
+		if s := fmt.Sprint(o["status"]); s == "shipped" || s == "delivered" {
+			fakeJSON(w, http.StatusOK, map[string]any{"accepted": false, "status": s, "reason": "order already " + s})
+			return
+		}
+		o["status"] = "cancelled"
+		fakeJSON(w, http.StatusOK, map[string]any{"accepted": true, "status": "cancelled"})
+	case action == "refunds" && r.Method == http.MethodPost:
+		var in map[string]any
+		if json.NewDecoder(r.Body).Decode(&in) != nil {
+			fakeJSON(w, http.StatusBadRequest, map[string]any{"error": "invalid json"})
+			return
+		}
+		f.refunds++
+		fakeJSON(w, http.StatusOK, map[string]any{"case_id": fmt.Sprintf("RF-%s-%d", parts[1], f.refunds), "status": "pending"})
+	case action == "reorder" && r.Method == http.MethodPost:
+		fakeJSON(w, http.StatusOK, map[string]any{"link": "https://rail.invalid/reorder/" + parts[1]})
+	default:
+		fakeJSON(w, http.StatusMethodNotAllowed, map[string]any{"error": "method_not_allowed"})
+	}
+}
+
+func fakeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
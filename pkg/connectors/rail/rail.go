@@ -0,0 +1,193 @@
+// Package rail is the reference builtin connector: a commerce rail reached
+// over a small JSON REST contract, so any order system exposing it (directly
+// or through an adapter) can back the canonical order operations.
+//
+//	GET  {base_url}/orders?email=&order_number=&phone=  -> {"orders": [order...]}
+//	GET  {base_url}/orders/{id}                         -> order
+//	POST {base_url}/orders/{id}/cancel   {"reason", "mode"}
+//	                                                    -> {"accepted": bool, "status": "..."}
+//	POST {base_url}/orders/{id}/refunds  {"amount", "currency", "reason", "items", "mode"}
+//	                                                    -> {"case_id": "...", "status": "..."}
+//	POST {base_url}/orders/{id}/reorder                 -> {"link": "https://..."}
+//
+// An order is {"id", "number", "status", "email", "total", "currency",
+// "created_at"}; mode is "execute", or "request" to file the action for review.
+// 404 means the order does not exist; 400 and 422 reject the inputs with
+// {"error": "..."}.
+//
+// Registry connectors of kind "rail" are backed by this package. Tenant config:
+// base_url (required), timeout_ms and auth_header; secrets: api_key, sent as a
+// bearer token or, when auth_header is set, as that header's value. Fake
+// implements the contract in memory for tests and local development.
+package rail
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"lamdis/pkg/connectors"
+	"lamdis/pkg/upstream"
+)
+
+// Kind is the registry kind served by this package.
+const Kind = "rail"
+
+// Rail is a configured rail connector.
+type Rail struct {
+	baseURL    string
+	apiKey     string
+	authHeader string
+	opts       upstream.CallOptions
+	client     *upstream.Client
+}
+
+// New is the connectors.Factory for Kind.
+func New(cfg, secret map[string]any) (connectors.Builtin, error) {
+	base, _ := cfg["base_url"].(string)
+	if u, err := url.Parse(base); err != nil || !u.IsAbs() {
+		return nil, errors.New("rail config: base_url must be an absolute url")
+	}
+	r := &Rail{baseURL: strings.TrimRight(base, "/"), client: upstream.Default}
+	r.apiKey, _ = secret["api_key"].(string)
+	r.authHeader, _ = cfg["auth_header"].(string)
+	if ms, ok := cfg["timeout_ms"].(float64); ok {
+		r.opts.TimeoutMS = int(ms)
+	}
+	return r, nil
+}
+
+// Register adds the rail factory to a registry.
+func Register(reg *connectors.Registry) { reg.RegisterFactory(Kind, New) }
+
+func (r *Rail) Name() string { return Kind }
+
+func (r *Rail) Operations() []connectors.OperationMeta {
+	return []connectors.OperationMeta{
+		{Method: "GET", Path: "/orders", Summary: "Find orders by email, number or phone"},
+		{Method: "GET", Path: "/orders/{id}", Summary: "Get an order"},
+		{Method: "POST", Path: "/orders/{id}/cancel", Summary: "Cancel an order"},
+		{Method: "POST", Path: "/orders/{id}/refunds", Summary: "Request a refund"},
+		{Method: "POST", Path: "/orders/{id}/reorder", Summary: "Create a reorder link"},
+	}
+}
+
+// Execute implements connectors.Builtin.
+func (r *Rail) Execute(ctx context.Context, op string, inputs map[string]any) (map[string]any, error) {
+	switch op {
+	case connectors.OpOrdersLocate:
+		q := url.Values{}
+		for _, k := range []string{"email", "order_number", "phone"} {
+			if v := str(inputs[k]); v != "" {
+				q.Set(k, v)
+			}
+		}
+		if len(q) == 0 {
+			return nil, fmt.Errorf("%w: one of email, order_number or phone is required", connectors.ErrInvalidInput)
+		}
+		var out struct {
+			Orders []map[string]any `json:"orders"`
+		}
+		if err := r.call(ctx, http.MethodGet, "/orders?"+q.Encode(), nil, &out); err != nil {
+			return nil, err
+		}
+		if out.Orders == nil {
+			out.Orders = []map[string]any{}
+		}
+		return map[string]any{"matches": out.Orders}, nil
+	case connectors.OpOrdersStatus:
+		id, err := orderID(inputs)
+		if err != nil {
+			return nil, err
+		}
+		var order map[string]any
+		if err := r.call(ctx, http.MethodGet, "/orders/"+id, nil, &order); err != nil {
+			return nil, err
+		}
+		return map[string]any{"status": order["status"], "order": order}, nil
+	case connectors.OpOrdersCancel:
+		return r.post(ctx, inputs, "/cancel", "reason", "mode")
+	case connectors.OpRefundsRequest:
+		return r.post(ctx, inputs, "/refunds", "amount", "currency", "reason", "items", "mode")
+	case connectors.OpReorderLink:
+		return r.post(ctx, inputs, "/reorder")
+	}
+	return nil, fmt.Errorf("%w: %s", connectors.ErrUnsupported, op)
+}
+
+// post sends the named inputs to an order sub-resource.
+func (r *Rail) post(ctx context.Context, inputs map[string]any, suffix string, fields ...string) (map[string]any, error) {
+	id, err := orderID(inputs)
+	if err != nil {
+		return nil, err
+	}
+	body := map[string]any{}
+	for _, f := range fields {
+		if v, ok := inputs[f]; ok && v != nil {
+			body[f] = v
+		}
+	}
+	out := map[string]any{}
+	if err := r.call(ctx, http.MethodPost, "/orders/"+id+suffix, body, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (r *Rail) call(ctx context.Context, method, path string, body any, out any) error {
+	req := upstream.Request{Method: method, URL: r.baseURL + path, Header: http.Header{"Accept": {"application/json"}}}
+	if body != nil {
+		req.Body, _ = json.Marshal(body)
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if r.apiKey != "" {
+		if r.authHeader != "" {
+			req.Header.Set(r.authHeader, r.apiKey)
+		} else {
+			req.Header.Set("Authorization", "Bearer "+r.apiKey)
+		}
+	}
+	resp, _, err := r.client.Do(ctx, req, r.opts)
+	if err != nil {
+		return err
+	}
+	switch {
+	case resp.Status == http.StatusNotFound:
+		return connectors.ErrNotFound
+	case resp.Status == http.StatusBadRequest || resp.Status == http.StatusUnprocessableEntity:
+		var e struct {
+			Error string `json:"error"`
+		}
+		_ = json.Unmarshal(resp.Body, &e)
+		return fmt.Errorf("%w: %s", connectors.ErrInvalidInput, e.Error)
+	case resp.Status < 200 || resp.Status > 299:
+		return fmt.Errorf("rail returned status %d", resp.Status)
+	}
+	if err := json.Unmarshal(resp.Body, out); err != nil {
+		return fmt.Errorf("rail returned invalid json: %w", err)
+	}
+	return nil
+}
+
+func orderID(inputs map[string]any) (string, error) {
+	id := str(inputs["id"])
+	if id == "" {
+		return "", fmt.Errorf("%w: id is required", connectors.ErrInvalidInput)
+	}
+	return url.PathEscape(id), nil
+}
+
+func str(v any) string {
+	switch t := v.(type) {
+	case string:
+		return strings.TrimSpace(t)
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	}
+	return ""
+}
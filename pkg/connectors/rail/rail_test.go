@@ -0,0 +1,136 @@
+package rail
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"lamdis/pkg/connectors"
+	"lamdis/pkg/upstream"
+)
+
+// newTestRail serves a Fake holding two orders and returns a rail configured
+// against it.
+func newTestRail(t *testing.T, cfg map[string]any, secret map[string]any) (connectors.Builtin, *Fake) {
+	t.Helper()
+	// The fake listens on loopback, which the default egress baseline allows
+	// only when private addresses are permitted.
+	upstream.Default.SetEgressBaseline(upstream.EgressPolicy{AllowPrivate: true})
+	fake := NewFake(
+		map[string]any{"id": "o-1", "number": "1001", "status": "paid", "email": "ada@example.com", "total": 42.5, "currency": "EUR"},
+		map[string]any{"id": "o-2", "number": "1002", "status": "shipped", "email": "ada@example.com", "total": 10.0, "currency": "EUR"},
+	)
+	fake.APIKey = "k-123"
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	if cfg == nil {
+		cfg = map[string]any{}
+	}
+	cfg["base_url"] = srv.URL
+	if secret == nil {
+		secret = map[string]any{"api_key": "k-123"}
+	}
+	r, err := New(cfg, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, fake
+}
+
+func TestRailAgainstFake(t *testing.T) {
+	r, fake := newTestRail(t, nil, nil)
+	ctx := context.Background()
+
+	out, err := r.Execute(ctx, connectors.OpOrdersLocate, map[string]any{"email": "ADA@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, _ := out["matches"].([]map[string]any); len(m) != 2 || m[0]["id"] != "o-1" {
+		t.Fatalf("locate: %v", out)
+	}
+
+	out, err = r.Execute(ctx, connectors.OpOrdersStatus, map[string]any{"id": "o-1"})
+	if err != nil || out["status"] != "paid" {
+		t.Fatalf("status: %v %v", out, err)
+	}
+
+	out, err = r.Execute(ctx, connectors.OpOrdersCancel, map[string]any{"id": "o-1", "reason": "changed mind"})
+	if err != nil || out["accepted"] != true {
+		t.Fatalf("cancel: %v %v", out, err)
+	}
+	if o, _ := fake.Order("o-1"); o["status"] != "cancelled" {
+		t.Fatalf("cancelled order status %v", o["status"])
+	}
+	out, err = r.Execute(ctx, connectors.OpOrdersCancel, map[string]any{"id": "o-2"})
+	if err != nil || out["accepted"] != false {
+		t.Fatalf("cancel shipped: %v %v", out, err)
+	}
+
+	out, err = r.Execute(ctx, connectors.OpRefundsRequest, map[string]any{"id": "o-2", "amount": 10.0, "currency": "EUR"})
+	if err != nil || out["case_id"] != "RF-o-2-1" || out["status"] != "pending" {
+		t.Fatalf("refund: %v %v", out, err)
+	}
+
+	out, err = r.Execute(ctx, connectors.OpReorderLink, map[string]any{"id": "o-1"})
+	if err != nil || out["link"] != "https://rail.invalid/reorder/o-1" {
+		t.Fatalf("reorder: %v %v", out, err)
+	}
+}
+
+func TestRailErrors(t *testing.T) {
+	r, _ := newTestRail(t, nil, nil)
+	ctx := context.Background()
+	for _, tc := range []struct {
+		op     string
+		inputs map[string]any
+		want   error
+	}{
+		{connectors.OpOrdersStatus, map[string]any{"id": "missing"}, connectors.ErrNotFound},
+		{connectors.OpOrdersStatus, map[string]any{}, connectors.ErrInvalidInput},
+		{connectors.OpOrdersLocate, map[string]any{}, connectors.ErrInvalidInput},
+		{"orders.delete", map[string]any{"id": "o-1"}, connectors.ErrUnsupported},
+	} {
+		if _, err := r.Execute(ctx, tc.op, tc.inputs); !errors.Is(err, tc.want) {
+			t.Errorf("%s %v: err %v, want %v", tc.op, tc.inputs, err, tc.want)
+		}
+	}
+}
+
+func TestRailCredentials(t *testing.T) {
+	ctx := context.Background()
+	in := map[string]any{"id": "o-1"}
+
+	r, _ := newTestRail(t, nil, map[string]any{"api_key": "wrong"})
+	if _, err := r.Execute(ctx, connectors.OpOrdersStatus, in); err == nil {
+		t.Fatal("wrong api key accepted")
+	}
+	// auth_header sends the key as is in that header, which the fake does not read.
+	r, _ = newTestRail(t, map[string]any{"auth_header": "X-Api-Key"}, nil)
+	if _, err := r.Execute(ctx, connectors.OpOrdersStatus, in); err == nil {
+		t.Fatal("key sent in auth_header accepted as bearer token")
+	}
+}
+
+func TestNewRejectsRelativeBaseURL(t *testing.T) {
+	for _, cfg := range []map[string]any{{}, {"base_url": "/orders"}, {"base_url": 42}} {
+		if _, err := New(cfg, nil); err == nil {
+			t.Errorf("config %v accepted", cfg)
+		}
+	}
+}
+
+func TestRegisterAddsFactory(t *testing.T) {
+	reg := connectors.NewRegistry(nil)
+	if _, ok := reg.Factory(Kind); ok {
+		t.Fatal("factory present before Register")
+	}
+	Register(reg)
+	f, ok := reg.Factory(Kind)
+	if !ok {
+		t.Fatal("factory missing after Register")
+	}
+	if _, err := f(map[string]any{"base_url": "/orders"}, nil); err == nil {
+		t.Fatal("registered factory accepted a relative base_url")
+	}
+}
@@ -2,6 +2,8 @@ package connectors
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,6 +11,11 @@ import (
 	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
+
+	"lamdis/pkg/graphql"
+	"lamdis/pkg/grpcconn"
+	"lamdis/pkg/secrets"
+	"lamdis/pkg/upstream"
 )
 
 // ConnectorRecord represents a connector definition stored in the DB.
@@ -17,13 +24,15 @@ import (
 // - custom: dynamic HTTP proxy / template (future extension)
 // Auth configuration kept generic for now.
 type ConnectorRecord struct {
-	ID          string
-	TenantID    string
-	Kind        string // logical unique name per tenant
-	BuiltinKind string // if non-empty, name of builtin implementation (e.g. "shopify")
-	ConfigJSON  map[string]any
-	SecretJSON  map[string]any
-	Auth        map[string]any // placeholder for auth strategy (oauth2, api_key etc.)
+	ID           string
+	TenantID     string
+	Kind         string // logical unique name per tenant
+	BuiltinKind  string // if non-empty, name of builtin implementation (e.g. "shopify")
+	ConfigJSON   map[string]any
+	SecretJSON   map[string]any
+	Auth         map[string]any    // placeholder for auth strategy (oauth2, api_key etc.)
+	Capabilities []string          // canonical operations declared in the connectors registry
+	Modes        map[string]string // declared mode per capability, when given
 }
 
 type OperationMeta struct {
@@ -37,25 +46,46 @@ type OperationMeta struct {
 type Builtin interface {
 	Name() string
 	Operations() []OperationMeta
+	// Execute runs a canonical operation (see the Op constants) with its
+	// inputs and returns the operation's result document. Operations the
+	// connector does not implement return ErrUnsupported.
+	Execute(ctx context.Context, op string, inputs map[string]any) (map[string]any, error)
 }
 
 // Factory returns a builtin connector implementation given config+secrets (as maps) if needed.
 type Factory func(cfg, secret map[string]any) (Builtin, error)
 
 type operationRow struct {
-	Method  string
-	Path    string
-	Summary string
-	Scopes  []string
-	Params  []map[string]any
-	BaseURL *string // optional upstream base URL for passthrough
-	AuthRef *string // optional reference to tenant_auth_configs.id for auth injection
-	Kind    *string // connector kind namespace
+	Method      string
+	Path        string
+	Summary     string
+	Scopes      []string
+	Params      []map[string]any
+	BaseURL     *string              // optional upstream base URL for passthrough
+	AuthRef     *string              // optional reference to tenant_auth_configs.id for auth injection
+	Kind        *string              // connector kind namespace
+	CallOptions upstream.CallOptions // timeout/retry/breaker settings for upstream calls
+	Passthrough upstream.Passthrough // header forwarding and streaming of passthrough calls
+	GraphQL     *graphql.Spec        // set for operations of GraphQL connectors
+	GRPC        *GRPCOperation       // set for operations of gRPC connectors
+}
+
+// GRPCOperation is the unary method a gRPC connector operation calls.
+type GRPCOperation struct {
+	Spec        grpcconn.Spec
+	Descriptors *grpcconn.Descriptors // nil when the connector's descriptor set is missing or invalid
+}
+
+// OperationSet is a tenant's dynamic operations with a fingerprint that
+// changes whenever the operations do.
+type OperationSet struct {
+	Operations  []operationRow
+	Fingerprint string
 }
 
 type cachedTenant struct {
-	loadedAt   time.Time
-	operations []operationRow
+	loadedAt time.Time
+	set      OperationSet
 }
 
 // Registry holds builtin factories and performs DB lookups for tenant connectors.
@@ -65,32 +95,122 @@ type Registry struct {
 	mu        sync.RWMutex
 	byTenant  map[string]cachedTenant
 	ttl       time.Duration
+	epoch     uint64 // bumped by Invalidate so loads racing it are not cached
 }
 
 func NewRegistry(pool *pgxpool.Pool) *Registry {
 	return &Registry{pool: pool, factories: map[string]Factory{}, byTenant: map[string]cachedTenant{}, ttl: 30 * time.Second}
 }
 
+// SetTTL sets how long tenant operations are cached. Services following
+// change events (see pkg/changes) cache longer and keep the TTL as a safety net.
+func (r *Registry) SetTTL(ttl time.Duration) {
+	r.mu.Lock()
+	r.ttl = ttl
+	r.mu.Unlock()
+}
+
+// Invalidate drops the cached operations of a tenant, or of every tenant when
+// tenantID is empty.
+func (r *Registry) Invalidate(tenantID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.epoch++
+	if tenantID == "" {
+		r.byTenant = map[string]cachedTenant{}
+		registryCacheInvalidations.WithLabelValues("all").Inc()
+		return
+	}
+	delete(r.byTenant, tenantID)
+	registryCacheInvalidations.WithLabelValues("tenant").Inc()
+}
+
+// cached returns the tenant's cached operations if still fresh, recording the
+// lookup, and otherwise the epoch to pass to store.
+func (r *Registry) cached(tenantID string) (OperationSet, uint64, bool) {
+	r.mu.RLock()
+	c, ok := r.byTenant[tenantID]
+	fresh := ok && time.Since(c.loadedAt) < r.ttl
+	epoch := r.epoch
+	r.mu.RUnlock()
+	switch {
+	case fresh:
+		registryCacheLookups.WithLabelValues("hit").Inc()
+		return c.set, epoch, true
+	case ok:
+		registryCacheLookups.WithLabelValues("expired").Inc()
+	default:
+		registryCacheLookups.WithLabelValues("miss").Inc()
+	}
+	return OperationSet{}, epoch, false
+}
+
+// store caches operations loaded since epoch unless an invalidation came in between.
+func (r *Registry) store(tenantID string, epoch uint64, c cachedTenant) {
+	r.mu.Lock()
+	if r.epoch == epoch {
+		r.byTenant[tenantID] = c
+	}
+	r.mu.Unlock()
+}
+
 func (r *Registry) RegisterFactory(kind string, f Factory) { r.factories[kind] = f }
 
-// ListTenantConnectors loads connector records for a tenant (both builtin and custom).
+// Factory returns the factory registered for a builtin kind.
+func (r *Registry) Factory(kind string) (Factory, bool) {
+	f, ok := r.factories[kind]
+	return f, ok
+}
+
+// ListTenantConnectors loads the registry connectors a tenant has enabled, with
+// the tenant's connector config and opened secrets. BuiltinKind is the registry
+// kind, which names the factory implementing it.
 func (r *Registry) ListTenantConnectors(ctx context.Context, tenantID string) ([]ConnectorRecord, error) {
-	rows, err := r.pool.Query(ctx, `SELECT kind, config, secret FROM tenant_connectors WHERE tenant_id=$1`, tenantID)
+	if r.pool == nil {
+		return nil, nil
+	}
+	rows, err := r.pool.Query(ctx, `
+		SELECT tc.connector_id, c.kind, COALESCE(tc.config,'{}'::jsonb), tc.secrets_encrypted, COALESCE(c.capabilities,'[]'::jsonb)
+		FROM tenant_connectors tc
+		JOIN connectors c ON c.id=tc.connector_id
+		WHERE tc.tenant_id=$1 AND COALESCE(tc.enabled,false)=true
+		ORDER BY tc.connector_id`, tenantID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	var out []ConnectorRecord
 	for rows.Next() {
-		var kind string
-		var cfgRaw, secRaw []byte
-		_ = rows.Scan(&kind, &cfgRaw, &secRaw)
-		var cfgMap, secMap map[string]any
+		var id, kind string
+		var cfgRaw, secRaw, capRaw []byte
+		if err := rows.Scan(&id, &kind, &cfgRaw, &secRaw, &capRaw); err != nil {
+			return nil, err
+		}
+		var cfgMap map[string]any
 		_ = json.Unmarshal(cfgRaw, &cfgMap)
-		_ = json.Unmarshal(secRaw, &secMap)
-		out = append(out, ConnectorRecord{TenantID: tenantID, Kind: kind, BuiltinKind: kind, ConfigJSON: cfgMap, SecretJSON: secMap})
+		// Unreadable secrets leave the record without them; factories report what is missing.
+		secMap, _ := secrets.Open(secRaw)
+		var caps []struct {
+			Canonical string `json:"canonical"`
+			Mode      string `json:"mode"`
+		}
+		_ = json.Unmarshal(capRaw, &caps)
+		rec := ConnectorRecord{ID: id, TenantID: tenantID, Kind: kind, BuiltinKind: kind, ConfigJSON: cfgMap, SecretJSON: secMap}
+		for _, c := range caps {
+			if c.Canonical == "" {
+				continue
+			}
+			rec.Capabilities = append(rec.Capabilities, c.Canonical)
+			if c.Mode != "" {
+				if rec.Modes == nil {
+					rec.Modes = map[string]string{}
+				}
+				rec.Modes[c.Canonical] = c.Mode
+			}
+		}
+		out = append(out, rec)
 	}
-	return out, nil
+	return out, rows.Err()
 }
 
 // InstantiateBuiltin turns a record referencing a builtin into an implementation.
@@ -107,57 +227,117 @@ func (r *Registry) InstantiateBuiltin(rec ConnectorRecord) (Builtin, error) {
 
 // LoadOperations returns dynamic operations for a tenant (cached).
 func (r *Registry) LoadOperations(ctx context.Context, tenantID string) ([]operationRow, error) {
+	set, err := r.LoadOperationSet(ctx, tenantID)
+	return set.Operations, err
+}
+
+// LoadOperationSet returns dynamic operations for a tenant (cached) with their
+// fingerprint. Operations are ordered by connector kind, method and path.
+func (r *Registry) LoadOperationSet(ctx context.Context, tenantID string) (OperationSet, error) {
 	// Dev fallback: if no DB configured, surface static sample operations so OpenAPI/manifest work.
 	if r.pool == nil {
 		// simple in-memory cache per tenant
-		r.mu.RLock()
-		c, ok := r.byTenant[tenantID]
-		if ok && time.Since(c.loadedAt) < r.ttl {
-			r.mu.RUnlock()
-			return c.operations, nil
+		set, epoch, ok := r.cached(tenantID)
+		if ok {
+			return set, nil
 		}
-		r.mu.RUnlock()
 		kind := "sample"
 		ops := []operationRow{
 			{Method: "GET", Path: "/v1/dev/ping", Summary: "Ping test endpoint", Scopes: []string{"dev:read"}, Kind: &kind},
 			{Method: "POST", Path: "/v1/dev/echo", Summary: "Echo posted payload", Scopes: []string{"dev:write"}, Kind: &kind},
 			{Method: "GET", Path: "/v1/dev/orders/{id}", Summary: "Fetch mock order by id", Scopes: []string{"order:read"}, Kind: &kind},
 		}
-		r.mu.Lock()
-		r.byTenant[tenantID] = cachedTenant{loadedAt: time.Now(), operations: ops}
-		r.mu.Unlock()
-		return ops, nil
+		set = OperationSet{Operations: ops, Fingerprint: "sample"}
+		r.store(tenantID, epoch, cachedTenant{loadedAt: time.Now(), set: set})
+		return set, nil
 	}
-	r.mu.RLock()
-	c, ok := r.byTenant[tenantID]
-	if ok && time.Since(c.loadedAt) < r.ttl {
-		r.mu.RUnlock()
-		return c.operations, nil
+	cachedSet, epoch, ok := r.cached(tenantID)
+	if ok {
+		return cachedSet, nil
 	}
-	r.mu.RUnlock()
+	loadedAt := time.Now()
 	rows, err := r.pool.Query(ctx, `
-		SELECT o.method, o.path, o.summary, COALESCE(o.scopes, ARRAY[]::text[]), COALESCE(o.params,'[]'::jsonb), d.base_url, d.auth_ref, d.kind
+		SELECT o.method, o.path, o.summary, COALESCE(o.scopes, ARRAY[]::text[]), COALESCE(o.params,'[]'::jsonb), d.base_url, d.auth_ref, d.kind, COALESCE(o.call_options,'{}'::jsonb),
+			COALESCE(d.config->>'protocol',''), COALESCE(o.request_tmpl,'{}'::jsonb),
+			CASE WHEN d.config->>'protocol'='grpc' THEN COALESCE(d.config->'grpc'->>'descriptor_set','') ELSE '' END,
+			COALESCE(o.passthrough,'{}'::jsonb)
 		FROM connector_operations o
 		JOIN connector_definitions d ON o.connector_id=d.id
 		JOIN tenant_connectors tc ON tc.connector_id=d.id::text AND tc.tenant_id=$1 AND COALESCE(tc.enabled,false)=true
 		WHERE d.tenant_id=$1
+		ORDER BY d.kind, o.method, o.path, o.id
 	`, tenantID)
 	if err != nil {
-		return nil, err
+		return OperationSet{}, err
 	}
 	defer rows.Close()
 	var ops []operationRow
+	fp := sha256.New()
 	for rows.Next() {
 		var or operationRow
-		var paramsRaw []byte
-		_ = rows.Scan(&or.Method, &or.Path, &or.Summary, &or.Scopes, &paramsRaw, &or.BaseURL, &or.AuthRef, &or.Kind)
+		var paramsRaw, callRaw, tmplRaw, passRaw []byte
+		var proto, descriptorSet string
+		_ = rows.Scan(&or.Method, &or.Path, &or.Summary, &or.Scopes, &paramsRaw, &or.BaseURL, &or.AuthRef, &or.Kind, &callRaw, &proto, &tmplRaw, &descriptorSet, &passRaw)
+		fmt.Fprintf(fp, "%q %q %q %q %q %q %q %q %q %q %q %q %q\n", or.Method, or.Path, or.Summary, or.Scopes, paramsRaw,
+			deref(or.BaseURL), deref(or.AuthRef), deref(or.Kind), callRaw, proto, tmplRaw, descriptorSet, passRaw)
+		_ = json.Unmarshal(passRaw, &or.Passthrough)
 		if len(paramsRaw) > 0 {
 			_ = json.Unmarshal(paramsRaw, &or.Params)
 		}
+		if len(callRaw) > 0 {
+			_ = json.Unmarshal(callRaw, &or.CallOptions)
+		}
+		switch proto {
+		case graphql.Protocol:
+			var tmpl map[string]any
+			_ = json.Unmarshal(tmplRaw, &tmpl)
+			if spec, ok := graphql.SpecFrom(tmpl); ok {
+				or.GraphQL = &spec
+			}
+		case grpcconn.Protocol:
+			var tmpl map[string]any
+			_ = json.Unmarshal(tmplRaw, &tmpl)
+			if spec, ok := grpcconn.SpecFrom(tmpl); ok {
+				desc, _ := grpcconn.DecodeDescriptors(descriptorSet)
+				or.GRPC = &GRPCOperation{Spec: spec, Descriptors: desc}
+			}
+		}
 		ops = append(ops, or)
 	}
-	r.mu.Lock()
-	r.byTenant[tenantID] = cachedTenant{loadedAt: time.Now(), operations: ops}
-	r.mu.Unlock()
-	return ops, nil
+	set := OperationSet{Operations: ops, Fingerprint: hex.EncodeToString(fp.Sum(nil))}
+	r.store(tenantID, epoch, cachedTenant{loadedAt: loadedAt, set: set})
+	return set, nil
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// LoadOutputSchemas returns the declared output schema per action key for a tenant.
+// Actions without a schema are omitted.
+func (r *Registry) LoadOutputSchemas(ctx context.Context, tenantID string) (map[string]map[string]any, error) {
+	out := map[string]map[string]any{}
+	if r.pool == nil {
+		return out, nil
+	}
+	rows, err := r.pool.Query(ctx, `SELECT key, COALESCE(output_schema,'{}'::jsonb) FROM actions WHERE tenant_id=$1`, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		var raw []byte
+		if err := rows.Scan(&key, &raw); err != nil {
+			return nil, err
+		}
+		var schema map[string]any
+		if json.Unmarshal(raw, &schema) == nil && len(schema) > 0 {
+			out[key] = schema
+		}
+	}
+	return out, nil
 }
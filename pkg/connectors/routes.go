@@ -0,0 +1,72 @@
+package connectors
+
+import "strings"
+
+// Route is a method and path pattern and the connector kind declaring it
+// ("canonical" for the platform's canonical operations).
+type Route struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Kind   string `json:"kind"`
+}
+
+// Conflict reports routes that match the same requests as a route declared
+// before them. Only the first is served. A conflict with an Error reports a
+// route whose path the router rejects instead: Served is that route, which is
+// not routed, and Shadowed is empty.
+type Conflict struct {
+	Served   Route   `json:"served"`
+	Shadowed []Route `json:"shadowed"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// Routes lists the routes of the set's operations, in order.
+func (s OperationSet) Routes() []Route {
+	out := make([]Route, len(s.Operations))
+	for i, o := range s.Operations {
+		out[i] = Route{Method: strings.ToUpper(o.Method), Path: o.Path}
+		if o.Kind != nil {
+			out[i].Kind = *o.Kind
+		}
+	}
+	return out
+}
+
+// PlanRoutes returns the indexes of the routes to serve, in order, and the
+// conflicts among them. Routes conflict when their methods are equal and their
+// paths differ at most in parameter names; the earliest one is served.
+func PlanRoutes(routes []Route) ([]int, []Conflict) {
+	var serve []int
+	var conflicts []Conflict
+	first := map[string]int{}    // route key -> index in routes
+	conflict := map[string]int{} // route key -> index in conflicts
+	for i, rt := range routes {
+		key := RouteKey(rt.Method, rt.Path)
+		j, dup := first[key]
+		if !dup {
+			first[key] = i
+			serve = append(serve, i)
+			continue
+		}
+		c, ok := conflict[key]
+		if !ok {
+			c = len(conflicts)
+			conflict[key] = c
+			conflicts = append(conflicts, Conflict{Served: routes[j]})
+		}
+		conflicts[c].Shadowed = append(conflicts[c].Shadowed, rt)
+	}
+	return serve, conflicts
+}
+
+// RouteKey identifies the requests a route matches: its method and its path
+// with parameter names (and patterns) dropped.
+func RouteKey(method, path string) string {
+	segs := strings.Split(path, "/")
+	for i, s := range segs {
+		if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+			segs[i] = "{}"
+		}
+	}
+	return strings.ToUpper(method) + " " + strings.Join(segs, "/")
+}
@@ -0,0 +1,126 @@
+// Package graphql supports connectors whose upstream is a GraphQL endpoint.
+// Each connector operation is a named query or mutation stored in the
+// operation's request_tmpl under "graphql":
+//
+//	{ "headers": {...},
+//	  "graphql": { "query": "query GetUser($id: ID!) { user(id: $id) { id name } }",
+//	               "operation_name": "GetUser",
+//	               "variables": { "id": "{{ inputs.id | required }}" } } }
+//
+// Only headers and variables are templated; the query document is sent as is.
+// Requests are POSTed to the connector's base_url, which is the GraphQL endpoint.
+package graphql
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Protocol is the connector_definitions.config.protocol value of GraphQL connectors.
+const Protocol = "graphql"
+
+// Spec is the GraphQL section of an operation's request_tmpl.
+type Spec struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operation_name,omitempty"`
+	Variables     map[string]any `json:"variables,omitempty"`
+}
+
+// SpecFrom extracts the GraphQL section of a request template.
+func SpecFrom(tmpl map[string]any) (Spec, bool) {
+	g, ok := tmpl["graphql"].(map[string]any)
+	if !ok {
+		return Spec{}, false
+	}
+	s := Spec{}
+	s.Query, _ = g["query"].(string)
+	s.OperationName, _ = g["operation_name"].(string)
+	s.Variables, _ = g["variables"].(map[string]any)
+	return s, strings.TrimSpace(s.Query) != ""
+}
+
+// Templated returns tmpl without the query document and operation name, which
+// are not templates: selection sets close with "}}" and would not validate.
+func Templated(tmpl map[string]any) map[string]any {
+	g, ok := tmpl["graphql"].(map[string]any)
+	if !ok {
+		return tmpl
+	}
+	out := make(map[string]any, len(tmpl))
+	for k, v := range tmpl {
+		out[k] = v
+	}
+	out["graphql"] = map[string]any{"variables": g["variables"]}
+	return out
+}
+
+// Body is the JSON request body for a query document and its variables.
+func Body(query, operationName string, variables map[string]any) map[string]any {
+	b := map[string]any{"query": query}
+	if operationName != "" {
+		b["operationName"] = operationName
+	}
+	if len(variables) > 0 {
+		b["variables"] = variables
+	}
+	return b
+}
+
+// Errors reports the messages of a response's populated "errors" array. GraphQL
+// servers answer 200 for failed and partially failed operations alike, so a
+// non-empty errors array is the failure signal.
+func Errors(resp map[string]any) (string, bool) {
+	errs, ok := resp["errors"].([]any)
+	if !ok || len(errs) == 0 {
+		return "", false
+	}
+	msgs := make([]string, 0, len(errs))
+	for _, e := range errs {
+		m, _ := e.(map[string]any)
+		msg, _ := m["message"].(string)
+		if msg == "" {
+			msg = fmt.Sprint(e)
+		}
+		if p, ok := m["path"].([]any); ok && len(p) > 0 {
+			segs := make([]string, len(p))
+			for i, s := range p {
+				segs[i] = fmt.Sprint(s)
+			}
+			msg += " (at " + strings.Join(segs, ".") + ")"
+		}
+		msgs = append(msgs, msg)
+	}
+	return strings.Join(msgs, "; "), true
+}
+
+// Variable is a variable definition of an operation document.
+type Variable struct {
+	Name     string
+	Type     string // GraphQL type reference, e.g. "[ID!]!"
+	Required bool   // non-null without a default value
+}
+
+var (
+	opHeaderRe = regexp.MustCompile(`^\s*(query|mutation|subscription)\b\s*([A-Za-z_][A-Za-z0-9_]*)?\s*(\(([^)]*)\))?`)
+	varDefRe   = regexp.MustCompile(`\$([A-Za-z_][A-Za-z0-9_]*)\s*:\s*([\[\]A-Za-z0-9_!\s]+?)\s*(=\s*[^,$]+)?\s*(?:,|$)`)
+	commentRe  = regexp.MustCompile(`#[^\n]*`)
+)
+
+// ParseOperation reads the kind, name and variable definitions of the first
+// operation in a document. It reads the operation header only and does not
+// validate the selection set.
+func ParseOperation(doc string) (kind, name string, vars []Variable, err error) {
+	m := opHeaderRe.FindStringSubmatch(commentRe.ReplaceAllString(doc, ""))
+	if m == nil {
+		return "", "", nil, fmt.Errorf("document does not start with a query or mutation")
+	}
+	if m[1] == "subscription" {
+		return "", "", nil, fmt.Errorf("subscriptions are not supported")
+	}
+	for _, v := range varDefRe.FindAllStringSubmatch(m[4], -1) {
+		typ := strings.Join(strings.Fields(v[2]), "")
+		vars = append(vars, Variable{Name: v[1], Type: typ, Required: strings.HasSuffix(typ, "!") && v[3] == ""})
+	}
+	return m[1], m[2], vars, nil
+}
@@ -0,0 +1,108 @@
+package graphql
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseOperation(t *testing.T) {
+	for _, tc := range []struct {
+		name, doc string
+		kind, op  string
+		vars      []Variable
+		wantErr   bool
+	}{
+		{
+			name: "query with variables",
+			doc:  "query GetUser($id: ID!, $tags: [ String! ], $limit: Int = 10, $page: Int! = 1) { user(id: $id) { id } }",
+			kind: "query", op: "GetUser",
+			vars: []Variable{
+				{Name: "id", Type: "ID!", Required: true},
+				{Name: "tags", Type: "[String!]"},
+				{Name: "limit", Type: "Int"},
+				{Name: "page", Type: "Int!"},
+			},
+		},
+		{
+			name: "comment before mutation",
+			doc:  "# creates\nmutation Create($in: NewUser!) { create(input: $in) { id } }",
+			kind: "mutation", op: "Create",
+			vars: []Variable{{Name: "in", Type: "NewUser!", Required: true}},
+		},
+		{name: "anonymous", doc: "query { me { id } }", kind: "query"},
+		{name: "subscription", doc: "subscription S { ticks }", wantErr: true},
+		{name: "shorthand", doc: "{ me { id } }", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			kind, name, vars, err := ParseOperation(tc.doc)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("err %v, wantErr %v", err, tc.wantErr)
+			}
+			if kind != tc.kind || name != tc.op || !reflect.DeepEqual(vars, tc.vars) {
+				t.Fatalf("got %q %q %+v", kind, name, vars)
+			}
+		})
+	}
+}
+
+func TestErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		resp map[string]any
+		msg  string
+		ok   bool
+	}{
+		{"no errors", map[string]any{"data": map[string]any{}}, "", false},
+		{"empty errors", map[string]any{"errors": []any{}}, "", false},
+		{
+			name: "messages with paths",
+			resp: map[string]any{"errors": []any{
+				map[string]any{"message": "not found", "path": []any{"user", float64(0), "name"}},
+				map[string]any{"message": "denied"},
+			}},
+			msg: "not found (at user.0.name); denied",
+			ok:  true,
+		},
+		{"no message", map[string]any{"errors": []any{"boom"}}, "boom", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			msg, ok := Errors(tc.resp)
+			if msg != tc.msg || ok != tc.ok {
+				t.Fatalf("Errors = %q, %v", msg, ok)
+			}
+		})
+	}
+}
+
+func TestSpecFromAndTemplated(t *testing.T) {
+	vars := map[string]any{"id": "{{ inputs.id | required }}"}
+	tmpl := map[string]any{
+		"headers": map[string]any{"X-Tenant": "{{ tenant }}"},
+		"graphql": map[string]any{"query": "query Q($id: ID!) { user(id: $id) { id }}", "operation_name": "Q", "variables": vars},
+	}
+	spec, ok := SpecFrom(tmpl)
+	if !ok || spec.OperationName != "Q" || !reflect.DeepEqual(spec.Variables, vars) {
+		t.Fatalf("spec %+v, %v", spec, ok)
+	}
+	got := Templated(tmpl)
+	want := map[string]any{"headers": tmpl["headers"], "graphql": map[string]any{"variables": vars}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("templated %v", got)
+	}
+	if _, ok := tmpl["graphql"].(map[string]any)["query"]; !ok {
+		t.Fatal("Templated modified its argument")
+	}
+	if _, ok := SpecFrom(map[string]any{"graphql": map[string]any{"query": "  "}}); ok {
+		t.Fatal("blank query accepted")
+	}
+}
+
+func TestBody(t *testing.T) {
+	if b := Body("{ a }", "", nil); !reflect.DeepEqual(b, map[string]any{"query": "{ a }"}) {
+		t.Fatalf("body %v", b)
+	}
+	b := Body("query Q { a }", "Q", map[string]any{"x": 1})
+	if b["operationName"] != "Q" || !reflect.DeepEqual(b["variables"], map[string]any{"x": 1}) {
+		t.Fatalf("body %v", b)
+	}
+}
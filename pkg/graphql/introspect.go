@@ -0,0 +1,371 @@
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"lamdis/pkg/upstream"
+	"lamdis/pkg/upstreamauth"
+)
+
+const introspectionQuery = `query IntrospectionQuery {
+  __schema {
+    queryType { name }
+    mutationType { name }
+    types {
+      kind name description
+      fields(includeDeprecated: false) {
+        name description
+        args { name description defaultValue type { ...TypeRef } }
+        type { ...TypeRef }
+      }
+      inputFields { name description defaultValue type { ...TypeRef } }
+    }
+  }
+}
+fragment TypeRef on __Type {
+  kind name
+  ofType { kind name ofType { kind name ofType { kind name ofType { kind name } } } }
+}`
+
+// TypeRef is an introspected type reference; wrappers (NON_NULL, LIST) nest OfType.
+type TypeRef struct {
+	Kind   string   `json:"kind"`
+	Name   string   `json:"name"`
+	OfType *TypeRef `json:"ofType"`
+}
+
+// String renders the reference in GraphQL notation, e.g. "[ID!]!".
+func (t TypeRef) String() string {
+	switch t.Kind {
+	case "NON_NULL":
+		if t.OfType != nil {
+			return t.OfType.String() + "!"
+		}
+	case "LIST":
+		if t.OfType != nil {
+			return "[" + t.OfType.String() + "]"
+		}
+	}
+	return t.Name
+}
+
+// named unwraps NON_NULL and LIST down to the named type.
+func (t TypeRef) named() TypeRef {
+	for (t.Kind == "NON_NULL" || t.Kind == "LIST") && t.OfType != nil {
+		t = *t.OfType
+	}
+	return t
+}
+
+// InputValue is an argument or input object field.
+type InputValue struct {
+	Name         string  `json:"name"`
+	Description  string  `json:"description"`
+	DefaultValue *string `json:"defaultValue"`
+	Type         TypeRef `json:"type"`
+}
+
+// Field is an output field; fields of the root types are the operations.
+type Field struct {
+	Name        string       `json:"name"`
+	Description string       `json:"description"`
+	Args        []InputValue `json:"args"`
+	Type        TypeRef      `json:"type"`
+}
+
+// FullType is an introspected named type.
+type FullType struct {
+	Kind        string       `json:"kind"`
+	Name        string       `json:"name"`
+	Description string       `json:"description"`
+	Fields      []Field      `json:"fields"`
+	InputFields []InputValue `json:"inputFields"`
+}
+
+// Schema is the introspected schema of an endpoint.
+type Schema struct {
+	QueryType    *struct{ Name string } `json:"queryType"`
+	MutationType *struct{ Name string } `json:"mutationType"`
+	Types        []FullType             `json:"types"`
+	byName       map[string]*FullType
+}
+
+func (s *Schema) index() {
+	s.byName = make(map[string]*FullType, len(s.Types))
+	for i := range s.Types {
+		s.byName[s.Types[i].Name] = &s.Types[i]
+	}
+}
+
+// Type returns a named type, or nil.
+func (s *Schema) Type(name string) *FullType {
+	if s == nil {
+		return nil
+	}
+	return s.byName[name]
+}
+
+// Introspect runs the introspection query against endpoint with the
+// connector's credentials applied. Servers with introspection disabled answer
+// with errors, which are returned.
+func Introspect(ctx context.Context, client *upstream.Client, auth upstreamauth.Config, endpoint string) (*Schema, error) {
+	body, _ := json.Marshal(Body(introspectionQuery, "IntrospectionQuery", nil))
+	req := upstream.Request{Method: http.MethodPost, URL: endpoint, Header: http.Header{}, Body: body}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	resp, _, err := upstreamauth.Do(ctx, client, auth, req, upstream.CallOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status < 200 || resp.Status > 299 {
+		return nil, fmt.Errorf("introspection returned status %d", resp.Status)
+	}
+	var out struct {
+		Data struct {
+			Schema *Schema `json:"__schema"`
+		} `json:"data"`
+	}
+	var raw map[string]any
+	_ = json.Unmarshal(resp.Body, &raw)
+	if msg, ok := Errors(raw); ok {
+		return nil, fmt.Errorf("introspection failed: %s", msg)
+	}
+	if err := json.Unmarshal(resp.Body, &out); err != nil || out.Data.Schema == nil {
+		return nil, fmt.Errorf("introspection response has no schema")
+	}
+	out.Data.Schema.index()
+	return out.Data.Schema, nil
+}
+
+// Operation is a connector operation derived from a schema field or an
+// operation document.
+type Operation struct {
+	Name    string           `json:"name"` // operationName, unique per connector
+	Kind    string           `json:"kind"` // query | mutation
+	Summary string           `json:"summary"`
+	Query   string           `json:"query"`
+	Params  []map[string]any `json:"params"`
+	// Variables binds each variable to the input of the same name.
+	Variables map[string]any `json:"variables"`
+}
+
+// Path is the operation's route on the gateway; actions are named after its last segment.
+func (o Operation) Path() string { return "/graphql/" + o.Name }
+
+// RequestTmpl is the operation's connector_operations.request_tmpl.
+func (o Operation) RequestTmpl() map[string]any {
+	return map[string]any{"headers": map[string]any{}, "graphql": map[string]any{"query": o.Query, "operation_name": o.Name, "variables": o.Variables}}
+}
+
+// GenerateOptions selects and shapes the generated operations.
+type GenerateOptions struct {
+	// Fields restricts generation to these root fields ("user" or "Mutation.createUser"); empty means all.
+	Fields []string
+	// Depth bounds nested object selections; scalar fields of the returned type are always selected. Default 2.
+	Depth int
+}
+
+// Generate derives one operation per root query and mutation field: a named
+// document declaring a variable per argument and selecting the scalar fields
+// of the returned type up to opts.Depth levels deep.
+func (s *Schema) Generate(opts GenerateOptions) []Operation {
+	if opts.Depth <= 0 {
+		opts.Depth = 2
+	}
+	want := map[string]bool{}
+	for _, f := range opts.Fields {
+		want[strings.ToLower(strings.TrimSpace(f))] = true
+	}
+	var ops []Operation
+	seen := map[string]bool{}
+	for _, root := range []struct {
+		kind string
+		typ  *struct{ Name string }
+	}{{"query", s.QueryType}, {"mutation", s.MutationType}} {
+		if root.typ == nil || s.Type(root.typ.Name) == nil {
+			continue
+		}
+		rt := s.Type(root.typ.Name)
+		for _, f := range rt.Fields {
+			if strings.HasPrefix(f.Name, "__") {
+				continue
+			}
+			if len(want) > 0 && !want[strings.ToLower(f.Name)] && !want[strings.ToLower(rt.Name+"."+f.Name)] {
+				continue
+			}
+			name := strings.ToUpper(f.Name[:1]) + f.Name[1:]
+			if seen[name] {
+				name += strings.ToUpper(root.kind[:1]) + root.kind[1:]
+			}
+			seen[name] = true
+			ops = append(ops, s.operation(root.kind, name, f, opts.Depth))
+		}
+	}
+	return ops
+}
+
+func (s *Schema) operation(kind, name string, f Field, depth int) Operation {
+	op := Operation{Name: name, Kind: kind, Summary: firstLine(f.Description), Variables: map[string]any{}}
+	if op.Summary == "" {
+		op.Summary = name
+	}
+	var defs, args []string
+	for _, a := range f.Args {
+		defs = append(defs, "$"+a.Name+": "+a.Type.String())
+		args = append(args, a.Name+": $"+a.Name)
+		required := a.Type.Kind == "NON_NULL" && a.DefaultValue == nil
+		op.Params = append(op.Params, param(a.Name, a.Description, required, s.paramType(a.Type)))
+		op.Variables[a.Name] = placeholder(a.Name, required)
+	}
+	var b strings.Builder
+	b.WriteString(kind + " " + name)
+	if len(defs) > 0 {
+		b.WriteString("(" + strings.Join(defs, ", ") + ")")
+	}
+	b.WriteString(" { " + f.Name)
+	if len(args) > 0 {
+		b.WriteString("(" + strings.Join(args, ", ") + ")")
+	}
+	if sel := s.selection(f.Type.named(), depth); sel != "" {
+		b.WriteString(" " + sel)
+	}
+	b.WriteString(" }")
+	op.Query = b.String()
+	return op
+}
+
+// selection builds the selection set of a returned type; fields that need
+// arguments are skipped.
+func (s *Schema) selection(t TypeRef, depth int) string {
+	ft := s.Type(t.Name)
+	if ft == nil {
+		return ""
+	}
+	switch ft.Kind {
+	case "OBJECT", "INTERFACE":
+	case "UNION":
+		return "{ __typename }"
+	default:
+		return ""
+	}
+	var sel []string
+	for _, f := range ft.Fields {
+		if hasRequiredArg(f) {
+			continue
+		}
+		n := f.Type.named()
+		switch k := s.kindOf(n); k {
+		case "SCALAR", "ENUM":
+			sel = append(sel, f.Name)
+		case "OBJECT", "INTERFACE", "UNION":
+			if depth > 1 {
+				if sub := s.selection(n, depth-1); sub != "" {
+					sel = append(sel, f.Name+" "+sub)
+				}
+			}
+		}
+	}
+	if len(sel) == 0 {
+		sel = []string{"__typename"}
+	}
+	return "{ " + strings.Join(sel, " ") + " }"
+}
+
+func (s *Schema) kindOf(t TypeRef) string {
+	if ft := s.Type(t.Name); ft != nil {
+		return ft.Kind
+	}
+	return t.Kind
+}
+
+func hasRequiredArg(f Field) bool {
+	for _, a := range f.Args {
+		if a.Type.Kind == "NON_NULL" && a.DefaultValue == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// paramType maps a GraphQL type onto the connector param types.
+func (s *Schema) paramType(t TypeRef) string {
+	if t.Kind == "NON_NULL" && t.OfType != nil {
+		t = *t.OfType
+	}
+	if t.Kind == "LIST" {
+		return "array"
+	}
+	return s.namedParamType(t.Name)
+}
+
+func (s *Schema) namedParamType(name string) string {
+	switch name {
+	case "Int", "Float":
+		return "number"
+	case "Boolean":
+		return "boolean"
+	case "String", "ID":
+		return "string"
+	}
+	if ft := s.Type(name); ft != nil && ft.Kind == "INPUT_OBJECT" {
+		return "object"
+	}
+	// Enums and custom scalars are passed as strings; without a schema so are
+	// unknown types.
+	return "string"
+}
+
+// FromDocument derives an operation from a query or mutation document. The
+// schema, when available, types the variables; it may be nil.
+func (s *Schema) FromDocument(doc, summary string) (Operation, error) {
+	kind, name, vars, err := ParseOperation(doc)
+	if err != nil {
+		return Operation{}, err
+	}
+	if name == "" {
+		return Operation{}, fmt.Errorf("operation documents must be named")
+	}
+	op := Operation{Name: name, Kind: kind, Summary: summary, Query: strings.TrimSpace(doc), Variables: map[string]any{}}
+	if op.Summary == "" {
+		op.Summary = name
+	}
+	for _, v := range vars {
+		typ := "array"
+		if !strings.HasPrefix(v.Type, "[") {
+			typ = s.namedParamType(strings.TrimSuffix(v.Type, "!"))
+		}
+		op.Params = append(op.Params, param(v.Name, "", v.Required, typ))
+		op.Variables[v.Name] = placeholder(v.Name, v.Required)
+	}
+	return op, nil
+}
+
+func param(name, desc string, required bool, typ string) map[string]any {
+	return map[string]any{
+		"name":        name,
+		"title":       strings.ToUpper(name[:1]) + name[1:],
+		"description": desc,
+		"required":    required,
+		"type":        typ,
+		"in":          "variables",
+	}
+}
+
+func placeholder(name string, required bool) string {
+	if required {
+		return "{{ inputs." + name + " | required }}"
+	}
+	return "{{ inputs." + name + " }}"
+}
+
+func firstLine(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		s = s[:i]
+	}
+	return s
+}
@@ -0,0 +1,218 @@
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"lamdis/pkg/upstream"
+	"lamdis/pkg/upstreamauth"
+)
+
+const schemaJSON = `{"data": {"__schema": {
+  "queryType": {"name": "Query"},
+  "mutationType": {"name": "Mutation"},
+  "types": [
+    {"kind": "OBJECT", "name": "Query", "fields": [
+      {"name": "user", "description": "Look up a user.\nBy id.", "args": [
+        {"name": "id", "type": {"kind": "NON_NULL", "ofType": {"kind": "SCALAR", "name": "ID"}}},
+        {"name": "role", "type": {"kind": "ENUM", "name": "Role"}}
+      ], "type": {"kind": "OBJECT", "name": "User"}},
+      {"name": "search", "args": [], "type": {"kind": "LIST", "ofType": {"kind": "UNION", "name": "Result"}}},
+      {"name": "__type", "args": [], "type": {"kind": "OBJECT", "name": "__Type"}}
+    ]},
+    {"kind": "OBJECT", "name": "Mutation", "fields": [
+      {"name": "createUser", "args": [
+        {"name": "input", "type": {"kind": "NON_NULL", "ofType": {"kind": "INPUT_OBJECT", "name": "NewUser"}}},
+        {"name": "notify", "defaultValue": "true", "type": {"kind": "NON_NULL", "ofType": {"kind": "SCALAR", "name": "Boolean"}}},
+        {"name": "tags", "type": {"kind": "LIST", "ofType": {"kind": "SCALAR", "name": "String"}}}
+      ], "type": {"kind": "NON_NULL", "ofType": {"kind": "OBJECT", "name": "User"}}}
+    ]},
+    {"kind": "OBJECT", "name": "User", "fields": [
+      {"name": "id", "args": [], "type": {"kind": "NON_NULL", "ofType": {"kind": "SCALAR", "name": "ID"}}},
+      {"name": "role", "args": [], "type": {"kind": "ENUM", "name": "Role"}},
+      {"name": "friends", "args": [{"name": "first", "type": {"kind": "NON_NULL", "ofType": {"kind": "SCALAR", "name": "Int"}}}], "type": {"kind": "LIST", "ofType": {"kind": "OBJECT", "name": "User"}}},
+      {"name": "manager", "args": [], "type": {"kind": "OBJECT", "name": "User"}}
+    ]},
+    {"kind": "UNION", "name": "Result"},
+    {"kind": "ENUM", "name": "Role"},
+    {"kind": "INPUT_OBJECT", "name": "NewUser", "inputFields": []},
+    {"kind": "SCALAR", "name": "ID"}
+  ]
+}}}`
+
+func testSchema(t *testing.T) *Schema {
+	t.Helper()
+	var out struct {
+		Data struct {
+			Schema *Schema `json:"__schema"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(schemaJSON), &out); err != nil {
+		t.Fatal(err)
+	}
+	out.Data.Schema.index()
+	return out.Data.Schema
+}
+
+func TestTypeRefString(t *testing.T) {
+	ref := TypeRef{Kind: "NON_NULL", OfType: &TypeRef{Kind: "LIST", OfType: &TypeRef{Kind: "NON_NULL", OfType: &TypeRef{Kind: "SCALAR", Name: "ID"}}}}
+	if got := ref.String(); got != "[ID!]!" {
+		t.Fatalf("String() = %q", got)
+	}
+	if got := ref.named().Name; got != "ID" {
+		t.Fatalf("named() = %q", got)
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	s := testSchema(t)
+	for _, tc := range []struct {
+		name string
+		opts GenerateOptions
+		want map[string]string // operation name -> query document
+	}{
+		{
+			name: "default depth",
+			want: map[string]string{
+				"User":       "query User($id: ID!, $role: Role) { user(id: $id, role: $role) { id role manager { id role } } }",
+				"Search":     "query Search { search { __typename } }",
+				"CreateUser": "mutation CreateUser($input: NewUser!, $notify: Boolean!, $tags: [String]) { createUser(input: $input, notify: $notify, tags: $tags) { id role manager { id role } } }",
+			},
+		},
+		{
+			name: "depth one and field filter",
+			opts: GenerateOptions{Fields: []string{"USER", "Mutation.createUser"}, Depth: 1},
+			want: map[string]string{
+				"User":       "query User($id: ID!, $role: Role) { user(id: $id, role: $role) { id role } }",
+				"CreateUser": "mutation CreateUser($input: NewUser!, $notify: Boolean!, $tags: [String]) { createUser(input: $input, notify: $notify, tags: $tags) { id role } }",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := map[string]string{}
+			for _, op := range s.Generate(tc.opts) {
+				got[op.Name] = op.Query
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("operations\n%v\nwant\n%v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGenerateParams(t *testing.T) {
+	s := testSchema(t)
+	ops := s.Generate(GenerateOptions{Fields: []string{"user", "createUser"}})
+	user, create := ops[0], ops[1]
+	if user.Summary != "Look up a user." || user.Path() != "/graphql/User" {
+		t.Fatalf("user %+v", user)
+	}
+	wantVars := map[string]any{"input": "{{ inputs.input | required }}", "notify": "{{ inputs.notify }}", "tags": "{{ inputs.tags }}"}
+	if !reflect.DeepEqual(create.Variables, wantVars) {
+		t.Fatalf("variables %v", create.Variables)
+	}
+	types := map[string]any{}
+	for _, p := range create.Params {
+		types[p["name"].(string)] = p["type"]
+	}
+	if !reflect.DeepEqual(types, map[string]any{"input": "object", "notify": "boolean", "tags": "array"}) {
+		t.Fatalf("param types %v", types)
+	}
+	tmpl := create.RequestTmpl()
+	if spec, ok := SpecFrom(tmpl); !ok || spec.OperationName != "CreateUser" || spec.Query != create.Query {
+		t.Fatalf("request_tmpl %v", tmpl)
+	}
+}
+
+func TestFromDocument(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		schema  *Schema
+		doc     string
+		types   map[string]any
+		wantErr bool
+	}{
+		{
+			name:   "typed by schema",
+			schema: testSchema(t),
+			doc:    "query Find($in: NewUser!, $n: Int, $ids: [ID!]) { find { id } }",
+			types:  map[string]any{"in": "object", "n": "number", "ids": "array"},
+		},
+		{
+			name:  "without schema",
+			doc:   "mutation M($in: NewUser!) { m { id } }",
+			types: map[string]any{"in": "string"},
+		},
+		{name: "unnamed", doc: "query { me { id } }", wantErr: true},
+		{name: "not an operation", doc: "fragment F on User { id }", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			op, err := tc.schema.FromDocument(tc.doc, "")
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("err %v, wantErr %v", err, tc.wantErr)
+			}
+			if tc.wantErr {
+				return
+			}
+			types := map[string]any{}
+			for _, p := range op.Params {
+				types[p["name"].(string)] = p["type"]
+			}
+			if !reflect.DeepEqual(types, tc.types) || op.Summary != op.Name {
+				t.Fatalf("operation %+v", op)
+			}
+		})
+	}
+}
+
+func TestIntrospect(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		status  int
+		body    string
+		wantErr string
+	}{
+		{name: "schema", status: http.StatusOK, body: schemaJSON},
+		{name: "introspection disabled", status: http.StatusOK, body: `{"errors": [{"message": "introspection is disabled"}]}`, wantErr: "introspection is disabled"},
+		{name: "no schema", status: http.StatusOK, body: `{"data": {}}`, wantErr: "no schema"},
+		{name: "status", status: http.StatusBadGateway, body: `{}`, wantErr: "status 502"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var gotAuth, gotOp string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var req map[string]any
+				_ = json.NewDecoder(r.Body).Decode(&req)
+				gotOp, _ = req["operationName"].(string)
+				gotAuth = r.Header.Get("Authorization")
+				w.WriteHeader(tc.status)
+				w.Write([]byte(tc.body))
+			}))
+			defer srv.Close()
+			client := upstream.NewClient(nil)
+			client.SetEgressBaseline(upstream.EgressPolicy{AllowPrivate: true})
+			auth := upstreamauth.Config{Type: upstreamauth.TypeBearer, Config: map[string]any{}, Secrets: map[string]any{"token": "t0k"}}
+
+			s, err := Introspect(context.Background(), client, auth, srv.URL)
+			if gotAuth != "Bearer t0k" || gotOp != "IntrospectionQuery" {
+				t.Fatalf("request auth %q operation %q", gotAuth, gotOp)
+			}
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("error %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.Type("User") == nil || s.QueryType.Name != "Query" {
+				t.Fatalf("schema %+v", s)
+			}
+		})
+	}
+}
@@ -0,0 +1,231 @@
+// Package grpcconn supports connectors whose upstream is a gRPC service.
+// Unary methods are described by a FileDescriptorSet, uploaded or fetched
+// through server reflection at import time, and stored base64-encoded in
+// connector_definitions.config.grpc.descriptor_set. The connector's base_url
+// is the target: grpcs://host:port (TLS) or grpc://host:port (plaintext).
+//
+// Each operation carries its method and the request message template:
+//
+//	{ "headers": { "x-tenant": "{{ inputs.tenant }}" },   // sent as metadata
+//	  "grpc": { "method": "/orders.v1.Orders/GetOrder",
+//	            "message": { "order_id": "{{ inputs.order_id | required }}" } } }
+//
+// Rendered messages are converted to the request type through protojson and
+// responses are converted back to JSON (proto field names, unpopulated fields
+// included) for mappings and output contracts.
+package grpcconn
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"lamdis/pkg/upstream"
+	"lamdis/pkg/upstreamauth"
+)
+
+// Protocol is the connector_definitions.config.protocol value of gRPC connectors.
+const Protocol = "grpc"
+
+// ErrInvalidMessage reports a rendered message that does not fit the request type.
+var ErrInvalidMessage = errors.New("invalid request message")
+
+// Spec is the gRPC section of an operation's request_tmpl.
+type Spec struct {
+	Method  string         `json:"method"` // "/package.Service/Method"
+	Message map[string]any `json:"message,omitempty"`
+}
+
+// SpecFrom extracts the gRPC section of a request template.
+func SpecFrom(tmpl map[string]any) (Spec, bool) {
+	g, ok := tmpl["grpc"].(map[string]any)
+	if !ok {
+		return Spec{}, false
+	}
+	s := Spec{}
+	s.Method, _ = g["method"].(string)
+	s.Message, _ = g["message"].(map[string]any)
+	return s, strings.HasPrefix(s.Method, "/")
+}
+
+// Descriptors is a parsed descriptor set.
+type Descriptors struct {
+	Files *protoregistry.Files
+	types *dynamicpb.Types
+}
+
+var parsed sync.Map // sha256 of the encoded set -> *Descriptors
+
+// DecodeDescriptors parses a base64-encoded FileDescriptorSet. Results are
+// cached by content, so callers may pass the stored value on every call.
+func DecodeDescriptors(encoded string) (*Descriptors, error) {
+	sum := sha256.Sum256([]byte(encoded))
+	if d, ok := parsed.Load(sum); ok {
+		return d.(*Descriptors), nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("descriptor set is not base64: %w", err)
+	}
+	d, err := ParseDescriptors(raw)
+	if err != nil {
+		return nil, err
+	}
+	parsed.Store(sum, d)
+	return d, nil
+}
+
+// ParseDescriptors parses a binary FileDescriptorSet. The set must be
+// self-contained (protoc --include_imports).
+func ParseDescriptors(raw []byte) (*Descriptors, error) {
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(raw, &set); err != nil {
+		return nil, fmt.Errorf("invalid FileDescriptorSet: %w", err)
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("descriptor set does not resolve (build it with --include_imports): %w", err)
+	}
+	return &Descriptors{Files: files, types: dynamicpb.NewTypes(files)}, nil
+}
+
+// Method looks up a method by its full name, "/package.Service/Method".
+func (d *Descriptors) Method(full string) (protoreflect.MethodDescriptor, error) {
+	svc, m, ok := strings.Cut(strings.TrimPrefix(full, "/"), "/")
+	if !ok {
+		return nil, fmt.Errorf("method %q is not /package.Service/Method", full)
+	}
+	desc, err := d.Files.FindDescriptorByName(protoreflect.FullName(svc))
+	if err != nil {
+		return nil, fmt.Errorf("service %s not in descriptors", svc)
+	}
+	sd, ok := desc.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a service", svc)
+	}
+	md := sd.Methods().ByName(protoreflect.Name(m))
+	if md == nil {
+		return nil, fmt.Errorf("service %s has no method %s", svc, m)
+	}
+	if md.IsStreamingClient() || md.IsStreamingServer() {
+		return nil, fmt.Errorf("%s is a streaming method; only unary methods are supported", full)
+	}
+	return md, nil
+}
+
+// Call is a unary call to perform.
+type Call struct {
+	Target  string
+	Method  string
+	Header  map[string]string // sent as metadata
+	Message any               // JSON value of the request message
+	// IdempotencyKey and OnRetry are passed to the upstream client.
+	IdempotencyKey string
+	OnRetry        func(upstream.Attempt)
+}
+
+// Result is the outcome of a call; Body is the JSON response when Code is OK.
+type Result struct {
+	Code   codes.Code
+	Detail string
+	Body   map[string]any
+}
+
+// Invoke performs a unary call with the connector's credentials applied as
+// metadata (mTLS configs supply the TLS client certificate). A message that
+// does not fit the request type is reported as ErrInvalidMessage without an
+// attempt being made.
+func Invoke(ctx context.Context, client *upstream.Client, auth upstreamauth.Config, d *Descriptors, call Call, opts upstream.CallOptions) (*Result, []upstream.Attempt, error) {
+	md, err := d.Method(call.Method)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+	}
+	in := dynamicpb.NewMessage(md.Input())
+	raw, _ := json.Marshal(call.Message)
+	if call.Message != nil {
+		if err := (protojson.UnmarshalOptions{Resolver: d.types}).Unmarshal(raw, in); err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+		}
+	}
+	msg, err := proto.Marshal(in)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+	}
+	meta, tlsCfg, err := credentials(ctx, client, auth, call.Target, call.Method, call.Header, msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, attempts, err := client.DoGRPC(ctx, upstream.GRPCRequest{
+		Target: call.Target, Method: call.Method, Metadata: meta, Message: msg,
+		IdempotencyKey: call.IdempotencyKey, OnRetry: call.OnRetry, TLS: tlsCfg,
+	}, opts)
+	if resp == nil {
+		return nil, attempts, err
+	}
+	res := &Result{Code: resp.Code, Detail: resp.Detail}
+	if resp.Code == codes.OK {
+		out := dynamicpb.NewMessage(md.Output())
+		if err := proto.Unmarshal(resp.Message, out); err != nil {
+			return res, attempts, fmt.Errorf("response does not decode as %s: %w", md.Output().FullName(), err)
+		}
+		b, err := protojson.MarshalOptions{UseProtoNames: true, EmitUnpopulated: true, Resolver: d.types}.Marshal(out)
+		if err != nil {
+			return res, attempts, err
+		}
+		_ = json.Unmarshal(b, &res.Body)
+	}
+	return res, attempts, err
+}
+
+// ErrQueryCredentials rejects credentials that travel in a URL query string,
+// which gRPC calls do not have.
+var ErrQueryCredentials = errors.New("api_key credentials sent in the query cannot be used with gRPC; send them in a header (metadata)")
+
+// CheckAuth reports auth configs that cannot be applied to gRPC calls.
+func CheckAuth(auth upstreamauth.Config) error {
+	if auth.InQuery() {
+		return ErrQueryCredentials
+	}
+	return nil
+}
+
+// credentials applies the auth config to a stand-in HTTP request for the call
+// and returns its headers as metadata, plus any TLS config it set.
+func credentials(ctx context.Context, client *upstream.Client, auth upstreamauth.Config, target, method string, header map[string]string, msg []byte) (map[string]string, *tls.Config, error) {
+	if err := CheckAuth(auth); err != nil {
+		return nil, nil, err
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, nil, err
+	}
+	req := upstream.Request{Method: http.MethodPost, URL: "https://" + u.Host + method, Header: http.Header{}, Body: msg}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	if err := auth.Apply(ctx, client, &req); err != nil {
+		return nil, nil, err
+	}
+	meta := make(map[string]string, len(req.Header))
+	for k, vs := range req.Header {
+		meta[strings.ToLower(k)] = strings.Join(vs, ",")
+	}
+	return meta, req.TLS, nil
+}
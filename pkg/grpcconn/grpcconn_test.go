@@ -0,0 +1,214 @@
+package grpcconn
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"lamdis/pkg/upstream"
+	"lamdis/pkg/upstreamauth"
+)
+
+const (
+	testTarget = "grpc://orders.test:80"
+	getOrder   = "/test.v1.Orders/GetOrder"
+)
+
+// ordersDescriptors describes
+//
+//	service Orders { rpc GetOrder(GetOrderRequest) returns (Order); }
+//	message GetOrderRequest { string order_id = 1; }
+//	message Order { string order_id = 1; int64 total_cents = 2; repeated string items = 3; bool paid = 4; }
+func ordersDescriptors(t *testing.T) *Descriptors {
+	t.Helper()
+	field := func(name string, num int32, typ descriptorpb.FieldDescriptorProto_Type, label descriptorpb.FieldDescriptorProto_Label) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{Name: proto.String(name), JsonName: proto.String(name), Number: proto.Int32(num), Type: typ.Enum(), Label: label.Enum()}
+	}
+	opt := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL
+	set := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{{
+		Name:    proto.String("test/orders.proto"),
+		Package: proto.String("test.v1"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			{Name: proto.String("GetOrderRequest"), Field: []*descriptorpb.FieldDescriptorProto{
+				field("order_id", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, opt),
+			}},
+			{Name: proto.String("Order"), Field: []*descriptorpb.FieldDescriptorProto{
+				field("order_id", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, opt),
+				field("total_cents", 2, descriptorpb.FieldDescriptorProto_TYPE_INT64, opt),
+				field("items", 3, descriptorpb.FieldDescriptorProto_TYPE_STRING, descriptorpb.FieldDescriptorProto_LABEL_REPEATED),
+				field("paid", 4, descriptorpb.FieldDescriptorProto_TYPE_BOOL, opt),
+			}},
+		},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("Orders"),
+			Method: []*descriptorpb.MethodDescriptorProto{{
+				Name:       proto.String("GetOrder"),
+				InputType:  proto.String(".test.v1.GetOrderRequest"),
+				OutputType: proto.String(".test.v1.Order"),
+			}},
+		}},
+	}}}
+	raw, err := proto.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := ParseDescriptors(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// ordersServer serves GetOrder in process. Order ids pick the outcome:
+// "missing" is NOT_FOUND, "flaky" is UNAVAILABLE, anything else is found.
+// The x-api-key metadata of the last call is kept in apiKey.
+type ordersServer struct {
+	md     protoreflect.MethodDescriptor
+	apiKey string
+	calls  int
+}
+
+func (s *ordersServer) getOrder(_ any, ctx context.Context, dec func(any) error, _ grpc.UnaryServerInterceptor) (any, error) {
+	s.calls++
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("x-api-key")) > 0 {
+		s.apiKey = md.Get("x-api-key")[0]
+	}
+	in := dynamicpb.NewMessage(s.md.Input())
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	id := in.Get(s.md.Input().Fields().ByName("order_id")).String()
+	switch id {
+	case "missing":
+		return nil, status.Error(codes.NotFound, "no such order")
+	case "flaky":
+		return nil, status.Error(codes.Unavailable, "try again")
+	}
+	out := dynamicpb.NewMessage(s.md.Output())
+	fields := s.md.Output().Fields()
+	out.Set(fields.ByName("order_id"), protoreflect.ValueOfString(id))
+	out.Set(fields.ByName("total_cents"), protoreflect.ValueOfInt64(1250))
+	items := out.Mutable(fields.ByName("items")).List()
+	items.Append(protoreflect.ValueOfString("book"))
+	items.Append(protoreflect.ValueOfString("pen"))
+	return out, nil
+}
+
+// startOrders serves the orders service over bufconn and returns a client
+// dialing it.
+func startOrders(t *testing.T, d *Descriptors) (*upstream.Client, *ordersServer) {
+	t.Helper()
+	md, err := d.Method(getOrder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &ordersServer{md: md}
+	lis := bufconn.Listen(1 << 20)
+	gs := grpc.NewServer()
+	gs.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "test.v1.Orders",
+		HandlerType: (*any)(nil),
+		Methods:     []grpc.MethodDesc{{MethodName: "GetOrder", Handler: srv.getOrder}},
+	}, struct{}{})
+	go func() { _ = gs.Serve(lis) }()
+	t.Cleanup(gs.Stop)
+
+	client := upstream.NewClient(nil)
+	client.SetGRPCDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) })
+	return client, srv
+}
+
+func TestInvokeMapsMessagesThroughProtoJSON(t *testing.T) {
+	d := ordersDescriptors(t)
+	client, srv := startOrders(t, d)
+	auth := upstreamauth.Config{Type: upstreamauth.TypeAPIKey, Config: map[string]any{"name": "x-api-key"}, Secrets: map[string]any{"api_key": "k-123"}}
+
+	res, attempts, err := Invoke(context.Background(), client, auth, d, Call{Target: testTarget, Method: getOrder, Message: map[string]any{"order_id": "o-1"}}, upstream.CallOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Code != codes.OK || len(attempts) != 1 || attempts[0].Status != http.StatusOK {
+		t.Fatalf("code %v, attempts %+v", res.Code, attempts)
+	}
+	// Proto field names, int64 as a JSON string and unpopulated fields included.
+	want := map[string]any{"order_id": "o-1", "total_cents": "1250", "items": []any{"book", "pen"}, "paid": false}
+	if !reflect.DeepEqual(res.Body, want) {
+		t.Fatalf("body %v, want %v", res.Body, want)
+	}
+	if srv.apiKey != "k-123" {
+		t.Fatalf("api key metadata %q", srv.apiKey)
+	}
+}
+
+func TestInvokeRejectsMessagesNotFittingTheRequestType(t *testing.T) {
+	d := ordersDescriptors(t)
+	client, srv := startOrders(t, d)
+
+	_, attempts, err := Invoke(context.Background(), client, upstreamauth.None, d, Call{Target: testTarget, Method: getOrder, Message: map[string]any{"order": "o-1"}}, upstream.CallOptions{})
+	if !errors.Is(err, ErrInvalidMessage) {
+		t.Fatalf("err %v, want ErrInvalidMessage", err)
+	}
+	if len(attempts) != 0 || srv.calls != 0 {
+		t.Fatalf("attempts %+v, server calls %d", attempts, srv.calls)
+	}
+}
+
+func TestInvokeMapsStatusCodes(t *testing.T) {
+	d := ordersDescriptors(t)
+	client, srv := startOrders(t, d)
+	opts := upstream.CallOptions{MaxAttempts: 2, IdempotencyHeader: "Idempotency-Key", Backoff: upstream.Backoff{InitialMS: 1, MaxMS: 1}}
+
+	for _, tc := range []struct {
+		id       string
+		code     codes.Code
+		status   int
+		attempts int
+	}{
+		{"missing", codes.NotFound, http.StatusNotFound, 1},
+		{"flaky", codes.Unavailable, http.StatusServiceUnavailable, 2}, // 503 is retried by default
+	} {
+		srv.calls = 0
+		res, attempts, err := Invoke(context.Background(), client, upstreamauth.None, d, Call{Target: testTarget, Method: getOrder, Message: map[string]any{"order_id": tc.id}, IdempotencyKey: "idem-1"}, opts)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.id, err)
+		}
+		if res.Code != tc.code || res.Body != nil {
+			t.Fatalf("%s: code %v body %v", tc.id, res.Code, res.Body)
+		}
+		if len(attempts) != tc.attempts || srv.calls != tc.attempts {
+			t.Fatalf("%s: attempts %+v, server calls %d", tc.id, attempts, srv.calls)
+		}
+		last := attempts[len(attempts)-1]
+		if last.Status != tc.status || last.GRPCCode != tc.code.String() {
+			t.Fatalf("%s: attempt %+v, want status %d code %s", tc.id, last, tc.status, tc.code)
+		}
+	}
+}
+
+func TestInvokeRejectsQueryCredentials(t *testing.T) {
+	d := ordersDescriptors(t)
+	client, srv := startOrders(t, d)
+	auth := upstreamauth.Config{Type: upstreamauth.TypeAPIKey, Config: map[string]any{"in": "query"}, Secrets: map[string]any{"api_key": "k-123"}}
+
+	if err := CheckAuth(auth); !errors.Is(err, ErrQueryCredentials) {
+		t.Fatalf("CheckAuth: %v", err)
+	}
+	_, _, err := Invoke(context.Background(), client, auth, d, Call{Target: testTarget, Method: getOrder, Message: map[string]any{"order_id": "o-1"}}, upstream.CallOptions{})
+	if !errors.Is(err, ErrQueryCredentials) || srv.calls != 0 {
+		t.Fatalf("err %v, server calls %d", err, srv.calls)
+	}
+}
@@ -0,0 +1,252 @@
+package grpcconn
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+
+	"lamdis/pkg/upstream"
+	"lamdis/pkg/upstreamauth"
+)
+
+// reflectionTimeout bounds a whole reflection session.
+const reflectionTimeout = 30 * time.Second
+
+// Reflect fetches the descriptors of every service the target exposes through
+// the grpc.reflection.v1 service, including the files they depend on, and
+// returns them as a binary FileDescriptorSet.
+func Reflect(ctx context.Context, client *upstream.Client, auth upstreamauth.Config, target string) ([]byte, error) {
+	meta, tlsCfg, err := credentials(ctx, client, auth, target, rpb.ServerReflection_ServerReflectionInfo_FullMethodName, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return reflectFiles(ctx, client, target, tlsCfg, meta)
+}
+
+func reflectFiles(ctx context.Context, client *upstream.Client, target string, tlsCfg *tls.Config, meta map[string]string) ([]byte, error) {
+	conn, err := client.GRPCConn(ctx, target, tlsCfg)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(metadata.NewOutgoingContext(ctx, metadata.New(meta)), reflectionTimeout)
+	defer cancel()
+	stream, err := rpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("server reflection unavailable: %w", err)
+	}
+	defer stream.CloseSend()
+	ask := func(req *rpb.ServerReflectionRequest) (*rpb.ServerReflectionResponse, error) {
+		if err := stream.Send(req); err != nil {
+			return nil, err
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			return nil, fmt.Errorf("server reflection failed: %w", err)
+		}
+		if e := resp.GetErrorResponse(); e != nil {
+			return nil, fmt.Errorf("server reflection: %s", e.GetErrorMessage())
+		}
+		return resp, nil
+	}
+	resp, err := ask(&rpb.ServerReflectionRequest{MessageRequest: &rpb.ServerReflectionRequest_ListServices{}})
+	if err != nil {
+		return nil, err
+	}
+	files := map[string]*descriptorpb.FileDescriptorProto{}
+	add := func(resp *rpb.ServerReflectionResponse) ([]string, error) {
+		var deps []string
+		for _, b := range resp.GetFileDescriptorResponse().GetFileDescriptorProto() {
+			fd := &descriptorpb.FileDescriptorProto{}
+			if err := proto.Unmarshal(b, fd); err != nil {
+				return nil, fmt.Errorf("server reflection returned an invalid file descriptor: %w", err)
+			}
+			files[fd.GetName()] = fd
+			deps = append(deps, fd.GetDependency()...)
+		}
+		return deps, nil
+	}
+	var pending []string
+	for _, svc := range resp.GetListServicesResponse().GetService() {
+		if strings.HasPrefix(svc.GetName(), "grpc.reflection.") {
+			continue
+		}
+		r, err := ask(&rpb.ServerReflectionRequest{MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: svc.GetName()}})
+		if err != nil {
+			return nil, err
+		}
+		deps, err := add(r)
+		if err != nil {
+			return nil, err
+		}
+		pending = append(pending, deps...)
+	}
+	// Servers usually send dependencies along; fetch any they left out.
+	for len(pending) > 0 {
+		name := pending[0]
+		pending = pending[1:]
+		if _, ok := files[name]; ok {
+			continue
+		}
+		r, err := ask(&rpb.ServerReflectionRequest{MessageRequest: &rpb.ServerReflectionRequest_FileByFilename{FileByFilename: name}})
+		if err != nil {
+			return nil, err
+		}
+		deps, err := add(r)
+		if err != nil {
+			return nil, err
+		}
+		pending = append(pending, deps...)
+	}
+	names := make([]string, 0, len(files))
+	for n := range files {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	set := &descriptorpb.FileDescriptorSet{}
+	for _, n := range names {
+		set.File = append(set.File, files[n])
+	}
+	return proto.Marshal(set)
+}
+
+// Encode returns the stored form of a binary descriptor set.
+func Encode(set []byte) string { return base64.StdEncoding.EncodeToString(set) }
+
+// Operation is a connector operation derived from a unary method.
+type Operation struct {
+	Method  string           `json:"method"` // "/package.Service/Method"
+	Summary string           `json:"summary"`
+	Params  []map[string]any `json:"params"`
+	// Message binds each request field to the input of the same name.
+	Message map[string]any `json:"message"`
+}
+
+// Path is the operation's route on the gateway; actions are named after the method.
+func (o Operation) Path() string { return "/grpc" + o.Method }
+
+// RequestTmpl is the operation's connector_operations.request_tmpl.
+func (o Operation) RequestTmpl() map[string]any {
+	return map[string]any{"headers": map[string]any{}, "grpc": map[string]any{"method": o.Method, "message": o.Message}}
+}
+
+// Operations lists the unary methods of the descriptors' services. Services
+// and methods filter by full service name ("orders.v1.Orders") and method
+// ("orders.v1.Orders/GetOrder" or "GetOrder"); empty means all.
+func (d *Descriptors) Operations(services, methods []string) []Operation {
+	wantSvc := lowerSet(services)
+	wantM := lowerSet(methods)
+	var ops []Operation
+	d.Files.RangeFiles(func(fd protoreflect.FileDescriptor) bool {
+		for i := 0; i < fd.Services().Len(); i++ {
+			sd := fd.Services().Get(i)
+			if strings.HasPrefix(string(sd.FullName()), "grpc.reflection.") {
+				continue
+			}
+			if len(wantSvc) > 0 && !wantSvc[strings.ToLower(string(sd.FullName()))] {
+				continue
+			}
+			for j := 0; j < sd.Methods().Len(); j++ {
+				md := sd.Methods().Get(j)
+				if md.IsStreamingClient() || md.IsStreamingServer() {
+					continue
+				}
+				if len(wantM) > 0 && !wantM[strings.ToLower(string(md.Name()))] && !wantM[strings.ToLower(string(sd.FullName())+"/"+string(md.Name()))] {
+					continue
+				}
+				ops = append(ops, operation(fd, sd, md))
+			}
+		}
+		return true
+	})
+	sort.Slice(ops, func(i, j int) bool { return ops[i].Method < ops[j].Method })
+	return ops
+}
+
+func operation(fd protoreflect.FileDescriptor, sd protoreflect.ServiceDescriptor, md protoreflect.MethodDescriptor) Operation {
+	op := Operation{Method: "/" + string(sd.FullName()) + "/" + string(md.Name()), Message: map[string]any{}}
+	op.Summary = firstLine(fd.SourceLocations().ByDescriptor(md).LeadingComments)
+	if op.Summary == "" {
+		op.Summary = string(sd.Name()) + "." + string(md.Name())
+	}
+	fields := md.Input().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		f := fields.Get(i)
+		name := string(f.Name())
+		required := f.Cardinality() == protoreflect.Required
+		op.Params = append(op.Params, map[string]any{
+			"name":        name,
+			"title":       strings.ToUpper(name[:1]) + name[1:],
+			"description": firstLine(f.ParentFile().SourceLocations().ByDescriptor(f).LeadingComments),
+			"required":    required,
+			"type":        paramType(f),
+			"in":          "message",
+		})
+		if required {
+			op.Message[name] = "{{ inputs." + name + " | required }}"
+		} else {
+			op.Message[name] = "{{ inputs." + name + " }}"
+		}
+	}
+	return op
+}
+
+// paramType maps a field onto the connector param types using its protojson form.
+func paramType(f protoreflect.FieldDescriptor) string {
+	switch {
+	case f.IsMap():
+		return "object"
+	case f.IsList():
+		return "array"
+	}
+	switch f.Kind() {
+	case protoreflect.BoolKind:
+		return "boolean"
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+		protoreflect.Uint32Kind, protoreflect.Fixed32Kind,
+		protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind,
+		protoreflect.Uint64Kind, protoreflect.Fixed64Kind,
+		protoreflect.FloatKind, protoreflect.DoubleKind:
+		return "number"
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		switch f.Message().FullName() {
+		case "google.protobuf.Timestamp", "google.protobuf.Duration", "google.protobuf.FieldMask",
+			"google.protobuf.StringValue", "google.protobuf.BytesValue":
+			return "string"
+		case "google.protobuf.BoolValue":
+			return "boolean"
+		case "google.protobuf.Int32Value", "google.protobuf.Int64Value", "google.protobuf.UInt32Value",
+			"google.protobuf.UInt64Value", "google.protobuf.FloatValue", "google.protobuf.DoubleValue":
+			return "number"
+		}
+		return "object"
+	}
+	return "string" // string, bytes (base64) and enums (by name)
+}
+
+func lowerSet(list []string) map[string]bool {
+	out := map[string]bool{}
+	for _, s := range list {
+		if s = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(s, "/"))); s != "" {
+			out[s] = true
+		}
+	}
+	return out
+}
+
+func firstLine(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
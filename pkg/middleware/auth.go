@@ -67,6 +67,12 @@ func JWTAuth(cfg config.Config, prov tenants.Provider, rdb *redis.Client) func(h
 				next.ServeHTTP(w, r)
 				return
 			}
+			// OAuth2 account-linking callbacks come from the user's browser and are
+			// authenticated by their single-use state parameter
+			if r.URL.Path == "/v1/connections/callback" {
+				next.ServeHTTP(w, r)
+				return
+			}
 
 			tenant := TenantFrom(r.Context())
 			issuer := strings.TrimRight(tenant.OAuthIssuer, "/")
@@ -177,6 +183,7 @@ func JWTAuth(cfg config.Config, prov tenants.Provider, rdb *redis.Client) func(h
 			// Populate context
 			ctx := WithScopes(r.Context(), scopes)
 			ctx = context.WithValue(ctx, "jwt", jt)
+			ctx = context.WithValue(ctx, ctxRawTokenKey{}, raw)
 			// TODO: DPoP verify & token hash binding
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
@@ -205,6 +212,15 @@ func ActorSub(ctx context.Context) string {
 	return ""
 }
 
+type ctxRawTokenKey struct{}
+
+// RawToken returns the caller's verified bearer token as presented, for
+// exchanging it on the caller's behalf.
+func RawToken(ctx context.Context) string {
+	s, _ := ctx.Value(ctxRawTokenKey{}).(string)
+	return s
+}
+
 func tokenFromCtx(ctx context.Context) jwt.Token {
 	if v := ctx.Value("jwt"); v != nil {
 		if t, ok := v.(jwt.Token); ok {
@@ -48,3 +48,10 @@ func (d *dwrapper) Write(b []byte) (int, error) {
 	}
 	return d.ResponseWriter.Write(b)
 }
+
+// Flush keeps streaming responses (SSE) working while debugging is enabled.
+func (d *dwrapper) Flush() {
+	if f, ok := d.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
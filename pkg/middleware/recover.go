@@ -13,6 +13,9 @@ func Recover(log *zap.SugaredLogger) func(http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			defer func() {
 				if rec := recover(); rec != nil {
+					if rec == http.ErrAbortHandler {
+						panic(rec) // net/http aborts the response quietly
+					}
 					log.Errorw("panic", "err", rec, "stack", string(debug.Stack()))
 					http.Error(w, "internal error", http.StatusInternalServerError)
 				}
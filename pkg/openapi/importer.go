@@ -0,0 +1,481 @@
+package openapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ImportOptions selects which operations of a document are imported. Empty
+// lists select everything.
+type ImportOptions struct {
+	// Operations lists operationIds or "METHOD /path" keys.
+	Operations []string `json:"operations,omitempty"`
+	// Tags keeps operations carrying at least one of these tags.
+	Tags []string `json:"tags,omitempty"`
+}
+
+// Imported is a connector definition derived from an OpenAPI document.
+type Imported struct {
+	Title      string              `json:"title"`
+	Summary    string              `json:"summary,omitempty"`
+	Version    string              `json:"version,omitempty"`
+	BaseURL    string              `json:"base_url"`
+	Operations []ImportedOperation `json:"operations"`
+}
+
+// ImportedOperation is one connector operation. Params follow the shape the
+// admin UI edits (name, title, description, required, type, default, example)
+// plus "in": path | query | header | body.
+type ImportedOperation struct {
+	OperationID string           `json:"operation_id,omitempty"`
+	Method      string           `json:"method"`
+	Path        string           `json:"path"`
+	Summary     string           `json:"summary"`
+	Tags        []string         `json:"tags,omitempty"`
+	Scopes      []string         `json:"scopes"`
+	Params      []map[string]any `json:"params"`
+	RequestTmpl map[string]any   `json:"request_tmpl"`
+}
+
+// Key identifies the operation across imports.
+func (op ImportedOperation) Key() string { return OperationKey(op.Method, op.Path) }
+
+// OperationKey is "METHOD /path", the identity used to match operations on re-import.
+func OperationKey(method, path string) string { return strings.ToUpper(method) + " " + path }
+
+var methods = []string{"get", "put", "post", "delete", "options", "head", "patch", "trace"}
+
+// Import parses an OpenAPI 3.0 or 3.1 document (JSON or YAML) and derives a
+// connector definition. Local $refs ("#/components/...") are resolved; external
+// references are rejected.
+func Import(raw []byte, opts ImportOptions) (Imported, error) {
+	doc, err := decode(raw)
+	if err != nil {
+		return Imported{}, err
+	}
+	ver, _ := doc["openapi"].(string)
+	if !strings.HasPrefix(ver, "3.") {
+		return Imported{}, errors.New("not an OpenAPI 3.x document (missing openapi: 3.x)")
+	}
+	r := resolver{doc: doc}
+	info := asMap(doc["info"])
+	out := Imported{Title: str(info["title"]), Summary: firstLine(str(info["description"])), Version: str(info["version"])}
+	if servers, ok := doc["servers"].([]any); ok && len(servers) > 0 {
+		out.BaseURL = serverURL(asMap(servers[0]))
+	}
+	wantOps := map[string]bool{}
+	for _, o := range opts.Operations {
+		wantOps[strings.ToLower(strings.TrimSpace(o))] = true
+	}
+	wantTags := map[string]bool{}
+	for _, t := range opts.Tags {
+		wantTags[strings.ToLower(strings.TrimSpace(t))] = true
+	}
+	paths := asMap(doc["paths"])
+	keys := make([]string, 0, len(paths))
+	for p := range paths {
+		keys = append(keys, p)
+	}
+	sort.Strings(keys)
+	for _, p := range keys {
+		item, err := r.deref(paths[p])
+		if err != nil {
+			return Imported{}, fmt.Errorf("paths.%s: %w", p, err)
+		}
+		pi := asMap(item)
+		for _, m := range methods {
+			node, ok := pi[m]
+			if !ok {
+				continue
+			}
+			op := asMap(node)
+			id := str(op["operationId"])
+			tags := strList(op["tags"])
+			if len(wantOps) > 0 && !wantOps[strings.ToLower(id)] && !wantOps[strings.ToLower(OperationKey(m, p))] {
+				continue
+			}
+			if len(wantTags) > 0 && !anyTag(tags, wantTags) {
+				continue
+			}
+			io, err := r.operation(m, p, pi, op, doc)
+			if err != nil {
+				return Imported{}, fmt.Errorf("%s: %w", OperationKey(m, p), err)
+			}
+			io.OperationID, io.Tags = id, tags
+			out.Operations = append(out.Operations, io)
+		}
+	}
+	return out, nil
+}
+
+func (r resolver) operation(method, path string, item, op, doc map[string]any) (ImportedOperation, error) {
+	io := ImportedOperation{Method: strings.ToUpper(method), Path: path, Scopes: []string{}, Params: []map[string]any{}}
+	io.Summary = str(op["summary"])
+	if io.Summary == "" {
+		io.Summary = firstLine(str(op["description"]))
+	}
+	if io.Summary == "" {
+		io.Summary = str(op["operationId"])
+	}
+	security, ok := op["security"].([]any)
+	if !ok {
+		security, _ = doc["security"].([]any)
+	}
+	io.Scopes = scopesOf(security)
+
+	// Operation parameters override path-item parameters with the same name and location.
+	type pkey struct{ name, in string }
+	order := []pkey{}
+	params := map[pkey]map[string]any{}
+	for _, list := range []any{item["parameters"], op["parameters"]} {
+		arr, _ := list.([]any)
+		for _, raw := range arr {
+			v, err := r.deref(raw)
+			if err != nil {
+				return io, err
+			}
+			pm := asMap(v)
+			k := pkey{str(pm["name"]), str(pm["in"])}
+			if k.name == "" || k.in == "cookie" {
+				continue
+			}
+			if _, seen := params[k]; !seen {
+				order = append(order, k)
+			}
+			params[k] = pm
+		}
+	}
+	tmpl := map[string]any{"headers": map[string]any{}, "query": map[string]any{}, "path_params": map[string]any{}}
+	section := map[string]string{"header": "headers", "query": "query", "path": "path_params"}
+	for _, k := range order {
+		pm := params[k]
+		schema, err := r.deref(pm["schema"])
+		if err != nil {
+			return io, err
+		}
+		required, _ := pm["required"].(bool)
+		if k.in == "path" {
+			required = true
+		}
+		io.Params = append(io.Params, param(k.name, k.in, str(pm["description"]), required, asMap(schema), pm["example"]))
+		tmpl[section[k.in]].(map[string]any)[k.name] = placeholder(k.name, required)
+	}
+
+	body, err := r.deref(op["requestBody"])
+	if err != nil {
+		return io, err
+	}
+	if rb := asMap(body); rb != nil {
+		media, ctype := jsonMedia(asMap(rb["content"]))
+		bodyRequired, _ := rb["required"].(bool)
+		schema, err := r.deref(asMap(media)["schema"])
+		if err != nil {
+			return io, err
+		}
+		sm, err := r.flatten(asMap(schema), 0)
+		if err != nil {
+			return io, err
+		}
+		if ctype != "" && ctype != "application/json" {
+			tmpl["headers"].(map[string]any)["Content-Type"] = ctype
+		}
+		if props := asMap(sm["properties"]); media != nil && len(props) > 0 {
+			req := map[string]bool{}
+			for _, n := range strList(sm["required"]) {
+				req[n] = true
+			}
+			names := make([]string, 0, len(props))
+			for n := range props {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			bt := map[string]any{}
+			for _, n := range names {
+				ps, err := r.deref(props[n])
+				if err != nil {
+					return io, err
+				}
+				psm := asMap(ps)
+				if b, _ := psm["readOnly"].(bool); b {
+					continue
+				}
+				io.Params = append(io.Params, param(n, "body", str(psm["description"]), bodyRequired && req[n], psm, psm["example"]))
+				bt[n] = placeholder(n, bodyRequired && req[n])
+			}
+			tmpl["body"] = bt
+		} else if media != nil {
+			io.Params = append(io.Params, param("body", "body", str(rb["description"]), bodyRequired, sm, asMap(media)["example"]))
+			tmpl["body"] = placeholder("body", bodyRequired)
+		}
+	}
+	io.RequestTmpl = tmpl
+	return io, nil
+}
+
+// flatten merges allOf members so their properties surface as body params.
+func (r resolver) flatten(s map[string]any, depth int) (map[string]any, error) {
+	all, ok := s["allOf"].([]any)
+	if !ok || depth > maxRefHops {
+		return s, nil
+	}
+	members := []map[string]any{s}
+	for _, m := range all {
+		v, err := r.deref(m)
+		if err != nil {
+			return nil, err
+		}
+		fm, err := r.flatten(asMap(v), depth+1)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, fm)
+	}
+	props := map[string]any{}
+	var required []any
+	for _, mm := range members {
+		for k, p := range asMap(mm["properties"]) {
+			props[k] = p
+		}
+		if req, ok := mm["required"].([]any); ok {
+			required = append(required, req...)
+		}
+	}
+	return map[string]any{"type": "object", "properties": props, "required": required}, nil
+}
+
+func param(name, in, desc string, required bool, schema map[string]any, example any) map[string]any {
+	p := map[string]any{
+		"name":        name,
+		"title":       titleCase(name),
+		"description": desc,
+		"required":    required,
+		"type":        schemaType(schema),
+		"in":          in,
+	}
+	if d, ok := schema["default"]; ok {
+		p["default"] = d
+	}
+	if example == nil {
+		example = schema["example"]
+	}
+	if example != nil {
+		p["example"] = example
+	}
+	if enum, ok := schema["enum"].([]any); ok {
+		p["enum"] = enum
+	}
+	return p
+}
+
+// placeholder binds a parameter to the execution input of the same name.
+func placeholder(name string, required bool) string {
+	if required {
+		return "{{ inputs." + name + " | required }}"
+	}
+	return "{{ inputs." + name + " }}"
+}
+
+// schemaType maps a schema to the param types the UI knows. OpenAPI 3.1 type
+// arrays use their first non-null member.
+func schemaType(s map[string]any) string {
+	t := s["type"]
+	if arr, ok := t.([]any); ok {
+		t = nil
+		for _, v := range arr {
+			if v != "null" {
+				t = v
+				break
+			}
+		}
+	}
+	switch str(t) {
+	case "integer", "number":
+		return "number"
+	case "boolean":
+		return "boolean"
+	case "array":
+		return "array"
+	case "object":
+		return "object"
+	case "":
+		if _, ok := s["properties"]; ok {
+			return "object"
+		}
+	}
+	return "string"
+}
+
+// jsonMedia picks the JSON request media type (including +json); requests are
+// sent as JSON, so other encodings are not templated.
+func jsonMedia(content map[string]any) (any, string) {
+	types := make([]string, 0, len(content))
+	for ct := range content {
+		types = append(types, ct)
+	}
+	sort.Strings(types)
+	for _, ct := range types {
+		if ct == "application/json" || strings.HasSuffix(ct, "+json") {
+			return content[ct], ct
+		}
+	}
+	return nil, ""
+}
+
+func scopesOf(security []any) []string {
+	seen := map[string]bool{}
+	out := []string{}
+	for _, req := range security {
+		for _, scopes := range asMap(req) {
+			for _, s := range strList(scopes) {
+				if !seen[s] {
+					seen[s] = true
+					out = append(out, s)
+				}
+			}
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// serverURL substitutes server variables with their defaults.
+func serverURL(s map[string]any) string {
+	u := str(s["url"])
+	for name, v := range asMap(s["variables"]) {
+		u = strings.ReplaceAll(u, "{"+name+"}", str(asMap(v)["default"]))
+	}
+	return strings.TrimRight(u, "/")
+}
+
+// resolver follows local JSON references within a document.
+type resolver struct{ doc map[string]any }
+
+// maxRefHops bounds chains of references to references.
+const maxRefHops = 32
+
+// deref replaces a {"$ref": "#/..."} node by its target, following chains.
+// Only the node itself is resolved; callers deref nested nodes as they reach
+// them, which keeps recursive schemas finite.
+func (r resolver) deref(v any) (any, error) {
+	for i := 0; i < maxRefHops; i++ {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return v, nil
+		}
+		ref, ok := m["$ref"].(string)
+		if !ok {
+			return v, nil
+		}
+		if !strings.HasPrefix(ref, "#/") {
+			return nil, fmt.Errorf("external $ref %q is not supported", ref)
+		}
+		var cur any = r.doc
+		for _, seg := range strings.Split(ref[2:], "/") {
+			seg, _ = url.PathUnescape(seg)
+			seg = strings.ReplaceAll(strings.ReplaceAll(seg, "~1", "/"), "~0", "~")
+			cur = asMap(cur)[seg]
+			if cur == nil {
+				return nil, fmt.Errorf("unresolved $ref %q", ref)
+			}
+		}
+		v = cur
+	}
+	return nil, errors.New("$ref chain too long")
+}
+
+// decode reads JSON or YAML into maps with string keys.
+func decode(raw []byte) (map[string]any, error) {
+	var v any
+	if err := json.Unmarshal(raw, &v); err != nil {
+		if yerr := yaml.Unmarshal(raw, &v); yerr != nil {
+			return nil, fmt.Errorf("document is neither JSON nor YAML: %w", yerr)
+		}
+	}
+	m, ok := normalize(v).(map[string]any)
+	if !ok {
+		return nil, errors.New("document is not an object")
+	}
+	return m, nil
+}
+
+// normalize converts YAML maps with non-string keys (e.g. response codes) to map[string]any.
+func normalize(v any) any {
+	switch t := v.(type) {
+	case map[string]any:
+		for k, c := range t {
+			t[k] = normalize(c)
+		}
+		return t
+	case map[any]any:
+		out := make(map[string]any, len(t))
+		for k, c := range t {
+			out[fmt.Sprint(k)] = normalize(c)
+		}
+		return out
+	case []any:
+		for i, c := range t {
+			t[i] = normalize(c)
+		}
+		return t
+	}
+	return v
+}
+
+func asMap(v any) map[string]any { m, _ := v.(map[string]any); return m }
+
+func str(v any) string { s, _ := v.(string); return s }
+
+func strList(v any) []string {
+	arr, _ := v.([]any)
+	out := make([]string, 0, len(arr))
+	for _, x := range arr {
+		if s, ok := x.(string); ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func anyTag(tags []string, want map[string]bool) bool {
+	for _, t := range tags {
+		if want[strings.ToLower(t)] {
+			return true
+		}
+	}
+	return false
+}
+
+func firstLine(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		s = s[:i]
+	}
+	return s
+}
+
+// titleCase turns "order_id" or "orderId" into "Order id".
+func titleCase(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		switch {
+		case r == '_' || r == '-':
+			b.WriteByte(' ')
+		case i > 0 && r >= 'A' && r <= 'Z':
+			b.WriteByte(' ')
+			b.WriteRune(r + ('a' - 'A'))
+		default:
+			b.WriteRune(r)
+		}
+	}
+	s := b.String()
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
@@ -0,0 +1,223 @@
+package openapi
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const petstore = `
+openapi: 3.1.0
+info:
+  title: Pets
+  version: "2.0"
+  description: |
+    Manage pets.
+    Second line.
+servers:
+  - url: https://{region}.pets.example.com/v2/
+    variables:
+      region: {default: eu}
+security:
+  - oauth: [pets.read]
+paths:
+  /pets/{petId}:
+    parameters:
+      - $ref: '#/components/parameters/PetId'
+      - {name: trace, in: header, schema: {type: string}}
+    get:
+      operationId: getPet
+      tags: [pets]
+      parameters:
+        - {name: trace, in: header, required: true, description: overridden, schema: {type: string}}
+        - {name: session, in: cookie, schema: {type: string}}
+        - {name: fields, in: query, schema: {type: [array, "null"]}}
+      responses:
+        "200": {description: ok}
+    delete:
+      operationId: deletePet
+      tags: [admin]
+      security:
+        - oauth: [pets.write, pets.admin]
+      responses:
+        "204": {description: gone}
+  /pets:
+    post:
+      summary: Create a pet
+      tags: [pets]
+      requestBody:
+        required: true
+        content:
+          application/vnd.pets+json:
+            schema:
+              allOf:
+                - $ref: '#/components/schemas/NewPet'
+                - type: object
+                  required: [age]
+                  properties:
+                    age: {type: integer, default: 1}
+      responses:
+        "201": {description: created}
+components:
+  parameters:
+    PetId: {name: petId, in: path, description: The pet, schema: {type: string, example: p-1}}
+  schemas:
+    NewPet:
+      type: object
+      required: [name]
+      properties:
+        id: {type: string, readOnly: true}
+        name: {type: string, enum: [rex, tom]}
+`
+
+func TestImport(t *testing.T) {
+	imp, err := Import([]byte(petstore), ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imp.Title != "Pets" || imp.Version != "2.0" || imp.Summary != "Manage pets." || imp.BaseURL != "https://eu.pets.example.com/v2" {
+		t.Fatalf("info %+v", imp)
+	}
+	var keys []string
+	byKey := map[string]ImportedOperation{}
+	for _, op := range imp.Operations {
+		keys = append(keys, op.Key())
+		byKey[op.Key()] = op
+	}
+	if want := []string{"POST /pets", "GET /pets/{petId}", "DELETE /pets/{petId}"}; !reflect.DeepEqual(keys, want) {
+		t.Fatalf("operations %v, want %v", keys, want)
+	}
+
+	get := byKey["GET /pets/{petId}"]
+	if get.Summary != "getPet" || !reflect.DeepEqual(get.Scopes, []string{"pets.read"}) {
+		t.Fatalf("get %+v", get)
+	}
+	wantTmpl := map[string]any{
+		"headers":     map[string]any{"trace": "{{ inputs.trace | required }}"},
+		"query":       map[string]any{"fields": "{{ inputs.fields }}"},
+		"path_params": map[string]any{"petId": "{{ inputs.petId | required }}"},
+	}
+	if !reflect.DeepEqual(get.RequestTmpl, wantTmpl) {
+		t.Fatalf("get request_tmpl %v", get.RequestTmpl)
+	}
+	params := map[string]map[string]any{}
+	for _, p := range get.Params {
+		params[p["name"].(string)] = p
+	}
+	if len(params) != 3 || params["session"] != nil {
+		t.Fatalf("get params %v", get.Params)
+	}
+	if p := params["petId"]; p["required"] != true || p["example"] != "p-1" || p["title"] != "Pet id" {
+		t.Fatalf("petId param %v", p)
+	}
+	if p := params["trace"]; p["description"] != "overridden" || p["required"] != true {
+		t.Fatalf("trace param %v", p)
+	}
+	if p := params["fields"]; p["type"] != "array" {
+		t.Fatalf("fields param %v", p)
+	}
+
+	if del := byKey["DELETE /pets/{petId}"]; !reflect.DeepEqual(del.Scopes, []string{"pets.admin", "pets.write"}) {
+		t.Fatalf("delete scopes %v", del.Scopes)
+	}
+
+	post := byKey["POST /pets"]
+	if post.Summary != "Create a pet" {
+		t.Fatalf("post summary %q", post.Summary)
+	}
+	wantBody := map[string]any{"age": "{{ inputs.age | required }}", "name": "{{ inputs.name | required }}"}
+	if !reflect.DeepEqual(post.RequestTmpl["body"], wantBody) {
+		t.Fatalf("post body %v", post.RequestTmpl["body"])
+	}
+	if ct := post.RequestTmpl["headers"].(map[string]any)["Content-Type"]; ct != "application/vnd.pets+json" {
+		t.Fatalf("post content type %v", ct)
+	}
+	for _, p := range post.Params {
+		switch p["name"] {
+		case "age":
+			if p["type"] != "number" || p["default"] != 1 {
+				t.Fatalf("age param %v", p)
+			}
+		case "name":
+			if !reflect.DeepEqual(p["enum"], []any{"rex", "tom"}) {
+				t.Fatalf("name param %v", p)
+			}
+		default:
+			t.Fatalf("unexpected body param %v", p)
+		}
+	}
+}
+
+func TestImportSelection(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts ImportOptions
+		want []string
+	}{
+		{"all", ImportOptions{}, []string{"POST /pets", "GET /pets/{petId}", "DELETE /pets/{petId}"}},
+		{"by operation id", ImportOptions{Operations: []string{"GETPET"}}, []string{"GET /pets/{petId}"}},
+		{"by key", ImportOptions{Operations: []string{" post /pets "}}, []string{"POST /pets"}},
+		{"by tag", ImportOptions{Tags: []string{"Admin"}}, []string{"DELETE /pets/{petId}"}},
+		{"operation and tag", ImportOptions{Operations: []string{"getPet", "deletePet"}, Tags: []string{"pets"}}, []string{"GET /pets/{petId}"}},
+		{"nothing", ImportOptions{Tags: []string{"none"}}, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			imp, err := Import([]byte(petstore), tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, op := range imp.Operations {
+				got = append(got, op.Key())
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("operations %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestImportErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name, doc, want string
+	}{
+		{"not a document", `[1, 2]`, "not an object"},
+		{"swagger 2", `{"swagger": "2.0", "paths": {}}`, "not an OpenAPI 3.x"},
+		{"garbage", "openapi: [3\n  x: :", "neither JSON nor YAML"},
+		{"external ref", `{"openapi": "3.0.3", "paths": {"/a": {"$ref": "other.yaml#/paths/a"}}}`, "external $ref"},
+		{"unresolved ref", `{"openapi": "3.0.3", "paths": {"/a": {"get": {"parameters": [{"$ref": "#/components/parameters/Nope"}]}}}}`, "unresolved $ref"},
+		{"ref cycle", `{"openapi": "3.0.3", "components": {"a": {"$ref": "#/components/b"}, "b": {"$ref": "#/components/a"}}, "paths": {"/a": {"$ref": "#/components/a"}}}`, "chain too long"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Import([]byte(tc.doc), ImportOptions{})
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("error %v, want %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestImportPlainBody(t *testing.T) {
+	doc := `{"openapi": "3.0.3", "info": {"title": "T"}, "paths": {"/upload": {"put": {
+		"description": "Upload a list.\nMore.",
+		"requestBody": {"description": "Items", "content": {"text/plain": {}, "application/json": {"schema": {"type": "array"}, "example": [1]}}}}}}}`
+	imp, err := Import([]byte(doc), ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	op := imp.Operations[0]
+	if op.Summary != "Upload a list." || op.RequestTmpl["body"] != "{{ inputs.body }}" {
+		t.Fatalf("operation %+v", op)
+	}
+	if p := op.Params[0]; p["type"] != "array" || p["description"] != "Items" || !reflect.DeepEqual(p["example"], []any{float64(1)}) {
+		t.Fatalf("body param %v", p)
+	}
+}
+
+func TestTitleCase(t *testing.T) {
+	for in, want := range map[string]string{"order_id": "Order id", "orderId": "Order id", "x-trace": "X trace", "": ""} {
+		if got := titleCase(in); got != want {
+			t.Fatalf("titleCase(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// quotaTTL bounds how long a tenant's monthly usage count is trusted before
+// it is recounted from usage_events; admitted requests are added in between.
+const quotaTTL = time.Minute
+
+// Quota is a tenant's monthly usage against its plan.
+type Quota struct {
+	Plan     string    `json:"plan"`
+	Limit    int64     `json:"limit"`
+	Used     int64     `json:"used"`
+	ResetsAt time.Time `json:"resets_at"`
+}
+
+type quotaCount struct {
+	at    time.Time
+	month time.Time
+	used  int64
+}
+
+// MonthStart is the start of the calendar month (UTC) containing t.
+func MonthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// CountUsage counts the tenant's usage events since the start of the month.
+func CountUsage(ctx context.Context, pool *pgxpool.Pool, tenantID string, month time.Time) (int64, error) {
+	var n int64
+	err := pool.QueryRow(ctx, `SELECT COUNT(*) FROM usage_events WHERE tenant_id=$1 AND started_at >= $2`, tenantID, month).Scan(&n)
+	return n, err
+}
+
+func (l *Limiter) quota(ctx context.Context, pool *pgxpool.Pool, tenantID, plan string, limit int64, now time.Time) Quota {
+	month := MonthStart(now)
+	q := Quota{Plan: plan, Limit: limit, ResetsAt: month.AddDate(0, 1, 0)}
+	l.mu.Lock()
+	c, ok := l.quotas[tenantID]
+	l.mu.Unlock()
+	if !ok || !c.month.Equal(month) || now.Sub(c.at) >= quotaTTL {
+		fresh := &quotaCount{at: now, month: month}
+		var err error
+		if pool != nil {
+			fresh.used, err = CountUsage(ctx, pool, tenantID, month)
+		}
+		// A failed recount keeps this month's previous count.
+		if err == nil || !ok || !c.month.Equal(month) {
+			c = fresh
+			l.mu.Lock()
+			l.quotas[tenantID] = c
+			l.mu.Unlock()
+		}
+	}
+	l.mu.Lock()
+	q.Used = c.used
+	l.mu.Unlock()
+	return q
+}
+
+func (l *Limiter) countUse(tenantID string) {
+	l.mu.Lock()
+	if c, ok := l.quotas[tenantID]; ok {
+		c.used++
+	}
+	l.mu.Unlock()
+}
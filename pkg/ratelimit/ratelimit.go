@@ -0,0 +1,346 @@
+// Package ratelimit enforces token-bucket request limits and monthly quotas on
+// the agent-facing endpoints (/v1/actions/*, canonical operations and
+// connector passthrough operations).
+//
+// Limits come from the tenant's plan (plans.rate_limits) overlaid with the
+// tenant's own (tenants.rate_limits), both shaped as Policy:
+//
+//	{ "tenant":     { "requests": 600, "period_seconds": 60 },
+//	  "actor":      { "requests": 60,  "period_seconds": 60, "burst": 20 },
+//	  "connectors": { "acme-rail": { "requests": 120 } },
+//	  "operations": { "refunds.request": { "requests": 10, "period_seconds": 3600 } } }
+//
+// A request takes a token from every bucket that applies to it: the tenant's,
+// its actor's (by sub), its connector's and its operation's. Buckets live in
+// Redis when configured so limits hold across replicas, and in process memory
+// otherwise or while Redis is unreachable. The plan's monthly_quota caps the
+// tenant's usage_events per calendar month (UTC).
+package ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+
+	"lamdis/pkg/middleware"
+	"lamdis/pkg/problems"
+)
+
+// Limit is a token bucket: Requests per PeriodSeconds (default 60), with
+// bursts up to Burst (default Requests).
+type Limit struct {
+	Requests      int `json:"requests"`
+	PeriodSeconds int `json:"period_seconds,omitempty"`
+	Burst         int `json:"burst,omitempty"`
+}
+
+func (l Limit) period() int {
+	if l.PeriodSeconds <= 0 {
+		return 60
+	}
+	return l.PeriodSeconds
+}
+
+func (l Limit) rate() float64 { return float64(l.Requests) / float64(l.period()) }
+
+func (l Limit) burst() float64 {
+	if l.Burst <= 0 {
+		return float64(l.Requests)
+	}
+	return float64(l.Burst)
+}
+
+// Policy is a set of limits; see the package documentation.
+type Policy struct {
+	Tenant     *Limit           `json:"tenant,omitempty"`
+	Actor      *Limit           `json:"actor,omitempty"`
+	Connectors map[string]Limit `json:"connectors,omitempty"` // by connector id or kind
+	Operations map[string]Limit `json:"operations,omitempty"` // by action key, canonical id or "METHOD /path"
+}
+
+// Validate reports limits that cannot be enforced.
+func (p Policy) Validate() error {
+	check := func(name string, l Limit) error {
+		if l.Requests <= 0 || l.PeriodSeconds < 0 || l.Burst < 0 {
+			return fmt.Errorf("%s: requests must be positive and period_seconds, burst not negative", name)
+		}
+		return nil
+	}
+	if p.Tenant != nil {
+		if err := check("tenant", *p.Tenant); err != nil {
+			return err
+		}
+	}
+	if p.Actor != nil {
+		if err := check("actor", *p.Actor); err != nil {
+			return err
+		}
+	}
+	for k, l := range p.Connectors {
+		if err := check("connectors."+k, l); err != nil {
+			return err
+		}
+	}
+	for k, l := range p.Operations {
+		if err := check("operations."+k, l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Over overlays p on base: p's tenant and actor limits replace base's, and
+// its connector and operation limits replace base's entries of the same name.
+func (p Policy) Over(base Policy) Policy {
+	out := base
+	if p.Tenant != nil {
+		out.Tenant = p.Tenant
+	}
+	if p.Actor != nil {
+		out.Actor = p.Actor
+	}
+	out.Connectors = overlay(base.Connectors, p.Connectors)
+	out.Operations = overlay(base.Operations, p.Operations)
+	return out
+}
+
+func overlay(base, over map[string]Limit) map[string]Limit {
+	if len(over) == 0 {
+		return base
+	}
+	out := make(map[string]Limit, len(base)+len(over))
+	for k, v := range base {
+		out[k] = v
+	}
+	for k, v := range over {
+		out[k] = v
+	}
+	return out
+}
+
+// Scope names what a request is limited on besides its tenant and actor.
+type Scope struct {
+	Connector string
+	Operation string
+}
+
+// Decision is the outcome of a check. Limit and Remaining describe the most
+// constrained bucket, which is the one that refused the request if any.
+type Decision struct {
+	Allowed    bool
+	Bucket     string // "tenant", "actor", "connector", "operation" or "quota"
+	Limit      Limit
+	Remaining  float64
+	Reset      time.Duration // until the bucket is full again
+	RetryAfter time.Duration // until a request may succeed, when refused
+	Quota      *Quota
+}
+
+// policyTTL bounds how long tenant limits are cached.
+const policyTTL = 30 * time.Second
+
+// Limiter checks requests against tenant limits.
+type Limiter struct {
+	mem   *memoryStore
+	redis store
+	now   func() time.Time
+
+	mu       sync.Mutex
+	policies map[string]cachedPolicy
+	quotas   map[string]*quotaCount
+}
+
+type cachedPolicy struct {
+	at     time.Time
+	policy Policy
+	quota  *int64
+	plan   string
+}
+
+// Default is the process-wide limiter.
+var Default = New()
+
+// New returns a limiter keeping buckets in memory.
+func New() *Limiter {
+	return &Limiter{mem: newMemoryStore(), now: time.Now, policies: map[string]cachedPolicy{}, quotas: map[string]*quotaCount{}}
+}
+
+// UseRedis moves buckets to Redis; nil keeps them in memory.
+func (l *Limiter) UseRedis(rdb *redis.Client) {
+	if rdb != nil {
+		l.redis = redisStore{rdb: rdb}
+	}
+}
+
+// Check takes a token from every bucket that applies to the request and
+// reports whether it may proceed.
+func (l *Limiter) Check(ctx context.Context, pool *pgxpool.Pool, tenantID, actor string, s Scope) Decision {
+	if tenantID == "" {
+		return Decision{Allowed: true}
+	}
+	cp := l.policy(ctx, pool, tenantID)
+	now := l.now()
+	var quota *Quota
+	if cp.quota != nil {
+		q := l.quota(ctx, pool, tenantID, cp.plan, *cp.quota, now)
+		if q.Used >= q.Limit {
+			return Decision{Bucket: "quota", Quota: &q, RetryAfter: q.ResetsAt.Sub(now)}
+		}
+		quota = &q
+	}
+	type applied struct {
+		name, key string
+		limit     Limit
+	}
+	var buckets []applied
+	if p := cp.policy.Tenant; p != nil {
+		buckets = append(buckets, applied{"tenant", tenantID + ":t", *p})
+	}
+	if p := cp.policy.Actor; p != nil && actor != "" {
+		buckets = append(buckets, applied{"actor", tenantID + ":a:" + actor, *p})
+	}
+	if p, ok := cp.policy.Connectors[s.Connector]; ok && s.Connector != "" {
+		buckets = append(buckets, applied{"connector", tenantID + ":c:" + s.Connector, p})
+	}
+	if p, ok := cp.policy.Operations[s.Operation]; ok && s.Operation != "" {
+		buckets = append(buckets, applied{"operation", tenantID + ":o:" + s.Operation, p})
+	}
+	d := Decision{Allowed: true, Quota: quota}
+	tightest := math.Inf(1)
+	for _, b := range buckets {
+		t := l.take(ctx, b.key, b.limit, now)
+		// Compare buckets by the share of their burst still available.
+		share := t.remaining / b.limit.burst()
+		if !t.allowed || share < tightest {
+			tightest = share
+			d.Bucket, d.Limit, d.Remaining = b.name, b.limit, t.remaining
+			d.Reset = seconds((b.limit.burst() - t.remaining) / b.limit.rate())
+		}
+		if !t.allowed {
+			d.Allowed = false
+			d.RetryAfter = seconds((1 - t.remaining) / b.limit.rate())
+			break
+		}
+	}
+	if d.Allowed && quota != nil {
+		l.countUse(tenantID)
+	}
+	return d
+}
+
+func (l *Limiter) take(ctx context.Context, key string, lim Limit, now time.Time) take {
+	if l.redis != nil {
+		if t, err := l.redis.take(ctx, key, lim.rate(), lim.burst(), now); err == nil {
+			return t
+		}
+	}
+	t, _ := l.mem.take(ctx, key, lim.rate(), lim.burst(), now)
+	return t
+}
+
+// policy returns the tenant's limits over its plan's, cached for policyTTL.
+// Without a database no limits apply.
+func (l *Limiter) policy(ctx context.Context, pool *pgxpool.Pool, tenantID string) cachedPolicy {
+	now := l.now()
+	l.mu.Lock()
+	cp, ok := l.policies[tenantID]
+	l.mu.Unlock()
+	if ok && now.Sub(cp.at) < policyTTL {
+		return cp
+	}
+	cp = cachedPolicy{at: now}
+	if pool != nil {
+		var tenantRaw, planRaw []byte
+		err := pool.QueryRow(ctx, `
+			SELECT COALESCE(t.rate_limits,'{}'::jsonb), COALESCE(t.plan,''), p.monthly_quota, COALESCE(p.rate_limits,'{}'::jsonb)
+			FROM tenants t LEFT JOIN plans p ON p.name=t.plan
+			WHERE t.id=$1`, tenantID).Scan(&tenantRaw, &cp.plan, &cp.quota, &planRaw)
+		if err == nil {
+			var tp, pp Policy
+			_ = json.Unmarshal(tenantRaw, &tp)
+			_ = json.Unmarshal(planRaw, &pp)
+			cp.policy = tp.Over(pp)
+		}
+	}
+	l.mu.Lock()
+	l.policies[tenantID] = cp
+	l.mu.Unlock()
+	return cp
+}
+
+// Invalidate drops the cached limits of a tenant, or of every tenant when
+// tenantID is empty, so they are reloaded on the next request.
+func (l *Limiter) Invalidate(tenantID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if tenantID == "" {
+		l.policies = map[string]cachedPolicy{}
+		return
+	}
+	delete(l.policies, tenantID)
+}
+
+// Enforce checks the request for the tenant and actor in its context and
+// writes the RateLimit-* headers. A refused request is answered with a 429
+// rate-limited problem and Enforce returns false.
+func (l *Limiter) Enforce(w http.ResponseWriter, r *http.Request, pool *pgxpool.Pool, s Scope) bool {
+	ctx := r.Context()
+	d := l.Check(ctx, pool, middleware.TenantFrom(ctx).ID, middleware.ActorSub(ctx), s)
+	if d.Bucket != "" && d.Bucket != "quota" {
+		h := w.Header()
+		h.Set("RateLimit-Limit", strconv.Itoa(int(d.Limit.burst())))
+		h.Set("RateLimit-Remaining", strconv.Itoa(int(math.Max(0, math.Floor(d.Remaining)))))
+		h.Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(d.Reset.Seconds()))))
+		h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d;burst=%d", d.Limit.Requests, d.Limit.period(), int(d.Limit.burst())))
+	}
+	if d.Allowed {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(d.retrySeconds()))
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	_ = json.NewEncoder(w).Encode(d.Problem())
+	return false
+}
+
+// Problem is the rate-limited problem document for a refused decision, as
+// sent by Enforce; batch endpoints report it per refused item.
+func (d Decision) Problem() map[string]any {
+	body := map[string]any{
+		"type":        problems.Type("rate-limited"),
+		"title":       "Rate limit exceeded",
+		"status":      http.StatusTooManyRequests,
+		"limit":       d.Bucket,
+		"retry_after": d.retrySeconds(),
+	}
+	if d.Bucket == "quota" {
+		body["detail"] = fmt.Sprintf("The monthly quota of %d requests for plan %s is used up until %s.", d.Quota.Limit, d.Quota.Plan, d.Quota.ResetsAt.Format(time.RFC3339))
+		body["quota"] = d.Quota
+	} else {
+		body["detail"] = fmt.Sprintf("The %s limit of %d requests per %d seconds is exhausted; retry in %d seconds.", d.Bucket, d.Limit.Requests, d.Limit.period(), d.retrySeconds())
+	}
+	return body
+}
+
+func (d Decision) retrySeconds() int {
+	return max(1, int(math.Ceil(d.RetryAfter.Seconds())))
+}
+
+func seconds(s float64) time.Duration {
+	if s <= 0 || math.IsInf(s, 0) || math.IsNaN(s) {
+		return 0
+	}
+	return time.Duration(s * float64(time.Second))
+}
+
+// OperationKey is the operation scope of a passthrough operation.
+func OperationKey(method, path string) string { return strings.ToUpper(method) + " " + path }
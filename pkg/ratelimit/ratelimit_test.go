@@ -0,0 +1,245 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+)
+
+// testLimiter returns a limiter with a fixed policy for tenant "t-1" and a
+// clock the test moves.
+func testLimiter(p Policy, quota *int64) (*Limiter, *time.Time) {
+	now := time.Date(2026, 3, 31, 23, 59, 0, 0, time.UTC)
+	l := New()
+	l.now = func() time.Time { return now }
+	l.policies["t-1"] = cachedPolicy{at: now.Add(time.Hour), policy: p, quota: quota, plan: "starter"}
+	return l, &now
+}
+
+func TestMemoryStoreTake(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	type step struct {
+		after     time.Duration // since start
+		allowed   bool
+		remaining float64
+	}
+	for _, tc := range []struct {
+		name        string
+		rate, burst float64
+		steps       []step
+	}{
+		{
+			name: "burst then refused",
+			rate: 1, burst: 2,
+			steps: []step{{0, true, 1}, {0, true, 0}, {0, false, 0}},
+		},
+		{
+			name: "refills at rate",
+			rate: 2, burst: 2,
+			steps: []step{{0, true, 1}, {0, true, 0}, {250 * time.Millisecond, false, 0.5}, {500 * time.Millisecond, true, 0}},
+		},
+		{
+			name: "refill capped at burst",
+			rate: 1, burst: 3,
+			steps: []step{{0, true, 2}, {time.Hour, true, 2}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMemoryStore()
+			for i, s := range tc.steps {
+				got, _ := m.take(context.Background(), "k", tc.rate, tc.burst, start.Add(s.after))
+				if got.allowed != s.allowed || math.Abs(got.remaining-s.remaining) > 1e-9 {
+					t.Fatalf("take %d: %+v, want allowed=%v remaining=%v", i+1, got, s.allowed, s.remaining)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryStorePrune(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	m := newMemoryStore()
+	m.take(context.Background(), "idle", 1, 1, now)
+	m.take(context.Background(), "busy", 0.01, 100, now)
+	m.prune(now.Add(2 * time.Second))
+	if _, ok := m.buckets["idle"]; ok {
+		t.Fatal("full bucket kept")
+	}
+	if _, ok := m.buckets["busy"]; !ok {
+		t.Fatal("refilling bucket dropped")
+	}
+}
+
+func TestCheckBuckets(t *testing.T) {
+	policy := Policy{
+		Tenant:     &Limit{Requests: 10},
+		Actor:      &Limit{Requests: 3, PeriodSeconds: 60, Burst: 2},
+		Connectors: map[string]Limit{"acme": {Requests: 5}},
+		Operations: map[string]Limit{"refunds.request": {Requests: 1, PeriodSeconds: 3600}},
+	}
+	type call struct {
+		actor   string
+		scope   Scope
+		allowed bool
+		bucket  string
+	}
+	for _, tc := range []struct {
+		name  string
+		calls []call
+	}{
+		{
+			name: "actor burst",
+			calls: []call{
+				{actor: "a", allowed: true, bucket: "actor"},
+				{actor: "a", allowed: true, bucket: "actor"},
+				{actor: "a", allowed: false, bucket: "actor"},
+				{actor: "b", allowed: true, bucket: "actor"},
+			},
+		},
+		{
+			name: "operation bucket",
+			calls: []call{
+				{scope: Scope{Operation: "refunds.request"}, allowed: true, bucket: "operation"},
+				{scope: Scope{Operation: "refunds.request"}, allowed: false, bucket: "operation"},
+				{scope: Scope{Operation: "orders.status"}, allowed: true, bucket: "tenant"},
+			},
+		},
+		{
+			name: "tenant bucket shared across scopes",
+			calls: func() []call {
+				var cs []call
+				for i := 0; i < 6; i++ {
+					cs = append(cs, call{scope: Scope{Connector: "acme"}, allowed: i < 5, bucket: "connector"})
+				}
+				// Six tenant tokens are gone: the refused call took one
+				// before its connector bucket refused it.
+				for i := 0; i < 5; i++ {
+					cs = append(cs, call{allowed: i < 4, bucket: "tenant"})
+				}
+				return cs
+			}(),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l, _ := testLimiter(policy, nil)
+			for i, c := range tc.calls {
+				d := l.Check(context.Background(), nil, "t-1", c.actor, c.scope)
+				if d.Allowed != c.allowed || d.Bucket != c.bucket {
+					t.Fatalf("call %d: allowed=%v bucket=%q, want allowed=%v bucket=%q", i+1, d.Allowed, d.Bucket, c.allowed, c.bucket)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckRetryAfterAndReset(t *testing.T) {
+	l, now := testLimiter(Policy{Tenant: &Limit{Requests: 2, PeriodSeconds: 60}}, nil)
+	ctx := context.Background()
+	l.Check(ctx, nil, "t-1", "", Scope{})
+	d := l.Check(ctx, nil, "t-1", "", Scope{})
+	if !d.Allowed || d.Remaining != 0 || d.Reset != time.Minute {
+		t.Fatalf("last token: %+v", d)
+	}
+	d = l.Check(ctx, nil, "t-1", "", Scope{})
+	if d.Allowed || d.RetryAfter != 30*time.Second || d.retrySeconds() != 30 {
+		t.Fatalf("refused: %+v", d)
+	}
+	*now = now.Add(30 * time.Second)
+	if d = l.Check(ctx, nil, "t-1", "", Scope{}); !d.Allowed {
+		t.Fatalf("after retry_after: %+v", d)
+	}
+	p := d.Problem()
+	if p["limit"] != "tenant" || p["status"] != 429 {
+		t.Fatalf("problem %v", p)
+	}
+}
+
+func TestCheckWithoutPolicy(t *testing.T) {
+	l := New()
+	for i := 0; i < 100; i++ {
+		if d := l.Check(context.Background(), nil, "t-1", "a", Scope{}); !d.Allowed || d.Bucket != "" {
+			t.Fatalf("call %d limited without a policy: %+v", i+1, d)
+		}
+	}
+	if d := l.Check(context.Background(), nil, "", "a", Scope{}); !d.Allowed {
+		t.Fatalf("anonymous call limited: %+v", d)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	limit := int64(2)
+	l, now := testLimiter(Policy{}, &limit)
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if d := l.Check(ctx, nil, "t-1", "", Scope{}); !d.Allowed || d.Quota == nil || d.Quota.Used != int64(i) {
+			t.Fatalf("call %d: %+v", i+1, d)
+		}
+	}
+	d := l.Check(ctx, nil, "t-1", "", Scope{})
+	if d.Allowed || d.Bucket != "quota" || d.RetryAfter != time.Minute {
+		t.Fatalf("over quota: %+v", d)
+	}
+	if p := d.Problem(); p["limit"] != "quota" || p["quota"] != d.Quota || p["retry_after"] != 60 {
+		t.Fatalf("problem %v", p)
+	}
+	if want := time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC); !d.Quota.ResetsAt.Equal(want) {
+		t.Fatalf("resets at %v, want %v", d.Quota.ResetsAt, want)
+	}
+	// A new month starts a new count.
+	*now = now.Add(time.Minute)
+	if d := l.Check(ctx, nil, "t-1", "", Scope{}); !d.Allowed || d.Quota.Used != 0 {
+		t.Fatalf("next month: %+v", d)
+	}
+}
+
+func TestMonthStart(t *testing.T) {
+	for _, tc := range []struct{ in, want time.Time }{
+		{time.Date(2026, 2, 28, 23, 0, 0, 0, time.UTC), time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)},
+		// 01:00 on March 1 in UTC+2 is still February in UTC.
+		{time.Date(2026, 3, 1, 1, 0, 0, 0, time.FixedZone("", 2*3600)), time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)},
+	} {
+		if got := MonthStart(tc.in); !got.Equal(tc.want) {
+			t.Fatalf("MonthStart(%v) = %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		p    Policy
+		ok   bool
+	}{
+		{"empty", Policy{}, true},
+		{"valid", Policy{Tenant: &Limit{Requests: 1}, Operations: map[string]Limit{"x": {Requests: 5, PeriodSeconds: 10, Burst: 1}}}, true},
+		{"zero requests", Policy{Actor: &Limit{}}, false},
+		{"negative period", Policy{Tenant: &Limit{Requests: 1, PeriodSeconds: -1}}, false},
+		{"negative burst", Policy{Connectors: map[string]Limit{"c": {Requests: 1, Burst: -1}}}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.p.Validate(); (err == nil) != tc.ok {
+				t.Fatalf("Validate: %v, want ok=%v", err, tc.ok)
+			}
+		})
+	}
+}
+
+func TestPolicyOver(t *testing.T) {
+	plan := Policy{
+		Tenant:     &Limit{Requests: 100},
+		Actor:      &Limit{Requests: 10},
+		Operations: map[string]Limit{"a": {Requests: 1}, "b": {Requests: 2}},
+	}
+	tenant := Policy{Tenant: &Limit{Requests: 500}, Operations: map[string]Limit{"b": {Requests: 20}}}
+	got := tenant.Over(plan)
+	if got.Tenant.Requests != 500 || got.Actor.Requests != 10 {
+		t.Fatalf("tenant/actor %+v %+v", got.Tenant, got.Actor)
+	}
+	if got.Operations["a"].Requests != 1 || got.Operations["b"].Requests != 20 {
+		t.Fatalf("operations %v", got.Operations)
+	}
+	if plan.Operations["b"].Requests != 2 {
+		t.Fatal("Over modified the base policy")
+	}
+}
@@ -0,0 +1,112 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// take is the outcome of taking one token from a bucket.
+type take struct {
+	allowed   bool
+	remaining float64 // tokens left after the take
+}
+
+// store holds token buckets. Buckets refill continuously at rate tokens per
+// second up to burst.
+type store interface {
+	take(ctx context.Context, key string, rate, burst float64, now time.Time) (take, error)
+}
+
+// memoryStore keeps buckets in process; limits are then per replica.
+type memoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	at     time.Time
+	full   time.Time // when the bucket is full again and can be dropped
+}
+
+// maxMemoryBuckets triggers pruning of full buckets.
+const maxMemoryBuckets = 100_000
+
+func newMemoryStore() *memoryStore { return &memoryStore{buckets: map[string]*bucket{}} }
+
+func (m *memoryStore) take(_ context.Context, key string, rate, burst float64, now time.Time) (take, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.buckets[key]
+	if !ok {
+		if len(m.buckets) >= maxMemoryBuckets {
+			m.prune(now)
+		}
+		b = &bucket{tokens: burst, at: now}
+		m.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.at).Seconds()*rate)
+	b.at = now
+	t := take{}
+	if b.tokens >= 1 {
+		b.tokens--
+		t.allowed = true
+	}
+	t.remaining = b.tokens
+	b.full = now.Add(time.Duration((burst - b.tokens) / rate * float64(time.Second)))
+	return t, nil
+}
+
+func (m *memoryStore) prune(now time.Time) {
+	for k, b := range m.buckets {
+		if !now.Before(b.full) {
+			delete(m.buckets, k)
+		}
+	}
+}
+
+// redisStore shares buckets between replicas. The refill and take run in one
+// script so concurrent requests cannot overdraw a bucket.
+type redisStore struct {
+	rdb *redis.Client
+}
+
+var takeScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local h = redis.call('HMGET', KEYS[1], 't', 'ts')
+local tokens = tonumber(h[1]) or burst
+local ts = tonumber(h[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) / 1000 * rate)
+local allowed = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+end
+redis.call('HSET', KEYS[1], 't', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil((burst - tokens) / rate * 1000) + 1000)
+return {allowed, tostring(tokens)}
+`)
+
+func (s redisStore) take(ctx context.Context, key string, rate, burst float64, now time.Time) (take, error) {
+	res, err := takeScript.Run(ctx, s.rdb, []string{"ratelimit:" + key},
+		strconv.FormatFloat(rate, 'f', -1, 64), strconv.FormatFloat(burst, 'f', -1, 64), now.UnixMilli()).Slice()
+	if err != nil {
+		return take{}, err
+	}
+	t := take{}
+	if len(res) == 2 {
+		n, _ := res[0].(int64)
+		t.allowed = n == 1
+		if s, ok := res[1].(string); ok {
+			t.remaining, _ = strconv.ParseFloat(s, 64)
+		}
+	}
+	return t, nil
+}
@@ -0,0 +1,93 @@
+// Package secrets opens connector auth secrets stored by the admin API.
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Decrypt reverses the admin-api encryptJSON format (versioned: 0x01 | nonce | ciphertext[GCM]).
+func Decrypt(blob []byte, key []byte) (map[string]any, error) {
+	if len(blob) < 2 { // version + minimal nonce
+		return nil, fmt.Errorf("invalid blob")
+	}
+	if blob[0] != 0x01 { // only support version 1
+		return nil, fmt.Errorf("unsupported version")
+	}
+	h := sha256.Sum256(key)
+	block, err := aes.NewCipher(h[:])
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(blob) < 1+gcm.NonceSize() {
+		return nil, fmt.Errorf("short nonce")
+	}
+	nonce := blob[1 : 1+gcm.NonceSize()]
+	ct := blob[1+gcm.NonceSize():]
+	plain, err := gcm.Open(nil, nonce, ct, nil)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]any
+	if err := json.Unmarshal(plain, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Open returns the secrets in blob. Blobs written without an ENCRYPTION_KEY are
+// plain JSON; encrypted blobs are decrypted with the key from the environment.
+func Open(blob []byte) (map[string]any, error) {
+	if len(blob) == 0 {
+		return map[string]any{}, nil
+	}
+	if blob[0] == '{' {
+		var m map[string]any
+		if err := json.Unmarshal(blob, &m); err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+	k := os.Getenv("ENCRYPTION_KEY")
+	if k == "" {
+		return nil, fmt.Errorf("ENCRYPTION_KEY not set")
+	}
+	return Decrypt(blob, []byte(k))
+}
+
+// Seal is the inverse of Open: v is encrypted in the admin-api format when
+// ENCRYPTION_KEY is set and stored as plain JSON otherwise.
+func Seal(v map[string]any) ([]byte, error) {
+	plain, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	k := os.Getenv("ENCRYPTION_KEY")
+	if k == "" {
+		return plain, nil
+	}
+	h := sha256.Sum256([]byte(k))
+	block, err := aes.NewCipher(h[:])
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := append([]byte{0x01}, nonce...)
+	return gcm.Seal(out, nonce, plain, nil), nil
+}
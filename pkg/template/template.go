@@ -0,0 +1,349 @@
+// Package template renders connector request templates. Placeholders take the
+// form {{ path | filter: arg }} and are resolved against a scope document such as
+// { inputs, facts, decision, secrets, steps }. Templates are walked as JSON trees:
+// a string consisting of a single placeholder yields the referenced value with its
+// JSON type preserved; placeholders embedded in longer strings are interpolated.
+package template
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	placeRe = regexp.MustCompile(`\{\{(.*?)\}\}`)
+	pathRe  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_\-]*(\.[a-zA-Z0-9_\-]+)*$`)
+)
+
+// Render returns a copy of v with every placeholder resolved against scope.
+// Maps and arrays are walked recursively; other values are returned unchanged.
+func Render(v any, scope map[string]any) (any, error) {
+	switch t := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(t))
+		for k, child := range t {
+			rv, err := Render(child, scope)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", k, err)
+			}
+			out[k] = rv
+		}
+		return out, nil
+	case []any:
+		out := make([]any, len(t))
+		for i, child := range t {
+			rv, err := Render(child, scope)
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %w", i, err)
+			}
+			out[i] = rv
+		}
+		return out, nil
+	case string:
+		return renderString(t, scope)
+	default:
+		return v, nil
+	}
+}
+
+// RenderString renders s and formats the result as a string (headers, query, path).
+func RenderString(s string, scope map[string]any) (string, error) {
+	v, err := renderString(s, scope)
+	if err != nil {
+		return "", err
+	}
+	return Stringify(v), nil
+}
+
+// Validate parses every placeholder in v and checks filter names and arity
+// without resolving any values.
+func Validate(v any) error {
+	switch t := v.(type) {
+	case map[string]any:
+		for k, child := range t {
+			if err := Validate(child); err != nil {
+				return fmt.Errorf("%s: %w", k, err)
+			}
+		}
+	case []any:
+		for i, child := range t {
+			if err := Validate(child); err != nil {
+				return fmt.Errorf("[%d]: %w", i, err)
+			}
+		}
+	case string:
+		if strings.Count(t, "{{") != strings.Count(t, "}}") {
+			return fmt.Errorf("unbalanced braces in %q", t)
+		}
+		for _, m := range placeRe.FindAllStringSubmatch(t, -1) {
+			if _, err := parse(m[1]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// References lists the scope paths of every placeholder in v, in order.
+// Placeholders that do not parse are skipped.
+func References(v any) []string {
+	var out []string
+	switch t := v.(type) {
+	case map[string]any:
+		for _, child := range t {
+			out = append(out, References(child)...)
+		}
+	case []any:
+		for _, child := range t {
+			out = append(out, References(child)...)
+		}
+	case string:
+		for _, m := range placeRe.FindAllStringSubmatch(t, -1) {
+			if e, err := parse(m[1]); err == nil {
+				out = append(out, e.path)
+			}
+		}
+	}
+	return out
+}
+
+// Stringify formats a rendered value for use in a string context.
+func Stringify(v any) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	case map[string]any, []any:
+		b, _ := json.Marshal(t)
+		return string(b)
+	default:
+		return fmt.Sprint(t)
+	}
+}
+
+func renderString(s string, scope map[string]any) (any, error) {
+	if !strings.Contains(s, "{{") {
+		return s, nil
+	}
+	// A lone placeholder keeps the referenced value's type.
+	if m := placeRe.FindStringSubmatchIndex(s); m != nil && m[0] == 0 && m[1] == len(s) {
+		return eval(s[m[2]:m[3]], scope)
+	}
+	var firstErr error
+	out := placeRe.ReplaceAllStringFunc(s, func(m string) string {
+		v, err := eval(placeRe.FindStringSubmatch(m)[1], scope)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		return Stringify(v)
+	})
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return out, nil
+}
+
+type filterCall struct {
+	name string
+	args []any
+}
+
+type expr struct {
+	path    string
+	filters []filterCall
+}
+
+func parse(src string) (expr, error) {
+	parts := splitOutsideQuotes(src, '|')
+	e := expr{path: strings.TrimSpace(parts[0])}
+	if !pathRe.MatchString(e.path) {
+		return e, fmt.Errorf("invalid reference %q", e.path)
+	}
+	for _, p := range parts[1:] {
+		name, rawArgs, _ := strings.Cut(p, ":")
+		fc := filterCall{name: strings.TrimSpace(name)}
+		if strings.TrimSpace(rawArgs) != "" {
+			for _, a := range splitOutsideQuotes(rawArgs, ',') {
+				lit, err := literal(strings.TrimSpace(a))
+				if err != nil {
+					return e, fmt.Errorf("filter %s: %w", fc.name, err)
+				}
+				fc.args = append(fc.args, lit)
+			}
+		}
+		spec, ok := filters[fc.name]
+		if !ok {
+			return e, fmt.Errorf("unknown filter %q", fc.name)
+		}
+		if len(fc.args) < spec.minArgs || len(fc.args) > spec.maxArgs {
+			return e, fmt.Errorf("filter %s expects %d-%d arguments", fc.name, spec.minArgs, spec.maxArgs)
+		}
+		e.filters = append(e.filters, fc)
+	}
+	return e, nil
+}
+
+func eval(src string, scope map[string]any) (any, error) {
+	e, err := parse(src)
+	if err != nil {
+		return nil, err
+	}
+	v := Lookup(scope, e.path)
+	for _, f := range e.filters {
+		if v, err = filters[f.name].fn(v, f.args); err != nil {
+			return nil, fmt.Errorf("%s: %w", e.path, err)
+		}
+	}
+	return v, nil
+}
+
+// Lookup walks a dot path through nested maps; numeric segments index arrays.
+func Lookup(scope map[string]any, path string) any {
+	cur := any(scope)
+	for _, seg := range strings.Split(path, ".") {
+		switch t := cur.(type) {
+		case map[string]any:
+			cur = t[seg]
+		case []any:
+			i, err := strconv.Atoi(seg)
+			if err != nil || i < 0 || i >= len(t) {
+				return nil
+			}
+			cur = t[i]
+		default:
+			return nil
+		}
+	}
+	return cur
+}
+
+// literal parses a filter argument: quoted string, number, true/false/null.
+func literal(s string) (any, error) {
+	if len(s) >= 2 && (s[0] == '\'' || s[0] == '"') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1], nil
+	}
+	switch s {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f, nil
+	}
+	return nil, fmt.Errorf("invalid literal %q", s)
+}
+
+func splitOutsideQuotes(s string, sep rune) []string {
+	var out []string
+	var quote rune
+	start := 0
+	for i, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == sep:
+			out = append(out, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(out, s[start:])
+}
+
+type filterSpec struct {
+	minArgs, maxArgs int
+	fn               func(v any, args []any) (any, error)
+}
+
+var filters = map[string]filterSpec{
+	"default": {1, 1, func(v any, a []any) (any, error) {
+		if v == nil || v == "" {
+			return a[0], nil
+		}
+		return v, nil
+	}},
+	"required": {0, 0, func(v any, _ []any) (any, error) {
+		if v == nil || v == "" {
+			return nil, fmt.Errorf("required value missing")
+		}
+		return v, nil
+	}},
+	"upper":     {0, 0, func(v any, _ []any) (any, error) { return strings.ToUpper(Stringify(v)), nil }},
+	"lower":     {0, 0, func(v any, _ []any) (any, error) { return strings.ToLower(Stringify(v)), nil }},
+	"trim":      {0, 0, func(v any, _ []any) (any, error) { return strings.TrimSpace(Stringify(v)), nil }},
+	"string":    {0, 0, func(v any, _ []any) (any, error) { return Stringify(v), nil }},
+	"urlencode": {0, 0, func(v any, _ []any) (any, error) { return url.QueryEscape(Stringify(v)), nil }},
+	"json": {0, 0, func(v any, _ []any) (any, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	}},
+	"number": {0, 0, func(v any, _ []any) (any, error) {
+		if v == nil {
+			return nil, nil
+		}
+		if f, ok := v.(float64); ok {
+			return f, nil
+		}
+		f, err := strconv.ParseFloat(strings.TrimSpace(Stringify(v)), 64)
+		if err != nil {
+			return nil, fmt.Errorf("not a number: %v", v)
+		}
+		return f, nil
+	}},
+	"int": {0, 0, func(v any, _ []any) (any, error) {
+		if v == nil {
+			return nil, nil
+		}
+		if f, ok := v.(float64); ok {
+			return float64(int64(f)), nil
+		}
+		f, err := strconv.ParseFloat(strings.TrimSpace(Stringify(v)), 64)
+		if err != nil {
+			return nil, fmt.Errorf("not a number: %v", v)
+		}
+		return float64(int64(f)), nil
+	}},
+	"bool": {0, 0, func(v any, _ []any) (any, error) {
+		switch t := v.(type) {
+		case nil:
+			return false, nil
+		case bool:
+			return t, nil
+		case float64:
+			return t != 0, nil
+		}
+		b, err := strconv.ParseBool(strings.TrimSpace(Stringify(v)))
+		if err != nil {
+			return nil, fmt.Errorf("not a boolean: %v", v)
+		}
+		return b, nil
+	}},
+	"join": {0, 1, func(v any, a []any) (any, error) {
+		arr, ok := v.([]any)
+		if !ok {
+			return Stringify(v), nil
+		}
+		sep := ","
+		if len(a) == 1 {
+			sep = Stringify(a[0])
+		}
+		parts := make([]string, len(arr))
+		for i, it := range arr {
+			parts[i] = Stringify(it)
+		}
+		return strings.Join(parts, sep), nil
+	}},
+}
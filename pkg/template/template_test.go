@@ -0,0 +1,115 @@
+package template
+
+import (
+	"reflect"
+	"testing"
+)
+
+var scope = map[string]any{
+	"inputs": map[string]any{
+		"order_id": "o-1",
+		"email":    "  Ada@Example.com ",
+		"amount":   "42.50",
+		"qty":      float64(3),
+		"paid":     "true",
+		"tags":     []any{"a", "b"},
+		"empty":    "",
+	},
+	"steps": map[string]any{"lookup": map[string]any{"response": map[string]any{"items": []any{map[string]any{"sku": "s-9"}}}}},
+}
+
+func TestRenderString(t *testing.T) {
+	for _, tc := range []struct {
+		tmpl string
+		want any
+	}{
+		{"{{inputs.order_id}}", "o-1"},
+		{"{{ inputs.qty }}", float64(3)}, // a lone placeholder keeps its type
+		{"/orders/{{inputs.order_id}}/items/{{inputs.qty}}", "/orders/o-1/items/3"},
+		{"{{inputs.email | trim | lower}}", "ada@example.com"},
+		{"{{inputs.email | trim | upper}}", "ADA@EXAMPLE.COM"},
+		{"{{inputs.amount | number}}", 42.5},
+		{"{{inputs.amount | int}}", float64(42)},
+		{"{{inputs.paid | bool}}", true},
+		{"{{inputs.missing | bool}}", false},
+		{"{{inputs.empty | default: 'n/a'}}", "n/a"},
+		{"{{inputs.missing | default: 7}}", float64(7)},
+		{"{{inputs.tags | join}}", "a,b"},
+		{"{{inputs.tags | join: ' | '}}", "a | b"},
+		{"{{inputs.tags | json}}", `["a","b"]`},
+		{"q={{inputs.email | trim | urlencode}}", "q=Ada%40Example.com"},
+		{"{{steps.lookup.response.items.0.sku}}", "s-9"},
+		{"{{inputs.missing}}", nil},
+		{"no placeholders", "no placeholders"},
+	} {
+		got, err := Render(tc.tmpl, scope)
+		if err != nil {
+			t.Errorf("%s: %v", tc.tmpl, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %#v, want %#v", tc.tmpl, got, tc.want)
+		}
+	}
+}
+
+func TestRenderErrors(t *testing.T) {
+	for _, tmpl := range []string{
+		"{{inputs.missing | required}}",
+		"{{inputs.empty | required}}",
+		"{{inputs.email | number}}",
+		"{{inputs.email | bool}}",
+	} {
+		if _, err := Render(tmpl, scope); err == nil {
+			t.Errorf("%s: rendered without error", tmpl)
+		}
+	}
+}
+
+func TestRenderWalksTrees(t *testing.T) {
+	tmpl := map[string]any{
+		"body":  map[string]any{"id": "{{inputs.order_id}}", "qty": "{{inputs.qty}}"},
+		"list":  []any{"{{inputs.order_id | upper}}", true},
+		"plain": float64(1),
+	}
+	got, err := Render(tmpl, scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"body":  map[string]any{"id": "o-1", "qty": float64(3)},
+		"list":  []any{"O-1", true},
+		"plain": float64(1),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		tmpl any
+		ok   bool
+	}{
+		{"{{inputs.a | default: 'x' | upper}}", true},
+		{map[string]any{"h": []any{"{{secrets.token}}", "Bearer {{secrets.token | trim}}"}}, true},
+		{"{{inputs.a | shout}}", false},                      // unknown filter
+		{"{{inputs.a | default}}", false},                    // missing argument
+		{"{{inputs.a | upper: 1}}", false},                   // extra argument
+		{"{{inputs.a | default: nope}}", false},              // invalid literal
+		{"{{inputs..a}}", false},                             // invalid reference
+		{"{{inputs.a", false},                                // unbalanced braces
+		{map[string]any{"x": []any{"{{ bad ref }}"}}, false}, // nested
+	} {
+		if err := Validate(tc.tmpl); (err == nil) != tc.ok {
+			t.Errorf("%v: err %v", tc.tmpl, err)
+		}
+	}
+}
+
+func TestReferences(t *testing.T) {
+	got := References([]any{"{{inputs.a | upper}}", "x {{facts.b}} {{inputs..bad}}"})
+	if !reflect.DeepEqual(got, []string{"inputs.a", "facts.b"}) {
+		t.Fatalf("got %v", got)
+	}
+}
@@ -0,0 +1,106 @@
+package upstream
+
+import (
+	"sync"
+	"time"
+)
+
+// BreakerOptions configures the circuit breaker kept per tenant and upstream.
+// After FailureThreshold consecutive failures (transport errors or 5xx) the
+// circuit opens and calls fail fast for CooldownMS; then a single trial call
+// is let through (half-open) and its outcome closes or re-opens the circuit.
+type BreakerOptions struct {
+	FailureThreshold int `json:"failure_threshold,omitempty"` // default 5; negative disables
+	CooldownMS       int `json:"cooldown_ms,omitempty"`       // default 30000
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+type breaker struct {
+	mu        sync.Mutex
+	opts      BreakerOptions
+	state     breakerState
+	failures  int
+	openedAt  time.Time
+	trialSent bool
+}
+
+func (b *breaker) allow() bool {
+	if b.opts.FailureThreshold < 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < time.Duration(b.opts.CooldownMS)*time.Millisecond {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.trialSent = true
+		return true
+	case breakerHalfOpen:
+		if b.trialSent {
+			return false
+		}
+		b.trialSent = true
+		return true
+	default:
+		return true
+	}
+}
+
+func (b *breaker) record(ok bool) {
+	if b.opts.FailureThreshold < 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ok {
+		b.state = breakerClosed
+		b.failures = 0
+		b.trialSent = false
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.opts.FailureThreshold {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+		b.trialSent = false
+	}
+}
+
+// breakerSet holds one breaker per upstream (scheme://host).
+type breakerSet struct {
+	mu sync.Mutex
+	m  map[string]*breaker
+}
+
+func newBreakerSet() *breakerSet { return &breakerSet{m: map[string]*breaker{}} }
+
+func (s *breakerSet) get(key string, opts BreakerOptions) *breaker {
+	if opts.FailureThreshold == 0 {
+		opts.FailureThreshold = 5
+	}
+	if opts.CooldownMS <= 0 {
+		opts.CooldownMS = 30000
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.m[key]
+	if !ok {
+		b = &breaker{opts: opts}
+		s.m[key] = b
+	}
+	// latest operation settings win for a shared upstream
+	b.mu.Lock()
+	b.opts = opts
+	b.mu.Unlock()
+	return b
+}
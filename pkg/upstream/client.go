@@ -0,0 +1,553 @@
+// Package upstream performs outbound calls to connector upstreams with
+// per-operation timeouts, retries with backoff, per-upstream circuit breakers
+// and egress (SSRF) controls.
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CallOptions configures how an operation calls its upstream.
+// Stored per operation in connector_operations.call_options.
+type CallOptions struct {
+	TimeoutMS   int     `json:"timeout_ms,omitempty"`   // per attempt; default 15000
+	MaxAttempts int     `json:"max_attempts,omitempty"` // total attempts including the first; default 1
+	Backoff     Backoff `json:"backoff,omitempty"`
+	// RetryOnStatus lists upstream status codes worth retrying (default 429, 502, 503, 504).
+	RetryOnStatus []int `json:"retry_on_status,omitempty"`
+	// RetryOnErrors lists transport error kinds worth retrying: timeout | connection (default both).
+	RetryOnErrors []string `json:"retry_on_errors,omitempty"`
+	// IdempotencyHeader names the header the upstream deduplicates on (e.g. Idempotency-Key).
+	// When set, non-idempotent methods may be retried and the header is sent on every attempt.
+	IdempotencyHeader string         `json:"idempotency_header,omitempty"`
+	CircuitBreaker    BreakerOptions `json:"circuit_breaker,omitempty"`
+	// MaxResponseBytes bounds the response body read into memory (default 4 MiB).
+	// Larger responses fail with ErrResponseTooLarge. Open leaves bodies unread.
+	MaxResponseBytes int64 `json:"max_response_bytes,omitempty"`
+}
+
+// Backoff is exponential backoff with proportional jitter between attempts.
+type Backoff struct {
+	InitialMS  int     `json:"initial_ms,omitempty"` // default 200
+	MaxMS      int     `json:"max_ms,omitempty"`     // default 5000
+	Multiplier float64 `json:"multiplier,omitempty"` // default 2
+	Jitter     float64 `json:"jitter,omitempty"`     // 0..1 fraction of the delay randomized; default 0.2
+}
+
+// Error kinds reported on attempts.
+const (
+	ErrKindTimeout     = "timeout"
+	ErrKindConnection  = "connection"
+	ErrKindCircuitOpen = "circuit_open"
+	ErrKindOther       = "error"
+)
+
+const maxRedirects = 10
+
+// ErrCircuitOpen is returned when the upstream's breaker rejects the call.
+var ErrCircuitOpen = errors.New("circuit open")
+
+// ErrResponseTooLarge is returned when a response body exceeds MaxResponseBytes.
+var ErrResponseTooLarge = errors.New("upstream response too large")
+
+// Request is a fully rendered upstream request. Body is replayed on each attempt.
+type Request struct {
+	Method string
+	URL    string
+	Header http.Header
+	Body   []byte
+	// BodyStream, when set, is sent instead of Body. It cannot be replayed, so
+	// the request is attempted once.
+	BodyStream io.Reader
+	// IdempotencyKey is sent in CallOptions.IdempotencyHeader when configured.
+	IdempotencyKey string
+	// OnRetry, when set, is called with each failed attempt that will be retried,
+	// before the backoff wait.
+	OnRetry func(Attempt)
+	// TLS, when set, is used for the connection (e.g. mTLS client certificates).
+	// Callers should reuse the same *tls.Config per credential: the client keeps
+	// one connection pool per config.
+	TLS *tls.Config
+}
+
+// Response is the final upstream response.
+type Response struct {
+	Status int
+	Header http.Header
+	Body   []byte
+	// Stream is the unread body of responses from Open; the caller closes it.
+	Stream io.ReadCloser
+}
+
+// Attempt records one try against the upstream.
+type Attempt struct {
+	Number   int           `json:"attempt"`
+	Status   int           `json:"status,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	ErrKind  string        `json:"error_kind,omitempty"`
+	Duration time.Duration `json:"-"`
+	Retrying bool          `json:"retrying,omitempty"`
+	GRPCCode string        `json:"grpc_code,omitempty"` // gRPC calls: status code name; Status holds its HTTP equivalent
+}
+
+// Client executes upstream requests. The zero value is not usable; use NewClient.
+type Client struct {
+	http     *http.Client
+	base     *http.Transport // cloned for per-request TLS configs; nil for custom round trippers
+	tlsHTTP  sync.Map        // *tls.Config -> *http.Client
+	breakers *breakerSet
+	sleep    func(ctx context.Context, d time.Duration) error
+	egress   EgressPolicy // operator baseline merged into every call
+	grpc     sync.Map     // gRPC target, TLS config and policy -> *grpc.ClientConn
+	grpcDial func(ctx context.Context, addr string) (net.Conn, error)
+}
+
+// NewClient builds a client around the given transport. Nil uses a transport
+// that enforces the egress policy on every dialed address; a custom transport
+// only gets the URL and redirect checks.
+func NewClient(rt http.RoundTripper) *Client {
+	if rt == nil {
+		rt = newEgressTransport()
+	}
+	c := &Client{
+		breakers: newBreakerSet(),
+		sleep:    sleepCtx,
+	}
+	c.base, _ = rt.(*http.Transport)
+	c.http = &http.Client{Transport: rt, CheckRedirect: c.checkRedirect}
+	return c
+}
+
+// httpFor returns the client for a request's TLS config, building a transport
+// (sharing the base transport's dialer and egress checks) on first use.
+func (c *Client) httpFor(cfg *tls.Config) (*http.Client, error) {
+	if cfg == nil {
+		return c.http, nil
+	}
+	if hc, ok := c.tlsHTTP.Load(cfg); ok {
+		return hc.(*http.Client), nil
+	}
+	if c.base == nil {
+		return nil, errors.New("per-request TLS requires an *http.Transport")
+	}
+	t := c.base.Clone()
+	t.TLSClientConfig = cfg
+	hc, _ := c.tlsHTTP.LoadOrStore(cfg, &http.Client{Transport: t, CheckRedirect: c.checkRedirect})
+	return hc.(*http.Client), nil
+}
+
+// SetEgressBaseline sets the operator egress policy merged into every call.
+// Call it during startup, before the client is shared.
+func (c *Client) SetEgressBaseline(p EgressPolicy) { c.egress = p }
+
+// EgressPolicy returns the effective policy for a tenant policy: the tenant's
+// allowlists merged with the client baseline.
+func (c *Client) EgressPolicy(tenant EgressPolicy) EgressPolicy { return tenant.Merge(c.egress) }
+
+func (c *Client) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return errors.New("stopped after too many redirects")
+	}
+	if p, ok := egressFrom(req.Context()); ok {
+		return p.CheckURL(req.URL.String())
+	}
+	return nil
+}
+
+// Default is the process-wide client shared by the execute and passthrough paths
+// so breaker state reflects all of a tenant's traffic to an upstream.
+var Default = NewClient(nil)
+
+// Do performs req according to opts, retrying when allowed. It returns the final
+// response (nil when every attempt failed at the transport level), every attempt
+// made, and the last transport error.
+func (c *Client) Do(ctx context.Context, req Request, opts CallOptions) (*Response, []Attempt, error) {
+	return c.do(ctx, req, opts, false)
+}
+
+// Open is Do for bodies too large to buffer: the final response's body is
+// left unread in Response.Stream, which the caller must close. The attempt
+// timeout covers the response headers; reading the body is then only bounded
+// by the same timeout applied to each wait for more data, so long downloads
+// run as long as the upstream keeps sending.
+func (c *Client) Open(ctx context.Context, req Request, opts CallOptions) (*Response, []Attempt, error) {
+	return c.do(ctx, req, opts, true)
+}
+
+func (c *Client) do(ctx context.Context, req Request, opts CallOptions, stream bool) (*Response, []Attempt, error) {
+	opts = opts.withDefaults()
+	tenant, _ := egressFrom(ctx)
+	pol := c.EgressPolicy(tenant)
+	if err := pol.CheckURL(req.URL); err != nil {
+		return nil, []Attempt{{Number: 1, Error: err.Error(), ErrKind: ErrKindEgress}}, err
+	}
+	ctx = WithEgress(ctx, pol)
+	maxAttempts := opts.MaxAttempts
+	if !retriable(req.Method, opts) || req.BodyStream != nil {
+		maxAttempts = 1
+	}
+	br := c.breakers.get(breakerKey(ctx, req.URL), opts.CircuitBreaker)
+	var attempts []Attempt
+	var lastErr error
+	var resp *Response
+	for n := 1; n <= maxAttempts; n++ {
+		at := Attempt{Number: n}
+		if !br.allow() {
+			at.Error, at.ErrKind = ErrCircuitOpen.Error(), ErrKindCircuitOpen
+			attempts = append(attempts, at)
+			return nil, attempts, ErrCircuitOpen
+		}
+		start := time.Now()
+		resp, lastErr = c.once(ctx, req, opts, stream)
+		at.Duration = time.Since(start)
+		retry := false
+		var wait time.Duration
+		if lastErr != nil {
+			at.Error, at.ErrKind = lastErr.Error(), classify(lastErr)
+			br.record(false)
+			retry = containsStr(opts.RetryOnErrors, at.ErrKind)
+		} else {
+			at.Status = resp.Status
+			br.record(resp.Status < 500)
+			retry = containsInt(opts.RetryOnStatus, resp.Status)
+			wait = min(retryAfter(resp.Header), time.Duration(opts.Backoff.MaxMS)*time.Millisecond)
+		}
+		if retry && n < maxAttempts && ctx.Err() == nil {
+			at.Retrying = true
+			attempts = append(attempts, at)
+			if req.OnRetry != nil {
+				req.OnRetry(at)
+			}
+			if resp != nil && resp.Stream != nil {
+				resp.Stream.Close()
+			}
+			if d := opts.Backoff.delay(n); d > wait {
+				wait = d
+			}
+			if err := c.sleep(ctx, wait); err != nil {
+				return resp, attempts, err
+			}
+			continue
+		}
+		attempts = append(attempts, at)
+		break
+	}
+	return resp, attempts, lastErr
+}
+
+func (c *Client) once(ctx context.Context, req Request, opts CallOptions, stream bool) (*Response, error) {
+	timeout := time.Duration(opts.TimeoutMS) * time.Millisecond
+	actx, cancel := context.WithCancel(ctx)
+	timer := time.AfterFunc(timeout, cancel)
+	keep := false // a streamed response cancels the attempt when closed
+	defer func() {
+		if !keep {
+			timer.Stop()
+			cancel()
+		}
+	}()
+	var body io.Reader = bytes.NewReader(req.Body)
+	if req.BodyStream != nil {
+		body = req.BodyStream
+	}
+	hr, err := http.NewRequestWithContext(actx, req.Method, req.URL, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range req.Header {
+		for _, v := range vs {
+			hr.Header.Add(k, v)
+		}
+	}
+	if opts.IdempotencyHeader != "" && req.IdempotencyKey != "" {
+		hr.Header.Set(opts.IdempotencyHeader, req.IdempotencyKey)
+	}
+	hc, err := c.httpFor(req.TLS)
+	if err != nil {
+		return nil, err
+	}
+	hres, err := hc.Do(hr)
+	if err != nil {
+		// Transport errors quote the URL, which may carry credentials in its
+		// query (api keys, signed URLs); the error ends up in attempts and
+		// responses, so only the query's names are kept.
+		var ue *url.Error
+		if errors.As(err, &ue) {
+			ue.URL = RedactURL(ue.URL)
+		}
+		return nil, err
+	}
+	if stream {
+		keep = true
+		timer.Stop()
+		return &Response{Status: hres.StatusCode, Header: hres.Header, Stream: &streamBody{ReadCloser: hres.Body, timer: timer, idle: timeout, cancel: cancel}}, nil
+	}
+	defer hres.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(hres.Body, opts.MaxResponseBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > opts.MaxResponseBytes {
+		return nil, ErrResponseTooLarge
+	}
+	return &Response{Status: hres.StatusCode, Header: hres.Header, Body: data}, nil
+}
+
+// streamBody is a streamed response body. Each read waiting longer than idle
+// for the upstream cancels the attempt; time the caller spends between reads
+// does not count. Closing it ends the attempt's context.
+type streamBody struct {
+	io.ReadCloser
+	timer  *time.Timer
+	idle   time.Duration
+	cancel context.CancelFunc
+}
+
+func (b *streamBody) Read(p []byte) (int, error) {
+	b.timer.Reset(b.idle)
+	n, err := b.ReadCloser.Read(p)
+	b.timer.Stop()
+	return n, err
+}
+
+func (b *streamBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.timer.Stop()
+	b.cancel()
+	return err
+}
+
+// Upper bounds of the call options accepted by Validate.
+const (
+	maxTimeoutMS        = 5 * 60 * 1000
+	maxAttemptsLimit    = 10
+	maxBackoffMS        = 60 * 1000
+	maxBackoffFactor    = 10
+	maxCooldownMS       = 60 * 60 * 1000
+	maxFailureThreshold = 1000
+	maxResponseLimit    = 256 << 20
+)
+
+// Validate reports options out of range. Zero values select the defaults; an
+// operation cannot hold a call open, retry or back off beyond the bounds above.
+func (o CallOptions) Validate() error {
+	inRange := func(name string, v, hi int) error {
+		if v < 0 || v > hi {
+			return fmt.Errorf("%s must be between 0 and %d", name, hi)
+		}
+		return nil
+	}
+	for _, err := range []error{
+		inRange("timeout_ms", o.TimeoutMS, maxTimeoutMS),
+		inRange("max_attempts", o.MaxAttempts, maxAttemptsLimit),
+		inRange("backoff.initial_ms", o.Backoff.InitialMS, maxBackoffMS),
+		inRange("backoff.max_ms", o.Backoff.MaxMS, maxBackoffMS),
+		inRange("circuit_breaker.cooldown_ms", o.CircuitBreaker.CooldownMS, maxCooldownMS),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	if o.Backoff.MaxMS > 0 && o.Backoff.InitialMS > o.Backoff.MaxMS {
+		return errors.New("backoff.initial_ms must not exceed backoff.max_ms")
+	}
+	if m := o.Backoff.Multiplier; m != 0 && (m < 1 || m > maxBackoffFactor) {
+		return fmt.Errorf("backoff.multiplier must be between 1 and %d", maxBackoffFactor)
+	}
+	if j := o.Backoff.Jitter; j < 0 || j > 1 {
+		return errors.New("backoff.jitter must be between 0 and 1")
+	}
+	if o.CircuitBreaker.FailureThreshold > maxFailureThreshold {
+		return fmt.Errorf("circuit_breaker.failure_threshold must not exceed %d", maxFailureThreshold)
+	}
+	if o.MaxResponseBytes < 0 || o.MaxResponseBytes > maxResponseLimit {
+		return fmt.Errorf("max_response_bytes must be between 0 and %d", maxResponseLimit)
+	}
+	for _, sc := range o.RetryOnStatus {
+		if sc < 100 || sc > 599 {
+			return fmt.Errorf("retry_on_status: invalid status %d", sc)
+		}
+	}
+	for _, k := range o.RetryOnErrors {
+		if k != ErrKindTimeout && k != ErrKindConnection {
+			return fmt.Errorf("retry_on_errors: unknown error kind %q (timeout | connection)", k)
+		}
+	}
+	if strings.ContainsAny(o.IdempotencyHeader, " \t\r\n:") {
+		return fmt.Errorf("invalid idempotency_header %q", o.IdempotencyHeader)
+	}
+	return nil
+}
+
+func (o CallOptions) withDefaults() CallOptions {
+	if o.TimeoutMS <= 0 {
+		o.TimeoutMS = 15000
+	}
+	if o.MaxAttempts <= 0 {
+		o.MaxAttempts = 1
+	}
+	if o.RetryOnStatus == nil {
+		o.RetryOnStatus = []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+	}
+	if o.RetryOnErrors == nil {
+		o.RetryOnErrors = []string{ErrKindTimeout, ErrKindConnection}
+	}
+	if o.MaxResponseBytes <= 0 {
+		o.MaxResponseBytes = 4 << 20
+	}
+	if o.Backoff.InitialMS <= 0 {
+		o.Backoff.InitialMS = 200
+	}
+	if o.Backoff.MaxMS <= 0 {
+		o.Backoff.MaxMS = 5000
+	}
+	if o.Backoff.Multiplier < 1 {
+		o.Backoff.Multiplier = 2
+	}
+	if o.Backoff.Jitter <= 0 || o.Backoff.Jitter > 1 {
+		o.Backoff.Jitter = 0.2
+	}
+	return o
+}
+
+// retriable reports whether a request may be sent more than once: only idempotent
+// methods, or any method when the upstream deduplicates on an idempotency header.
+func retriable(method string, opts CallOptions) bool {
+	switch strings.ToUpper(method) {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return opts.IdempotencyHeader != ""
+}
+
+func (b Backoff) delay(attempt int) time.Duration {
+	d := float64(b.InitialMS) * math.Pow(b.Multiplier, float64(attempt-1))
+	if d > float64(b.MaxMS) {
+		d = float64(b.MaxMS)
+	}
+	d += d * b.Jitter * (rand.Float64()*2 - 1)
+	return time.Duration(d) * time.Millisecond
+}
+
+// retryAfter honours a Retry-After header expressed in seconds. Callers cap it
+// at the backoff maximum so an upstream cannot park a call indefinitely.
+func retryAfter(h http.Header) time.Duration {
+	if h == nil {
+		return 0
+	}
+	if s, err := strconv.Atoi(strings.TrimSpace(h.Get("Retry-After"))); err == nil && s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	return 0
+}
+
+// classify maps a transport error onto an error kind.
+func classify(err error) string {
+	if errors.Is(err, ErrCircuitOpen) {
+		return ErrKindCircuitOpen
+	}
+	if errors.Is(err, ErrEgressDenied) {
+		return ErrKindEgress
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrKindTimeout
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return ErrKindTimeout
+	}
+	var oe *net.OpError
+	if errors.As(err, &oe) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return ErrKindConnection
+	}
+	var de *net.DNSError
+	if errors.As(err, &de) {
+		return ErrKindConnection
+	}
+	return ErrKindOther
+}
+
+// RedactURL returns raw without user info, fragment or query values; query
+// parameter names are kept. It is the form in which URLs are recorded.
+func RedactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		base, _, _ := strings.Cut(raw, "?")
+		return base
+	}
+	u.User, u.Fragment, u.RawFragment = nil, "", ""
+	if u.RawQuery != "" {
+		var names []string
+		for _, kv := range strings.Split(u.RawQuery, "&") {
+			if name, _, _ := strings.Cut(kv, "="); name != "" {
+				names = append(names, name)
+			}
+		}
+		u.RawQuery = strings.Join(names, "&")
+	}
+	return u.String()
+}
+
+type tenantKey struct{}
+
+// WithTenant attaches the calling tenant to ctx. Breakers are kept per tenant
+// and upstream, so one tenant's failing calls do not open the circuit for
+// other tenants of the same host.
+func WithTenant(ctx context.Context, tenantID string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenantID)
+}
+
+func breakerKey(ctx context.Context, raw string) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	u, err := url.Parse(raw)
+	if err != nil {
+		return tenant + " " + raw
+	}
+	return tenant + " " + u.Scheme + "://" + u.Host
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+func containsInt(list []int, v int) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+func containsStr(list []string, v string) bool {
+	for _, x := range list {
+		if strings.EqualFold(x, v) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,234 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// scriptedServer answers with the given statuses in turn, repeating the last,
+// and counts the requests it received.
+type scriptedServer struct {
+	mu       sync.Mutex
+	statuses []int
+	header   http.Header
+	calls    int
+	idemKeys []string
+}
+
+func (s *scriptedServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.idemKeys = append(s.idemKeys, r.Header.Get("Idempotency-Key"))
+	st := s.statuses[min(s.calls, len(s.statuses)-1)]
+	s.calls++
+	for k, vs := range s.header {
+		w.Header()[k] = vs
+	}
+	w.WriteHeader(st)
+	_, _ = w.Write([]byte(`{}`))
+}
+
+// testClient returns a client allowed to reach loopback servers whose waits
+// between attempts are recorded instead of slept.
+func testClient() (*Client, *[]time.Duration) {
+	c := NewClient(nil)
+	c.SetEgressBaseline(EgressPolicy{AllowPrivate: true})
+	var waits []time.Duration
+	c.sleep = func(_ context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return nil
+	}
+	return c, &waits
+}
+
+func TestDoRetries(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		method   string
+		idemHdr  string
+		statuses []int
+		attempts int
+		status   int
+	}{
+		{"idempotent method retried until success", http.MethodGet, "", []int{503, 502, 200}, 3, 200},
+		{"retries exhausted", http.MethodGet, "", []int{503}, 3, 503},
+		{"non-idempotent method not retried", http.MethodPost, "", []int{503, 200}, 1, 503},
+		{"non-idempotent method with idempotency header retried", http.MethodPost, "Idempotency-Key", []int{503, 200}, 2, 200},
+		{"client error not retried", http.MethodGet, "", []int{400, 200}, 1, 400},
+		{"server error outside retry_on_status not retried", http.MethodGet, "", []int{500, 200}, 1, 500},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := &scriptedServer{statuses: tc.statuses}
+			ts := httptest.NewServer(srv)
+			defer ts.Close()
+			c, _ := testClient()
+			opts := CallOptions{MaxAttempts: 3, IdempotencyHeader: tc.idemHdr, Backoff: Backoff{InitialMS: 1, MaxMS: 1}}
+
+			resp, attempts, err := c.Do(context.Background(), Request{Method: tc.method, URL: ts.URL, IdempotencyKey: "k-1"}, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Status != tc.status || len(attempts) != tc.attempts || srv.calls != tc.attempts {
+				t.Fatalf("status %d, attempts %+v, server calls %d", resp.Status, attempts, srv.calls)
+			}
+			for i, at := range attempts {
+				if at.Retrying != (i < len(attempts)-1) {
+					t.Fatalf("attempt %d retrying=%v", i+1, at.Retrying)
+				}
+			}
+			if tc.idemHdr != "" {
+				for _, k := range srv.idemKeys {
+					if k != "k-1" {
+						t.Fatalf("idempotency keys %v", srv.idemKeys)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDoCapsRetryAfterAtBackoffMax(t *testing.T) {
+	srv := &scriptedServer{statuses: []int{503, 200}, header: http.Header{"Retry-After": {"120"}}}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	c, waits := testClient()
+
+	opts := CallOptions{MaxAttempts: 2, Backoff: Backoff{InitialMS: 10, MaxMS: 50, Jitter: 0.1}}
+	if _, _, err := c.Do(context.Background(), Request{Method: http.MethodGet, URL: ts.URL}, opts); err != nil {
+		t.Fatal(err)
+	}
+	// min(Retry-After, max_ms) wins over the shorter backoff delay.
+	if len(*waits) != 1 || (*waits)[0] != 50*time.Millisecond {
+		t.Fatalf("waits %v", *waits)
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	b := Backoff{InitialMS: 100, MaxMS: 1000, Multiplier: 2}
+	for _, tc := range []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second}, // capped
+		{9, time.Second},
+	} {
+		if got := b.delay(tc.attempt); got != tc.want {
+			t.Errorf("attempt %d: %v, want %v", tc.attempt, got, tc.want)
+		}
+	}
+	b.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := b.delay(1); d < 50*time.Millisecond || d > 150*time.Millisecond {
+			t.Fatalf("jittered delay %v outside ±50%%", d)
+		}
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	b := &breaker{opts: BreakerOptions{FailureThreshold: 2, CooldownMS: 20}}
+	b.record(false)
+	if !b.allow() {
+		t.Fatal("open below the threshold")
+	}
+	b.record(false)
+	if b.allow() {
+		t.Fatal("closed at the threshold")
+	}
+	time.Sleep(25 * time.Millisecond)
+	if !b.allow() {
+		t.Fatal("no trial call after the cooldown")
+	}
+	if b.allow() {
+		t.Fatal("second call let through while half-open")
+	}
+	b.record(false) // failed trial re-opens
+	if b.allow() {
+		t.Fatal("closed after a failed trial")
+	}
+	time.Sleep(25 * time.Millisecond)
+	if !b.allow() {
+		t.Fatal("no trial call after the second cooldown")
+	}
+	b.record(true)
+	if !b.allow() || !b.allow() {
+		t.Fatal("not closed after a successful trial")
+	}
+
+	disabled := &breaker{opts: BreakerOptions{FailureThreshold: -1}}
+	for i := 0; i < 10; i++ {
+		disabled.record(false)
+	}
+	if !disabled.allow() {
+		t.Fatal("disabled breaker opened")
+	}
+}
+
+func TestDoFailsFastOnOpenCircuitPerTenant(t *testing.T) {
+	srv := &scriptedServer{statuses: []int{500}}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	c, _ := testClient()
+	opts := CallOptions{CircuitBreaker: BreakerOptions{FailureThreshold: 2, CooldownMS: 60000}}
+	acme := WithTenant(context.Background(), "acme")
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := c.Do(acme, Request{Method: http.MethodGet, URL: ts.URL}, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, attempts, err := c.Do(acme, Request{Method: http.MethodGet, URL: ts.URL}, opts)
+	if !errors.Is(err, ErrCircuitOpen) || len(attempts) != 1 || attempts[0].ErrKind != ErrKindCircuitOpen || srv.calls != 2 {
+		t.Fatalf("err %v, attempts %+v, server calls %d", err, attempts, srv.calls)
+	}
+	// Another tenant's calls to the same upstream keep their own circuit.
+	if _, _, err := c.Do(WithTenant(context.Background(), "globex"), Request{Method: http.MethodGet, URL: ts.URL}, opts); err != nil {
+		t.Fatalf("other tenant: %v", err)
+	}
+}
+
+func TestDoRejectsOversizedResponses(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write(make([]byte, 2048))
+	}))
+	defer ts.Close()
+	c, _ := testClient()
+	_, _, err := c.Do(context.Background(), Request{Method: http.MethodGet, URL: ts.URL}, CallOptions{MaxResponseBytes: 1024})
+	if !errors.Is(err, ErrResponseTooLarge) {
+		t.Fatalf("err %v", err)
+	}
+}
+
+func TestCallOptionsValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts CallOptions
+		ok   bool
+	}{
+		{"defaults", CallOptions{}, true},
+		{"typical", CallOptions{TimeoutMS: 5000, MaxAttempts: 3, Backoff: Backoff{InitialMS: 100, MaxMS: 2000, Multiplier: 2, Jitter: 0.2}, RetryOnStatus: []int{503}, RetryOnErrors: []string{"timeout"}, IdempotencyHeader: "Idempotency-Key"}, true},
+		{"breaker disabled", CallOptions{CircuitBreaker: BreakerOptions{FailureThreshold: -1}}, true},
+		{"negative timeout", CallOptions{TimeoutMS: -1}, false},
+		{"huge timeout", CallOptions{TimeoutMS: 24 * 60 * 60 * 1000}, false},
+		{"too many attempts", CallOptions{MaxAttempts: 1000}, false},
+		{"initial above max", CallOptions{Backoff: Backoff{InitialMS: 3000, MaxMS: 1000}}, false},
+		{"shrinking multiplier", CallOptions{Backoff: Backoff{Multiplier: 0.5}}, false},
+		{"jitter above one", CallOptions{Backoff: Backoff{Jitter: 2}}, false},
+		{"huge cooldown", CallOptions{CircuitBreaker: BreakerOptions{CooldownMS: 1 << 30}}, false},
+		{"negative response limit", CallOptions{MaxResponseBytes: -1}, false},
+		{"invalid status", CallOptions{RetryOnStatus: []int{42}}, false},
+		{"unknown error kind", CallOptions{RetryOnErrors: []string{"dns"}}, false},
+		{"invalid header", CallOptions{IdempotencyHeader: "Idempotency Key"}, false},
+	} {
+		if err := tc.opts.Validate(); (err == nil) != tc.ok {
+			t.Errorf("%s: err %v", tc.name, err)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrEgressDenied is returned (wrapped) when a destination violates the egress policy.
+var ErrEgressDenied = errors.New("egress denied")
+
+// ErrKindEgress is the attempt error kind for egress policy violations; it is never retried.
+const ErrKindEgress = "egress_denied"
+
+// EgressPolicy restricts which upstreams connector calls may reach.
+//
+// Tenants configure AllowHosts, AllowCIDRs and RequireHTTPS (tenants.egress_policy);
+// the operator sets a process baseline (Client.SetEgressBaseline) which is merged in
+// and is the only way to reach private, loopback or link-local addresses.
+type EgressPolicy struct {
+	// AllowHosts lists permitted hostnames: exact ("api.example.com") or a
+	// wildcard suffix ("*.example.com"). Together with AllowCIDRs it forms an
+	// allowlist; when both are empty any public destination is allowed.
+	AllowHosts []string `json:"allow_hosts,omitempty"`
+	// AllowCIDRs lists permitted destination ranges, matched on the dialed IP.
+	AllowCIDRs []string `json:"allow_cidrs,omitempty"`
+	// RequireHTTPS rejects plain http URLs (and plaintext grpc targets).
+	RequireHTTPS bool `json:"require_https,omitempty"`
+
+	// AllowPrivate permits private, loopback and link-local destinations.
+	// Operator only; never read from tenant configuration.
+	AllowPrivate bool `json:"-"`
+	// PrivateCIDRs permits specific private ranges (e.g. a peered VPC). Operator only.
+	PrivateCIDRs []string `json:"-"`
+}
+
+// Validate reports malformed allowlist entries.
+func (p EgressPolicy) Validate() error {
+	for _, h := range p.AllowHosts {
+		h = strings.TrimPrefix(strings.TrimSpace(h), "*.")
+		if h == "" || strings.ContainsAny(h, "/:*@ ") {
+			return fmt.Errorf("invalid allow_hosts entry %q", h)
+		}
+	}
+	for _, c := range append(append([]string{}, p.AllowCIDRs...), p.PrivateCIDRs...) {
+		if _, err := netip.ParsePrefix(strings.TrimSpace(c)); err != nil {
+			return fmt.Errorf("invalid CIDR %q", c)
+		}
+	}
+	return nil
+}
+
+// Merge combines a tenant policy with the operator baseline: allowlists come
+// from the tenant, HTTPS is required if either requires it, and private
+// destinations are governed by the baseline alone.
+func (p EgressPolicy) Merge(base EgressPolicy) EgressPolicy {
+	return EgressPolicy{
+		AllowHosts:   p.AllowHosts,
+		AllowCIDRs:   p.AllowCIDRs,
+		RequireHTTPS: p.RequireHTTPS || base.RequireHTTPS,
+		AllowPrivate: base.AllowPrivate,
+		PrivateCIDRs: base.PrivateCIDRs,
+	}
+}
+
+// CheckURL applies the checks that need no DNS: scheme, HTTPS and the host
+// allowlist, plus the address checks when the host is an IP literal.
+func (p EgressPolicy) CheckURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("%w: invalid URL", ErrEgressDenied)
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "https", "grpcs":
+	case "http", "grpc":
+		if p.RequireHTTPS {
+			return fmt.Errorf("%w: https is required", ErrEgressDenied)
+		}
+	default:
+		return fmt.Errorf("%w: unsupported scheme %q", ErrEgressDenied, u.Scheme)
+	}
+	host := u.Hostname()
+	if host == "" {
+		return fmt.Errorf("%w: URL has no host", ErrEgressDenied)
+	}
+	if u.User != nil {
+		return fmt.Errorf("%w: URL must not carry credentials", ErrEgressDenied)
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return p.checkIP(ip, p.hostAllowed(host))
+	}
+	if p.restricted() && !p.hostAllowed(host) && len(p.AllowCIDRs) == 0 {
+		return fmt.Errorf("%w: host %s is not in the egress allowlist", ErrEgressDenied, host)
+	}
+	return nil
+}
+
+// CheckResolved runs CheckURL and also resolves the host and checks every
+// address, so configuration pointing at internal names is rejected on save.
+// Addresses are checked again when dialing, as DNS answers can change.
+func (p EgressPolicy) CheckResolved(ctx context.Context, raw string) error {
+	if err := p.CheckURL(raw); err != nil {
+		return err
+	}
+	u, _ := url.Parse(raw)
+	host := u.Hostname()
+	if _, err := netip.ParseAddr(host); err == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		// Unresolvable here may still resolve for the data plane; dial-time checks apply then.
+		return nil
+	}
+	named := p.hostAllowed(host)
+	for _, ip := range addrs {
+		if err := p.checkIP(ip, named); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p EgressPolicy) restricted() bool { return len(p.AllowHosts) > 0 || len(p.AllowCIDRs) > 0 }
+
+func (p EgressPolicy) hostAllowed(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, h := range p.AllowHosts {
+		h = strings.ToLower(strings.TrimSpace(h))
+		if strings.HasPrefix(h, "*.") {
+			if strings.HasSuffix(host, h[1:]) {
+				return true
+			}
+		} else if host == h {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIP applies the address rules to a dialed or literal IP. named reports
+// whether the hostname already matched AllowHosts.
+func (p EgressPolicy) checkIP(ip netip.Addr, named bool) error {
+	ip = ip.Unmap()
+	if internalAddr(ip) && !p.AllowPrivate && !inPrefixes(ip, p.PrivateCIDRs) {
+		return fmt.Errorf("%w: %s is a private or reserved address", ErrEgressDenied, ip)
+	}
+	if p.restricted() && !named && !inPrefixes(ip, p.AllowCIDRs) {
+		return fmt.Errorf("%w: %s is not in the egress allowlist", ErrEgressDenied, ip)
+	}
+	return nil
+}
+
+// reservedPrefixes are non-public ranges not covered by the netip predicates.
+var reservedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),     // "this" network
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),  // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"), // benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),   // reserved, incl. broadcast
+	netip.MustParsePrefix("64:ff9b::/96"),  // NAT64 can reach IPv4 internals
+}
+
+// internalAddr reports loopback, private, link-local (incl. cloud metadata at
+// 169.254.169.254), unspecified, multicast and reserved addresses.
+func internalAddr(ip netip.Addr) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsUnspecified() || ip.IsMulticast() || ip.IsInterfaceLocalMulticast() {
+		return true
+	}
+	for _, pfx := range reservedPrefixes {
+		if pfx.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func inPrefixes(ip netip.Addr, cidrs []string) bool {
+	for _, c := range cidrs {
+		if pfx, err := netip.ParsePrefix(strings.TrimSpace(c)); err == nil && pfx.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type egressKey struct{}
+
+// WithEgress attaches a tenant egress policy to ctx; Client.Do merges it with
+// the client's baseline and enforces it on the URL, redirects and dialed IPs.
+func WithEgress(ctx context.Context, p EgressPolicy) context.Context {
+	return context.WithValue(ctx, egressKey{}, p)
+}
+
+func egressFrom(ctx context.Context) (EgressPolicy, bool) {
+	p, ok := ctx.Value(egressKey{}).(EgressPolicy)
+	return p, ok
+}
+
+// newEgressTransport clones the default transport with a dialer that checks
+// the IP actually being connected to, after DNS resolution, so a hostname
+// that re-resolves to an internal address (DNS rebinding) is still refused.
+// Proxies are not used: they would hide the real destination from the check.
+func newEgressTransport() *http.Transport {
+	base := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		p, ok := egressFrom(ctx)
+		if !ok {
+			return base.DialContext(ctx, network, addr)
+		}
+		return dialChecked(ctx, base, p, network, addr)
+	}
+	return t
+}
+
+// dialChecked dials addr and refuses the connection when the resolved IP is
+// not permitted by p.
+func dialChecked(ctx context.Context, base *net.Dialer, p EgressPolicy, network, addr string) (net.Conn, error) {
+	host, _, _ := net.SplitHostPort(addr)
+	named := p.hostAllowed(host)
+	d := *base
+	d.Control = func(_, address string, _ syscall.RawConn) error {
+		ap, err := netip.ParseAddrPort(address)
+		if err != nil {
+			return fmt.Errorf("%w: unparseable address %s", ErrEgressDenied, address)
+		}
+		return p.checkIP(ap.Addr(), named)
+	}
+	return d.DialContext(ctx, network, addr)
+}
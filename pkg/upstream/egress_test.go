@@ -0,0 +1,123 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckIP(t *testing.T) {
+	open := EgressPolicy{}
+	for _, tc := range []struct {
+		ip     string
+		policy EgressPolicy
+		ok     bool
+	}{
+		{"93.184.216.34", open, true},
+		{"2606:4700::1111", open, true},
+		{"169.254.169.254", open, false}, // cloud metadata
+		{"127.0.0.1", open, false},
+		{"10.1.2.3", open, false},
+		{"172.16.0.1", open, false},
+		{"192.168.1.1", open, false},
+		{"100.64.0.1", open, false}, // carrier-grade NAT
+		{"0.0.0.0", open, false},
+		{"::1", open, false},
+		{"fe80::1", open, false},
+		{"fd00::1", open, false},
+		{"64:ff9b::a9fe:a9fe", open, false}, // NAT64 form of 169.254.169.254
+		{"64:ff9b::808:808", open, false},   // NAT64 is refused as a whole
+		{"::ffff:169.254.169.254", open, false},
+		{"::ffff:127.0.0.1", open, false},
+		{"::ffff:10.0.0.1", open, false},
+		{"::ffff:93.184.216.34", open, true},
+		{"10.1.2.3", EgressPolicy{AllowPrivate: true}, true},
+		{"10.1.2.3", EgressPolicy{PrivateCIDRs: []string{"10.1.0.0/16"}}, true},
+		{"10.2.0.1", EgressPolicy{PrivateCIDRs: []string{"10.1.0.0/16"}}, false},
+		{"::ffff:10.1.2.3", EgressPolicy{PrivateCIDRs: []string{"10.1.0.0/16"}}, true},
+		{"93.184.216.34", EgressPolicy{AllowCIDRs: []string{"93.184.216.0/24"}}, true},
+		{"8.8.8.8", EgressPolicy{AllowCIDRs: []string{"93.184.216.0/24"}}, false},
+		{"169.254.169.254", EgressPolicy{AllowCIDRs: []string{"169.254.0.0/16"}}, false}, // tenants cannot open private ranges
+	} {
+		err := tc.policy.checkIP(netip.MustParseAddr(tc.ip), false)
+		if (err == nil) != tc.ok || err != nil && !errors.Is(err, ErrEgressDenied) {
+			t.Errorf("%s %+v: err %v", tc.ip, tc.policy, err)
+		}
+	}
+}
+
+func TestCheckURL(t *testing.T) {
+	allow := EgressPolicy{AllowHosts: []string{"api.example.com", "*.partner.test"}}
+	for _, tc := range []struct {
+		url    string
+		policy EgressPolicy
+		ok     bool
+	}{
+		{"https://api.example.com/v1", EgressPolicy{}, true},
+		{"http://api.example.com/v1", EgressPolicy{}, true},
+		{"http://api.example.com/v1", EgressPolicy{RequireHTTPS: true}, false},
+		{"grpcs://api.example.com:443", EgressPolicy{RequireHTTPS: true}, true},
+		{"ftp://api.example.com/file", EgressPolicy{}, false},
+		{"https://user:pw@api.example.com/", EgressPolicy{}, false},
+		{"http://169.254.169.254/latest/meta-data", EgressPolicy{}, false},
+		{"http://[::ffff:169.254.169.254]/latest/meta-data", EgressPolicy{}, false},
+		{"http://[64:ff9b::a9fe:a9fe]/", EgressPolicy{}, false},
+		{"http://127.0.0.1:8080/", EgressPolicy{}, false},
+		{"https://api.example.com/", allow, true},
+		{"https://eu.partner.test/", allow, true},
+		{"https://partner.test.evil.com/", allow, false},
+		{"https://other.example.com/", allow, false},
+	} {
+		err := tc.policy.CheckURL(tc.url)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: err %v", tc.url, err)
+		}
+	}
+}
+
+func TestMergeKeepsPrivateAccessOperatorOnly(t *testing.T) {
+	tenant := EgressPolicy{AllowHosts: []string{"api.example.com"}, AllowPrivate: true, PrivateCIDRs: []string{"10.0.0.0/8"}}
+	got := tenant.Merge(EgressPolicy{RequireHTTPS: true})
+	if got.AllowPrivate || len(got.PrivateCIDRs) != 0 || !got.RequireHTTPS || len(got.AllowHosts) != 1 {
+		t.Fatalf("merged %+v", got)
+	}
+}
+
+func TestDialCheckedRefusesInternalAddresses(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+	defer ts.Close()
+	addr := strings.TrimPrefix(ts.URL, "http://")
+	base := &net.Dialer{Timeout: time.Second}
+
+	if _, err := dialChecked(context.Background(), base, EgressPolicy{}, "tcp", addr); !errors.Is(err, ErrEgressDenied) {
+		t.Fatalf("loopback dial: err %v", err)
+	}
+	// A name resolving to loopback is refused on the dialed address too.
+	_, port, _ := net.SplitHostPort(addr)
+	if _, err := dialChecked(context.Background(), base, EgressPolicy{}, "tcp", net.JoinHostPort("localhost", port)); !errors.Is(err, ErrEgressDenied) {
+		t.Fatalf("localhost dial: err %v", err)
+	}
+	conn, err := dialChecked(context.Background(), base, EgressPolicy{AllowPrivate: true}, "tcp", addr)
+	if err != nil {
+		t.Fatalf("operator-allowed dial: %v", err)
+	}
+	conn.Close()
+}
+
+func TestDoRefusesInternalUpstreamsWithoutRetry(t *testing.T) {
+	srv := &scriptedServer{statuses: []int{200}}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	c := NewClient(nil) // default baseline: no private destinations
+
+	_, attempts, err := c.Do(context.Background(), Request{Method: http.MethodGet, URL: ts.URL}, CallOptions{MaxAttempts: 3})
+	if !errors.Is(err, ErrEgressDenied) || len(attempts) != 1 || attempts[0].ErrKind != ErrKindEgress || srv.calls != 0 {
+		t.Fatalf("err %v, attempts %+v, server calls %d", err, attempts, srv.calls)
+	}
+}
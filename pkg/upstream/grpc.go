@@ -0,0 +1,244 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// GRPCRequest is a unary gRPC call with an already serialized request message.
+type GRPCRequest struct {
+	// Target is grpcs://host[:port] (TLS, default port 443) or grpc://host[:port] (plaintext, default 80).
+	Target string
+	// Method is the full method name, "/package.Service/Method".
+	Method   string
+	Metadata map[string]string
+	Message  []byte
+	// IdempotencyKey is sent as metadata named by CallOptions.IdempotencyHeader when configured.
+	IdempotencyKey string
+	OnRetry        func(Attempt)
+	// TLS overrides the TLS configuration of grpcs targets (e.g. mTLS client certificates).
+	TLS *tls.Config
+}
+
+// GRPCResponse is the outcome of the final attempt. Message is the serialized
+// response, set when Code is OK.
+type GRPCResponse struct {
+	Code    codes.Code
+	Detail  string // status message
+	Message []byte
+	Header  metadata.MD
+}
+
+// DoGRPC performs a unary call with the same egress, timeout, retry and
+// breaker rules as Do. Each attempt records the gRPC code and its HTTP
+// equivalent as Status, so retry_on_status and success criteria apply
+// unchanged: UNAVAILABLE is 503 and retried by default. DEADLINE_EXCEEDED is
+// reported as a timeout.
+func (c *Client) DoGRPC(ctx context.Context, req GRPCRequest, opts CallOptions) (*GRPCResponse, []Attempt, error) {
+	opts = opts.withDefaults()
+	conn, err := c.GRPCConn(ctx, req.Target, req.TLS)
+	if err != nil {
+		at := Attempt{Number: 1, Error: err.Error(), ErrKind: classify(err)}
+		return nil, []Attempt{at}, err
+	}
+	maxAttempts := opts.MaxAttempts
+	if !retriable(http.MethodPost, opts) {
+		maxAttempts = 1
+	}
+	md := metadata.New(req.Metadata)
+	if opts.IdempotencyHeader != "" && req.IdempotencyKey != "" {
+		md.Set(strings.ToLower(opts.IdempotencyHeader), req.IdempotencyKey)
+	}
+	ctx = metadata.NewOutgoingContext(ctx, md)
+	br := c.breakers.get(breakerKey(ctx, req.Target), opts.CircuitBreaker)
+	var attempts []Attempt
+	var lastErr error
+	var resp *GRPCResponse
+	for n := 1; n <= maxAttempts; n++ {
+		at := Attempt{Number: n}
+		if !br.allow() {
+			at.Error, at.ErrKind = ErrCircuitOpen.Error(), ErrKindCircuitOpen
+			attempts = append(attempts, at)
+			return nil, attempts, ErrCircuitOpen
+		}
+		start := time.Now()
+		resp, lastErr = c.grpcOnce(ctx, conn, req, opts)
+		at.Duration = time.Since(start)
+		at.GRPCCode, at.Status = resp.Code.String(), HTTPStatusFromCode(resp.Code)
+		retry := containsInt(opts.RetryOnStatus, at.Status)
+		if lastErr != nil {
+			at.Error, at.ErrKind = lastErr.Error(), classify(lastErr)
+			retry = containsStr(opts.RetryOnErrors, at.ErrKind)
+		}
+		br.record(at.Status < 500)
+		if retry && n < maxAttempts && ctx.Err() == nil {
+			at.Retrying = true
+			attempts = append(attempts, at)
+			if req.OnRetry != nil {
+				req.OnRetry(at)
+			}
+			if err := c.sleep(ctx, opts.Backoff.delay(n)); err != nil {
+				return resp, attempts, err
+			}
+			continue
+		}
+		attempts = append(attempts, at)
+		break
+	}
+	return resp, attempts, lastErr
+}
+
+// grpcOnce performs one attempt. A response is always returned; the error is
+// set for outcomes that are not an upstream answer: timeouts and egress denials.
+func (c *Client) grpcOnce(ctx context.Context, conn *grpc.ClientConn, req GRPCRequest, opts CallOptions) (*GRPCResponse, error) {
+	actx, cancel := context.WithTimeout(ctx, time.Duration(opts.TimeoutMS)*time.Millisecond)
+	defer cancel()
+	var out []byte
+	resp := &GRPCResponse{}
+	err := conn.Invoke(actx, req.Method, req.Message, &out, grpc.ForceCodec(rawCodec{}), grpc.Header(&resp.Header))
+	st := status.Convert(err)
+	resp.Code, resp.Detail = st.Code(), st.Message()
+	switch {
+	case err == nil:
+		resp.Message = out
+		return resp, nil
+	case st.Code() == codes.DeadlineExceeded:
+		return resp, fmt.Errorf("%w: %s", context.DeadlineExceeded, st.Message())
+	case st.Code() == codes.Unavailable && strings.Contains(st.Message(), ErrEgressDenied.Error()):
+		return resp, fmt.Errorf("%w: %s", ErrEgressDenied, st.Message())
+	}
+	return resp, nil
+}
+
+// GRPCConn returns a shared connection to a grpc:// or grpcs:// target, held
+// to the egress policy in ctx merged with the client's baseline. Connections
+// are kept per target, TLS config and policy, as the policy is enforced when
+// the connection dials rather than per call.
+func (c *Client) GRPCConn(ctx context.Context, target string, cfg *tls.Config) (*grpc.ClientConn, error) {
+	tenant, _ := egressFrom(ctx)
+	pol := c.EgressPolicy(tenant)
+	if err := pol.CheckURL(target); err != nil {
+		return nil, err
+	}
+	u, _ := url.Parse(target)
+	secure := strings.EqualFold(u.Scheme, "grpcs")
+	addr := u.Host
+	if u.Port() == "" {
+		if secure {
+			addr = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			addr = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+	key := fmt.Sprintf("%s|%t|%p|%+v", addr, secure, cfg, pol)
+	if conn, ok := c.grpc.Load(key); ok {
+		return conn.(*grpc.ClientConn), nil
+	}
+	creds := insecure.NewCredentials()
+	if secure {
+		tc := &tls.Config{MinVersion: tls.VersionTLS12}
+		if cfg != nil {
+			tc = cfg.Clone()
+		}
+		if tc.ServerName == "" {
+			tc.ServerName = u.Hostname()
+		}
+		creds = credentials.NewTLS(tc)
+	}
+	base := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	// passthrough hands host:port to the dialer, which resolves it and checks
+	// every dialed address, as the HTTP transport does.
+	dial := func(ctx context.Context, addr string) (net.Conn, error) {
+		return dialChecked(ctx, base, pol, "tcp", addr)
+	}
+	if c.grpcDial != nil {
+		dial = c.grpcDial
+	}
+	conn, err := grpc.NewClient("passthrough:///"+addr,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithContextDialer(dial))
+	if err != nil {
+		return nil, err
+	}
+	if prev, loaded := c.grpc.LoadOrStore(key, conn); loaded {
+		_ = conn.Close()
+		return prev.(*grpc.ClientConn), nil
+	}
+	return conn, nil
+}
+
+// SetGRPCDialer replaces the dialer of gRPC connections, e.g. with an
+// in-process listener. Like a custom HTTP transport, it only gets the target
+// URL checks of the egress policy. Call it before the client is shared.
+func (c *Client) SetGRPCDialer(dial func(ctx context.Context, addr string) (net.Conn, error)) {
+	c.grpcDial = dial
+}
+
+// HTTPStatusFromCode maps a gRPC code onto the HTTP status with the same meaning.
+func HTTPStatusFromCode(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	default: // Unknown, Internal, DataLoss
+		return http.StatusInternalServerError
+	}
+}
+
+// rawCodec passes already serialized messages through; descriptors and
+// JSON conversion are the caller's concern.
+type rawCodec struct{}
+
+func (rawCodec) Name() string { return "proto" }
+
+func (rawCodec) Marshal(v any) ([]byte, error) {
+	switch t := v.(type) {
+	case []byte:
+		return t, nil
+	case *[]byte:
+		return *t, nil
+	}
+	return nil, errors.New("raw codec: message must be []byte")
+}
+
+func (rawCodec) Unmarshal(data []byte, v any) error {
+	p, ok := v.(*[]byte)
+	if !ok {
+		return errors.New("raw codec: target must be *[]byte")
+	}
+	*p = append((*p)[:0], data...)
+	return nil
+}
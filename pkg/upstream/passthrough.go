@@ -0,0 +1,116 @@
+package upstream
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Passthrough configures how a passthrough operation relays caller requests.
+// Stored per operation in connector_operations.passthrough.
+type Passthrough struct {
+	// Headers selects the caller's request headers forwarded upstream
+	// (default DefaultRequestHeaders).
+	Headers HeaderRules `json:"headers,omitempty"`
+	// ResponseHeaders selects the upstream response headers relayed in stream
+	// mode (default DefaultResponseHeaders).
+	ResponseHeaders HeaderRules `json:"response_headers,omitempty"`
+	// Stream relays the upstream response as is (status, headers and body,
+	// unbuffered) instead of wrapping it in the JSON envelope, and streams the
+	// request body upstream. Streamed request bodies are sent once, without retries.
+	// The operation's timeout then bounds the response headers and each wait
+	// for more of the body, not the whole download.
+	Stream bool `json:"stream,omitempty"`
+	// MaxBufferedBytes bounds the request and response bodies held in memory
+	// outside stream mode (default 4 MiB).
+	MaxBufferedBytes int64 `json:"max_buffered_bytes,omitempty"`
+}
+
+// defaultMaxBuffered is the default MaxBufferedBytes.
+const defaultMaxBuffered = 4 << 20
+
+// BufferLimit returns MaxBufferedBytes or its default.
+func (p Passthrough) BufferLimit() int64 {
+	if p.MaxBufferedBytes <= 0 {
+		return defaultMaxBuffered
+	}
+	return p.MaxBufferedBytes
+}
+
+// HeaderRules selects headers by name, case-insensitively. An entry ending in
+// "*" matches by prefix (e.g. "X-Acme-*"). Deny wins over Allow; an empty
+// Allow uses the defaults.
+type HeaderRules struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+var (
+	// DefaultRequestHeaders are forwarded upstream unless an allowlist is configured.
+	DefaultRequestHeaders = []string{"Content-Type", "Accept", "Accept-Language", "If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"}
+	// DefaultResponseHeaders are relayed in stream mode unless an allowlist is configured.
+	DefaultResponseHeaders = []string{"Content-Type", "Content-Disposition", "Content-Language", "Cache-Control", "ETag", "Last-Modified", "Location", "Retry-After"}
+)
+
+// neverForwarded are hop-by-hop headers, headers the HTTP client manages and
+// the caller's own credentials for this service; rules cannot forward them.
+var neverForwarded = []string{
+	"Authorization", "Proxy-Authorization", "Proxy-Authenticate", "Cookie", "Set-Cookie", "DPoP",
+	"Connection", "Keep-Alive", "TE", "Trailer", "Transfer-Encoding", "Upgrade", "Host", "Content-Length",
+	"X-Tenant-ID", "Idempotency-Key",
+}
+
+// Validate reports rules that are not header names or prefixes.
+func (p Passthrough) Validate() error {
+	if p.MaxBufferedBytes < 0 {
+		return errors.New("max_buffered_bytes must not be negative")
+	}
+	for _, set := range [][]string{p.Headers.Allow, p.Headers.Deny, p.ResponseHeaders.Allow, p.ResponseHeaders.Deny} {
+		for _, h := range set {
+			name := strings.TrimSuffix(h, "*")
+			if name == "" && h != "*" || strings.ContainsAny(name, " \t\r\n:*") {
+				return fmt.Errorf("invalid header rule %q", h)
+			}
+		}
+	}
+	return nil
+}
+
+// Forward returns the caller headers to forward upstream.
+func (p Passthrough) Forward(src http.Header) http.Header {
+	return p.Headers.filter(src, DefaultRequestHeaders)
+}
+
+// Relay returns the upstream response headers to relay to the caller.
+func (p Passthrough) Relay(src http.Header) http.Header {
+	return p.ResponseHeaders.filter(src, DefaultResponseHeaders)
+}
+
+func (r HeaderRules) filter(src http.Header, defaults []string) http.Header {
+	allow := r.Allow
+	if len(allow) == 0 {
+		allow = defaults
+	}
+	out := http.Header{}
+	for k, vs := range src {
+		if !matchHeader(allow, k) || matchHeader(r.Deny, k) || matchHeader(neverForwarded, k) {
+			continue
+		}
+		out[k] = append([]string(nil), vs...)
+	}
+	return out
+}
+
+func matchHeader(rules []string, name string) bool {
+	for _, rule := range rules {
+		if prefix, ok := strings.CutSuffix(rule, "*"); ok {
+			if len(name) >= len(prefix) && strings.EqualFold(name[:len(prefix)], prefix) {
+				return true
+			}
+		} else if strings.EqualFold(rule, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,256 @@
+package upstreamauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"lamdis/pkg/upstream"
+)
+
+// RFC 8693 identifiers.
+const (
+	grantTokenExchange   = "urn:ietf:params:oauth:grant-type:token-exchange"
+	tokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+// Token exchange modes. Delegation presents the agent's own token as
+// actor_token so the issued token names the agent in its act claim;
+// impersonation sends the subject token alone.
+const (
+	ExchangeDelegation    = "delegation"
+	ExchangeImpersonation = "impersonation"
+)
+
+type subjectTokenKey struct{}
+
+// WithSubjectToken records the caller's access token, the subject of token_exchange.
+func WithSubjectToken(ctx context.Context, raw string) context.Context {
+	return context.WithValue(ctx, subjectTokenKey{}, raw)
+}
+
+// SubjectTokenFrom returns the token set by WithSubjectToken.
+func SubjectTokenFrom(ctx context.Context) string {
+	s, _ := ctx.Value(subjectTokenKey{}).(string)
+	return s
+}
+
+// ExchangeAudit describes a token exchange for the execution audit. Tokens are
+// never part of it.
+type ExchangeAudit struct {
+	Mode               string         `json:"mode"`
+	TokenURL           string         `json:"token_url"`
+	Audience           string         `json:"audience,omitempty"`
+	Resource           string         `json:"resource,omitempty"`
+	Scope              string         `json:"scope,omitempty"`
+	RequestedTokenType string         `json:"requested_token_type"`
+	Subject            string         `json:"subject,omitempty"`
+	Act                map[string]any `json:"act,omitempty"`
+	Cached             bool           `json:"cached"`
+	ExpiresAt          time.Time      `json:"expires_at"`
+}
+
+// Audit collects what credentials did for one call; see WithAudit.
+type Audit struct {
+	mu       sync.Mutex
+	exchange *ExchangeAudit
+}
+
+type auditKey struct{}
+
+// WithAudit returns a context in which Apply records credential details, such
+// as token exchanges, into the returned Audit.
+func WithAudit(ctx context.Context) (context.Context, *Audit) {
+	a := &Audit{}
+	return context.WithValue(ctx, auditKey{}, a), a
+}
+
+// Exchange returns the last token exchange performed, or nil.
+func (a *Audit) Exchange() *ExchangeAudit {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.exchange
+}
+
+func recordExchange(ctx context.Context, ex ExchangeAudit) {
+	if a, ok := ctx.Value(auditKey{}).(*Audit); ok {
+		a.mu.Lock()
+		a.exchange = &ex
+		a.mu.Unlock()
+	}
+}
+
+type exchangedToken struct {
+	access  string
+	act     map[string]any
+	expires time.Time
+}
+
+var exchanged = struct {
+	mu sync.Mutex
+	m  map[string]exchangedToken
+}{m: map[string]exchangedToken{}}
+
+// maxExchangeCache bounds the exchanged token cache; expired entries are swept
+// when it is exceeded.
+const maxExchangeCache = 10000
+
+// exchangeToken trades the caller's token for one meant for the upstream.
+//
+//	config: token_url, audience, resource, scopes, auth_style, mode (delegation | impersonation,
+//	        default delegation), requested_token_type (default access_token),
+//	        subject_token_type (default access_token), actor_scopes
+//	config/secrets: client_id (the agent); secrets: client_secret
+func (c Config) exchangeToken(ctx context.Context, client *upstream.Client) (string, error) {
+	subject := SubjectTokenFrom(ctx)
+	if subject == "" {
+		return "", errors.New("token exchange needs the caller's access token, which this request does not carry")
+	}
+	mode := strings.ToLower(c.cfg("mode", ExchangeDelegation))
+	audit := ExchangeAudit{
+		Mode:               mode,
+		TokenURL:           c.cfg("token_url", ""),
+		Audience:           c.cfg("audience", ""),
+		Resource:           c.cfg("resource", ""),
+		Scope:              strings.Join(c.scopes(), " "),
+		RequestedTokenType: c.cfg("requested_token_type", tokenTypeAccessToken),
+		Subject:            ActorFrom(ctx),
+	}
+	key := c.exchangeKey(subject)
+	exchanged.mu.Lock()
+	tok, ok := exchanged.m[key]
+	exchanged.mu.Unlock()
+	if ok && time.Now().Add(refreshSkew).Before(tok.expires) {
+		audit.Cached, audit.Act, audit.ExpiresAt = true, tok.act, tok.expires
+		recordExchange(ctx, audit)
+		return tok.access, nil
+	}
+
+	form := url.Values{
+		"grant_type":           {grantTokenExchange},
+		"subject_token":        {subject},
+		"subject_token_type":   {c.cfg("subject_token_type", tokenTypeAccessToken)},
+		"requested_token_type": {audit.RequestedTokenType},
+	}
+	if audit.Audience != "" {
+		form.Set("audience", audit.Audience)
+	}
+	if audit.Resource != "" {
+		form.Set("resource", audit.Resource)
+	}
+	if audit.Scope != "" {
+		form.Set("scope", audit.Scope)
+	}
+	switch mode {
+	case ExchangeDelegation:
+		actor, err := c.actorConfig().token(ctx, client)
+		if err != nil {
+			return "", fmt.Errorf("agent actor token: %w", err)
+		}
+		form.Set("actor_token", actor)
+		form.Set("actor_token_type", tokenTypeAccessToken)
+	case ExchangeImpersonation:
+	default:
+		return "", fmt.Errorf("unknown token exchange mode %q", mode)
+	}
+	issued, err := c.requestToken(ctx, client, form)
+	if err != nil {
+		return "", err
+	}
+	claims := jwtClaims(issued.access)
+	tok = exchangedToken{access: issued.access, expires: issued.expires}
+	tok.act, _ = claims["act"].(map[string]any)
+	if tok.expires.IsZero() {
+		if exp, ok := claims["exp"].(float64); ok {
+			tok.expires = time.Unix(int64(exp), 0)
+		} else {
+			tok.expires = time.Now().Add(defaultTokenTTL)
+		}
+	}
+	// An opaque token cannot be inspected; a JWT issued for delegation must name the agent.
+	if mode == ExchangeDelegation && claims != nil && !c.namesAgent(tok.act) {
+		return "", errors.New("exchanged token has no act claim naming the agent client")
+	}
+	exchanged.mu.Lock()
+	if len(exchanged.m) >= maxExchangeCache {
+		now := time.Now()
+		for k, v := range exchanged.m {
+			if now.After(v.expires) {
+				delete(exchanged.m, k)
+			}
+		}
+	}
+	exchanged.m[key] = tok
+	exchanged.mu.Unlock()
+	audit.Act, audit.ExpiresAt = tok.act, tok.expires
+	recordExchange(ctx, audit)
+	return tok.access, nil
+}
+
+// exchangeKey covers the subject token and every setting that changes the
+// token issued for it.
+func (c Config) exchangeKey(subject string) string {
+	sum := sha256.Sum256([]byte(subject))
+	return strings.Join([]string{hex.EncodeToString(sum[:]), c.ID, c.cfg("token_url", ""), c.cfg("audience", ""), c.cfg("resource", ""),
+		strings.Join(c.scopes(), " "), strings.ToLower(c.cfg("mode", ExchangeDelegation)), c.cfg("requested_token_type", tokenTypeAccessToken)}, "|")
+}
+
+// dropExchanged forgets the caller's exchanged token after the upstream rejected it.
+func (c Config) dropExchanged(ctx context.Context) {
+	exchanged.mu.Lock()
+	delete(exchanged.m, c.exchangeKey(SubjectTokenFrom(ctx)))
+	exchanged.mu.Unlock()
+}
+
+// actorConfig is the agent's own client credentials grant at the same token
+// endpoint, scoped by actor_scopes rather than the downstream scopes.
+func (c Config) actorConfig() Config {
+	cfg := map[string]any{"token_url": c.cfg("token_url", ""), "auth_style": c.cfg("auth_style", "header")}
+	if s, ok := c.Config["actor_scopes"]; ok {
+		cfg["scopes"] = s
+	}
+	if id := c.cfg("client_id", ""); id != "" {
+		cfg["client_id"] = id
+	}
+	return Config{ID: c.ID + ":actor", Type: TypeOAuth2Client, Config: cfg, Secrets: c.Secrets}
+}
+
+// namesAgent reports whether an act claim identifies the configured client.
+func (c Config) namesAgent(act map[string]any) bool {
+	id := c.str("client_id")
+	if act == nil || id == "" {
+		return false
+	}
+	for _, k := range []string{"sub", "client_id", "azp"} {
+		if s, _ := act[k].(string); s == id {
+			return true
+		}
+	}
+	return false
+}
+
+// jwtClaims decodes a JWT payload without verifying it; the token is only
+// inspected for its lifetime and act claim. Non-JWT tokens yield nil.
+func jwtClaims(tok string) map[string]any {
+	parts := strings.Split(tok, ".")
+	if len(parts) != 3 {
+		return nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil
+	}
+	var claims map[string]any
+	if json.Unmarshal(b, &claims) != nil {
+		return nil
+	}
+	return claims
+}
@@ -0,0 +1,49 @@
+package upstreamauth
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"sync"
+)
+
+// tlsConfigs keeps one *tls.Config per credential so the upstream client can
+// reuse its connection pool across requests.
+var tlsConfigs sync.Map // key -> *tls.Config
+
+// clientTLS builds (or returns the cached) TLS config for an mtls auth config.
+//
+//	secrets: cert_pem, key_pem (client certificate chain and private key),
+//	         ca_pem (optional roots to verify the upstream instead of the system pool)
+//	config:  server_name (optional SNI / verification name override)
+func (c Config) clientTLS() (*tls.Config, error) {
+	certPEM, keyPEM, caPEM := c.secret("cert_pem"), c.secret("key_pem"), c.secret("ca_pem")
+	if certPEM == "" || keyPEM == "" {
+		return nil, errors.New("mtls cert_pem and key_pem are required")
+	}
+	h := sha256.Sum256([]byte(certPEM + "\x00" + keyPEM + "\x00" + caPEM + "\x00" + c.cfg("server_name", "")))
+	key := c.ID + "|" + hex.EncodeToString(h[:])
+	if cfg, ok := tlsConfigs.Load(key); ok {
+		return cfg.(*tls.Config), nil
+	}
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		ServerName:   c.cfg("server_name", ""),
+	}
+	if caPEM != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(caPEM)) {
+			return nil, errors.New("mtls ca_pem contains no certificates")
+		}
+		cfg.RootCAs = pool
+	}
+	actual, _ := tlsConfigs.LoadOrStore(key, cfg)
+	return actual.(*tls.Config), nil
+}
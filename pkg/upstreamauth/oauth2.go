@@ -0,0 +1,180 @@
+package upstreamauth
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"lamdis/pkg/upstream"
+)
+
+// Tokens are refreshed this long before they expire.
+const refreshSkew = 30 * time.Second
+
+// defaultTokenTTL bounds client credentials tokens whose response has no expires_in.
+const defaultTokenTTL = 5 * time.Minute
+
+type cachedToken struct {
+	access  string
+	refresh string
+	scope   string
+	expires time.Time // zero when the server did not say
+}
+
+// tokenRejected is a non-200 answer from the token endpoint.
+type tokenRejected struct{ status int }
+
+func (e tokenRejected) Error() string {
+	return fmt.Sprintf("oauth2 token endpoint returned status %d", e.status)
+}
+
+// tokenEntry serialises fetches per credential so concurrent callers share one.
+type tokenEntry struct {
+	mu  sync.Mutex
+	tok cachedToken
+}
+
+var tokens = struct {
+	mu sync.Mutex
+	m  map[string]*tokenEntry
+}{m: map[string]*tokenEntry{}}
+
+// cacheKey covers everything that changes the token issued, so editing the
+// auth config naturally bypasses tokens minted for the old settings.
+func (c Config) cacheKey() string {
+	return strings.Join([]string{c.ID, c.cfg("token_url", ""), c.str("client_id"), strings.Join(c.scopes(), " "), c.cfg("audience", "")}, "|")
+}
+
+func (c Config) entry() *tokenEntry {
+	k := c.cacheKey()
+	tokens.mu.Lock()
+	defer tokens.mu.Unlock()
+	e, ok := tokens.m[k]
+	if !ok {
+		e = &tokenEntry{}
+		tokens.m[k] = e
+	}
+	return e
+}
+
+func (c Config) invalidate() {
+	e := c.entry()
+	e.mu.Lock()
+	e.tok.access, e.tok.expires = "", time.Time{}
+	e.mu.Unlock()
+}
+
+// token returns a cached access token, refreshing or re-issuing it when it is
+// about to expire. A refresh token, when the server issued one, is tried first.
+func (c Config) token(ctx context.Context, client *upstream.Client) (string, error) {
+	e := c.entry()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.tok.access != "" && time.Now().Add(refreshSkew).Before(e.tok.expires) {
+		return e.tok.access, nil
+	}
+	if e.tok.refresh != "" {
+		if tok, err := c.requestToken(ctx, client, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {e.tok.refresh}}); err == nil {
+			if tok.refresh == "" {
+				tok.refresh = e.tok.refresh
+			}
+			e.tok = tok.withDefaultExpiry()
+			return tok.access, nil
+		}
+	}
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if s := c.scopes(); len(s) > 0 {
+		form.Set("scope", strings.Join(s, " "))
+	}
+	if aud := c.cfg("audience", ""); aud != "" {
+		form.Set("audience", aud)
+	}
+	if extra, ok := c.Config["params"].(map[string]any); ok {
+		for k, v := range extra {
+			form.Set(k, fmt.Sprint(v))
+		}
+	}
+	tok, err := c.requestToken(ctx, client, form)
+	if err != nil {
+		return "", err
+	}
+	e.tok = tok.withDefaultExpiry()
+	return tok.access, nil
+}
+
+// withDefaultExpiry bounds cached client tokens whose lifetime is unknown.
+func (t cachedToken) withDefaultExpiry() cachedToken {
+	if t.expires.IsZero() {
+		t.expires = time.Now().Add(defaultTokenTTL)
+	}
+	return t
+}
+
+func (c Config) requestToken(ctx context.Context, client *upstream.Client, form url.Values) (cachedToken, error) {
+	tokenURL := c.cfg("token_url", "")
+	if tokenURL == "" {
+		return cachedToken{}, errors.New("oauth2 token_url is not set")
+	}
+	id, secret := c.str("client_id"), c.secret("client_secret")
+	if id == "" {
+		return cachedToken{}, errors.New("oauth2 client_id is not set")
+	}
+	h := http.Header{}
+	h.Set("Content-Type", "application/x-www-form-urlencoded")
+	h.Set("Accept", "application/json")
+	if strings.EqualFold(c.cfg("auth_style", "header"), "body") {
+		form.Set("client_id", id)
+		form.Set("client_secret", secret)
+	} else {
+		// RFC 6749 §2.3.1: credentials are form-encoded before Basic encoding.
+		cred := url.QueryEscape(id) + ":" + url.QueryEscape(secret)
+		h.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(cred)))
+	}
+	resp, _, err := client.Do(ctx, upstream.Request{Method: http.MethodPost, URL: tokenURL, Header: h, Body: []byte(form.Encode())}, upstream.CallOptions{TimeoutMS: 10000})
+	if err != nil {
+		return cachedToken{}, fmt.Errorf("oauth2 token request: %w", err)
+	}
+	if resp.Status != http.StatusOK {
+		return cachedToken{}, tokenRejected{status: resp.Status}
+	}
+	var body struct {
+		AccessToken  string  `json:"access_token"`
+		RefreshToken string  `json:"refresh_token"`
+		Scope        string  `json:"scope"`
+		ExpiresIn    float64 `json:"expires_in"`
+	}
+	if err := json.Unmarshal(resp.Body, &body); err != nil || body.AccessToken == "" {
+		return cachedToken{}, errors.New("oauth2 token response has no access_token")
+	}
+	tok := cachedToken{access: body.AccessToken, refresh: body.RefreshToken, scope: body.Scope}
+	if body.ExpiresIn > 0 {
+		tok.expires = time.Now().Add(time.Duration(body.ExpiresIn) * time.Second)
+	}
+	return tok, nil
+}
+
+// scopes accepts a list or a space-separated string; the result is sorted so
+// equivalent configs share cache entries.
+func (c Config) scopes() []string {
+	var out []string
+	switch v := c.Config["scopes"].(type) {
+	case string:
+		out = strings.Fields(v)
+	case []any:
+		for _, s := range v {
+			if str, ok := s.(string); ok && str != "" {
+				out = append(out, str)
+			}
+		}
+	}
+	sort.Strings(out)
+	return out
+}
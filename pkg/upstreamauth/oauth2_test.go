@@ -0,0 +1,199 @@
+package upstreamauth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"lamdis/pkg/upstream"
+)
+
+// tokenServer is a client credentials endpoint that counts grants by type.
+type tokenServer struct {
+	mu        sync.Mutex
+	grants    map[string]int
+	expiresIn int
+	refresh   string
+	status    int
+}
+
+func (s *tokenServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.status != 0 {
+		w.WriteHeader(s.status)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if id, secret, ok := r.BasicAuth(); !ok || id != "client" || secret != "s3cret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	grant := r.PostForm.Get("grant_type")
+	s.grants[grant]++
+	body := map[string]any{"access_token": fmt.Sprintf("%s-%d", grant, s.grants[grant])}
+	if s.expiresIn > 0 {
+		body["expires_in"] = s.expiresIn
+	}
+	if s.refresh != "" {
+		body["refresh_token"] = s.refresh
+	}
+	json.NewEncoder(w).Encode(body)
+}
+
+func (s *tokenServer) count(grant string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.grants[grant]
+}
+
+func oauthClient(t *testing.T, srv *tokenServer) (*upstream.Client, Config) {
+	t.Helper()
+	ts := httptest.NewServer(srv)
+	t.Cleanup(ts.Close)
+	client := upstream.NewClient(nil)
+	client.SetEgressBaseline(upstream.EgressPolicy{AllowPrivate: true})
+	c := Config{
+		ID:      t.Name(), // keeps cache entries apart between tests
+		Type:    TypeOAuth2Client,
+		Config:  map[string]any{"token_url": ts.URL, "scopes": "write read"},
+		Secrets: map[string]any{"client_id": "client", "client_secret": "s3cret"},
+	}
+	return client, c
+}
+
+func bearer(t *testing.T, c Config, client *upstream.Client) string {
+	t.Helper()
+	req := upstream.Request{Method: http.MethodGet, URL: "https://api.example.com/x"}
+	if err := c.Apply(context.Background(), client, &req); err != nil {
+		t.Fatal(err)
+	}
+	return req.Header.Get("Authorization")
+}
+
+func TestOAuth2ClientTokenCaching(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		expiresIn  int
+		refresh    string
+		invalidate bool
+		want       []string // Authorization header of each of three calls
+		issued     map[string]int
+	}{
+		{
+			name:      "reused while valid",
+			expiresIn: 3600,
+			want:      []string{"Bearer client_credentials-1", "Bearer client_credentials-1", "Bearer client_credentials-1"},
+			issued:    map[string]int{"client_credentials": 1},
+		},
+		{
+			name:   "no expires_in uses the default lifetime",
+			want:   []string{"Bearer client_credentials-1", "Bearer client_credentials-1", "Bearer client_credentials-1"},
+			issued: map[string]int{"client_credentials": 1},
+		},
+		{
+			name:      "expiring within the skew is re-issued",
+			expiresIn: 10,
+			want:      []string{"Bearer client_credentials-1", "Bearer client_credentials-2", "Bearer client_credentials-3"},
+			issued:    map[string]int{"client_credentials": 3},
+		},
+		{
+			name:      "refresh token is used before a new grant",
+			expiresIn: 10,
+			refresh:   "r-1",
+			want:      []string{"Bearer client_credentials-1", "Bearer refresh_token-1", "Bearer refresh_token-2"},
+			issued:    map[string]int{"client_credentials": 1, "refresh_token": 2},
+		},
+		{
+			name:       "invalidate forces a new token",
+			expiresIn:  3600,
+			invalidate: true,
+			want:       []string{"Bearer client_credentials-1", "Bearer client_credentials-2", "Bearer client_credentials-3"},
+			issued:     map[string]int{"client_credentials": 3},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := &tokenServer{grants: map[string]int{}, expiresIn: tc.expiresIn, refresh: tc.refresh}
+			client, c := oauthClient(t, srv)
+			for i, want := range tc.want {
+				if got := bearer(t, c, client); got != want {
+					t.Fatalf("call %d: %q, want %q", i+1, got, want)
+				}
+				if tc.invalidate {
+					c.invalidate()
+				}
+			}
+			for grant, n := range tc.issued {
+				if got := srv.count(grant); got != n {
+					t.Fatalf("%s grants %d, want %d", grant, got, n)
+				}
+			}
+		})
+	}
+}
+
+func TestOAuth2TokenCacheKey(t *testing.T) {
+	srv := &tokenServer{grants: map[string]int{}, expiresIn: 3600}
+	client, c := oauthClient(t, srv)
+	bearer(t, c, client)
+
+	// Equivalent scopes share the entry; a different scope does not.
+	same := c
+	same.Config = map[string]any{"token_url": c.Config["token_url"], "scopes": []any{"read", "write"}}
+	bearer(t, same, client)
+	if n := srv.count("client_credentials"); n != 1 {
+		t.Fatalf("grants after equivalent config %d, want 1", n)
+	}
+	other := c
+	other.Config = map[string]any{"token_url": c.Config["token_url"], "scopes": "admin"}
+	bearer(t, other, client)
+	if n := srv.count("client_credentials"); n != 2 {
+		t.Fatalf("grants after scope change %d, want 2", n)
+	}
+}
+
+func TestOAuth2RenewOn401(t *testing.T) {
+	srv := &tokenServer{grants: map[string]int{}, expiresIn: 3600}
+	client, c := oauthClient(t, srv)
+	var mu sync.Mutex
+	var seen []string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		seen = append(seen, r.Header.Get("Authorization"))
+		if len(seen) == 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer api.Close()
+
+	resp, attempts, err := Do(context.Background(), client, c, upstream.Request{Method: http.MethodGet, URL: api.URL}, upstream.CallOptions{})
+	if err != nil || resp.Status != http.StatusOK {
+		t.Fatalf("resp %+v err %v", resp, err)
+	}
+	if len(attempts) != 2 || attempts[1].Number != 2 {
+		t.Fatalf("attempts %+v", attempts)
+	}
+	if len(seen) != 2 || seen[0] != "Bearer client_credentials-1" || seen[1] != "Bearer client_credentials-2" {
+		t.Fatalf("tokens sent %v", seen)
+	}
+}
+
+func TestOAuth2TokenRejected(t *testing.T) {
+	srv := &tokenServer{grants: map[string]int{}, status: http.StatusForbidden}
+	client, c := oauthClient(t, srv)
+	req := upstream.Request{Method: http.MethodGet, URL: "https://api.example.com/x"}
+	err := c.Apply(context.Background(), client, &req)
+	if _, ok := err.(tokenRejected); !ok {
+		t.Fatalf("error %v, want tokenRejected", err)
+	}
+}
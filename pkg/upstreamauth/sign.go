@@ -0,0 +1,263 @@
+package upstreamauth
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"lamdis/pkg/upstream"
+)
+
+// HMAC canonical string components (config.canonical, joined by config.separator).
+var hmacComponents = map[string]bool{
+	"method": true, "host": true, "path": true, "query": true, "timestamp": true,
+	"nonce": true, "body": true, "body_sha256": true,
+}
+
+// signHMAC signs the request with an HMAC over a configurable canonical string.
+//
+//	config: algorithm (sha256 | sha512 | sha1, default sha256)
+//	        canonical (list of method | host | path | query | timestamp | nonce |
+//	                   body | body_sha256 | header:<name>; default method, path, timestamp, body_sha256)
+//	        separator (default "\n"), encoding (hex | base64, default hex)
+//	        header (default X-Signature), prefix (prepended to the signature, e.g. "sha256=")
+//	        timestamp_header (default X-Timestamp), timestamp_format (unix | unix_ms | rfc3339)
+//	        key_id_header (sent with secrets.key_id when set), nonce_header
+//	        key_encoding (raw | base64 | hex, default raw)
+//	secrets: secret, key_id
+func (c Config) signHMAC(req *upstream.Request) error {
+	key, err := c.hmacKey()
+	if err != nil {
+		return err
+	}
+	newHash, err := hashFunc(c.cfg("algorithm", "sha256"))
+	if err != nil {
+		return err
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		return err
+	}
+	ts := formatTimestamp(time.Now(), c.cfg("timestamp_format", "unix"))
+	req.Header.Set(c.cfg("timestamp_header", "X-Timestamp"), ts)
+	nonce := ""
+	if h := c.cfg("nonce_header", ""); h != "" {
+		nonce = strconv.FormatInt(time.Now().UnixNano(), 36)
+		req.Header.Set(h, nonce)
+	}
+	parts := []string{}
+	for _, comp := range c.canonical() {
+		switch {
+		case comp == "method":
+			parts = append(parts, strings.ToUpper(req.Method))
+		case comp == "host":
+			parts = append(parts, strings.ToLower(u.Host))
+		case comp == "path":
+			parts = append(parts, u.EscapedPath())
+		case comp == "query":
+			parts = append(parts, canonicalQuery(u.Query()))
+		case comp == "timestamp":
+			parts = append(parts, ts)
+		case comp == "nonce":
+			parts = append(parts, nonce)
+		case comp == "body":
+			parts = append(parts, string(req.Body))
+		case comp == "body_sha256":
+			sum := sha256.Sum256(req.Body)
+			parts = append(parts, hex.EncodeToString(sum[:]))
+		case strings.HasPrefix(comp, "header:"):
+			parts = append(parts, strings.TrimSpace(req.Header.Get(strings.TrimPrefix(comp, "header:"))))
+		}
+	}
+	mac := hmac.New(newHash, key)
+	mac.Write([]byte(strings.Join(parts, c.separator())))
+	sum := mac.Sum(nil)
+	sig := hex.EncodeToString(sum)
+	if strings.EqualFold(c.cfg("encoding", "hex"), "base64") {
+		sig = base64.StdEncoding.EncodeToString(sum)
+	}
+	req.Header.Set(c.cfg("header", "X-Signature"), c.cfg("prefix", "")+sig)
+	if h := c.cfg("key_id_header", ""); h != "" {
+		if id := c.str("key_id"); id != "" {
+			req.Header.Set(h, id)
+		}
+	}
+	return nil
+}
+
+func (c Config) validateHMAC() error {
+	if _, err := c.hmacKey(); err != nil {
+		return err
+	}
+	if _, err := hashFunc(c.cfg("algorithm", "sha256")); err != nil {
+		return err
+	}
+	for _, comp := range c.canonical() {
+		if !hmacComponents[comp] && !strings.HasPrefix(comp, "header:") {
+			return fmt.Errorf("unknown canonical component %q", comp)
+		}
+	}
+	return nil
+}
+
+func (c Config) hmacKey() ([]byte, error) {
+	s := c.secret("secret")
+	if s == "" {
+		return nil, errors.New("hmac secret is not set")
+	}
+	switch strings.ToLower(c.cfg("key_encoding", "raw")) {
+	case "base64":
+		return base64.StdEncoding.DecodeString(s)
+	case "hex":
+		return hex.DecodeString(s)
+	case "raw":
+		return []byte(s), nil
+	}
+	return nil, fmt.Errorf("unknown key_encoding %q", c.cfg("key_encoding", ""))
+}
+
+func (c Config) canonical() []string {
+	list, ok := c.Config["canonical"].([]any)
+	if !ok || len(list) == 0 {
+		return []string{"method", "path", "timestamp", "body_sha256"}
+	}
+	out := make([]string, 0, len(list))
+	for _, v := range list {
+		if s, ok := v.(string); ok {
+			out = append(out, strings.ToLower(strings.TrimSpace(s)))
+		}
+	}
+	return out
+}
+
+// separator allows an empty string, unlike cfg.
+func (c Config) separator() string {
+	if s, ok := c.Config["separator"].(string); ok {
+		return s
+	}
+	return "\n"
+}
+
+func hashFunc(name string) (func() hash.Hash, error) {
+	switch strings.ToLower(name) {
+	case "sha256":
+		return sha256.New, nil
+	case "sha512":
+		return sha512.New, nil
+	case "sha1":
+		return sha1.New, nil
+	}
+	return nil, fmt.Errorf("unsupported hmac algorithm %q", name)
+}
+
+func formatTimestamp(t time.Time, format string) string {
+	switch strings.ToLower(format) {
+	case "unix_ms":
+		return strconv.FormatInt(t.UnixMilli(), 10)
+	case "rfc3339":
+		return t.UTC().Format(time.RFC3339)
+	}
+	return strconv.FormatInt(t.Unix(), 10)
+}
+
+// canonicalQuery sorts keys and values and uses RFC 3986 encoding.
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vs := append([]string(nil), q[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			parts = append(parts, awsEscape(k)+"="+awsEscape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// signSigV4 signs the request with AWS Signature Version 4.
+//
+//	config: region, service
+//	secrets: access_key_id, secret_access_key, session_token (optional)
+func (c Config) signSigV4(req *upstream.Request) error {
+	region, service := c.cfg("region", ""), c.cfg("service", "")
+	akid, secret := c.str("access_key_id"), c.secret("secret_access_key")
+	if region == "" || service == "" {
+		return errors.New("aws_sigv4 region and service are required")
+	}
+	if akid == "" || secret == "" {
+		return errors.New("aws_sigv4 access_key_id and secret_access_key are required")
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		return err
+	}
+	t := time.Now().UTC()
+	amzDate := t.Format("20060102T150405Z")
+	day := t.Format("20060102")
+	payload := sha256.Sum256(req.Body)
+	payloadHash := hex.EncodeToString(payload[:])
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if tok := c.secret("session_token"); tok != "" {
+		req.Header.Set("X-Amz-Security-Token", tok)
+	}
+	// Canonical headers: host plus every x-amz-* header and content-type.
+	hdrs := map[string]string{"host": strings.ToLower(u.Host)}
+	for k, vs := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") || lk == "content-type" {
+			hdrs[lk] = strings.Join(strings.Fields(strings.Join(vs, ",")), " ")
+		}
+	}
+	names := make([]string, 0, len(hdrs))
+	for k := range hdrs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var ch strings.Builder
+	for _, k := range names {
+		ch.WriteString(k + ":" + hdrs[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	creq := strings.Join([]string{strings.ToUpper(req.Method), path, canonicalQuery(u.Query()), ch.String(), signed, payloadHash}, "\n")
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	creqHash := sha256.Sum256([]byte(creq))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(creqHash[:])
+	k := hmacSHA256([]byte("AWS4"+secret), day)
+	k = hmacSHA256(k, region)
+	k = hmacSHA256(k, service)
+	k = hmacSHA256(k, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(k, toSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+akid+"/"+scope+", SignedHeaders="+signed+", Signature="+sig)
+	return nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
+
+// awsEscape is RFC 3986 percent-encoding (spaces as %20, "~" unescaped).
+func awsEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
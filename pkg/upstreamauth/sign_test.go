@@ -0,0 +1,211 @@
+package upstreamauth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"lamdis/pkg/upstream"
+)
+
+func TestSignHMAC(t *testing.T) {
+	body := []byte(`{"amount":10}`)
+	bodySum := sha256.Sum256(body)
+	for _, tc := range []struct {
+		name   string
+		config map[string]any
+		header string
+		hash   func() hash.Hash
+		b64    bool
+		prefix string
+		// canonical builds the expected string to sign from the timestamp sent.
+		canonical func(ts string) string
+	}{
+		{
+			name:   "defaults",
+			config: map[string]any{},
+			header: "X-Signature",
+			hash:   sha256.New,
+			canonical: func(ts string) string {
+				return "POST\n/v1/pay%20now\n" + ts + "\n" + hex.EncodeToString(bodySum[:])
+			},
+		},
+		{
+			name: "custom components and separator",
+			config: map[string]any{
+				"canonical": []any{"method", "host", "query", "header:X-Tenant", "body"},
+				"separator": "",
+				"header":    "X-Sig",
+				"prefix":    "sha256=",
+			},
+			header: "X-Sig",
+			hash:   sha256.New,
+			prefix: "sha256=",
+			canonical: func(string) string {
+				return "POSTapi.example.coma=1&a=2&b=x%20y" + "t-1" + string(body)
+			},
+		},
+		{
+			name:   "sha512 base64",
+			config: map[string]any{"algorithm": "sha512", "encoding": "base64", "canonical": []any{"timestamp", "body_sha256"}},
+			header: "X-Signature",
+			hash:   sha512.New,
+			b64:    true,
+			canonical: func(ts string) string {
+				return ts + "\n" + hex.EncodeToString(bodySum[:])
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := Config{Type: TypeHMAC, Config: tc.config, Secrets: map[string]any{"secret": "s3cret"}}
+			req := upstream.Request{
+				Method: "post",
+				URL:    "https://API.example.com/v1/pay%20now?b=x+y&a=2&a=1",
+				Header: http.Header{"X-Tenant": {" t-1 "}},
+				Body:   body,
+			}
+			if err := c.Apply(context.Background(), nil, &req); err != nil {
+				t.Fatal(err)
+			}
+			ts := req.Header.Get("X-Timestamp")
+			if ts == "" {
+				t.Fatal("no timestamp header")
+			}
+			mac := hmac.New(tc.hash, []byte("s3cret"))
+			mac.Write([]byte(tc.canonical(ts)))
+			want := hex.EncodeToString(mac.Sum(nil))
+			if tc.b64 {
+				want = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+			}
+			if got := req.Header.Get(tc.header); got != tc.prefix+want {
+				t.Fatalf("signature %q, want %q", got, tc.prefix+want)
+			}
+		})
+	}
+}
+
+func TestSignHMACKeyID(t *testing.T) {
+	c := Config{Type: TypeHMAC, Config: map[string]any{"key_id_header": "X-Key-Id", "nonce_header": "X-Nonce", "key_encoding": "hex"},
+		Secrets: map[string]any{"secret": hex.EncodeToString([]byte("k")), "key_id": "key-7"}}
+	req := upstream.Request{Method: http.MethodGet, URL: "https://api.example.com/x"}
+	if err := c.Apply(context.Background(), nil, &req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Header.Get("X-Key-Id") != "key-7" || req.Header.Get("X-Nonce") == "" {
+		t.Fatalf("headers %v", req.Header)
+	}
+}
+
+func TestValidateHMAC(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		config  map[string]any
+		secrets map[string]any
+		ok      bool
+	}{
+		{"defaults", nil, map[string]any{"secret": "s"}, true},
+		{"header component", map[string]any{"canonical": []any{"header:X-Date", "body"}}, map[string]any{"secret": "s"}, true},
+		{"no secret", nil, nil, false},
+		{"bad algorithm", map[string]any{"algorithm": "md5"}, map[string]any{"secret": "s"}, false},
+		{"bad component", map[string]any{"canonical": []any{"method", "cookie"}}, map[string]any{"secret": "s"}, false},
+		{"bad base64 key", map[string]any{"key_encoding": "base64"}, map[string]any{"secret": "%%"}, false},
+		{"unknown key encoding", map[string]any{"key_encoding": "rot13"}, map[string]any{"secret": "s"}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := Validate(TypeHMAC, tc.config, tc.secrets); (err == nil) != tc.ok {
+				t.Fatalf("Validate: %v, want ok=%v", err, tc.ok)
+			}
+		})
+	}
+}
+
+var sigV4Auth = regexp.MustCompile(`^AWS4-HMAC-SHA256 Credential=AKID/(\d{8})/eu-west-1/execute-api/aws4_request, SignedHeaders=([a-z0-9;-]+), Signature=([0-9a-f]{64})$`)
+
+func TestSignSigV4(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		secrets map[string]any
+		header  http.Header
+		signed  string
+	}{
+		{
+			name:    "minimal",
+			secrets: map[string]any{"access_key_id": "AKID", "secret_access_key": "secret"},
+			signed:  "host;x-amz-content-sha256;x-amz-date",
+		},
+		{
+			name:    "session token and content type",
+			secrets: map[string]any{"access_key_id": "AKID", "secret_access_key": "secret", "session_token": "tok"},
+			header:  http.Header{"Content-Type": {"application/json"}, "X-Request-Id": {"r-1"}},
+			signed:  "content-type;host;x-amz-content-sha256;x-amz-date;x-amz-security-token",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := Config{Type: TypeAWSSigV4, Config: map[string]any{"region": "eu-west-1", "service": "execute-api"}, Secrets: tc.secrets}
+			body := []byte(`{"q":1}`)
+			req := upstream.Request{Method: http.MethodPost, URL: "https://abc.execute-api.eu-west-1.amazonaws.com/prod/items?b=2&a=1", Header: tc.header, Body: body}
+			if err := c.Apply(context.Background(), nil, &req); err != nil {
+				t.Fatal(err)
+			}
+			m := sigV4Auth.FindStringSubmatch(req.Header.Get("Authorization"))
+			if m == nil {
+				t.Fatalf("authorization %q", req.Header.Get("Authorization"))
+			}
+			date := req.Header.Get("X-Amz-Date")
+			if !strings.HasPrefix(date, m[1]+"T") || len(date) != len("20060102T150405Z") {
+				t.Fatalf("x-amz-date %q, scope day %q", date, m[1])
+			}
+			if m[2] != tc.signed {
+				t.Fatalf("signed headers %q, want %q", m[2], tc.signed)
+			}
+			sum := sha256.Sum256(body)
+			if got := req.Header.Get("X-Amz-Content-Sha256"); got != hex.EncodeToString(sum[:]) {
+				t.Fatalf("content sha256 %q", got)
+			}
+		})
+	}
+}
+
+func TestSignSigV4Errors(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		config  map[string]any
+		secrets map[string]any
+	}{
+		{"no region", map[string]any{"service": "s3"}, map[string]any{"access_key_id": "a", "secret_access_key": "s"}},
+		{"no secret", map[string]any{"region": "us-east-1", "service": "s3"}, map[string]any{"access_key_id": "a"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := upstream.Request{Method: http.MethodGet, URL: "https://s3.amazonaws.com/b"}
+			if err := (Config{Type: TypeAWSSigV4, Config: tc.config, Secrets: tc.secrets}).Apply(context.Background(), nil, &req); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestCanonicalQuery(t *testing.T) {
+	for _, tc := range []struct{ raw, want string }{
+		{"", ""},
+		{"b=2&a=1", "a=1&b=2"},
+		{"a=2&a=1", "a=1&a=2"},
+		{"q=a+b&t=~x", "q=a%20b&t=~x"},
+	} {
+		parsed, err := url.ParseQuery(tc.raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := canonicalQuery(parsed); got != tc.want {
+			t.Fatalf("canonicalQuery(%q) = %q, want %q", tc.raw, got, tc.want)
+		}
+	}
+}
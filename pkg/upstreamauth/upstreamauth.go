@@ -0,0 +1,325 @@
+// Package upstreamauth injects tenant_auth_configs credentials into upstream
+// requests. It is shared by the execute (orchestrator) and passthrough
+// (connector) paths so both authenticate identically.
+//
+// Supported types and their settings (config is plain JSON, secrets are the
+// encrypted blob written by the admin API):
+//
+//	api_key        config: in ("header" | "query", default header), name (default x-api-key)
+//	               secrets: api_key (config.api_key is honoured for legacy rows)
+//	bearer         config: header (default Authorization), prefix (default Bearer)
+//	               secrets: token
+//	basic          config/secrets: username; secrets: password
+//	oauth2_client  config: token_url, scopes, audience, auth_style ("header" | "body"), params
+//	               config/secrets: client_id; secrets: client_secret
+//	oauth2_user    per-end-user tokens from the authorization code flow (see AuthorizeURL);
+//	               the token of the actor in ctx (WithActor) is sent
+//	token_exchange RFC 8693 exchange of the caller's token (WithSubjectToken) for one
+//	               issued to the upstream (see exchangeToken)
+//	hmac           signature over a configurable canonical string (see signHMAC)
+//	aws_sigv4      AWS Signature Version 4 (see signSigV4)
+//	mtls           client certificate for mutual TLS (see clientTLS)
+package upstreamauth
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"lamdis/pkg/secrets"
+	"lamdis/pkg/upstream"
+)
+
+// Auth types stored in tenant_auth_configs.type.
+const (
+	TypeAPIKey        = "api_key"
+	TypeBearer        = "bearer"
+	TypeBasic         = "basic"
+	TypeOAuth2Client  = "oauth2_client"
+	TypeOAuth2User    = "oauth2_user"
+	TypeTokenExchange = "token_exchange"
+	TypeHMAC          = "hmac"
+	TypeAWSSigV4      = "aws_sigv4"
+	TypeMTLS          = "mtls"
+)
+
+// Supported reports whether typ is an auth type Apply understands.
+func Supported(typ string) bool {
+	switch strings.ToLower(typ) {
+	case TypeAPIKey, TypeBearer, TypeBasic, TypeOAuth2Client, TypeOAuth2User, TypeTokenExchange, TypeHMAC, TypeAWSSigV4, TypeMTLS:
+		return true
+	}
+	return false
+}
+
+// Validate checks settings that can be verified without calling anything, so
+// broken signing keys or certificates are rejected when they are saved.
+func Validate(typ string, config, secrets map[string]any) error {
+	c := Config{Type: typ, Config: config, Secrets: secrets}
+	if c.Config == nil {
+		c.Config = map[string]any{}
+	}
+	switch strings.ToLower(typ) {
+	case TypeHMAC:
+		return c.validateHMAC()
+	case TypeMTLS:
+		_, err := c.clientTLS()
+		return err
+	case TypeOAuth2User:
+		if c.cfg("token_url", "") == "" {
+			return errors.New("oauth2_user token_url is required")
+		}
+		_, err := c.AuthorizeURL("state", "challenge")
+		return err
+	case TypeTokenExchange:
+		if c.cfg("token_url", "") == "" || c.str("client_id") == "" {
+			return errors.New("token_exchange token_url and client_id are required")
+		}
+		switch strings.ToLower(c.cfg("mode", ExchangeDelegation)) {
+		case ExchangeDelegation, ExchangeImpersonation:
+		default:
+			return fmt.Errorf("unknown token exchange mode %q", c.cfg("mode", ""))
+		}
+	}
+	return nil
+}
+
+// InQuery reports whether the credentials are sent in the URL query string
+// (api_key with in: query) rather than in headers.
+func (c Config) InQuery() bool {
+	return strings.EqualFold(c.Type, TypeAPIKey) && strings.EqualFold(c.cfg("in", "header"), "query")
+}
+
+// ErrKind is the attempt error kind reported when credentials cannot be applied.
+const ErrKind = "auth_error"
+
+// Config is one tenant_auth_configs row with its secrets opened.
+type Config struct {
+	ID      string
+	Type    string
+	Config  map[string]any
+	Secrets map[string]any
+
+	user *userLink // oauth2_user: the actor's stored connection
+}
+
+// None is the config of operations without an auth_ref; Apply is a no-op for it.
+var None = Config{Config: map[string]any{}, Secrets: map[string]any{}}
+
+// Load reads and opens an auth config. An empty id or a missing database yields None.
+// An oauth2_user config is bound to the actor in ctx; ErrNotLinked is returned
+// when that actor has no connection.
+func Load(ctx context.Context, pool *pgxpool.Pool, tenantID, id string) (Config, error) {
+	if pool == nil || id == "" {
+		return None, nil
+	}
+	c, err := load(ctx, pool, tenantID, id)
+	if err != nil {
+		return None, err
+	}
+	if strings.EqualFold(c.Type, TypeOAuth2User) {
+		if err := c.loadUser(ctx, pool, tenantID); err != nil {
+			return None, fmt.Errorf("auth config %s: %w", id, err)
+		}
+	}
+	return c, nil
+}
+
+// LoadLinkable reads an oauth2_user config for the account linking flow, which
+// runs before the actor has a connection. Other types are reported as an error.
+func LoadLinkable(ctx context.Context, pool *pgxpool.Pool, tenantID, id string) (Config, error) {
+	c, err := load(ctx, pool, tenantID, id)
+	if err != nil {
+		return None, err
+	}
+	if !strings.EqualFold(c.Type, TypeOAuth2User) {
+		return None, fmt.Errorf("auth config %s is not %s", id, TypeOAuth2User)
+	}
+	return c, nil
+}
+
+func load(ctx context.Context, pool *pgxpool.Pool, tenantID, id string) (Config, error) {
+	c := Config{ID: id}
+	var blob []byte
+	if err := pool.QueryRow(ctx, `SELECT type, COALESCE(config,'{}'::jsonb), secrets_encrypted FROM tenant_auth_configs WHERE id=$1 AND tenant_id=$2`,
+		id, tenantID).Scan(&c.Type, &c.Config, &blob); err != nil {
+		return None, fmt.Errorf("auth config %s: %w", id, err)
+	}
+	sec, err := secrets.Open(blob)
+	if err != nil {
+		return None, fmt.Errorf("auth config %s secrets: %w", id, err)
+	}
+	c.Secrets = sec
+	if c.Config == nil {
+		c.Config = map[string]any{}
+	}
+	return c, nil
+}
+
+// Apply adds the credentials to req. OAuth2 tokens are fetched (or taken from
+// the cache) through client, so the egress policy in ctx applies to token_url.
+func (c Config) Apply(ctx context.Context, client *upstream.Client, req *upstream.Request) error {
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	switch strings.ToLower(c.Type) {
+	case "":
+		return nil
+	case TypeAPIKey:
+		key := c.str("api_key")
+		if key == "" {
+			return errors.New("api_key secret is not set")
+		}
+		name := c.cfg("name", "x-api-key")
+		if strings.EqualFold(c.cfg("in", "header"), "query") {
+			u, err := url.Parse(req.URL)
+			if err != nil {
+				return err
+			}
+			q := u.Query()
+			q.Set(name, key)
+			u.RawQuery = q.Encode()
+			req.URL = u.String()
+			return nil
+		}
+		req.Header.Set(name, key)
+	case TypeBearer:
+		tok := c.secret("token")
+		if tok == "" {
+			return errors.New("bearer token secret is not set")
+		}
+		req.Header.Set(c.cfg("header", "Authorization"), strings.TrimSpace(c.cfg("prefix", "Bearer")+" "+tok))
+	case TypeBasic:
+		user, pass := c.str("username"), c.secret("password")
+		if user == "" {
+			return errors.New("basic auth username is not set")
+		}
+		req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user+":"+pass)))
+	case TypeOAuth2Client:
+		tok, err := c.token(ctx, client)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+tok)
+	case TypeOAuth2User:
+		tok, err := c.userToken(ctx, client, false)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+tok)
+	case TypeTokenExchange:
+		tok, err := c.exchangeToken(ctx, client)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+tok)
+	case TypeHMAC, TypeAWSSigV4:
+		if req.BodyStream != nil {
+			return errors.New("cannot sign a streamed body")
+		}
+		if strings.EqualFold(c.Type, TypeHMAC) {
+			return c.signHMAC(req)
+		}
+		return c.signSigV4(req)
+	case TypeMTLS:
+		cfg, err := c.clientTLS()
+		if err != nil {
+			return err
+		}
+		req.TLS = cfg
+	default:
+		return fmt.Errorf("unsupported auth type %q", c.Type)
+	}
+	return nil
+}
+
+// SignsBody reports whether the credentials sign the request body, which must
+// then be buffered rather than streamed.
+func (c Config) SignsBody() bool {
+	t := strings.ToLower(c.Type)
+	return t == TypeHMAC || t == TypeAWSSigV4
+}
+
+// Do applies the credentials and performs req. When an OAuth2 upstream answers
+// 401 the token is renewed and the call is made once more with the fresh one.
+// A credential failure is returned as a single attempt of kind ErrKind.
+func Do(ctx context.Context, client *upstream.Client, c Config, req upstream.Request, opts upstream.CallOptions) (*upstream.Response, []upstream.Attempt, error) {
+	return call(ctx, client.Do, client, c, req, opts)
+}
+
+// Open is Do with the response body left unread (see upstream.Client.Open).
+// A streamed request body cannot be resent, so a 401 is then returned as is.
+func Open(ctx context.Context, client *upstream.Client, c Config, req upstream.Request, opts upstream.CallOptions) (*upstream.Response, []upstream.Attempt, error) {
+	return call(ctx, client.Open, client, c, req, opts)
+}
+
+type doFunc func(context.Context, upstream.Request, upstream.CallOptions) (*upstream.Response, []upstream.Attempt, error)
+
+func call(ctx context.Context, do doFunc, client *upstream.Client, c Config, req upstream.Request, opts upstream.CallOptions) (*upstream.Response, []upstream.Attempt, error) {
+	base := req.Header.Clone()
+	send := func() (*upstream.Response, []upstream.Attempt, error) {
+		r := req
+		r.Header = base.Clone()
+		if err := c.Apply(ctx, client, &r); err != nil {
+			err = fmt.Errorf("upstream auth: %w", err)
+			return nil, []upstream.Attempt{{Number: 1, Error: err.Error(), ErrKind: ErrKind}}, err
+		}
+		return do(ctx, r, opts)
+	}
+	resp, attempts, err := send()
+	if err == nil && resp != nil && resp.Status == http.StatusUnauthorized && req.BodyStream == nil && c.renew(ctx, client) {
+		if resp.Stream != nil {
+			resp.Stream.Close()
+		}
+		var more []upstream.Attempt
+		resp, more, err = send()
+		for _, at := range more {
+			at.Number += len(attempts)
+			attempts = append(attempts, at)
+		}
+	}
+	return resp, attempts, err
+}
+
+// renew discards the current OAuth2 token after the upstream rejected it and
+// reports whether a retry can use a different one.
+func (c Config) renew(ctx context.Context, client *upstream.Client) bool {
+	switch strings.ToLower(c.Type) {
+	case TypeOAuth2Client:
+		c.invalidate()
+		return true
+	case TypeOAuth2User:
+		_, err := c.userToken(ctx, client, true)
+		return err == nil
+	case TypeTokenExchange:
+		c.dropExchanged(ctx)
+		return true
+	}
+	return false
+}
+
+// str reads a value from secrets, falling back to config.
+func (c Config) str(k string) string {
+	if v := c.secret(k); v != "" {
+		return v
+	}
+	return c.cfg(k, "")
+}
+
+func (c Config) secret(k string) string {
+	s, _ := c.Secrets[k].(string)
+	return s
+}
+
+func (c Config) cfg(k, def string) string {
+	if s, _ := c.Config[k].(string); strings.TrimSpace(s) != "" {
+		return s
+	}
+	return def
+}
@@ -0,0 +1,262 @@
+package upstreamauth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"lamdis/pkg/secrets"
+	"lamdis/pkg/upstream"
+)
+
+// ErrNotLinked is returned (wrapped) when an oauth2_user credential is needed
+// but the acting end user has not linked their upstream account, or the link
+// can no longer be refreshed.
+var ErrNotLinked = errors.New("account not linked")
+
+type actorKey struct{}
+
+// WithActor records the end user (token subject) a request acts for; oauth2_user
+// credentials are resolved for this subject.
+func WithActor(ctx context.Context, sub string) context.Context {
+	return context.WithValue(ctx, actorKey{}, sub)
+}
+
+// ActorFrom returns the subject set by WithActor.
+func ActorFrom(ctx context.Context) string {
+	s, _ := ctx.Value(actorKey{}).(string)
+	return s
+}
+
+// userLink identifies the stored connection an oauth2_user config resolves to.
+type userLink struct {
+	pool     *pgxpool.Pool
+	tenantID string
+	sub      string
+}
+
+// loadUser binds an oauth2_user config to the actor in ctx and checks that the
+// actor has linked their account, so executions fail before any request is sent.
+func (c *Config) loadUser(ctx context.Context, pool *pgxpool.Pool, tenantID string) error {
+	sub := ActorFrom(ctx)
+	if sub == "" {
+		return fmt.Errorf("%w: the request has no end user", ErrNotLinked)
+	}
+	var n int
+	if err := pool.QueryRow(ctx, `WITH s AS (
+		SELECT set_config('app.tenant_id', $1, true)
+	) SELECT count(*) FROM user_connections WHERE tenant_id=$1 AND auth_id=$2 AND actor_sub=$3`, tenantID, c.ID, sub).Scan(&n); err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotLinked
+	}
+	c.user = &userLink{pool: pool, tenantID: tenantID, sub: sub}
+	return nil
+}
+
+// userToken returns the actor's access token, refreshing it when it is about to
+// expire. The row is locked while refreshing so replicas sharing a rotating
+// refresh token do not race each other into invalidating it.
+func (c Config) userToken(ctx context.Context, client *upstream.Client, force bool) (string, error) {
+	if c.user == nil {
+		return "", fmt.Errorf("%w: the request has no end user", ErrNotLinked)
+	}
+	u := c.user
+	tx, err := u.pool.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+	if _, err := tx.Exec(ctx, "SELECT set_config('app.tenant_id', $1, true)", u.tenantID); err != nil {
+		return "", err
+	}
+	var blob []byte
+	var expires *time.Time
+	err = tx.QueryRow(ctx, `SELECT tokens_encrypted, expires_at FROM user_connections
+		WHERE tenant_id=$1 AND auth_id=$2 AND actor_sub=$3 FOR UPDATE`, u.tenantID, c.ID, u.sub).Scan(&blob, &expires)
+	if err == pgx.ErrNoRows {
+		return "", ErrNotLinked
+	}
+	if err != nil {
+		return "", err
+	}
+	stored, err := secrets.Open(blob)
+	if err != nil {
+		return "", err
+	}
+	access, _ := stored["access_token"].(string)
+	refresh, _ := stored["refresh_token"].(string)
+	if !force && access != "" && (expires == nil || time.Now().Add(refreshSkew).Before(*expires)) {
+		return access, nil
+	}
+	if refresh == "" {
+		return "", fmt.Errorf("%w: the access token expired and no refresh token was issued", ErrNotLinked)
+	}
+	tok, err := c.requestToken(ctx, client, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refresh}})
+	if err != nil {
+		var rej tokenRejected
+		if errors.As(err, &rej) {
+			return "", fmt.Errorf("%w: refresh was rejected (status %d), the account must be linked again", ErrNotLinked, rej.status)
+		}
+		return "", err
+	}
+	if tok.refresh == "" {
+		tok.refresh = refresh
+	}
+	if err := saveTokens(ctx, tx, u.tenantID, c.ID, u.sub, tok); err != nil {
+		return "", err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return "", err
+	}
+	return tok.access, nil
+}
+
+// saveTokens upserts the actor's connection inside tx.
+func saveTokens(ctx context.Context, q pgx.Tx, tenantID, authID, sub string, tok cachedToken) error {
+	blob, err := secrets.Seal(map[string]any{"access_token": tok.access, "refresh_token": tok.refresh})
+	if err != nil {
+		return err
+	}
+	var expires *time.Time
+	if !tok.expires.IsZero() {
+		expires = &tok.expires
+	}
+	_, err = q.Exec(ctx, `INSERT INTO user_connections(tenant_id, auth_id, actor_sub, tokens_encrypted, scopes, expires_at)
+		VALUES ($1,$2,$3,$4,$5,$6)
+		ON CONFLICT (tenant_id, auth_id, actor_sub) DO UPDATE SET tokens_encrypted=EXCLUDED.tokens_encrypted,
+			scopes=CASE WHEN EXCLUDED.scopes='' THEN user_connections.scopes ELSE EXCLUDED.scopes END,
+			expires_at=EXCLUDED.expires_at, updated_at=now()`,
+		tenantID, authID, sub, blob, tok.scope, expires)
+	return err
+}
+
+// NewPKCE returns an RFC 7636 code verifier and its S256 challenge.
+func NewPKCE() (verifier, challenge string) {
+	verifier = randomToken()
+	sum := sha256.Sum256([]byte(verifier))
+	return verifier, base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// NewState returns an unguessable value for the authorize request's state.
+func NewState() string { return randomToken() }
+
+func randomToken() string {
+	b := make([]byte, 32)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// AuthorizeURL builds the upstream authorization request for an oauth2_user
+// config. challenge is omitted when the config sets pkce to false.
+//
+//	config: authorize_url, token_url, redirect_uri, scopes, auth_style,
+//	        authorize_params (extra query parameters), pkce (default true),
+//	        return_urls (prefixes the callback may redirect the browser to)
+//	config/secrets: client_id; secrets: client_secret
+func (c Config) AuthorizeURL(state, challenge string) (string, error) {
+	authURL, redirect := c.cfg("authorize_url", ""), c.cfg("redirect_uri", "")
+	if authURL == "" || redirect == "" {
+		return "", errors.New("oauth2_user authorize_url and redirect_uri are required")
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		return "", err
+	}
+	id := c.str("client_id")
+	if id == "" {
+		return "", errors.New("oauth2 client_id is not set")
+	}
+	q := u.Query()
+	if extra, ok := c.Config["authorize_params"].(map[string]any); ok {
+		for k, v := range extra {
+			q.Set(k, fmt.Sprint(v))
+		}
+	}
+	q.Set("response_type", "code")
+	q.Set("client_id", id)
+	q.Set("redirect_uri", redirect)
+	q.Set("state", state)
+	if s := c.scopes(); len(s) > 0 {
+		q.Set("scope", strings.Join(s, " "))
+	}
+	if c.PKCE() {
+		q.Set("code_challenge", challenge)
+		q.Set("code_challenge_method", "S256")
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// PKCE reports whether authorize requests carry a code challenge.
+func (c Config) PKCE() bool {
+	v, ok := c.Config["pkce"].(bool)
+	return !ok || v
+}
+
+// ReturnAllowed reports whether the callback may redirect the browser to raw:
+// its scheme and host must equal, and its path extend, one of config.return_urls.
+func (c Config) ReturnAllowed(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.User != nil {
+		return false
+	}
+	list, _ := c.Config["return_urls"].([]any)
+	for _, v := range list {
+		s, _ := v.(string)
+		p, err := url.Parse(s)
+		if err != nil || s == "" {
+			continue
+		}
+		if strings.EqualFold(u.Scheme, p.Scheme) && strings.EqualFold(u.Host, p.Host) && strings.HasPrefix(u.Path, p.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// Link exchanges an authorization code for tokens and stores them as sub's
+// connection, replacing any earlier link.
+func (c Config) Link(ctx context.Context, pool *pgxpool.Pool, client *upstream.Client, tenantID, sub, code, verifier string) error {
+	form := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {c.cfg("redirect_uri", "")}}
+	if verifier != "" {
+		form.Set("code_verifier", verifier)
+	}
+	tok, err := c.requestToken(ctx, client, form)
+	if err != nil {
+		return err
+	}
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	if _, err := tx.Exec(ctx, "SELECT set_config('app.tenant_id', $1, true)", tenantID); err != nil {
+		return err
+	}
+	if err := saveTokens(ctx, tx, tenantID, c.ID, sub, tok); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// Unlink deletes sub's connection for an auth config and reports whether one existed.
+func Unlink(ctx context.Context, pool *pgxpool.Pool, tenantID, authID, sub string) (bool, error) {
+	tag, err := pool.Exec(ctx, `WITH s AS (
+		SELECT set_config('app.tenant_id', $1, true)
+	) DELETE FROM user_connections WHERE tenant_id=$1 AND auth_id=$2 AND actor_sub=$3`, tenantID, authID, sub)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}